@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	"libvirt_keepawake/internal/doctor"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"os"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose DBUS backends, libvirt access and permissions",
+	Long: `Checks that session and system DBUS are reachable, which inhibition backends are running, that sleep can be
+inhibited and released, and that every libvirt URI given with --connect is accessible. Exits with 1 if any check failed.`,
+	Example: "  libvirt-keepawake doctor --connect=qemu:///system --connect=qemu:///session",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		uris, _ := cmd.Flags().GetStringSlice("connect")
+		libvirtTimeout, _ := cmd.Flags().GetDuration("libvirt-timeout")
+		report := doctor.NewDoctor(
+			func() (*dbus.Conn, error) { return connectBus(dbus.SessionBusPrivateNoAutoStartup) },
+			func() (*dbus.Conn, error) { return connectBus(dbus.SystemBusPrivate) },
+			uris,
+			func(uri string, readOnly bool) (doctor.LibvirtConnection, error) {
+				return libvirt_watcher.Dial(uri, readOnly, libvirtTimeout)
+			},
+		).Run()
+		if err := report.Write(cmd.OutOrStdout()); err != nil {
+			return err
+		}
+		if report.Failed() {
+			os.Exit(1)
+		}
+		return nil
+	},
+}
+
+// connectBus opens private DBUS connection and authenticates it like the daemon does
+func connectBus(open func(...dbus.ConnOption) (*dbus.Conn, error)) (*dbus.Conn, error) {
+	conn, err := open()
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Auth(nil); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("can't authenticate: %w", err)
+	}
+	if err := conn.Hello(); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("can't send hello: %w", err)
+	}
+	return conn, nil
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
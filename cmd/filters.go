@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/domain_rules"
+	"libvirt_keepawake/internal/stream_detector"
+
+	"github.com/spf13/cobra"
+)
+
+// addDomainFilters makes the orchestrator inhibit sleep only for some running domains if it's enabled by flags
+func addDomainFilters(cmd *cobra.Command, orchestrator *internal.Orchestrator) error {
+	if err := addDomainRules(cmd, orchestrator); err != nil {
+		return err
+	}
+	return addStreamDetector(cmd, orchestrator)
+}
+
+// addDomainRules makes the orchestrator inhibit sleep only for domains matching --inhibit-rule
+func addDomainRules(cmd *cobra.Command, orchestrator *internal.Orchestrator) error {
+	specs, _ := cmd.Flags().GetStringArray("inhibit-rule")
+	if len(specs) == 0 {
+		return nil
+	}
+	rules := make([]domain_rules.Rule, 0, len(specs))
+	for _, spec := range specs {
+		rule, err := domain_rules.ParseRule(spec)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	orchestrator.AddDomainFilter(domain_rules.NewFilter(rules, "/sys"))
+	return nil
+}
+
+// addStreamDetector makes the orchestrator inhibit sleep only during streaming sessions
+func addStreamDetector(cmd *cobra.Command, orchestrator *internal.Orchestrator) error {
+	detectStreaming, _ := cmd.Flags().GetBool("detect-streaming")
+	domains, _ := cmd.Flags().GetStringArray("detect-streaming-domain")
+	if !detectStreaming && len(domains) == 0 {
+		return nil
+	}
+	portsSpec, _ := cmd.Flags().GetString("streaming-ports")
+	ports, err := stream_detector.ParsePorts(portsSpec)
+	if err != nil {
+		return err
+	}
+	linger, _ := cmd.Flags().GetDuration("streaming-linger")
+	orchestrator.AddDomainFilter(stream_detector.NewDetector("/proc", ports, linger, domains))
+	return nil
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"io"
+	"libvirt_keepawake/internal/libvirt_hook"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// hookStdinTimeout limits waiting for domain XML, the hook must return quickly
+const hookStdinTimeout = time.Second
+
+// maxHookStdin is enough for any domain XML
+const maxHookStdin = 1 << 20
+
+var hookCmd = &cobra.Command{
+	Use:   "hook",
+	Short: "libvirt hooks forwarding domain events to the running daemon",
+}
+
+var qemuHookCmd = &cobra.Command{
+	Use:   "qemu <domain> <operation> <sub-operation> <extra>",
+	Short: "libvirt qemu hook, symlink the binary as /etc/libvirt/hooks/qemu",
+	Long: `Forwards domain start/stop events from libvirt to daemons of all logged-in users, so they inhibit sleep right
+away instead of waiting for the next check. Always exits with 0 and never blocks the domain start, even if no daemon
+is running.`,
+	Example: "  ln -s /usr/bin/libvirt-keepawake /etc/libvirt/hooks/qemu",
+	// libvirt passes "-" and other arguments which must not be parsed as flags
+	DisableFlagParsing: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		// libvirt logs hook output only on failure, but keep it quiet anyway
+		log.SetOutput(os.Stderr)
+		log.SetLevel(log.WarnLevel)
+		message, err := libvirt_hook.ParseArgs("qemu", args, readHookStdin())
+		if err != nil {
+			log.WithError(err).Warn("Can't parse libvirt hook arguments")
+			return
+		}
+		if !message.TriggersCheck() {
+			return
+		}
+		libvirt_hook.Forward(libvirt_hook.SocketGlob, message)
+	},
+}
+
+// readHookStdin reads domain XML written by libvirt, giving up after hookStdinTimeout
+func readHookStdin() []byte {
+	result := make(chan []byte, 1)
+	go func() {
+		data, err := io.ReadAll(io.LimitReader(os.Stdin, maxHookStdin))
+		if err != nil {
+			log.WithError(err).Debug("Can't read domain XML from stdin")
+		}
+		result <- data
+	}()
+	select {
+	case data := <-result:
+		return data
+	case <-time.After(hookStdinTimeout):
+		return nil
+	}
+}
+
+func init() {
+	hookCmd.AddCommand(qemuHookCmd)
+	rootCmd.AddCommand(hookCmd)
+}
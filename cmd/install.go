@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"libvirt_keepawake/internal/installer"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var installCmd = &cobra.Command{
+	Use:   "install --init=systemd-user|openrc|xdg-autostart [--uninstall] [-- daemon flags]",
+	Short: "Install service definition to start the daemon on login",
+	Long: `Writes a systemd user unit, an OpenRC user service or an XDG autostart desktop entry which starts the daemon
+from the current binary with given daemon flags. Running it again only updates the file when something changed.`,
+	Example: "  libvirt-keepawake install --init=systemd-user -- --tray --log-sink=journald",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		init, _ := cmd.Flags().GetString("init")
+		uninstall, _ := cmd.Flags().GetBool("uninstall")
+		binaryPath, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("can't determine path of the binary: %w", err)
+		}
+		if resolvedPath, err := filepath.EvalSymlinks(binaryPath); err == nil {
+			binaryPath = resolvedPath
+		}
+		configHome := os.Getenv("XDG_CONFIG_HOME")
+		if configHome == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return fmt.Errorf("can't determine config directory: %w", err)
+			}
+			configHome = filepath.Join(home, ".config")
+		}
+		options := installer.Options{
+			Init:       installer.InitSystem(init),
+			BinaryPath: binaryPath,
+			Args:       args,
+			ConfigHome: configHome,
+		}
+
+		var change installer.Change
+		if uninstall {
+			change, err = installer.Uninstall(options)
+		} else {
+			change, err = installer.Install(options)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(change)
+		if change.Action == installer.ActionUnchanged || change.Action == installer.ActionAbsent {
+			return nil
+		}
+		if steps := installer.NextSteps(options.Init, uninstall); len(steps) > 0 {
+			fmt.Println("Now run:")
+			for _, step := range steps {
+				fmt.Println("  " + step)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	var initSystems []string
+	for _, initSystem := range installer.InitSystems {
+		initSystems = append(initSystems, string(initSystem))
+	}
+	installCmd.Flags().String("init", "", "init system: "+strings.Join(initSystems, ", "))
+	_ = installCmd.MarkFlagRequired("init")
+	installCmd.Flags().Bool("uninstall", false, "remove previously installed service definition")
+	rootCmd.AddCommand(installCmd)
+}
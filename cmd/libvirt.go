@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"fmt"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dialLibvirt connects to every URI and returns connections together with a function closing them. Without readOnly,
+// full access is tried first and read-only connection is used when it's denied
+func dialLibvirt(
+	uris []string, readOnly bool, callTimeout time.Duration,
+) (libvirt_watcher.MultiConnect, func(), error) {
+	var connections libvirt_watcher.MultiConnect
+	var adapters []*libvirt_watcher.LibvirtConnectAdapter
+	closeAll := func() {
+		for i, adapter := range adapters {
+			if err := adapter.Close(); err != nil {
+				log.WithField("uri", uris[i]).WithError(err).Error("Can't close libvirt connection")
+			}
+		}
+	}
+	for _, uri := range uris {
+		uriLog := log.WithField("uri", uri)
+		adapter, err := libvirt_watcher.Dial(uri, readOnly, callTimeout)
+		if err != nil && !readOnly {
+			uriLog.WithError(err).Warn("Can't connect to libvirt, falling back to read-only connection")
+			adapter, err = libvirt_watcher.Dial(uri, true, callTimeout)
+		}
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("can't connect to libvirt %s: %w", uri, err)
+		}
+		uriLog.Info("Successfully connected to libvirt")
+		adapters = append(adapters, adapter)
+		connections = append(connections, adapter)
+	}
+	return connections, closeAll, nil
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/dbus_inhibitor"
+	"libvirt_keepawake/internal/state"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show what the daemon would do with every domain",
+	Long: `Lists all domains on the libvirt URIs given with --connect and shows whether the daemon would inhibit sleep for
+them, and if not, why. Pause, disabled domains and held inhibitors are read from the state file, neither the power
+manager nor the state file are changed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if verbose, _ := cmd.Flags().GetBool("verbose"); verbose {
+			log.SetLevel(log.DebugLevel)
+		} else {
+			log.SetLevel(log.ErrorLevel)
+		}
+		uris, _ := cmd.Flags().GetStringSlice("connect")
+		libvirtTimeout, _ := cmd.Flags().GetDuration("libvirt-timeout")
+		connections, closeConnections, err := dialLibvirt(uris, true, libvirtTimeout)
+		if err != nil {
+			return err
+		}
+		defer closeConnections()
+
+		stateFile, _ := cmd.Flags().GetString("state-file")
+		if stateFile == "" {
+			stateFile, err = state.DefaultPath()
+			if err != nil {
+				return err
+			}
+		}
+		processes, err := processSource(cmd)
+		if err != nil {
+			return err
+		}
+		// container and process sources only list activities here, they don't need to watch for changes
+		orchestrator := internal.NewOrchestrator(
+			dbus_inhibitor.NewNoopSleepInhibitor(),
+			time.NewTicker(time.Hour),
+			activitySources(libvirtSources(connections), containerSources(cmd), processes)...,
+		)
+		if err := addDomainFilters(cmd, orchestrator); err != nil {
+			return err
+		}
+		orchestrator.SetJournal(state.NewReadOnlyJournal(stateFile))
+		orchestrator.LoadState()
+		plan, err := orchestrator.Plan(cmd.Context())
+		if err != nil {
+			return err
+		}
+
+		output := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(output, "DOMAIN\tSTATE\tACTION\tREASON")
+		for _, entry := range plan {
+			domainState := "stopped"
+			if entry.Running {
+				domainState = "running"
+			}
+			fmt.Fprintf(output, "%s\t%s\t%s\t%s\n", entry.Domain, domainState, entry.Action, entry.Reason)
+		}
+		return output.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+}
@@ -1,26 +1,48 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/container_source"
 	"libvirt_keepawake/internal/dbus_inhibitor"
+	"libvirt_keepawake/internal/desktop_notifier"
+	"libvirt_keepawake/internal/hooks"
+	"libvirt_keepawake/internal/libvirt_hook"
 	"libvirt_keepawake/internal/libvirt_watcher"
+	"libvirt_keepawake/internal/logging"
+	"libvirt_keepawake/internal/login1_inhibitor"
+	"libvirt_keepawake/internal/power_guard"
+	"libvirt_keepawake/internal/power_profiles"
+	"libvirt_keepawake/internal/process_source"
+	"libvirt_keepawake/internal/single_instance"
+	"libvirt_keepawake/internal/state"
+	"libvirt_keepawake/internal/stream_detector"
+	"libvirt_keepawake/internal/systemd_notify"
+	"libvirt_keepawake/internal/tray"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"syscall"
 	"time"
 
 	"github.com/godbus/dbus/v5"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	libvirtLibrary "libvirt.org/go/libvirt"
 )
 
 var rootCmd = &cobra.Command{
-	Use:   "Starts daemon",
+	Use:   "libvirt-keepawake",
 	Short: "Starts Daemon",
 	Long:  `Start Daemon`,
 	Run: func(cmd *cobra.Command, args []string) {
+		logFormat, _ := cmd.Flags().GetString("log-format")
+		logSink, _ := cmd.Flags().GetString("log-sink")
+		if err := logging.Setup(logging.Format(logFormat), logging.Sink(logSink)); err != nil {
+			log.WithError(err).Error("Can't setup logging")
+			os.Exit(1)
+		}
 		if verbose, err := cmd.Flags().GetBool("verbose"); err != nil {
 			log.WithError(err).Error("Can't get verbose flag value")
 			return
@@ -55,28 +77,198 @@ var rootCmd = &cobra.Command{
 
 		log.Info("Successfully connected to session DBUS")
 
-		sleepInhibitor := dbus_inhibitor.NewDbusSleepInhibitor(conn)
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		var sleepInhibitor dbus_inhibitor.SleepInhibitor
+		// instanceLost stays nil in dry-run mode, it can run next to the real daemon
+		var instanceLost <-chan struct{}
+		dbusTimeout, _ := cmd.Flags().GetDuration("dbus-timeout")
+		if dryRun {
+			log.Info("Dry run: sleep won't be inhibited, state file won't be changed")
+			sleepInhibitor = dbus_inhibitor.NewNoopSleepInhibitor()
+		} else {
+			replace, _ := cmd.Flags().GetBool("replace")
+			instance, err := single_instance.Claim(conn, replace, 15*time.Second)
+			if errors.Is(err, single_instance.ErrAlreadyRunning) {
+				log.WithError(err).Error("Daemon is already running, use --replace to replace it")
+				os.Exit(1)
+			} else if err != nil {
+				log.WithError(err).Error("Can't ensure only one instance is running")
+				os.Exit(1)
+			}
+			defer instance.Release()
+			instanceLost = instance.Lost()
+			sleepInhibitor = dbus_inhibitor.NewDbusSleepInhibitor(conn, dbusTimeout)
+		}
+
+		uris, _ := cmd.Flags().GetStringSlice("connect")
+		libvirtTimeout, _ := cmd.Flags().GetDuration("libvirt-timeout")
+		connections, closeConnections, err := dialLibvirt(uris, false, libvirtTimeout)
+		if err != nil {
+			log.WithError(err).Error("Can't connect to libvirt, run `libvirt-keepawake doctor` for details")
+			os.Exit(1)
+		}
+		defer closeConnections()
+		// watcher lists domains of all connections for guards, the orchestrator checks every connection separately
+		watcher := libvirt_watcher.NewLibvirtWatcher(connections)
+		domainSources := libvirtSources(connections)
+
+		ticker := time.NewTicker(10 * time.Second)
 
-		// how to listen for libvirt event
-		libVirtConn, libVirtConErr := libvirtLibrary.NewConnect("qemu:///system")
-		if libVirtConErr != nil {
-			log.WithError(libVirtConErr).Error("Can't connect to libvirt")
+		containers := containerSources(cmd)
+		for _, source := range containers {
+			source.Start()
+			defer source.Stop()
+		}
+		processes, err := processSource(cmd)
+		if err != nil {
+			log.WithError(err).Error("Can't set up process matching")
+			os.Exit(1)
+		}
+		if processes != nil {
+			if err := processes.Start(); err != nil {
+				log.WithError(err).Error("Can't start watching processes")
+				os.Exit(1)
+			}
+			defer processes.Stop()
+		}
+		orchestrator := internal.NewOrchestrator(
+			sleepInhibitor, ticker, activitySources(domainSources, containers, processes)...,
+		)
+		if err := addDomainFilters(cmd, orchestrator); err != nil {
+			log.WithError(err).Error("Can't set up domain filters")
 			os.Exit(1)
+		}
+		stateFile, _ := cmd.Flags().GetString("state-file")
+		if stateFile == "" {
+			stateFile, err = state.DefaultPath()
+			if err != nil {
+				log.WithError(err).Error("Can't determine state file path")
+				os.Exit(1)
+			}
+		}
+		if dryRun {
+			orchestrator.SetJournal(state.NewReadOnlyJournal(stateFile))
 		} else {
-			log.Info("Successfully connected to libvirt")
+			orchestrator.SetJournal(state.NewJournal(stateFile))
+		}
+		if notifications, _ := cmd.Flags().GetBool("notifications"); notifications {
+			notifier := desktop_notifier.NewDesktopNotifier(conn, orchestrator, 2*time.Second)
+			if err := notifier.Start(); err != nil {
+				log.WithError(err).Error("Can't start desktop notifier")
+				os.Exit(1)
+			}
+			defer notifier.Stop()
+			orchestrator.AddListener(notifier)
+		}
+		if showTray, _ := cmd.Flags().GetBool("tray"); showTray {
+			trayIcon := tray.NewTray(conn, orchestrator, func() { termination <- syscall.SIGTERM })
+			if err := trayIcon.Start(); err != nil {
+				log.WithError(err).Error("Can't start tray icon")
+				os.Exit(1)
+			}
+			defer trayIcon.Stop()
+			orchestrator.AddListener(trayIcon)
+		}
+		// dry run doesn't take over the socket of the real daemon
+		if !dryRun {
+			if stopHookListener, err := startHookListener(domainSources); err != nil {
+				log.WithError(err).Warn("Can't listen for libvirt hook events, domains are detected only by polling")
+			} else {
+				defer stopHookListener()
+			}
+		}
+		sleepAction, _ := cmd.Flags().GetString("sleep-action")
+		if sleepAction != "none" && !slices.Contains(power_guard.SleepActions, power_guard.SleepAction(sleepAction)) {
+			log.Errorf("Unknown sleep action %s", sleepAction)
+			os.Exit(1)
+		}
+		blockShutdown, _ := cmd.Flags().GetBool("block-shutdown")
+		blockShutdownDomains, _ := cmd.Flags().GetStringArray("block-shutdown-domain")
+		blockShutdown = blockShutdown || len(blockShutdownDomains) > 0
+		guestShutdown, _ := cmd.Flags().GetBool("guest-shutdown")
+		shutdownPolicy, shutdownPolicies, err := parseShutdownPolicies(cmd)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		guestShutdown = guestShutdown || len(shutdownPolicies) > 0
+		handleWhats, handleDomains := handleBlockerOptions(cmd)
+		holdProfile, _ := cmd.Flags().GetString("hold-profile")
+		if holdProfile != "" && !slices.Contains(power_profiles.HoldableProfiles, power_profiles.Profile(holdProfile)) {
+			log.Errorf("Power profile %s can't be held, only performance or power-saver can", holdProfile)
+			os.Exit(1)
+		}
+		needsSystemBus := sleepAction != "none" || blockShutdown || guestShutdown || len(handleWhats) > 0 ||
+			holdProfile != ""
+		// logind locks and power profiles affect the whole host, dry run doesn't take them
+		if needsSystemBus && !dryRun {
+			systemConn, err := connectBus(dbus.SystemBusPrivate)
+			if err != nil {
+				log.WithError(err).Error("Can't connect to system DBUS")
+				os.Exit(1)
+			}
 			defer func() {
-				_, err := libVirtConn.Close()
-				if err != nil {
-					log.WithError(err).Error("Can't close libvirt connection")
+				if err := systemConn.Close(); err != nil {
+					log.WithError(err).Error("Can't close system DBUS connection")
 				}
 			}()
+			login1 := login1_inhibitor.NewLogin1Inhibitor(systemConn, dbusTimeout)
+			if sleepAction != "none" {
+				sleepActionDomains, _ := cmd.Flags().GetStringArray("sleep-action-domain")
+				sleepGuard := power_guard.NewSleepGuard(
+					login1, watcher, power_guard.SleepAction(sleepAction), sleepActionDomains,
+				)
+				if err := sleepGuard.Start(); err != nil {
+					log.WithError(err).Error("Can't start handling domains on sleep")
+					os.Exit(1)
+				}
+				defer sleepGuard.Stop()
+			}
+			if blockShutdown {
+				orchestrator.AddDomainLock(power_guard.NewShutdownBlocker(login1, blockShutdownDomains))
+			}
+			if holdProfile != "" {
+				holdProfileDomains, _ := cmd.Flags().GetStringArray("hold-profile-domain")
+				orchestrator.AddDomainLock(power_profiles.NewProfileHolder(
+					systemConn, power_profiles.Profile(holdProfile), holdProfileDomains, dbusTimeout,
+				))
+			}
+			if len(handleWhats) > 0 {
+				orchestrator.AddDomainLock(power_guard.NewHandleBlocker(login1, handleWhats, handleDomains))
+			}
+			if guestShutdown {
+				shutdownGuard := power_guard.NewShutdownGuard(login1, watcher, shutdownPolicy, shutdownPolicies)
+				if err := shutdownGuard.Start(); err != nil {
+					log.WithError(err).Error("Can't start shutting down domains with the host")
+					os.Exit(1)
+				}
+				defer shutdownGuard.Stop()
+			}
+		}
+		if hookCommands, _ := cmd.Flags().GetStringArray("hook"); len(hookCommands) > 0 {
+			hookTimeout, _ := cmd.Flags().GetDuration("hook-timeout")
+			hookConcurrency, _ := cmd.Flags().GetInt("hook-concurrency")
+			runner := hooks.NewRunner(hookCommands, hookTimeout, hookConcurrency)
+			runner.SetDryRun(dryRun)
+			runner.Start()
+			// registered before stopping the orchestrator, so hooks for inhibitors released on exit still run
+			defer runner.Stop()
+			orchestrator.AddListener(runner)
+		}
+		shutdownTimeout, _ := cmd.Flags().GetDuration("shutdown-timeout")
+		orchestrator.SetShutdownTimeout(shutdownTimeout)
+		orchestrator.SetRetryPolicy(retryPolicy(cmd))
+		verifyInterval, _ := cmd.Flags().GetDuration("verify-interval")
+		orchestrator.SetVerifyInterval(verifyInterval)
+		systemdService := systemdNotifyService(orchestrator)
+		// after all listeners are registered, so they learn about adopted inhibitors and the restored pause
+		if dryRun {
+			// inhibitors of the running daemon are shown as held, they're neither released nor rejected as ones of
+			// another backend
+			orchestrator.LoadState()
+		} else {
+			orchestrator.RestoreState(cmd.Context())
 		}
-		connAdapter := libvirt_watcher.LibvirtConnectAdapter{Connect: libVirtConn}
-		watcher := libvirt_watcher.NewLibvirtWatcher(&connAdapter)
-
-		ticker := time.NewTicker(10 * time.Second)
-
-		orchestrator := internal.NewOrchestrator(sleepInhibitor, watcher, ticker)
 		orchestrator.Start()
 		defer func() {
 			log.Debug("Stopping orchestrator")
@@ -88,19 +280,249 @@ var rootCmd = &cobra.Command{
 				}
 			}
 		}()
+		if systemdService != nil {
+			systemdService.Start()
+			// deferred after stopping the orchestrator, so systemd knows about stopping while inhibitors are released
+			defer systemdService.Stop()
+		}
 		log.Debug("Will wait for SIGTERM/SIGHUP")
-		<-termination
+		select {
+		case <-termination:
+		case <-instanceLost:
+			log.Info("Replaced by another instance, releasing inhibitors")
+		}
 		log.Infof("Exiting")
 	},
 }
 
 func init() {
 	rootCmd.PersistentFlags().BoolP("verbose", "v", false, "verbose output")
+	rootCmd.Flags().Bool(
+		"notifications", false, "show desktop notifications when sleep is blocked or allowed again",
+	)
+	rootCmd.Flags().Bool("tray", false, "show system tray icon(StatusNotifierItem) with pause and per-domain toggles")
+	rootCmd.Flags().StringArray(
+		"hook", nil, "executable to run when sleep is inhibited, allowed, paused or resumed, can be repeated",
+	)
+	rootCmd.Flags().Duration("hook-timeout", 30*time.Second, "kill hooks running longer than this")
+	rootCmd.Flags().Int("hook-concurrency", 4, "maximum number of hooks running at the same time")
+	rootCmd.Flags().String(
+		"sleep-action", "none",
+		"what to do with running domains when the host goes to sleep anyway: none, suspend or managedsave",
+	)
+	rootCmd.Flags().StringArray(
+		"sleep-action-domain", nil, "domain to apply --sleep-action to, can be repeated (default all running domains)",
+	)
+	rootCmd.Flags().Bool("block-shutdown", false, "block host shutdown and reboot while domains are running")
+	rootCmd.Flags().StringArray(
+		"block-shutdown-domain", nil, "block host shutdown and reboot only while this domain is running, can be repeated",
+	)
+	rootCmd.Flags().Bool(
+		"inhibit-lid-switch", false, "prevent logind from suspending the host on lid close while domains are running",
+	)
+	rootCmd.Flags().StringArray(
+		"inhibit-lid-switch-domain", nil,
+		"prevent lid close handling only while this domain is running, can be repeated",
+	)
+	rootCmd.Flags().Bool(
+		"inhibit-suspend-key", false, "also prevent logind from handling the suspend key while domains are running",
+	)
+	rootCmd.Flags().Bool(
+		"inhibit-power-key", false, "also prevent logind from handling the power key while domains are running",
+	)
+	rootCmd.Flags().String(
+		"hold-profile", "", "power-profiles-daemon profile to hold while domains are running, performance or power-saver",
+	)
+	rootCmd.Flags().StringArray(
+		"hold-profile-domain", nil, "hold --hold-profile only while this domain is running, can be repeated",
+	)
+	rootCmd.Flags().Bool(
+		"guest-shutdown", false, "shut running domains down(ACPI) before the host powers off, delaying the poweroff",
+	)
+	rootCmd.Flags().Duration(
+		"guest-shutdown-timeout", time.Minute, "how long to wait for a domain to shut down before --guest-shutdown-fallback",
+	)
+	rootCmd.Flags().String(
+		"guest-shutdown-fallback", string(power_guard.FallbackManagedSave),
+		"what to do with domains which didn't shut down in time: managedsave, destroy or none",
+	)
+	rootCmd.Flags().StringArray(
+		"guest-shutdown-policy", nil,
+		"per-domain guest shutdown policy DOMAIN=TIMEOUT[:FALLBACK] or DOMAIN=skip, can be repeated",
+	)
+	rootCmd.Flags().Duration(
+		"dbus-timeout", dbus_inhibitor.DefaultCallTimeout,
+		"give up on power manager, logind and power-profiles-daemon calls after this long",
+	)
+	rootCmd.Flags().Duration(
+		"shutdown-timeout", internal.DefaultShutdownTimeout,
+		"how long to wait for inhibitors to be released on exit before giving up",
+	)
+	rootCmd.Flags().Duration(
+		"retry-delay", internal.DefaultRetryPolicy.InitialDelay,
+		"delay before retrying a failed inhibit or uninhibit, doubles after every failure",
+	)
+	rootCmd.Flags().Duration(
+		"retry-max-delay", internal.DefaultRetryPolicy.MaxDelay, "maximum delay between retries of a failed inhibitor",
+	)
+	rootCmd.Flags().Int(
+		"retry-escalate-after", internal.DefaultRetryPolicy.EscalateAfter,
+		"notify and run hooks after this many failures in a row, 0 disables it",
+	)
+	rootCmd.Flags().Duration(
+		"verify-interval", internal.DefaultVerifyInterval,
+		"how often to check that the power manager still has our inhibitors, 0 disables it",
+	)
+	rootCmd.Flags().Bool("replace", false, "replace already running instance instead of exiting")
+	rootCmd.Flags().Bool(
+		"dry-run", false, "run the loop, but only log what would be done instead of inhibiting sleep",
+	)
+	rootCmd.PersistentFlags().String(
+		"state-file", "", "file to persist held inhibitors in (default $XDG_STATE_HOME/libvirt-keepawake/state.json)",
+	)
+	rootCmd.PersistentFlags().StringArray(
+		"inhibit-rule", nil,
+		"inhibit sleep only for domains matching the rule: hostdev, hostdev:TYPE or hostdev-id:VENDOR:PRODUCT, "+
+			"can be repeated",
+	)
+	rootCmd.PersistentFlags().Bool(
+		"detect-streaming", false,
+		"inhibit sleep only while a client is connected to streaming ports of a domain(e.g. Moonlight to Sunshine)",
+	)
+	rootCmd.PersistentFlags().StringArray(
+		"detect-streaming-domain", nil,
+		"detect streaming only for this domain, other domains inhibit sleep whenever running, can be repeated",
+	)
+	rootCmd.PersistentFlags().String(
+		"streaming-ports", stream_detector.DefaultPorts, "comma separated ports and port ranges of streaming servers",
+	)
+	rootCmd.PersistentFlags().Duration(
+		"streaming-linger", 5*time.Minute, "keep inhibiting sleep this long after the streaming session ended",
+	)
+	rootCmd.PersistentFlags().StringArray(
+		"container-socket", nil,
+		"Podman or Docker API socket to watch containers on, e.g. /run/podman/podman.sock, can be repeated",
+	)
+	rootCmd.PersistentFlags().StringArray(
+		"container-label", []string{container_source.DefaultLabel},
+		"inhibit sleep only for containers with this label(key or key=value), can be repeated",
+	)
+	rootCmd.PersistentFlags().StringArray(
+		"process-match", nil,
+		"inhibit sleep while a process matches NAME:KEY=VALUE[;KEY=VALUE...] with keys exe(glob), argv(regexp), "+
+			"cgroup and user, e.g. qemu:exe=/usr/bin/qemu-system-*, can be repeated",
+	)
+	rootCmd.PersistentFlags().Duration(
+		"process-scan-interval", process_source.DefaultScanInterval, "how often to scan /proc for matching processes",
+	)
+	rootCmd.PersistentFlags().Duration(
+		"libvirt-timeout", libvirt_watcher.DefaultCallTimeout, "give up on libvirt calls after this long",
+	)
+	rootCmd.PersistentFlags().StringSlice(
+		"connect", []string{"qemu:///system"}, "libvirt URIs to watch domains on, can be repeated",
+	)
+	rootCmd.PersistentFlags().String("log-format", string(logging.FormatText), "log format: text or json")
+	rootCmd.PersistentFlags().String(
+		"log-sink", string(logging.SinkStdout), "where to send logs: stdout, syslog or journald",
+	)
+}
+
+/*
+systemdNotifyService reports readiness, status and watchdog pings to systemd when the daemon runs as a Type=notify
+service, nil otherwise. The service is subscribed to orchestrator events, but has to be started.
+*/
+func systemdNotifyService(orchestrator *internal.Orchestrator) *systemd_notify.Service {
+	notifier, watchdogInterval, err := systemd_notify.FromEnvironment()
+	if err != nil {
+		log.WithError(err).Error("Can't notify systemd, readiness won't be reported")
+		return nil
+	}
+	if notifier == nil {
+		return nil
+	}
+	if watchdogInterval > 0 {
+		log.Infof("systemd watchdog is enabled, the main loop is checked every %s", watchdogInterval/2)
+	}
+	service := systemd_notify.NewService(notifier, orchestrator, watchdogInterval)
+	orchestrator.AddListener(service)
+	return service
+}
+
+// retryPolicy builds the retry policy of failed inhibitors from --retry-* flags
+func retryPolicy(cmd *cobra.Command) internal.RetryPolicy {
+	policy := internal.DefaultRetryPolicy
+	policy.InitialDelay, _ = cmd.Flags().GetDuration("retry-delay")
+	policy.MaxDelay, _ = cmd.Flags().GetDuration("retry-max-delay")
+	policy.EscalateAfter, _ = cmd.Flags().GetInt("retry-escalate-after")
+	return policy
+}
+
+// startHookListener listens for events forwarded by `hook qemu` and triggers a check when a domain starts or stops
+func startHookListener(watchers []*libvirt_watcher.LibvirtWatcher) (stop func(), err error) {
+	socketPath, err := libvirt_hook.SocketPath()
+	if err != nil {
+		return nil, err
+	}
+	listener := libvirt_hook.NewListener(socketPath, func(message libvirt_hook.Message) {
+		if !message.TriggersCheck() {
+			return
+		}
+		for _, watcher := range watchers {
+			watcher.Notify()
+		}
+	})
+	if err := listener.Start(); err != nil {
+		return nil, err
+	}
+	return listener.Stop, nil
 }
 
 func Execute() {
+	// libvirt runs /etc/libvirt/hooks/qemu, which can be a symlink to the binary
+	if filepath.Base(os.Args[0]) == "qemu" {
+		rootCmd.SetArgs(append([]string{"hook", "qemu"}, os.Args[1:]...))
+	}
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 }
+
+// handleBlockerOptions returns logind handle-* operations to block while domains are running and the domains
+func handleBlockerOptions(cmd *cobra.Command) ([]login1_inhibitor.What, []string) {
+	inhibitLidSwitch, _ := cmd.Flags().GetBool("inhibit-lid-switch")
+	domains, _ := cmd.Flags().GetStringArray("inhibit-lid-switch-domain")
+	var whats []login1_inhibitor.What
+	if inhibitLidSwitch || len(domains) > 0 {
+		whats = append(whats, login1_inhibitor.WhatHandleLidSwitch)
+	}
+	if inhibitSuspendKey, _ := cmd.Flags().GetBool("inhibit-suspend-key"); inhibitSuspendKey {
+		whats = append(whats, login1_inhibitor.WhatHandleSuspendKey)
+	}
+	if inhibitPowerKey, _ := cmd.Flags().GetBool("inhibit-power-key"); inhibitPowerKey {
+		whats = append(whats, login1_inhibitor.WhatHandlePowerKey)
+	}
+	return whats, domains
+}
+
+// parseShutdownPolicies returns default guest shutdown policy and per-domain overrides
+func parseShutdownPolicies(
+	cmd *cobra.Command,
+) (power_guard.ShutdownPolicy, map[string]power_guard.ShutdownPolicy, error) {
+	timeout, _ := cmd.Flags().GetDuration("guest-shutdown-timeout")
+	fallback, _ := cmd.Flags().GetString("guest-shutdown-fallback")
+	if !slices.Contains(power_guard.Fallbacks, power_guard.Fallback(fallback)) {
+		return power_guard.ShutdownPolicy{}, nil, fmt.Errorf("unknown guest shutdown fallback %s", fallback)
+	}
+	defaultPolicy := power_guard.ShutdownPolicy{Timeout: timeout, Fallback: power_guard.Fallback(fallback)}
+	specs, _ := cmd.Flags().GetStringArray("guest-shutdown-policy")
+	policies := make(map[string]power_guard.ShutdownPolicy, len(specs))
+	for _, spec := range specs {
+		domain, policy, err := power_guard.ParseShutdownPolicy(spec, defaultPolicy)
+		if err != nil {
+			return power_guard.ShutdownPolicy{}, nil, err
+		}
+		policies[domain] = policy
+	}
+	return defaultPolicy, policies, nil
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"libvirt_keepawake/internal/activity_source"
+	"libvirt_keepawake/internal/container_source"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"libvirt_keepawake/internal/process_source"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+/*
+containerSources creates a source for every --container-socket. Sources are named after the socket file, e.g.
+"podman" for podman.sock, so containers get inhibitors like "podman/training".
+*/
+func containerSources(cmd *cobra.Command) []*container_source.ContainerSource {
+	socketPaths, _ := cmd.Flags().GetStringArray("container-socket")
+	labels, _ := cmd.Flags().GetStringArray("container-label")
+	var sources []*container_source.ContainerSource
+	names := make(map[string]bool, len(socketPaths))
+	for _, socketPath := range socketPaths {
+		name := strings.TrimSuffix(filepath.Base(socketPath), ".sock")
+		for i := 2; names[name]; i++ {
+			name = fmt.Sprintf("%s-%d", strings.TrimSuffix(filepath.Base(socketPath), ".sock"), i)
+		}
+		names[name] = true
+		sources = append(sources, container_source.NewContainerSource(name, socketPath, labels))
+	}
+	return sources
+}
+
+/*
+processSource creates a source of processes matching --process-match, nil if there are no matchers. Processes get
+inhibitors like "processes/qemu-4242".
+*/
+func processSource(cmd *cobra.Command) (*process_source.ProcessSource, error) {
+	specs, _ := cmd.Flags().GetStringArray("process-match")
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	matchers := make([]process_source.Matcher, 0, len(specs))
+	for _, spec := range specs {
+		matcher, err := process_source.ParseMatcher(spec)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+	scanInterval, _ := cmd.Flags().GetDuration("process-scan-interval")
+	return process_source.NewProcessSource(process_source.DefaultProcRoot, matchers, scanInterval), nil
+}
+
+/*
+libvirtSources creates a watcher for every libvirt connection, so domains of a connection which fails keep their
+inhibitors while domains of other connections are still checked.
+*/
+func libvirtSources(connections libvirt_watcher.MultiConnect) []*libvirt_watcher.LibvirtWatcher {
+	watchers := make([]*libvirt_watcher.LibvirtWatcher, 0, len(connections))
+	for _, connection := range connections {
+		watchers = append(watchers, libvirt_watcher.NewLibvirtWatcher(connection))
+	}
+	return watchers
+}
+
+// activitySources returns libvirt watchers followed by container sources and the process source if there is one
+func activitySources(
+	watchers []*libvirt_watcher.LibvirtWatcher,
+	containers []*container_source.ContainerSource,
+	processes *process_source.ProcessSource,
+) []activity_source.ActivitySource {
+	var sources []activity_source.ActivitySource
+	for _, watcher := range watchers {
+		sources = append(sources, watcher)
+	}
+	for _, source := range containers {
+		sources = append(sources, source)
+	}
+	if processes != nil {
+		sources = append(sources, processes)
+	}
+	return sources
+}
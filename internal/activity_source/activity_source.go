@@ -0,0 +1,36 @@
+package activity_source
+
+import "context"
+
+// Activity is something which keeps the host awake while it exists, e.g. a running domain
+type Activity struct {
+	// ID is stable while the activity exists and unique within its source, the orchestrator qualifies it with the
+	// source name
+	ID string
+	// Label is a human readable name of the activity
+	Label string
+	// Reason explains why the activity keeps the host awake, e.g. "running"
+	Reason string
+	// UUID identifies the underlying object across restarts if it has such an identifier, e.g. domain UUID
+	UUID string
+	// Object is the underlying object, e.g. libvirt_watcher.MinimalLibvirtDomain, so filters can inspect it
+	Object any
+}
+
+/*
+ActivitySource lists activities sleep should be inhibited for. The orchestrator lists all sources on every check, so
+listing should be quick and give up when ctx is done.
+*/
+type ActivitySource interface {
+	// Name is unique among sources, it qualifies IDs of activities
+	Name() string
+	Activities(ctx context.Context) ([]Activity, error)
+	// Events signals that activities changed, so they are checked right away instead of on the next tick. Nil if the
+	// source can only be polled
+	Events() <-chan struct{}
+}
+
+// InactiveLister is implemented by sources which know activities that aren't running now, e.g. stopped domains
+type InactiveLister interface {
+	InactiveActivities(ctx context.Context) ([]Activity, error)
+}
@@ -0,0 +1,55 @@
+package activity_source
+
+// Fake ActivitySource with activities set by tests. Intended for testing purposes only
+
+import (
+	"context"
+	"sync"
+)
+
+type FakeActivitySource struct {
+	SourceName string
+	mutex      sync.Mutex
+	activities []Activity
+	err        error
+	events     chan struct{}
+}
+
+func NewFakeActivitySource(name string) *FakeActivitySource {
+	return &FakeActivitySource{SourceName: name, events: make(chan struct{}, 1)}
+}
+
+func (f *FakeActivitySource) Name() string {
+	return f.SourceName
+}
+
+func (f *FakeActivitySource) Activities(_ context.Context) ([]Activity, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	return append([]Activity{}, f.activities...), nil
+}
+
+// SetError makes Activities fail with err, nil makes it work again
+func (f *FakeActivitySource) SetError(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.err = err
+}
+
+func (f *FakeActivitySource) Events() <-chan struct{} {
+	return f.events
+}
+
+// UpdateActivities replaces current activities and signals the change
+func (f *FakeActivitySource) UpdateActivities(activities []Activity) {
+	f.mutex.Lock()
+	f.activities = activities
+	f.mutex.Unlock()
+	select {
+	case f.events <- struct{}{}:
+	default:
+	}
+}
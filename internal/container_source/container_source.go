@@ -0,0 +1,206 @@
+package container_source
+
+// Activity source of running Podman or Docker containers. Both engines serve the Docker compatible REST API on a unix
+// socket, e.g. /run/podman/podman.sock or /var/run/docker.sock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"libvirt_keepawake/internal/activity_source"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultLabel selects containers which keep the host awake
+const DefaultLabel = "keepawake=true"
+
+// requestTimeout limits listing, the event stream isn't limited
+const requestTimeout = 5 * time.Second
+
+// reconnectDelay is the pause before subscribing to events again after the stream broke
+const reconnectDelay = 5 * time.Second
+
+// container is the part of the /containers/json response this source uses
+type container struct {
+	ID     string   `json:"Id"`
+	Names  []string `json:"Names"`
+	Image  string   `json:"Image"`
+	Status string   `json:"Status"`
+}
+
+/*
+ContainerSource is an activity_source.ActivitySource of running containers with all labels, labels are "key" or
+"key=value". The source subscribes to start and die events of such containers, so they are checked right away.
+Containers are identified by name, the container ID is their UUID.
+*/
+type ContainerSource struct {
+	name       string
+	socketPath string
+	labels     []string
+	client     *http.Client
+	events     chan struct{}
+	cancel     context.CancelFunc
+	stopped    sync.WaitGroup
+}
+
+func NewContainerSource(name string, socketPath string, labels []string) *ContainerSource {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return &ContainerSource{
+		name:       name,
+		socketPath: socketPath,
+		labels:     labels,
+		client:     &http.Client{Transport: transport},
+		events:     make(chan struct{}, 1),
+	}
+}
+
+func (c *ContainerSource) Name() string {
+	return c.name
+}
+
+func (c *ContainerSource) Events() <-chan struct{} {
+	return c.events
+}
+
+/*
+Activities lists running containers with the labels. If the engine isn't running(no socket or connection refused),
+there are no running containers, other errors fail the listing.
+*/
+func (c *ContainerSource) Activities(ctx context.Context) ([]activity_source.Activity, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	response, err := c.get(ctx, "/containers/json", map[string][]string{"label": c.labels, "status": {"running"}})
+	if isEngineDown(err) {
+		log.WithField("socket", c.socketPath).WithError(err).Debug("Container engine isn't running")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var containers []container
+	if err := json.NewDecoder(response.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("invalid containers list: %w", err)
+	}
+	activities := make([]activity_source.Activity, 0, len(containers))
+	for _, listed := range containers {
+		name := listed.ID
+		if len(listed.Names) > 0 {
+			name = strings.TrimPrefix(listed.Names[0], "/")
+		}
+		activities = append(activities, activity_source.Activity{
+			ID:     name,
+			Label:  name,
+			Reason: fmt.Sprintf("container of %s is running", listed.Image),
+			UUID:   listed.ID,
+		})
+	}
+	return activities, nil
+}
+
+// Start subscribes to container events
+func (c *ContainerSource) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.stopped.Add(1)
+	go c.watchEvents(ctx)
+}
+
+func (c *ContainerSource) Stop() {
+	c.cancel()
+	c.stopped.Wait()
+}
+
+func (c *ContainerSource) watchEvents(ctx context.Context) {
+	defer c.stopped.Done()
+	sourceLog := log.WithField("socket", c.socketPath)
+	for {
+		err := c.readEvents(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if isEngineDown(err) {
+			sourceLog.WithError(err).Debug("Container engine isn't running, will subscribe to events later")
+		} else {
+			sourceLog.WithError(err).Warn("Container events stream broke, will subscribe again")
+		}
+		select {
+		case <-time.After(reconnectDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readEvents notifies about every start and die event until the stream ends
+func (c *ContainerSource) readEvents(ctx context.Context) error {
+	response, err := c.get(ctx, "/events", map[string][]string{
+		"type": {"container"}, "event": {"start", "die"}, "label": c.labels,
+	})
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	// containers could start or stop while not subscribed
+	c.notify()
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var event struct {
+			Action string `json:"Action"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		log.WithField("action", event.Action).Debug("Received container event")
+		c.notify()
+	}
+}
+
+func (c *ContainerSource) notify() {
+	select {
+	case c.events <- struct{}{}:
+	default: // check is already scheduled
+	}
+}
+
+func (c *ContainerSource) get(ctx context.Context, path string, filters map[string][]string) (*http.Response, error) {
+	encodedFilters, err := json.Marshal(filters)
+	if err != nil {
+		return nil, err
+	}
+	// host is ignored, the connection goes to the socket
+	requestURL := url.URL{Scheme: "http", Host: "engine", Path: path}
+	requestURL.RawQuery = url.Values{"filters": {string(encodedFilters)}}.Encode()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("GET %s returned %s", path, response.Status)
+	}
+	return response, nil
+}
+
+func isEngineDown(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,108 @@
+package container_source
+
+import (
+	"context"
+	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/activity_source"
+	"libvirt_keepawake/internal/dbus_inhibitor"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ContainerSourceSuite struct {
+	suite.Suite
+	socketPath string
+	engine     *FakeContainerEngine
+}
+
+func (s *ContainerSourceSuite) SetupTest() {
+	s.socketPath = filepath.Join(s.T().TempDir(), "engine.sock")
+	var err error
+	s.engine, err = NewFakeContainerEngine(s.socketPath)
+	s.Require().NoError(err)
+	s.engine.SetContainers([]FakeContainer{
+		{ID: "a1", Name: "training", Image: "pytorch", Labels: map[string]string{"keepawake": "true"}},
+		{ID: "b2", Name: "jellyfin", Image: "jellyfin", Labels: map[string]string{"keepawake": "false"}},
+		{ID: "c3", Name: "postgres", Image: "postgres"},
+	})
+}
+
+func (s *ContainerSourceSuite) TearDownTest() {
+	s.engine.Close()
+}
+
+func (s *ContainerSourceSuite) TestListContainers() {
+	source := NewContainerSource("podman", s.socketPath, []string{DefaultLabel})
+
+	activities, err := source.Activities(context.Background())
+
+	s.Require().NoError(err)
+	s.Assert().Equal([]activity_source.Activity{
+		{ID: "training", Label: "training", Reason: "container of pytorch is running", UUID: "a1"},
+	}, activities)
+
+	// key only filter
+	activities, err = NewContainerSource("podman", s.socketPath, []string{"keepawake"}).Activities(context.Background())
+	s.Require().NoError(err)
+	s.Assert().Len(activities, 2)
+}
+
+// TestEngineDown tests that no containers are running when the engine isn't running
+func (s *ContainerSourceSuite) TestEngineDown() {
+	source := NewContainerSource("docker", filepath.Join(s.T().TempDir(), "docker.sock"), []string{DefaultLabel})
+
+	activities, err := source.Activities(context.Background())
+
+	s.Assert().NoError(err)
+	s.Assert().Empty(activities)
+}
+
+func (s *ContainerSourceSuite) TestEvents() {
+	source := NewContainerSource("podman", s.socketPath, []string{DefaultLabel})
+	source.Start()
+	defer source.Stop()
+	s.Require().Eventually(func() bool { return s.engine.Subscribers() == 1 }, 2*time.Second, 10*time.Millisecond)
+	// the source notifies after subscribing, containers could change while it wasn't subscribed
+	s.Assert().Eventually(func() bool { return len(source.Events()) == 1 }, time.Second, 10*time.Millisecond)
+	<-source.Events()
+
+	s.engine.EmitEvent("start")
+
+	select {
+	case <-source.Events():
+	case <-time.After(2 * time.Second):
+		s.Fail("no event after container start")
+	}
+}
+
+// TestOrchestrator tests that containers inhibit sleep and container events trigger a check right away
+func (s *ContainerSourceSuite) TestOrchestrator() {
+	source := NewContainerSource("podman", s.socketPath, []string{DefaultLabel})
+	source.Start()
+	defer source.Stop()
+	sleepInhibitor := dbus_inhibitor.NewNoopSleepInhibitor()
+	orchestrator := internal.NewOrchestrator(sleepInhibitor, time.NewTicker(time.Hour), source)
+	orchestrator.Start()
+	defer orchestrator.Stop()
+	s.Require().Eventually(func() bool { return s.engine.Subscribers() == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	s.Assert().Eventually(func() bool {
+		inhibitors, _ := sleepInhibitor.GetInhibitors(context.Background())
+		return slices.Equal([]string{internal.InhibitorAppNamePrefix + "podman/training"}, inhibitors)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	s.engine.SetContainers(nil)
+	s.engine.EmitEvent("die")
+	s.Assert().Eventually(func() bool {
+		inhibitors, _ := sleepInhibitor.GetInhibitors(context.Background())
+		return len(inhibitors) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestRunContainerSourceSuite(t *testing.T) {
+	suite.Run(t, new(ContainerSourceSuite))
+}
@@ -0,0 +1,130 @@
+package container_source
+
+// Fake Docker compatible API on a unix socket, which lists containers and streams events. Intended for testing
+// purposes only
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type FakeContainer struct {
+	ID     string
+	Name   string
+	Image  string
+	Labels map[string]string
+}
+
+type FakeContainerEngine struct {
+	server      *httptest.Server
+	mutex       sync.Mutex
+	containers  []FakeContainer
+	subscribers []chan string
+}
+
+// NewFakeContainerEngine starts serving on socketPath
+func NewFakeContainerEngine(socketPath string) (*FakeContainerEngine, error) {
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	engine := &FakeContainerEngine{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers/json", engine.listContainers)
+	mux.HandleFunc("GET /events", engine.streamEvents)
+	engine.server = httptest.NewUnstartedServer(mux)
+	engine.server.Listener = listener
+	engine.server.Start()
+	return engine, nil
+}
+
+func (f *FakeContainerEngine) Close() {
+	f.server.CloseClientConnections()
+	f.server.Close()
+}
+
+// SetContainers replaces running containers, events aren't sent
+func (f *FakeContainerEngine) SetContainers(containers []FakeContainer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.containers = containers
+}
+
+// EmitEvent sends a container event with the action(start, die, etc.) to all subscribers
+func (f *FakeContainerEngine) EmitEvent(action string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, subscriber := range f.subscribers {
+		subscriber <- action
+	}
+}
+
+// Subscribers returns number of connected event streams
+func (f *FakeContainerEngine) Subscribers() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.subscribers)
+}
+
+func (f *FakeContainerEngine) listContainers(writer http.ResponseWriter, request *http.Request) {
+	var filters map[string][]string
+	if err := json.Unmarshal([]byte(request.URL.Query().Get("filters")), &filters); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	listed := make([]map[string]any, 0, len(f.containers))
+	for _, fakeContainer := range f.containers {
+		if !matchesLabels(fakeContainer.Labels, filters["label"]) {
+			continue
+		}
+		listed = append(listed, map[string]any{
+			"Id": fakeContainer.ID, "Names": []string{"/" + fakeContainer.Name}, "Image": fakeContainer.Image,
+			"Labels": fakeContainer.Labels, "State": "running", "Status": "Up 5 minutes",
+		})
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(listed)
+}
+
+func (f *FakeContainerEngine) streamEvents(writer http.ResponseWriter, request *http.Request) {
+	events := make(chan string, 8)
+	f.mutex.Lock()
+	f.subscribers = append(f.subscribers, events)
+	f.mutex.Unlock()
+	defer func() {
+		f.mutex.Lock()
+		f.subscribers = slices.DeleteFunc(f.subscribers, func(subscriber chan string) bool { return subscriber == events })
+		f.mutex.Unlock()
+	}()
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.(http.Flusher).Flush()
+	for {
+		select {
+		case action := <-events:
+			_ = json.NewEncoder(writer).Encode(map[string]string{"Type": "container", "Action": action})
+			writer.(http.Flusher).Flush()
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
+// matchesLabels checks "key" and "key=value" filters like the engines do
+func matchesLabels(labels map[string]string, filters []string) bool {
+	for _, filter := range filters {
+		key, value, hasValue := strings.Cut(filter, "=")
+		actual, found := labels[key]
+		if !found || (hasValue && actual != value) {
+			return false
+		}
+	}
+	return true
+}
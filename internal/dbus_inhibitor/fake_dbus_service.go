@@ -5,6 +5,7 @@ package dbus_inhibitor
 
 import (
 	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
 	"sync"
 )
 import log "github.com/sirupsen/logrus"
@@ -12,7 +13,13 @@ import log "github.com/sirupsen/logrus"
 type FakeDbusService struct {
 	dbusConnection   *dbus.Conn
 	activeInhibitors map[uint32]string
-	mutex            sync.Mutex
+	lastCookie       uint32
+	listingDisabled  bool
+	inhibitFailing   bool
+	unInhibitFailing bool
+	// unresponsive is closed when the service responds again, nil while it's responsive
+	unresponsive chan struct{}
+	mutex        sync.Mutex
 }
 
 /*
@@ -39,10 +46,20 @@ func (s *FakeDbusService) Start() error {
 	if err != nil {
 		log.Fatalf("Failed to export Inhibitor object: %v", err)
 	}
+	// real power managers are introspectable, doctor and the inhibitor verification rely on it
+	err = s.dbusConnection.Export(
+		fakeIntrospectable{service: s},
+		"/org/freedesktop/PowerManagement/Inhibit",
+		"org.freedesktop.DBus.Introspectable",
+	)
+	if err != nil {
+		log.Fatalf("Failed to export introspection data: %v", err)
+	}
 	return nil
 }
 
 func (s *FakeDbusService) Stop() {
+	s.SetUnresponsive(false)
 	// Releasing the Name on the bus
 	_, err := s.dbusConnection.ReleaseName("org.freedesktop.PowerManagement")
 	if err != nil {
@@ -57,18 +74,101 @@ func (s *FakeDbusService) Stop() {
 // Inhibit is the method that will handle the Inhibit D-Bus calls.
 func (s *FakeDbusService) Inhibit(appName string, reason string) (uint32, *dbus.Error) {
 	log.Printf("Inhibit called with appName: %s, reason: %s", appName, reason)
+	s.waitUntilResponsive()
 	// Implement your inhibition logic here
 	// The uint return value is typically a cookie to uniquely identify this inhibition request
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	cookie := uint32(len(s.activeInhibitors) + 1)
+	if s.inhibitFailing {
+		return 0, dbus.NewError("org.freedesktop.DBus.Error.Failed", []interface{}{"Inhibit failed"})
+	}
+	// cookies are never reused, like in real power managers
+	s.lastCookie++
+	cookie := s.lastCookie
 	s.activeInhibitors[cookie] = appName
 	return cookie, nil
 }
 
+/*
+SetUnresponsive makes calls hang until the service is made responsive again, like a wedged power manager. Calls
+which hang when the service becomes responsive are handled as usual.
+*/
+func (s *FakeDbusService) SetUnresponsive(unresponsive bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if unresponsive && s.unresponsive == nil {
+		s.unresponsive = make(chan struct{})
+	} else if !unresponsive && s.unresponsive != nil {
+		close(s.unresponsive)
+		s.unresponsive = nil
+	}
+}
+
+func (s *FakeDbusService) waitUntilResponsive() {
+	s.mutex.Lock()
+	unresponsive := s.unresponsive
+	s.mutex.Unlock()
+	if unresponsive != nil {
+		<-unresponsive
+	}
+}
+
+// SetInhibitFailing makes Inhibit fail, like a power manager refusing inhibitors
+func (s *FakeDbusService) SetInhibitFailing(failing bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.inhibitFailing = failing
+}
+
+// SetUnInhibitFailing makes UnInhibit fail with an error other than an unknown cookie
+func (s *FakeDbusService) SetUnInhibitFailing(failing bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.unInhibitFailing = failing
+}
+
+// SetListingEnabled allows to make GetInhibitors fail like on power managers which don't implement it
+func (s *FakeDbusService) SetListingEnabled(enabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listingDisabled = !enabled
+}
+
+// fakeIntrospectable describes FakeDbusService, GetInhibitors is left out while listing is disabled
+type fakeIntrospectable struct {
+	service *FakeDbusService
+}
+
+func (i fakeIntrospectable) Introspect() (string, *dbus.Error) {
+	i.service.mutex.Lock()
+	listingDisabled := i.service.listingDisabled
+	i.service.mutex.Unlock()
+	var methods []introspect.Method
+	for _, method := range introspect.Methods(i.service) {
+		if method.Name == "GetInhibitors" && listingDisabled {
+			continue
+		}
+		methods = append(methods, method)
+	}
+	node := &introspect.Node{
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			{Name: "org.freedesktop.PowerManagement.Inhibit", Methods: methods},
+		},
+	}
+	return string(introspect.NewIntrospectable(node)), nil
+}
+
 func (s *FakeDbusService) GetInhibitors() ([]string, *dbus.Error) {
 	log.Printf("GetInhibitors called")
+	s.waitUntilResponsive()
+	s.mutex.Lock()
+	listingDisabled := s.listingDisabled
+	s.mutex.Unlock()
+	if listingDisabled {
+		return nil, dbus.NewError("org.freedesktop.DBus.Error.UnknownMethod", []interface{}{"Unknown method"})
+	}
 	// The string return value is typically a list of app names that are currently inhibiting sleep
 	var inhibitors = []string{}
 	s.mutex.Lock()
@@ -81,9 +181,13 @@ func (s *FakeDbusService) GetInhibitors() ([]string, *dbus.Error) {
 
 func (s *FakeDbusService) UnInhibit(cookie uint32) *dbus.Error {
 	log.Printf("UnInhibit called with cookie: %d", cookie)
+	s.waitUntilResponsive()
 	// The bool return value is typically a success flag to indicate if the uninhibition was successful
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.unInhibitFailing {
+		return dbus.NewError("org.freedesktop.DBus.Error.Failed", []interface{}{"UnInhibit failed"})
+	}
 	if _, ok := s.activeInhibitors[cookie]; ok {
 		delete(s.activeInhibitors, cookie)
 		return nil
@@ -1,79 +1,198 @@
 package dbus_inhibitor
 
 import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"libvirt_keepawake/internal/logging"
+	"time"
+
 	dbus "github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
 	"github.com/sirupsen/logrus"
 )
 
 const dbusDest string = "org.freedesktop.PowerManagement"
 const dbusPath dbus.ObjectPath = "/org/freedesktop/PowerManagement/Inhibit"
+const dbusInterface string = "org.freedesktop.PowerManagement.Inhibit"
+
+// ErrListingNotSupported is returned by GetInhibitors when the power manager doesn't implement listing
+var ErrListingNotSupported = errors.New("power manager doesn't support listing inhibitors")
+
+// ErrCookieNotFound is returned by UnInhibit when the power manager doesn't know the cookie, e.g. after its restart
+var ErrCookieNotFound = errors.New("power manager doesn't know the cookie")
+
+// DefaultCallTimeout limits every call to the power manager, so a wedged power manager can't block the daemon
+const DefaultCallTimeout = 5 * time.Second
 
+/*
+SleepInhibitor inhibits sleep through a power manager. Calls give up when ctx is done, an interrupted Inhibit might
+have been handled by the power manager anyway, it drops the inhibitor when the daemon disconnects.
+*/
 type SleepInhibitor interface {
-	Inhibit(appName string) (cookie uint32, success bool, err error)
+	// Backend returns name of the service which actually inhibits sleep
+	Backend() string
+	Inhibit(ctx context.Context, appName string) (cookie uint32, success bool, err error)
 	// GetInhibitors returns a list of current inhibitors where every element of the list is a string with application
 	// name which is inhibiting the sleep. This method is available for xfce4-power-manager and gnome-power-manager.
 	// but might not be available in other cases.
-	GetInhibitors() (inhibitors []string, err error)
-	UnInhibit(cookie uint32) (err error)
+	GetInhibitors(ctx context.Context) (inhibitors []string, err error)
+	UnInhibit(ctx context.Context, cookie uint32) (err error)
+}
+
+/*
+ListingDetector is implemented by inhibitors which can tell if GetInhibitors is supported without calling it, e.g.
+through D-Bus introspection. Inhibitors which don't implement it are assumed to support listing.
+*/
+type ListingDetector interface {
+	SupportsListing(ctx context.Context) (bool, error)
+}
+
+/*
+Adopter is implemented by inhibitors which can take over inhibitors they didn't create. NoopSleepInhibitor adopts
+inhibitors of the running daemon, so dry-run mode sees them as held and only logs releasing them.
+*/
+type Adopter interface {
+	Adopt(cookie uint32, appName string)
 }
 
 type DbusSleepInhibitor struct {
 	dbusConnection *dbus.Conn
+	// callTimeout limits every D-Bus call in addition to the context passed by the caller
+	callTimeout time.Duration
 }
 
-func NewDbusSleepInhibitor(dbusConnection *dbus.Conn) SleepInhibitor {
+func NewDbusSleepInhibitor(dbusConnection *dbus.Conn, callTimeout time.Duration) SleepInhibitor {
 	return &DbusSleepInhibitor{
 		dbusConnection: dbusConnection,
+		callTimeout:    callTimeout,
 	}
 }
 
-func (d *DbusSleepInhibitor) Inhibit(appName string) (cookie uint32, success bool, err error) {
+func (d *DbusSleepInhibitor) Backend() string {
+	return dbusDest
+}
+
+func (d *DbusSleepInhibitor) Inhibit(ctx context.Context, appName string) (cookie uint32, success bool, err error) {
 	obj := d.dbusConnection.Object(
 		dbusDest,
 		dbusPath,
 	)
 	dBusMethod := "org.freedesktop.PowerManagement.Inhibit.Inhibit"
-	logrus.Debugf("Will inhibit sleep for app %s by calling %s", appName, dBusMethod)
-	err = obj.Call(dBusMethod, 0, appName, "VM is running").Store(&cookie)
-	logrus.Debugf("Called to inhibit sleep and got cookie: %d", cookie)
+	inhibitLog := backendLog().WithField(logging.FieldDomain, appName)
+	inhibitLog.Debugf("Will inhibit sleep by calling %s", dBusMethod)
+	ctx, cancel := context.WithTimeout(ctx, d.callTimeout)
+	defer cancel()
+	err = obj.CallWithContext(ctx, dBusMethod, 0, appName, "VM is running").Store(&cookie)
 	if err != nil {
-		logrus.Errorf("Can't retrieve or store cookie. Err %s", err)
+		inhibitLog.WithError(err).Error("Can't retrieve or store cookie")
 		return 0, false, err
 	}
-	logrus.Debugf("Inhibit cookie: %d", cookie)
+	inhibitLog.WithField(logging.FieldCookie, cookie).Debug("Called to inhibit sleep and got cookie")
 	return cookie, true, nil
 }
 
-func (d *DbusSleepInhibitor) GetInhibitors() (inhibitors []string, err error) {
+func (d *DbusSleepInhibitor) GetInhibitors(ctx context.Context) (inhibitors []string, err error) {
 	obj := d.dbusConnection.Object(
 		dbusDest,
 		dbusPath,
 	)
 	dBusMethod := "org.freedesktop.PowerManagement.Inhibit.GetInhibitors"
-	call := obj.Call(dBusMethod, 0)
+	ctx, cancel := context.WithTimeout(ctx, d.callTimeout)
+	defer cancel()
+	call := obj.CallWithContext(ctx, dBusMethod, 0)
+	if isUnknownMethod(call.Err) {
+		backendLog().WithError(call.Err).Debugf("DBUS method %s is not supported", dBusMethod)
+		return inhibitors, fmt.Errorf("%w: %s", ErrListingNotSupported, call.Err)
+	}
 	if call.Err != nil {
-		logrus.Errorf("Can't call DBUS dBusMethod %s. Err %s", dBusMethod, call.Err)
+		backendLog().WithError(call.Err).Errorf("Can't call DBUS dBusMethod %s", dBusMethod)
 		return inhibitors, call.Err
 	}
 	err = call.Store(&inhibitors)
 	if err != nil {
-		logrus.Errorf("Can't retrieve or store inhibitors. Err %s", err)
+		backendLog().WithError(err).Error("Can't retrieve or store inhibitors")
 		return inhibitors, err
 	}
-	logrus.Debugf("Current Inhibitors: %v", inhibitors)
+	backendLog().Debugf("Current Inhibitors: %v", inhibitors)
 	return inhibitors, nil
 }
 
-func (d *DbusSleepInhibitor) UnInhibit(cookie uint32) (err error) {
+// SupportsListing introspects the power manager to check if it implements GetInhibitors
+func (d *DbusSleepInhibitor) SupportsListing(ctx context.Context) (bool, error) {
+	obj := d.dbusConnection.Object(dbusDest, dbusPath)
+	ctx, cancel := context.WithTimeout(ctx, d.callTimeout)
+	defer cancel()
+	var data string
+	err := obj.CallWithContext(ctx, "org.freedesktop.DBus.Introspectable.Introspect", 0).Store(&data)
+	if err != nil {
+		return false, fmt.Errorf("can't introspect %s: %w", dbusDest, err)
+	}
+	var node introspect.Node
+	if err := xml.Unmarshal([]byte(data), &node); err != nil {
+		return false, fmt.Errorf("can't parse introspection data of %s: %w", dbusDest, err)
+	}
+	for _, iface := range node.Interfaces {
+		if iface.Name != dbusInterface {
+			continue
+		}
+		for _, method := range iface.Methods {
+			if method.Name == "GetInhibitors" {
+				return true, nil
+			}
+		}
+	}
+	backendLog().Debug("Power manager doesn't implement GetInhibitors")
+	return false, nil
+}
+
+func (d *DbusSleepInhibitor) UnInhibit(ctx context.Context, cookie uint32) (err error) {
 	dBusMethod := "org.freedesktop.PowerManagement.Inhibit.UnInhibit"
 	obj := d.dbusConnection.Object(dbusDest, dbusPath)
-	call := obj.Call(dBusMethod, 0, cookie)
+	uninhibitLog := backendLog().WithField(logging.FieldCookie, cookie)
+	ctx, cancel := context.WithTimeout(ctx, d.callTimeout)
+	defer cancel()
+	call := obj.CallWithContext(ctx, dBusMethod, 0, cookie)
+	if isCookieNotFound(call.Err) {
+		uninhibitLog.WithError(call.Err).Info("Power manager doesn't know the cookie")
+		return fmt.Errorf("%w: %s", ErrCookieNotFound, call.Err)
+	}
 	if call.Err != nil {
-		logrus.Infof(
-			"Can't call DBUS dBusMethod %s. Might be okay if inhibitor doesn't exists. Err %s",
-			dBusMethod, call.Err,
+		uninhibitLog.WithError(call.Err).Infof(
+			"Can't call DBUS dBusMethod %s. Might be okay if inhibitor doesn't exists", dBusMethod,
 		)
 		return call.Err
 	}
+	uninhibitLog.Debug("Uninhibited sleep")
 	return nil
 }
+
+// isUnknownMethod checks if err means the called method isn't implemented by the service
+func isUnknownMethod(err error) bool {
+	var dbusErr dbus.Error
+	if !errors.As(err, &dbusErr) {
+		return false
+	}
+	switch dbusErr.Name {
+	case "org.freedesktop.DBus.Error.UnknownMethod",
+		"org.freedesktop.DBus.Error.UnknownInterface",
+		"org.freedesktop.DBus.Error.NotSupported":
+		return true
+	}
+	return false
+}
+
+// isCookieNotFound checks if err means the power manager doesn't have an inhibitor with the cookie
+func isCookieNotFound(err error) bool {
+	var dbusErr dbus.Error
+	if !errors.As(err, &dbusErr) {
+		return false
+	}
+	return dbusErr.Name == "org.xfce.PowerManager.Error.CookieNotFound"
+}
+
+// backendLog returns a logger with the backend field set, so every line can be attributed to the power manager
+func backendLog() *logrus.Entry {
+	return logrus.WithField(logging.FieldBackend, dbusDest)
+}
@@ -1,9 +1,11 @@
 package dbus_inhibitor
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	dbus "github.com/godbus/dbus/v5"
 	"github.com/stretchr/testify/assert"
@@ -32,7 +34,7 @@ func (s *DbusSleepInhibitorSuite) SetupSuite() {
 		s.T().Fatalf("Can't connect to test dbus server. Err %s", err)
 	}
 
-	s.SleepInhibitor = NewDbusSleepInhibitor(conn)
+	s.SleepInhibitor = NewDbusSleepInhibitor(conn, DefaultCallTimeout)
 	err = s.FakeDbusService.Start()
 	if err != nil {
 		s.T().Fatalf("Can't start fake dbus service. Err %s", err)
@@ -66,24 +68,65 @@ func (s *DbusSleepInhibitorSuite) TearDownSuite() {
 }
 
 func (s *DbusSleepInhibitorSuite) TestInhibit() {
-	cookie, success, err := s.SleepInhibitor.Inhibit("test")
+	cookie, success, err := s.SleepInhibitor.Inhibit(context.Background(), "test")
 	assert.Equal(s.T(), uint32(1), cookie)
 	assert.True(s.T(), success)
 	assert.NoError(s.T(), err)
 
-	activeInhibitors, err := s.SleepInhibitor.GetInhibitors()
+	activeInhibitors, err := s.SleepInhibitor.GetInhibitors(context.Background())
 	assert.NoError(s.T(), err)
 	assert.Equal(s.T(), []string{"test"}, activeInhibitors)
 
-	dbusErr := s.SleepInhibitor.UnInhibit(cookie)
+	dbusErr := s.SleepInhibitor.UnInhibit(context.Background(), cookie)
 	assert.NoError(s.T(), dbusErr)
 }
 
 func (s *DbusSleepInhibitorSuite) TestUninhibitedNonExisting() {
-	dbusErr := s.SleepInhibitor.UnInhibit(9999)
+	dbusErr := s.SleepInhibitor.UnInhibit(context.Background(), 9999)
 	assert.Errorf(s.T(), dbusErr, "org.freedesktop.PowerManagement.Inhibit.Error.InhibitorNotFound")
 }
 
+func (s *DbusSleepInhibitorSuite) TestGetInhibitorsNotSupported() {
+	s.FakeDbusService.SetListingEnabled(false)
+	defer s.FakeDbusService.SetListingEnabled(true)
+	_, err := s.SleepInhibitor.GetInhibitors(context.Background())
+	assert.ErrorIs(s.T(), err, ErrListingNotSupported)
+}
+
+func (s *DbusSleepInhibitorSuite) TestSupportsListing() {
+	detector := s.SleepInhibitor.(ListingDetector)
+	supported, err := detector.SupportsListing(context.Background())
+	s.Require().NoError(err)
+	s.Assert().True(supported)
+
+	s.FakeDbusService.SetListingEnabled(false)
+	defer s.FakeDbusService.SetListingEnabled(true)
+	supported, err = detector.SupportsListing(context.Background())
+	s.Require().NoError(err)
+	s.Assert().False(supported)
+}
+
+// TestUnresponsivePowerManager tests that calls give up after the timeout or when the context is cancelled
+func (s *DbusSleepInhibitorSuite) TestUnresponsivePowerManager() {
+	s.FakeDbusService.SetUnresponsive(true)
+	defer s.FakeDbusService.SetUnresponsive(false)
+	inhibitor := s.SleepInhibitor.(*DbusSleepInhibitor)
+	inhibitor.callTimeout = 100 * time.Millisecond
+	defer func() { inhibitor.callTimeout = DefaultCallTimeout }()
+
+	startedAt := time.Now()
+	_, success, err := inhibitor.Inhibit(context.Background(), "test")
+	assert.ErrorIs(s.T(), err, context.DeadlineExceeded)
+	assert.False(s.T(), success)
+	_, err = inhibitor.GetInhibitors(context.Background())
+	assert.ErrorIs(s.T(), err, context.DeadlineExceeded)
+	assert.Less(s.T(), time.Since(startedAt), time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(s.T(), inhibitor.UnInhibit(ctx, 1), context.Canceled)
+}
+
 func TestRunDbusSleepInhibitorSuite(t *testing.T) {
 	suite.Run(t, new(DbusSleepInhibitorSuite))
 }
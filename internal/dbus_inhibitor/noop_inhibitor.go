@@ -0,0 +1,80 @@
+package dbus_inhibitor
+
+import (
+	"context"
+	"fmt"
+	"libvirt_keepawake/internal/logging"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NoopBackend is reported as backend by NoopSleepInhibitor, so its inhibitors are never mistaken for real ones
+const NoopBackend = "noop"
+
+// NoopSleepInhibitor only logs what would be done, used in dry-run mode to observe decisions without touching the
+// power manager
+type NoopSleepInhibitor struct {
+	mutex      sync.Mutex
+	lastCookie uint32
+	inhibitors map[uint32]string
+}
+
+func NewNoopSleepInhibitor() *NoopSleepInhibitor {
+	return &NoopSleepInhibitor{inhibitors: make(map[uint32]string)}
+}
+
+func (n *NoopSleepInhibitor) Backend() string {
+	return NoopBackend
+}
+
+func (n *NoopSleepInhibitor) Inhibit(_ context.Context, appName string) (cookie uint32, success bool, err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.lastCookie++
+	n.inhibitors[n.lastCookie] = appName
+	noopLog().WithFields(logrus.Fields{
+		logging.FieldDomain: appName,
+		logging.FieldCookie: n.lastCookie,
+	}).Info("Dry run: would inhibit sleep")
+	return n.lastCookie, true, nil
+}
+
+// Adopt implements Adopter, cookies of new inhibitors are above adopted ones, so they never collide
+func (n *NoopSleepInhibitor) Adopt(cookie uint32, appName string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.inhibitors[cookie] = appName
+	n.lastCookie = max(n.lastCookie, cookie)
+}
+
+func (n *NoopSleepInhibitor) GetInhibitors(_ context.Context) (inhibitors []string, err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	inhibitors = []string{}
+	for _, appName := range n.inhibitors {
+		inhibitors = append(inhibitors, appName)
+	}
+	sort.Strings(inhibitors)
+	return inhibitors, nil
+}
+
+func (n *NoopSleepInhibitor) UnInhibit(_ context.Context, cookie uint32) (err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	appName, ok := n.inhibitors[cookie]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrCookieNotFound, cookie)
+	}
+	delete(n.inhibitors, cookie)
+	noopLog().WithFields(logrus.Fields{
+		logging.FieldDomain: appName,
+		logging.FieldCookie: cookie,
+	}).Info("Dry run: would uninhibit sleep")
+	return nil
+}
+
+func noopLog() *logrus.Entry {
+	return logrus.WithField(logging.FieldBackend, NoopBackend)
+}
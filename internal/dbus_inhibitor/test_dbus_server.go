@@ -26,7 +26,7 @@ func startDBUSProcess(socketPath string) (*os.Process, error) {
    
 	<policy context='default'>
 	  <allow send_destination='*' eavesdrop='true'/>
-      <allow own='org.freedesktop.PowerManagement'/>
+      <allow own='*'/>
 	  <allow eavesdrop='true'/>
 	  <allow user='*'/>
 	</policy>
@@ -0,0 +1,83 @@
+package desktop_notifier
+
+// Fake dbus service which listen for `org.freedesktop.Notifications` and records shown notifications.
+// Intended for testing purposes only
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+type FakeNotification struct {
+	Id         uint32
+	ReplacesId uint32
+	Summary    string
+	Body       string
+	Actions    []string
+}
+
+type FakeNotificationService struct {
+	dbusConnection *dbus.Conn
+	notifications  []FakeNotification
+	lastId         uint32
+	mutex          sync.Mutex
+}
+
+func NewFakeNotificationService(dbusConnection *dbus.Conn) *FakeNotificationService {
+	return &FakeNotificationService{dbusConnection: dbusConnection}
+}
+
+func (s *FakeNotificationService) Start() error {
+	reply, err := s.dbusConnection.RequestName(notificationsDest, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return err
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return fmt.Errorf("name %s is already taken", notificationsDest)
+	}
+	return s.dbusConnection.Export(s, notificationsPath, notificationsInterface)
+}
+
+func (s *FakeNotificationService) Stop() {
+	if _, err := s.dbusConnection.ReleaseName(notificationsDest); err != nil {
+		log.Warnf("Failed to release Name: %v on test dbus", err)
+	}
+	if err := s.dbusConnection.Close(); err != nil {
+		log.Warnf("Failed to close connection: %v on test dbus", err)
+	}
+}
+
+// Notify is the method that will handle the Notify D-Bus calls.
+func (s *FakeNotificationService) Notify(
+	appName string, replacesId uint32, appIcon string, summary string, body string,
+	actions []string, hints map[string]dbus.Variant, expireTimeout int32,
+) (uint32, *dbus.Error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id := replacesId
+	if id == 0 {
+		s.lastId++
+		id = s.lastId
+	}
+	s.notifications = append(s.notifications, FakeNotification{
+		Id: id, ReplacesId: replacesId, Summary: summary, Body: body, Actions: actions,
+	})
+	return id, nil
+}
+
+// GetNotifications returns all notifications shown so far. Should be called only from tests
+func (s *FakeNotificationService) GetNotifications() []FakeNotification {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	notifications := make([]FakeNotification, len(s.notifications))
+	copy(notifications, s.notifications)
+	return notifications
+}
+
+// InvokeAction emits ActionInvoked signal as if a user clicked on a notification button
+func (s *FakeNotificationService) InvokeAction(notificationId uint32, actionKey string) error {
+	return s.dbusConnection.Emit(notificationsPath, notificationsInterface+".ActionInvoked", notificationId, actionKey)
+}
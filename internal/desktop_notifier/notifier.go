@@ -0,0 +1,205 @@
+package desktop_notifier
+
+import (
+	"fmt"
+	"libvirt_keepawake/internal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const notificationsDest = "org.freedesktop.Notifications"
+const notificationsPath dbus.ObjectPath = "/org/freedesktop/Notifications"
+const notificationsInterface = "org.freedesktop.Notifications"
+
+const appName = "libvirt-keepawake"
+const appIcon = "computer"
+
+// ActionPause is a key of the notification action which pauses inhibition for PauseDuration
+const ActionPause = "pause"
+const PauseDuration = time.Hour
+
+// Pauser is implemented by internal.Orchestrator
+type Pauser interface {
+	Pause(duration time.Duration)
+}
+
+/*
+DesktopNotifier shows desktop notifications(org.freedesktop.Notifications) when the orchestrator activates or
+deactivates inhibitors. Events arriving within coalesceWindow are merged into one notification, and every new
+notification replaces the previous one, so a user sees at most one notification from us.
+*/
+type DesktopNotifier struct {
+	dbusConnection *dbus.Conn
+	pauser         Pauser
+	coalesceWindow time.Duration
+	events         chan internal.Event
+	signals        chan *dbus.Signal
+	done           chan struct{}
+	stopped        sync.WaitGroup
+	// state below is accessed only from the notifier goroutine
+	activeDomains      map[internal.InhibitorName]bool
+	failedDomains      map[internal.InhibitorName]internal.Event
+	pausedUntil        time.Time
+	lastNotificationId uint32
+}
+
+func NewDesktopNotifier(dbusConnection *dbus.Conn, pauser Pauser, coalesceWindow time.Duration) *DesktopNotifier {
+	return &DesktopNotifier{
+		dbusConnection: dbusConnection,
+		pauser:         pauser,
+		coalesceWindow: coalesceWindow,
+		events:         make(chan internal.Event, 64),
+		signals:        make(chan *dbus.Signal, 16),
+		done:           make(chan struct{}),
+		activeDomains:  make(map[internal.InhibitorName]bool),
+		failedDomains:  make(map[internal.InhibitorName]internal.Event),
+	}
+}
+
+// Start subscribes to notification actions and starts processing orchestrator events
+func (n *DesktopNotifier) Start() error {
+	err := n.dbusConnection.AddMatchSignal(
+		dbus.WithMatchInterface(notificationsInterface),
+		dbus.WithMatchMember("ActionInvoked"),
+	)
+	if err != nil {
+		return fmt.Errorf("can't subscribe to notification actions: %w", err)
+	}
+	n.dbusConnection.Signal(n.signals)
+	n.stopped.Add(1)
+	go n.run()
+	return nil
+}
+
+// Stop stops processing events. Pending events are dropped
+func (n *DesktopNotifier) Stop() {
+	close(n.done)
+	n.stopped.Wait()
+	n.dbusConnection.RemoveSignal(n.signals)
+}
+
+// HandleEvent implements internal.EventListener
+func (n *DesktopNotifier) HandleEvent(event internal.Event) {
+	// every check would replace the notification otherwise
+	if event.Kind == internal.EventChecked {
+		return
+	}
+	select {
+	case n.events <- event:
+	default:
+		log.Warnf("Notifier queue is full, dropping event %s", event.Kind)
+	}
+}
+
+func (n *DesktopNotifier) run() {
+	defer n.stopped.Done()
+	// nil channel blocks forever, so there is no pending notification until the first event
+	var coalesceTimer <-chan time.Time
+	for {
+		select {
+		case event := <-n.events:
+			n.applyEvent(event)
+			if coalesceTimer == nil {
+				coalesceTimer = time.After(n.coalesceWindow)
+			}
+		case <-coalesceTimer:
+			coalesceTimer = nil
+			n.notify()
+		case signal := <-n.signals:
+			n.handleSignal(signal)
+		case <-n.done:
+			return
+		}
+	}
+}
+
+func (n *DesktopNotifier) applyEvent(event internal.Event) {
+	switch event.Kind {
+	case internal.EventInhibitorActivated:
+		n.activeDomains[event.Domain] = true
+	case internal.EventInhibitorDeactivated:
+		delete(n.activeDomains, event.Domain)
+	case internal.EventPaused:
+		n.pausedUntil = event.PausedUntil
+	case internal.EventResumed:
+		n.pausedUntil = time.Time{}
+	case internal.EventInhibitorFailed:
+		n.failedDomains[event.Domain] = event
+	case internal.EventInhibitorRecovered:
+		delete(n.failedDomains, event.Domain)
+	}
+}
+
+// notify shows a notification describing the current state, replacing the previous one
+func (n *DesktopNotifier) notify() {
+	summary, body, actions := n.describeState()
+	obj := n.dbusConnection.Object(notificationsDest, notificationsPath)
+	var notificationId uint32
+	err := obj.Call(
+		notificationsInterface+".Notify", 0,
+		appName, n.lastNotificationId, appIcon, summary, body, actions, map[string]dbus.Variant{}, int32(-1),
+	).Store(&notificationId)
+	if err != nil {
+		log.WithError(err).Error("Can't show desktop notification")
+		return
+	}
+	log.Debugf("Shown notification %d: %s. %s", notificationId, summary, body)
+	n.lastNotificationId = notificationId
+}
+
+func (n *DesktopNotifier) describeState() (summary string, body string, actions []string) {
+	// failures are shown first, the user might need to restart the power manager
+	if len(n.failedDomains) > 0 {
+		domains := make([]string, 0, len(n.failedDomains))
+		for domain := range n.failedDomains {
+			domains = append(domains, string(domain))
+		}
+		sort.Strings(domains)
+		lines := make([]string, 0, len(domains))
+		for _, domain := range domains {
+			failure := n.failedDomains[internal.InhibitorName(domain)]
+			if failure.Operation == internal.OperationUnInhibit {
+				lines = append(lines, fmt.Sprintf("Can't allow sleep again after %s: %s", domain, failure.Error))
+			} else {
+				lines = append(lines, fmt.Sprintf("Can't block sleep for %s: %s", domain, failure.Error))
+			}
+		}
+		return "Power manager is failing", strings.Join(lines, "\n"), []string{}
+	}
+	if !n.pausedUntil.IsZero() {
+		return "Sleep allowed", fmt.Sprintf("Inhibition is paused until %s", n.pausedUntil.Format(time.TimeOnly)), []string{}
+	}
+	if len(n.activeDomains) == 0 {
+		return "Sleep allowed", "No VMs are running", []string{}
+	}
+	domains := make([]string, 0, len(n.activeDomains))
+	for domain := range n.activeDomains {
+		domains = append(domains, string(domain))
+	}
+	sort.Strings(domains)
+	verb := "is"
+	if len(domains) > 1 {
+		verb = "are"
+	}
+	body = fmt.Sprintf("%s %s running", strings.Join(domains, ", "), verb)
+	return "Sleep blocked", body, []string{ActionPause, "Allow sleep for 1h"}
+}
+
+func (n *DesktopNotifier) handleSignal(signal *dbus.Signal) {
+	if signal.Name != notificationsInterface+".ActionInvoked" || len(signal.Body) != 2 {
+		return
+	}
+	notificationId, ok := signal.Body[0].(uint32)
+	if !ok || notificationId != n.lastNotificationId {
+		return
+	}
+	if action, ok := signal.Body[1].(string); ok && action == ActionPause {
+		log.Infof("User asked to allow sleep for %s from notification", PauseDuration)
+		n.pauser.Pause(PauseDuration)
+	}
+}
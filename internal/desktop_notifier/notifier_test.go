@@ -0,0 +1,136 @@
+package desktop_notifier
+
+import (
+	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/dbus_inhibitor"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/suite"
+)
+
+type fakePauser struct {
+	mutex  sync.Mutex
+	pauses []time.Duration
+}
+
+func (p *fakePauser) Pause(duration time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pauses = append(p.pauses, duration)
+}
+
+func (p *fakePauser) getPauses() []time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]time.Duration{}, p.pauses...)
+}
+
+type DesktopNotifierSuite struct {
+	suite.Suite
+	dbusProcess         *os.Process
+	notificationService *FakeNotificationService
+	pauser              *fakePauser
+	notifier            *DesktopNotifier
+}
+
+func (s *DesktopNotifierSuite) SetupTest() {
+	dbusSocketPath, dbusProcess, err := dbus_inhibitor.RunDbusServer()
+	if err != nil {
+		s.T().Fatalf("Can't start dbus server. Err %s", err)
+	}
+	s.dbusProcess = dbusProcess
+
+	serviceConn, err := dbus.Connect(dbusSocketPath)
+	s.Require().NoError(err)
+	s.notificationService = NewFakeNotificationService(serviceConn)
+	s.Require().NoError(s.notificationService.Start())
+
+	conn, err := dbus.Connect(dbusSocketPath)
+	s.Require().NoError(err)
+	s.pauser = &fakePauser{}
+	s.notifier = NewDesktopNotifier(conn, s.pauser, 200*time.Millisecond)
+	s.Require().NoError(s.notifier.Start())
+}
+
+func (s *DesktopNotifierSuite) TearDownTest() {
+	s.notifier.Stop()
+	s.notificationService.Stop()
+	if err := s.dbusProcess.Kill(); err != nil {
+		s.T().Fatalf("Can't kill dbus server with PID %d. Err %s", s.dbusProcess.Pid, err)
+	}
+}
+
+// TestCoalesceAndReplace checks a burst of events produces one notification, and the next one replaces it
+func (s *DesktopNotifierSuite) TestCoalesceAndReplace() {
+	s.notifier.HandleEvent(internal.Event{Kind: internal.EventInhibitorActivated, Domain: "win11"})
+	s.notifier.HandleEvent(internal.Event{Kind: internal.EventInhibitorActivated, Domain: "linux"})
+	s.Require().Eventually(func() bool {
+		return len(s.notificationService.GetNotifications()) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	first := s.notificationService.GetNotifications()[0]
+	s.Assert().Equal("Sleep blocked", first.Summary)
+	s.Assert().Equal("linux, win11 are running", first.Body)
+	s.Assert().Equal(uint32(0), first.ReplacesId)
+	s.Assert().Equal([]string{ActionPause, "Allow sleep for 1h"}, first.Actions)
+
+	s.notifier.HandleEvent(internal.Event{Kind: internal.EventInhibitorDeactivated, Domain: "linux"})
+	s.notifier.HandleEvent(internal.Event{Kind: internal.EventInhibitorDeactivated, Domain: "win11"})
+	s.Require().Eventually(func() bool {
+		return len(s.notificationService.GetNotifications()) == 2
+	}, 5*time.Second, 50*time.Millisecond)
+	second := s.notificationService.GetNotifications()[1]
+	s.Assert().Equal("Sleep allowed", second.Summary)
+	s.Assert().Equal(first.Id, second.ReplacesId)
+
+	// no extra notifications were shown
+	time.Sleep(400 * time.Millisecond)
+	s.Assert().Len(s.notificationService.GetNotifications(), 2)
+}
+
+func (s *DesktopNotifierSuite) TestPauseAction() {
+	s.notifier.HandleEvent(internal.Event{Kind: internal.EventInhibitorActivated, Domain: "win11"})
+	s.Require().Eventually(func() bool {
+		return len(s.notificationService.GetNotifications()) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	notification := s.notificationService.GetNotifications()[0]
+	s.Assert().Equal("win11 is running", notification.Body)
+
+	// actions of other notifications are ignored
+	s.Require().NoError(s.notificationService.InvokeAction(notification.Id+100, ActionPause))
+	s.Require().NoError(s.notificationService.InvokeAction(notification.Id, ActionPause))
+	s.Require().Eventually(func() bool {
+		return len(s.pauser.getPauses()) > 0
+	}, 5*time.Second, 50*time.Millisecond)
+	s.Assert().Equal([]time.Duration{PauseDuration}, s.pauser.getPauses())
+}
+
+// TestFailureNotification checks escalated failures are shown until the domain recovers
+func (s *DesktopNotifierSuite) TestFailureNotification() {
+	s.notifier.HandleEvent(internal.Event{Kind: internal.EventInhibitorActivated, Domain: "linux"})
+	s.notifier.HandleEvent(internal.Event{
+		Kind: internal.EventInhibitorFailed, Domain: "win11", Operation: internal.OperationInhibit, Error: "refused",
+	})
+	s.Require().Eventually(func() bool {
+		return len(s.notificationService.GetNotifications()) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	notification := s.notificationService.GetNotifications()[0]
+	s.Assert().Equal("Power manager is failing", notification.Summary)
+	s.Assert().Equal("Can't block sleep for win11: refused", notification.Body)
+
+	s.notifier.HandleEvent(internal.Event{
+		Kind: internal.EventInhibitorRecovered, Domain: "win11", Operation: internal.OperationInhibit,
+	})
+	s.notifier.HandleEvent(internal.Event{Kind: internal.EventInhibitorActivated, Domain: "win11"})
+	s.Require().Eventually(func() bool {
+		return len(s.notificationService.GetNotifications()) == 2
+	}, 5*time.Second, 50*time.Millisecond)
+	s.Assert().Equal("linux, win11 are running", s.notificationService.GetNotifications()[1].Body)
+}
+
+func TestRunDesktopNotifierSuite(t *testing.T) {
+	suite.Run(t, new(DesktopNotifierSuite))
+}
@@ -0,0 +1,391 @@
+package doctor
+
+// Diagnoses why sleep isn't inhibited: checks DBUS buses, inhibition backends and access to libvirt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/dbus_inhibitor"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	log "github.com/sirupsen/logrus"
+	"libvirt.org/go/libvirt"
+)
+
+type Status string
+
+const (
+	StatusPass Status = "PASS"
+	StatusWarn Status = "WARN"
+	StatusFail Status = "FAIL"
+	StatusSkip Status = "SKIP"
+)
+
+// Bus is the DBUS bus a backend lives on
+type Bus string
+
+const (
+	SessionBus Bus = "session"
+	SystemBus  Bus = "system"
+)
+
+// DoctorAppName is the application name of the inhibitor created by the round-trip check
+const DoctorAppName = internal.InhibitorAppNamePrefix + "doctor"
+
+type Result struct {
+	Check       string
+	Status      Status
+	Details     string
+	Remediation string
+}
+
+type Report struct {
+	Results []Result
+}
+
+func (r *Report) add(result Result) {
+	r.Results = append(r.Results, result)
+}
+
+// Failed returns true if at least one check failed, warnings don't count
+func (r Report) Failed() bool {
+	for _, result := range r.Results {
+		if result.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Report) Write(w io.Writer) error {
+	counts := make(map[Status]int)
+	for _, result := range r.Results {
+		counts[result.Status]++
+		if _, err := fmt.Fprintf(w, "[%s] %s: %s\n", result.Status, result.Check, result.Details); err != nil {
+			return err
+		}
+		if result.Remediation != "" {
+			for _, line := range strings.Split(result.Remediation, "\n") {
+				if _, err := fmt.Fprintf(w, "       %s\n", line); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	_, err := fmt.Fprintf(
+		w, "\n%d passed, %d warnings, %d failed, %d skipped\n",
+		counts[StatusPass], counts[StatusWarn], counts[StatusFail], counts[StatusSkip],
+	)
+	return err
+}
+
+// Backend describes a DBUS service which is able to inhibit sleep
+type Backend struct {
+	Bus       Bus
+	Dest      string
+	Path      dbus.ObjectPath
+	Interface string
+	// Methods must be implemented for the backend to be usable
+	Methods []string
+	// OptionalMethods make some features work, e.g. GetInhibitors is needed to detect stale inhibitors
+	OptionalMethods []string
+	// Required backends fail the report when missing, other are only reported
+	Required    bool
+	Remediation string
+}
+
+var Backends = []Backend{
+	{
+		Bus:             SessionBus,
+		Dest:            "org.freedesktop.PowerManagement",
+		Path:            "/org/freedesktop/PowerManagement/Inhibit",
+		Interface:       "org.freedesktop.PowerManagement.Inhibit",
+		Methods:         []string{"Inhibit", "UnInhibit"},
+		OptionalMethods: []string{"GetInhibitors"},
+		Required:        true,
+		Remediation: "Start a power manager implementing org.freedesktop.PowerManagement, " +
+			"e.g. xfce4-power-manager or gnome-power-manager",
+	},
+	{
+		Bus:         SystemBus,
+		Dest:        "org.freedesktop.login1",
+		Path:        "/org/freedesktop/login1",
+		Interface:   "org.freedesktop.login1.Manager",
+		Methods:     []string{"Inhibit"},
+		Remediation: "systemd-logind or elogind isn't running",
+	},
+}
+
+// LibvirtConnection is a libvirt connection opened by doctor, it's closed after the check
+type LibvirtConnection interface {
+	libvirt_watcher.MinimalLibvirtConnect
+	Close() error
+}
+
+type Doctor struct {
+	// SessionBus and SystemBus open new authenticated connections, doctor closes them when done
+	SessionBus  func() (*dbus.Conn, error)
+	SystemBus   func() (*dbus.Conn, error)
+	Backends    []Backend
+	URIs        []string
+	DialLibvirt func(uri string, readOnly bool) (LibvirtConnection, error)
+	// lookupGroupMembership allows to fake group membership of the current user in tests
+	lookupGroupMembership func(group string) (exists bool, member bool)
+}
+
+func NewDoctor(
+	sessionBus func() (*dbus.Conn, error),
+	systemBus func() (*dbus.Conn, error),
+	uris []string,
+	dialLibvirt func(uri string, readOnly bool) (LibvirtConnection, error),
+) *Doctor {
+	return &Doctor{
+		SessionBus:            sessionBus,
+		SystemBus:             systemBus,
+		Backends:              Backends,
+		URIs:                  uris,
+		DialLibvirt:           dialLibvirt,
+		lookupGroupMembership: lookupGroupMembership,
+	}
+}
+
+// Run runs all checks, checks which depend on a failed one are skipped
+func (d *Doctor) Run() Report {
+	var report Report
+	buses := map[Bus]*dbus.Conn{
+		SessionBus: d.checkBus(&report, SessionBus, d.SessionBus),
+		SystemBus:  d.checkBus(&report, SystemBus, d.SystemBus),
+	}
+	defer func() {
+		for _, conn := range buses {
+			if conn != nil {
+				if err := conn.Close(); err != nil {
+					log.WithError(err).Warn("Can't close DBUS connection")
+				}
+			}
+		}
+	}()
+
+	powerManagementUsable := false
+	for _, backend := range d.Backends {
+		usable := d.checkBackend(&report, buses[backend.Bus], backend)
+		if backend.Dest == "org.freedesktop.PowerManagement" {
+			powerManagementUsable = usable
+		}
+	}
+	d.checkRoundTrip(&report, buses[SessionBus], powerManagementUsable)
+
+	for _, uri := range d.URIs {
+		d.checkLibvirt(&report, uri)
+	}
+	return report
+}
+
+func (d *Doctor) checkBus(report *Report, bus Bus, connect func() (*dbus.Conn, error)) *dbus.Conn {
+	check := fmt.Sprintf("%s bus", bus)
+	conn, err := connect()
+	if err != nil {
+		result := Result{Check: check, Status: StatusFail, Details: fmt.Sprintf("can't connect: %s", err)}
+		if bus == SessionBus {
+			result.Remediation = "Run from inside the desktop session, DBUS_SESSION_BUS_ADDRESS must be set"
+		} else {
+			result.Remediation = "Make sure dbus system daemon is running"
+		}
+		report.add(result)
+		return nil
+	}
+	report.add(Result{Check: check, Status: StatusPass, Details: "connected"})
+	return conn
+}
+
+// checkBackend returns true if backend is running and implements all required methods
+func (d *Doctor) checkBackend(report *Report, conn *dbus.Conn, backend Backend) bool {
+	check := fmt.Sprintf("backend %s", backend.Dest)
+	missingStatus := StatusWarn
+	if backend.Required {
+		missingStatus = StatusFail
+	}
+	if conn == nil {
+		report.add(Result{Check: check, Status: StatusSkip, Details: fmt.Sprintf("%s bus isn't available", backend.Bus)})
+		return false
+	}
+	var hasOwner bool
+	err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, backend.Dest).Store(&hasOwner)
+	if err != nil {
+		report.add(Result{
+			Check: check, Status: missingStatus, Details: fmt.Sprintf("can't check if service is running: %s", err),
+		})
+		return false
+	}
+	if !hasOwner {
+		report.add(Result{
+			Check: check, Status: missingStatus, Details: "not running", Remediation: backend.Remediation,
+		})
+		return false
+	}
+
+	node, err := introspect.Call(conn.Object(backend.Dest, backend.Path))
+	if err != nil {
+		report.add(Result{
+			Check: check, Status: missingStatus, Details: fmt.Sprintf("running, but can't be introspected: %s", err),
+		})
+		return false
+	}
+	var methods []string
+	for _, iface := range node.Interfaces {
+		if iface.Name != backend.Interface {
+			continue
+		}
+		for _, method := range iface.Methods {
+			methods = append(methods, method.Name)
+		}
+	}
+	var missing, missingOptional []string
+	for _, method := range backend.Methods {
+		if !slices.Contains(methods, method) {
+			missing = append(missing, method)
+		}
+	}
+	for _, method := range backend.OptionalMethods {
+		if !slices.Contains(methods, method) {
+			missingOptional = append(missingOptional, method)
+		}
+	}
+	if len(missing) > 0 {
+		report.add(Result{
+			Check:  check,
+			Status: missingStatus,
+			Details: fmt.Sprintf(
+				"%s at %s doesn't implement %s", backend.Interface, backend.Path, strings.Join(missing, ", "),
+			),
+			Remediation: backend.Remediation,
+		})
+		return false
+	}
+	if len(missingOptional) > 0 {
+		report.add(Result{
+			Check:   check,
+			Status:  StatusWarn,
+			Details: fmt.Sprintf("running, but doesn't implement %s", strings.Join(missingOptional, ", ")),
+			Remediation: "Inhibitors left by a crashed daemon can't be detected, " +
+				"they're released only when the power manager restarts",
+		})
+		return true
+	}
+	report.add(Result{Check: check, Status: StatusPass, Details: "running and implements " + backend.Interface})
+	return true
+}
+
+func (d *Doctor) checkRoundTrip(report *Report, conn *dbus.Conn, backendUsable bool) {
+	check := "inhibit round-trip"
+	if conn == nil || !backendUsable {
+		report.add(Result{Check: check, Status: StatusSkip, Details: "power management backend isn't usable"})
+		return
+	}
+	inhibitor := dbus_inhibitor.NewDbusSleepInhibitor(conn, dbus_inhibitor.DefaultCallTimeout)
+	cookie, _, err := inhibitor.Inhibit(context.Background(), DoctorAppName)
+	if err != nil {
+		report.add(Result{
+			Check:       check,
+			Status:      StatusFail,
+			Details:     fmt.Sprintf("Inhibit failed: %s", err),
+			Remediation: "Check logs of the power manager, it might refuse inhibitors from other applications",
+		})
+		return
+	}
+	if err := inhibitor.UnInhibit(context.Background(), cookie); err != nil {
+		report.add(Result{
+			Check:   check,
+			Status:  StatusFail,
+			Details: fmt.Sprintf("Inhibit returned cookie %d, but UnInhibit failed: %s", cookie, err),
+			Remediation: fmt.Sprintf(
+				"Inhibitor %q might still be active, restart the power manager to release it", DoctorAppName,
+			),
+		})
+		return
+	}
+	report.add(Result{
+		Check: check, Status: StatusPass, Details: fmt.Sprintf("inhibited and released sleep with cookie %d", cookie),
+	})
+}
+
+func (d *Doctor) checkLibvirt(report *Report, uri string) {
+	check := fmt.Sprintf("libvirt %s", uri)
+	count, err := d.countActiveDomains(uri, false)
+	if err == nil {
+		report.add(Result{Check: check, Status: StatusPass, Details: fmt.Sprintf("connected, %d running domains", count)})
+		return
+	}
+	readOnlyCount, readOnlyErr := d.countActiveDomains(uri, true)
+	if readOnlyErr == nil {
+		report.add(Result{
+			Check:  check,
+			Status: StatusWarn,
+			Details: fmt.Sprintf(
+				"only read-only access, %d running domains, full access failed: %s", readOnlyCount, err,
+			),
+			Remediation: "Running domains are still detected, but they can't be managed.\n" + d.permissionHint(uri),
+		})
+		return
+	}
+	report.add(Result{
+		Check:   check,
+		Status:  StatusFail,
+		Details: fmt.Sprintf("can't connect: %s", err),
+		Remediation: "Make sure libvirtd(or virtqemud) is running, e.g. systemctl start libvirtd.\n" +
+			d.permissionHint(uri),
+	})
+}
+
+func (d *Doctor) countActiveDomains(uri string, readOnly bool) (int, error) {
+	connection, err := d.DialLibvirt(uri, readOnly)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := connection.Close(); err != nil {
+			log.WithError(err).Warn("Can't close libvirt connection")
+		}
+	}()
+	domains, err := connection.ListAllDomains(context.Background(), libvirt.CONNECT_LIST_DOMAINS_ACTIVE)
+	if err != nil {
+		return 0, err
+	}
+	return len(domains), nil
+}
+
+func (d *Doctor) permissionHint(uri string) string {
+	if !strings.Contains(uri, "/system") {
+		return "Session connections run as the current user, check that the session daemon can be started"
+	}
+	if exists, member := d.lookupGroupMembership("libvirt"); exists && !member {
+		return "Add the user to libvirt group: sudo usermod -aG libvirt $USER, then log in again"
+	}
+	return "Check that polkit allows org.libvirt.unix.manage for the user, e.g. with a rule in /etc/polkit-1/rules.d"
+}
+
+// lookupGroupMembership checks if group exists and the current process is a member of it
+func lookupGroupMembership(group string) (exists bool, member bool) {
+	libvirtGroup, err := user.LookupGroup(group)
+	if err != nil {
+		return false, false
+	}
+	groups, err := os.Getgroups()
+	if err != nil {
+		return true, false
+	}
+	for _, gid := range groups {
+		if fmt.Sprint(gid) == libvirtGroup.Gid {
+			return true, true
+		}
+	}
+	return true, false
+}
@@ -0,0 +1,180 @@
+package doctor
+
+import (
+	"bytes"
+	"errors"
+	"libvirt_keepawake/internal/dbus_inhibitor"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"os"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/suite"
+)
+
+type closableFakeConnect struct {
+	*libvirt_watcher.FakeLibvirtConnect
+}
+
+func (c closableFakeConnect) Close() error {
+	return nil
+}
+
+type DoctorSuite struct {
+	suite.Suite
+	dbusSocketPath  string
+	dbusProcess     *os.Process
+	fakeDbusService *dbus_inhibitor.FakeDbusService
+	doctor          *Doctor
+	// dialErrors contains errors returned by fake libvirt dialer for full and read-only access
+	dialErrors map[bool]error
+}
+
+func (s *DoctorSuite) SetupTest() {
+	dbusSocketPath, dbusProcess, err := dbus_inhibitor.RunDbusServer()
+	if err != nil {
+		s.T().Fatalf("Can't start dbus server. Err %s", err)
+	}
+	s.dbusSocketPath = dbusSocketPath
+	s.dbusProcess = dbusProcess
+	s.fakeDbusService = nil
+	s.dialErrors = map[bool]error{}
+
+	connectTestBus := func() (*dbus.Conn, error) {
+		return dbus.Connect(s.dbusSocketPath)
+	}
+	libvirtConnect := new(libvirt_watcher.FakeLibvirtConnect)
+	libvirtConnect.UpdateActiveDomains([]libvirt_watcher.MinimalLibvirtDomain{
+		libvirt_watcher.FakeLibvirtDomain{Name: "domain1"},
+	})
+	s.doctor = NewDoctor(
+		connectTestBus,
+		connectTestBus,
+		[]string{"qemu:///system"},
+		func(uri string, readOnly bool) (LibvirtConnection, error) {
+			if err := s.dialErrors[readOnly]; err != nil {
+				return nil, err
+			}
+			return closableFakeConnect{libvirtConnect}, nil
+		},
+	)
+	s.doctor.lookupGroupMembership = func(group string) (bool, bool) {
+		return true, false
+	}
+}
+
+func (s *DoctorSuite) TearDownTest() {
+	if s.fakeDbusService != nil {
+		s.fakeDbusService.Stop()
+	}
+	if err := s.dbusProcess.Kill(); err != nil {
+		s.T().Fatalf("Can't kill dbus server with PID %d. Err %s", s.dbusProcess.Pid, err)
+	}
+}
+
+func (s *DoctorSuite) startPowerManager() {
+	conn, err := dbus.Connect(s.dbusSocketPath)
+	s.Require().NoError(err)
+	s.fakeDbusService = dbus_inhibitor.NewFakeDbusService(conn)
+	s.Require().NoError(s.fakeDbusService.Start())
+}
+
+func (s *DoctorSuite) result(check string) Result {
+	report := s.doctor.Run()
+	for _, result := range report.Results {
+		if result.Check == check {
+			return result
+		}
+	}
+	s.FailNowf("check not found", "no result for %s in %v", check, report.Results)
+	return Result{}
+}
+
+func (s *DoctorSuite) TestAllChecksPass() {
+	s.startPowerManager()
+
+	report := s.doctor.Run()
+
+	s.Assert().False(report.Failed())
+	statuses := map[string]Status{}
+	for _, result := range report.Results {
+		statuses[result.Check] = result.Status
+	}
+	s.Assert().Equal(map[string]Status{
+		"session bus": StatusPass,
+		"system bus":  StatusPass,
+		"backend org.freedesktop.PowerManagement": StatusPass,
+		// login1 isn't running on the test bus, but it's not required
+		"backend org.freedesktop.login1": StatusWarn,
+		"inhibit round-trip":             StatusPass,
+		"libvirt qemu:///system":         StatusPass,
+	}, statuses)
+	inhibitors, _ := s.fakeDbusService.GetInhibitors()
+	s.Assert().Empty(inhibitors, "round-trip must release its inhibitor")
+}
+
+func (s *DoctorSuite) TestPowerManagerMissing() {
+	report := s.doctor.Run()
+
+	s.Assert().True(report.Failed())
+	s.Assert().Equal(StatusFail, s.result("backend org.freedesktop.PowerManagement").Status)
+	s.Assert().Equal(StatusSkip, s.result("inhibit round-trip").Status)
+}
+
+func (s *DoctorSuite) TestSessionBusUnavailable() {
+	s.doctor.SessionBus = func() (*dbus.Conn, error) {
+		return nil, errors.New("no session bus")
+	}
+
+	result := s.result("session bus")
+
+	s.Assert().Equal(StatusFail, result.Status)
+	s.Assert().Contains(result.Remediation, "DBUS_SESSION_BUS_ADDRESS")
+	s.Assert().Equal(StatusSkip, s.result("backend org.freedesktop.PowerManagement").Status)
+}
+
+func (s *DoctorSuite) TestLibvirtReadOnlyFallback() {
+	s.dialErrors[false] = errors.New("authentication failed")
+
+	result := s.result("libvirt qemu:///system")
+
+	s.Assert().Equal(StatusWarn, result.Status)
+	s.Assert().Contains(result.Details, "1 running domains")
+	s.Assert().Contains(result.Remediation, "usermod -aG libvirt")
+}
+
+func (s *DoctorSuite) TestLibvirtUnreachable() {
+	s.dialErrors[false] = errors.New("no socket")
+	s.dialErrors[true] = errors.New("no socket")
+	s.doctor.lookupGroupMembership = func(group string) (bool, bool) {
+		return true, true
+	}
+
+	result := s.result("libvirt qemu:///system")
+
+	s.Assert().Equal(StatusFail, result.Status)
+	s.Assert().Contains(result.Remediation, "polkit")
+}
+
+func (s *DoctorSuite) TestWriteReport() {
+	report := Report{Results: []Result{
+		{Check: "session bus", Status: StatusPass, Details: "connected"},
+		{Check: "libvirt qemu:///system", Status: StatusFail, Details: "can't connect", Remediation: "line1\nline2"},
+	}}
+	var output bytes.Buffer
+
+	s.Require().NoError(report.Write(&output))
+
+	s.Assert().Equal(
+		"[PASS] session bus: connected\n"+
+			"[FAIL] libvirt qemu:///system: can't connect\n"+
+			"       line1\n"+
+			"       line2\n"+
+			"\n1 passed, 0 warnings, 1 failed, 0 skipped\n",
+		output.String(),
+	)
+}
+
+func TestRunDoctorSuite(t *testing.T) {
+	suite.Run(t, new(DoctorSuite))
+}
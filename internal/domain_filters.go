@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"libvirt_keepawake/internal/activity_source"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"libvirt_keepawake/internal/logging"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+DomainFilter decides whether a running domain needs sleep to be inhibited, e.g. only while somebody is connected to
+it. Filters are called on every check outside the orchestrator mutex, so they may do I/O, but should be quick and give
+up when ctx is done.
+*/
+type DomainFilter interface {
+	// Name identifies the filter in logs
+	Name() string
+	// NeedsInhibitor returns false if the domain is idle, reason is shown in logs and in the plan
+	NeedsInhibitor(ctx context.Context, domain libvirt_watcher.MinimalLibvirtDomain) (needed bool, reason string)
+}
+
+// AddDomainFilter makes the orchestrator inhibit sleep only for domains all filters consider busy. Should be called
+// before Start
+func (o *Orchestrator) AddDomainFilter(filter DomainFilter) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.domainFilters = append(o.domainFilters, filter)
+}
+
+/*
+findIdleDomains returns names of running domains some filter considers idle, with the reason. Domains with the same
+name share an inhibitor, so a name is idle only if all domains with this name are idle. Activities which aren't
+domains are never idle. Must be called without the mutex held.
+*/
+func (o *Orchestrator) findIdleDomains(
+	ctx context.Context, activities []activity_source.Activity,
+) map[InhibitorName]string {
+	o.mutex.Lock()
+	filters := append([]DomainFilter{}, o.domainFilters...)
+	o.mutex.Unlock()
+	if len(filters) == 0 {
+		return nil
+	}
+	idle := make(map[InhibitorName]string)
+	busy := make(map[InhibitorName]bool)
+	for _, activity := range activities {
+		domain, isDomain := activity.Object.(libvirt_watcher.MinimalLibvirtDomain)
+		if !isDomain {
+			continue
+		}
+		name := InhibitorName(activity.ID)
+		needed, reason := true, ""
+		for _, filter := range filters {
+			if needed, reason = filter.NeedsInhibitor(ctx, domain); !needed {
+				log.WithFields(log.Fields{logging.FieldDomain: name, "filter": filter.Name()}).
+					Debugf("Domain is idle: %s", reason)
+				break
+			}
+		}
+		if needed {
+			busy[name] = true
+			delete(idle, name)
+		} else if !busy[name] {
+			idle[name] = reason
+		}
+	}
+	return idle
+}
+
+// filterIdleDomains removes domains found idle by findIdleDomains
+func filterIdleDomains(
+	activities []activity_source.Activity, idle map[InhibitorName]string,
+) []activity_source.Activity {
+	if len(idle) == 0 {
+		return activities
+	}
+	var busyActivities []activity_source.Activity
+	for _, activity := range activities {
+		if _, found := idle[InhibitorName(activity.ID)]; found {
+			continue
+		}
+		busyActivities = append(busyActivities, activity)
+	}
+	return busyActivities
+}
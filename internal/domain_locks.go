@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"libvirt_keepawake/internal/activity_source"
+	"libvirt_keepawake/internal/logging"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+DomainLock is held for every running domain user didn't disable, e.g. logind lock blocking shutdown. Locks have their
+own lifecycle alongside the sleep inhibitor: pause, idle domains and failures of the power manager don't affect them.
+Locks which couldn't be acquired are retried on every check, holds which couldn't be released are kept and retried
+following the retry policy. Acquire and Release get the context of the check or of
+the shutdown, implementations calling D-Bus services should give up when it's done or after the D-Bus timeout.
+*/
+type DomainLock interface {
+	// Name identifies the lock in logs
+	Name() string
+	// Applies returns false for domains the lock shouldn't be held for
+	Applies(domain InhibitorName) bool
+	// Acquire takes the lock, it's held until the returned hold is released
+	Acquire(ctx context.Context, domain InhibitorName) (DomainLockHold, error)
+}
+
+// DomainLockHold is an acquired DomainLock
+type DomainLockHold interface {
+	Release(ctx context.Context) error
+}
+
+// AddDomainLock makes the orchestrator hold lock for running domains. Should be called before Start
+func (o *Orchestrator) AddDomainLock(lock DomainLock) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.domainLocks = append(o.domainLocks, lock)
+}
+
+// syncDomainLocks acquires missing locks for activities and releases locks of domains which aren't among them
+// anymore. Must be called with the mutex held
+func (o *Orchestrator) syncDomainLocks(ctx context.Context, activities []activity_source.Activity) {
+	running := make(map[InhibitorName]bool, len(activities))
+	for _, activity := range activities {
+		running[InhibitorName(activity.ID)] = true
+	}
+	for name := range o.heldLocks {
+		if !running[name] {
+			o.releaseDomainLocks(ctx, name, false)
+		}
+	}
+	for name := range running {
+		// the domain is running again, holds which couldn't be released are kept
+		delete(o.lockFailures, name)
+		for _, lock := range o.domainLocks {
+			if _, held := o.heldLocks[name][lock.Name()]; held || !lock.Applies(name) {
+				continue
+			}
+			lockLog := log.WithFields(log.Fields{logging.FieldDomain: name, "lock": lock.Name()})
+			hold, err := lock.Acquire(ctx, name)
+			if err != nil {
+				lockLog.WithError(err).Error("Can't acquire lock for domain, will retry")
+				continue
+			}
+			if o.heldLocks[name] == nil {
+				o.heldLocks[name] = make(map[string]DomainLockHold)
+			}
+			o.heldLocks[name][lock.Name()] = hold
+			lockLog.Info("Acquired lock for domain")
+		}
+	}
+}
+
+/*
+releaseDomainLocks releases all locks held for the domain. Holds which can't be released are kept and retried after
+the delay of the retry policy, or right away when force is set, e.g. on shutdown. Must be called with the mutex held.
+*/
+func (o *Orchestrator) releaseDomainLocks(ctx context.Context, name InhibitorName, force bool) {
+	for lockName, hold := range o.heldLocks[name] {
+		failure, failed := o.lockFailures[name][lockName]
+		if failed && !force && time.Now().Before(failure.RetryAt) {
+			continue
+		}
+		if err := hold.Release(ctx); err != nil {
+			o.recordLockFailure(name, lockName, err)
+			continue
+		}
+		delete(o.heldLocks[name], lockName)
+		delete(o.lockFailures[name], lockName)
+		log.WithFields(log.Fields{logging.FieldDomain: name, "lock": lockName}).Info("Released lock for domain")
+	}
+	if len(o.heldLocks[name]) == 0 {
+		delete(o.heldLocks, name)
+		delete(o.lockFailures, name)
+	}
+}
+
+// recordLockFailure counts a failed release of the lock and schedules a check for its retry. Must be called with the
+// mutex held
+func (o *Orchestrator) recordLockFailure(name InhibitorName, lockName string, err error) {
+	if o.lockFailures[name] == nil {
+		o.lockFailures[name] = make(map[string]Failure)
+	}
+	failure := o.lockFailures[name][lockName]
+	failure.Operation = OperationReleaseLock
+	failure.Count++
+	failure.LastError = err.Error()
+	delay := o.retryPolicy.Delay(failure.Count, o.random)
+	failure.RetryAt = time.Now().Add(delay)
+	o.lockFailures[name][lockName] = failure
+	log.WithFields(log.Fields{logging.FieldDomain: name, "lock": lockName}).WithError(err).Warnf(
+		"Can't release lock for domain, failed %d times in a row, will retry in %s",
+		failure.Count, delay.Round(time.Millisecond),
+	)
+	time.AfterFunc(delay, o.Trigger)
+}
@@ -0,0 +1,202 @@
+package domain_rules
+
+// Rules selecting domains which need sleep to be inhibited by their devices, e.g. passthrough VMs can't survive host
+// suspend, while plain virtio VMs usually can
+
+import (
+	"context"
+	"fmt"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"libvirt_keepawake/internal/logging"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var hostdevTypes = []libvirt_watcher.HostdevType{
+	libvirt_watcher.HostdevPCI, libvirt_watcher.HostdevUSB, libvirt_watcher.HostdevMdev, libvirt_watcher.HostdevSCSI,
+}
+
+// Rule matches domains with a host device of Type(any type when empty) or with Vendor and Product IDs
+type Rule struct {
+	Spec string
+	Type libvirt_watcher.HostdevType
+	// Vendor is checked when it's set, Product is checked when it's set as well
+	Vendor  *uint16
+	Product *uint16
+}
+
+/*
+ParseRule parses a rule in one of the forms:
+
+	hostdev                        any host device
+	hostdev:pci                    host device of the type: pci, usb, mdev or scsi
+	hostdev-id:10de:2204           PCI or USB host device with vendor and product IDs, product can be *
+*/
+func ParseRule(spec string) (Rule, error) {
+	kind, argument, _ := strings.Cut(spec, ":")
+	rule := Rule{Spec: spec}
+	switch kind {
+	case "hostdev":
+		if argument != "" && !slices.Contains(hostdevTypes, libvirt_watcher.HostdevType(argument)) {
+			return Rule{}, fmt.Errorf("unknown host device type %q in rule %q", argument, spec)
+		}
+		rule.Type = libvirt_watcher.HostdevType(argument)
+	case "hostdev-id":
+		vendor, product, found := strings.Cut(argument, ":")
+		if !found {
+			return Rule{}, fmt.Errorf("rule %q isn't in hostdev-id:VENDOR:PRODUCT form", spec)
+		}
+		vendorID, err := strconv.ParseUint(vendor, 16, 16)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid vendor ID in rule %q: %w", spec, err)
+		}
+		rule.Vendor = ptr(uint16(vendorID))
+		if product != "*" {
+			productID, err := strconv.ParseUint(product, 16, 16)
+			if err != nil {
+				return Rule{}, fmt.Errorf("invalid product ID in rule %q: %w", spec, err)
+			}
+			rule.Product = ptr(uint16(productID))
+		}
+	default:
+		return Rule{}, fmt.Errorf("unknown rule %q", spec)
+	}
+	return rule, nil
+}
+
+func ptr(value uint16) *uint16 {
+	return &value
+}
+
+/*
+Filter is an internal.DomainFilter which considers a domain busy if it matches any of the rules. PCI devices are
+described in domain XML only by their address, their IDs are read from sysfs. Domains are considered busy if their
+XML can't be read.
+*/
+type Filter struct {
+	rules     []Rule
+	sysfsRoot string
+}
+
+// NewFilter creates a filter, sysfsRoot is /sys outside tests
+func NewFilter(rules []Rule, sysfsRoot string) *Filter {
+	return &Filter{rules: rules, sysfsRoot: sysfsRoot}
+}
+
+func (f *Filter) Name() string {
+	return "rules"
+}
+
+func (f *Filter) NeedsInhibitor(ctx context.Context, domain libvirt_watcher.MinimalLibvirtDomain) (bool, string) {
+	description, err := libvirt_watcher.DescribeDomain(ctx, domain)
+	if err != nil {
+		name, _ := domain.GetName()
+		log.WithField(logging.FieldDomain, name).WithError(err).Warn("Can't read domain XML to apply rules")
+		return true, "domain XML can't be read"
+	}
+	for _, hostdev := range description.Devices.Hostdevs {
+		device := f.describeHostdev(hostdev)
+		for _, rule := range f.rules {
+			if f.matches(rule, hostdev, device) {
+				return true, fmt.Sprintf("has %s host device %s(rule %s)", hostdev.Type, device.name, rule.Spec)
+			}
+		}
+	}
+	return false, "no host device matches the rules"
+}
+
+// hostdevIDs are the name of a host device for messages and its IDs, if they are known
+type hostdevIDs struct {
+	name            string
+	vendor, product *uint16
+}
+
+func (f *Filter) describeHostdev(hostdev libvirt_watcher.Hostdev) hostdevIDs {
+	source := hostdev.Source
+	switch {
+	case source.Vendor != nil && source.Product != nil:
+		vendor, vendorErr := source.Vendor.Value()
+		product, productErr := source.Product.Value()
+		if vendorErr == nil && productErr == nil {
+			return hostdevIDs{name: fmt.Sprintf("%04x:%04x", vendor, product), vendor: &vendor, product: &product}
+		}
+	case source.Address == nil:
+	case hostdev.Type == libvirt_watcher.HostdevPCI:
+		address, err := source.Address.PCIAddress()
+		if err != nil {
+			break
+		}
+		device := hostdevIDs{name: address}
+		directory := filepath.Join(f.sysfsRoot, "bus", "pci", "devices", address)
+		device.vendor, device.product = readSysfsID(directory, "vendor"), readSysfsID(directory, "device")
+		return device
+	case hostdev.Type == libvirt_watcher.HostdevUSB:
+		return f.findUSBDevice(source.Address.Bus, source.Address.Device)
+	case hostdev.Type == libvirt_watcher.HostdevMdev:
+		return hostdevIDs{name: source.Address.UUID}
+	}
+	return hostdevIDs{name: "unknown"}
+}
+
+// findUSBDevice reads IDs of the USB device selected in domain XML by bus and device numbers
+func (f *Filter) findUSBDevice(bus string, device string) hostdevIDs {
+	name := fmt.Sprintf("bus %s device %s", bus, device)
+	bus, device = normalizeNumber(bus, 0), normalizeNumber(device, 0)
+	directories, _ := filepath.Glob(filepath.Join(f.sysfsRoot, "bus", "usb", "devices", "*"))
+	for _, directory := range directories {
+		if bus != "" && readSysfsNumber(directory, "busnum") == bus && readSysfsNumber(directory, "devnum") == device {
+			return hostdevIDs{
+				name:    name,
+				vendor:  readSysfsID(directory, "idVendor"),
+				product: readSysfsID(directory, "idProduct"),
+			}
+		}
+	}
+	return hostdevIDs{name: name}
+}
+
+func (f *Filter) matches(rule Rule, hostdev libvirt_watcher.Hostdev, device hostdevIDs) bool {
+	if rule.Type != "" && rule.Type != hostdev.Type {
+		return false
+	}
+	if rule.Vendor != nil && (device.vendor == nil || *device.vendor != *rule.Vendor) {
+		return false
+	}
+	return rule.Product == nil || (device.product != nil && *device.product == *rule.Product)
+}
+
+// readSysfsID reads a hex ID, PCI attributes have the 0x prefix, USB ones don't
+func readSysfsID(directory string, attribute string) *uint16 {
+	data, err := os.ReadFile(filepath.Join(directory, attribute))
+	if err != nil {
+		return nil
+	}
+	value, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(string(data)), "0x"), 16, 16)
+	if err != nil {
+		return nil
+	}
+	return ptr(uint16(value))
+}
+
+// readSysfsNumber reads a decimal number, sysfs pads busnum with zeros
+func readSysfsNumber(directory string, attribute string) string {
+	data, err := os.ReadFile(filepath.Join(directory, attribute))
+	if err != nil {
+		return ""
+	}
+	return normalizeNumber(strings.TrimSpace(string(data)), 10)
+}
+
+// normalizeNumber formats number in decimal without leading zeros, it's empty if number is invalid
+func normalizeNumber(number string, base int) string {
+	value, err := strconv.ParseUint(number, base, 32)
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatUint(value, 10)
+}
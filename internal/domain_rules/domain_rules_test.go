@@ -0,0 +1,104 @@
+package domain_rules
+
+import (
+	"context"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DomainRulesSuite struct {
+	suite.Suite
+}
+
+func (s *DomainRulesSuite) domain(name string, xmlFile string) libvirt_watcher.FakeLibvirtDomain {
+	data, err := os.ReadFile(xmlFile)
+	s.Require().NoError(err)
+	return libvirt_watcher.FakeLibvirtDomain{Name: name, XML: string(data)}
+}
+
+func (s *DomainRulesSuite) filter(specs ...string) *Filter {
+	var rules []Rule
+	for _, spec := range specs {
+		rule, err := ParseRule(spec)
+		s.Require().NoError(err)
+		rules = append(rules, rule)
+	}
+	return NewFilter(rules, "testdata/sys")
+}
+
+func (s *DomainRulesSuite) TestParseRule() {
+	rule, err := ParseRule("hostdev-id:10de:*")
+	s.Require().NoError(err)
+	s.Assert().Equal(uint16(0x10de), *rule.Vendor)
+	s.Assert().Nil(rule.Product)
+
+	for _, spec := range []string{"gpu", "hostdev:isa", "hostdev-id:10de", "hostdev-id:nvidia:2204", "hostdev-id:10de:x"} {
+		_, err := ParseRule(spec)
+		s.Assert().Error(err, spec)
+	}
+}
+
+func (s *DomainRulesSuite) TestHostdevType() {
+	gpu := s.domain("win11", "../libvirt_watcher/testdata/win11-gpu.xml")
+	virtio := s.domain("linux", "../libvirt_watcher/testdata/linux-virtio.xml")
+	mdev := s.domain("render", "../libvirt_watcher/testdata/render-mdev.xml")
+
+	needed, reason := s.filter("hostdev:pci").NeedsInhibitor(context.Background(), gpu)
+	s.Assert().True(needed)
+	s.Assert().Equal("has pci host device 0000:01:00.0(rule hostdev:pci)", reason)
+	needed, reason = s.filter("hostdev:pci").NeedsInhibitor(context.Background(), virtio)
+	s.Assert().False(needed)
+	s.Assert().Equal("no host device matches the rules", reason)
+	needed, _ = s.filter("hostdev:pci").NeedsInhibitor(context.Background(), mdev)
+	s.Assert().False(needed)
+	needed, _ = s.filter("hostdev").NeedsInhibitor(context.Background(), mdev)
+	s.Assert().True(needed)
+}
+
+func (s *DomainRulesSuite) TestHostdevID() {
+	gpu := s.domain("win11", "../libvirt_watcher/testdata/win11-gpu.xml")
+	yubikey := s.domain("vault", "testdata/yubikey-usb.xml")
+
+	// PCI IDs are read from sysfs
+	needed, reason := s.filter("hostdev-id:10de:1aef").NeedsInhibitor(context.Background(), gpu)
+	s.Assert().True(needed)
+	s.Assert().Equal("has pci host device 0000:01:00.1(rule hostdev-id:10de:1aef)", reason)
+	// USB IDs are taken from domain XML
+	needed, reason = s.filter("hostdev-id:1002:*", "hostdev-id:046d:c52b").NeedsInhibitor(context.Background(), gpu)
+	s.Assert().True(needed)
+	s.Assert().Equal("has usb host device 046d:c52b(rule hostdev-id:046d:c52b)", reason)
+	// USB device selected by address is looked up in sysfs
+	needed, reason = s.filter("hostdev-id:1050:*").NeedsInhibitor(context.Background(), yubikey)
+	s.Assert().True(needed)
+	s.Assert().Equal("has usb host device bus 1 device 5(rule hostdev-id:1050:*)", reason)
+	needed, _ = s.filter("hostdev-id:1002:*").NeedsInhibitor(context.Background(), yubikey)
+	s.Assert().False(needed)
+}
+
+// TestUnreadableXML tests that domains are inhibited if they can't be checked
+func (s *DomainRulesSuite) TestUnreadableXML() {
+	broken := libvirt_watcher.FakeLibvirtDomain{Name: "broken", XML: "<domain"}
+
+	needed, _ := s.filter("hostdev").NeedsInhibitor(context.Background(), broken)
+
+	s.Assert().True(needed)
+}
+
+// TestUnresponsiveDomain tests that domains are inhibited if libvirt doesn't return their XML before ctx is done
+func (s *DomainRulesSuite) TestUnresponsiveDomain() {
+	unresponsive := libvirt_watcher.FakeLibvirtDomain{Name: "unresponsive", Unresponsive: true}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	needed, _ := s.filter("hostdev").NeedsInhibitor(ctx, unresponsive)
+
+	s.Assert().True(needed)
+}
+
+func TestRunDomainRulesSuite(t *testing.T) {
+	suite.Run(t, new(DomainRulesSuite))
+}
@@ -0,0 +1,51 @@
+package internal
+
+import "time"
+
+type EventKind string
+
+const (
+	// EventInhibitorActivated is sent when sleep inhibitor was activated for a domain, also when a vanished inhibitor
+	// was re-acquired with a new cookie
+	EventInhibitorActivated EventKind = "activated"
+	// EventInhibitorDeactivated is sent when sleep inhibitor was released for a domain
+	EventInhibitorDeactivated EventKind = "deactivated"
+	// EventPaused is sent when user paused inhibition, all inhibitors are released until the pause ends
+	EventPaused EventKind = "paused"
+	// EventResumed is sent when the pause ended or was cancelled
+	EventResumed EventKind = "resumed"
+	// EventDomainEnabled is sent when user allowed inhibiting sleep for a domain again
+	EventDomainEnabled EventKind = "domain_enabled"
+	// EventDomainDisabled is sent when user forbade inhibiting sleep for a domain
+	EventDomainDisabled EventKind = "domain_disabled"
+	// EventActiveDomainsChanged is sent when the set of running domains changed
+	EventActiveDomainsChanged EventKind = "active_domains_changed"
+	// EventInhibitorFailed is sent when activating or releasing an inhibitor failed RetryPolicy.EscalateAfter times in
+	// a row, it's still retried
+	EventInhibitorFailed EventKind = "failed"
+	// EventInhibitorRecovered is sent when a failing operation succeeded or isn't needed anymore
+	EventInhibitorRecovered EventKind = "recovered"
+	// EventChecked is sent after every check of activities which wasn't cancelled, even if listing them failed, so
+	// listeners can tell the main loop is alive
+	EventChecked EventKind = "checked"
+)
+
+// Event describes a change of the orchestrator state. Domain is set only for activation/deactivation, failure and
+// domain enable/disable events, DomainUUID and Cookie only for activation/deactivation, PausedUntil only for pause
+// events, Operation only for failure events and Error only for EventInhibitorFailed.
+type Event struct {
+	Kind        EventKind
+	Domain      InhibitorName
+	DomainUUID  string
+	Cookie      InhibitorCookie
+	PausedUntil time.Time
+	Operation   Operation
+	Error       string
+	Time        time.Time
+}
+
+// EventListener gets notified about orchestrator events. HandleEvent is called from the orchestrator goroutine,
+// so implementations must not block.
+type EventListener interface {
+	HandleEvent(event Event)
+}
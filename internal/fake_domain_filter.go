@@ -0,0 +1,43 @@
+package internal
+
+// Fake DomainFilter with switchable idle domains. Intended for testing purposes only
+
+import (
+	"context"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"sync"
+)
+
+type FakeDomainFilter struct {
+	mutex sync.Mutex
+	idle  map[string]bool
+}
+
+func (f *FakeDomainFilter) Name() string {
+	return "fake"
+}
+
+func (f *FakeDomainFilter) NeedsInhibitor(
+	_ context.Context, domain libvirt_watcher.MinimalLibvirtDomain,
+) (bool, string) {
+	name, err := domain.GetName()
+	if err != nil {
+		return true, ""
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.idle[name] {
+		return false, "domain is idle"
+	}
+	return true, "domain is busy"
+}
+
+// SetIdle makes NeedsInhibitor return false for the domain
+func (f *FakeDomainFilter) SetIdle(domain string, idle bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.idle == nil {
+		f.idle = make(map[string]bool)
+	}
+	f.idle[domain] = idle
+}
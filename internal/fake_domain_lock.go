@@ -0,0 +1,102 @@
+package internal
+
+// Fake DomainLock tracking which domains hold it. Intended for testing purposes only
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+)
+
+type FakeDomainLock struct {
+	LockName string
+	// Domains the lock applies to, all domains when empty
+	Domains []InhibitorName
+	mutex   sync.Mutex
+	held    map[InhibitorName]bool
+	failing map[InhibitorName]bool
+	// releaseFailing are domains Release fails for, releases counts their attempts
+	releaseFailing map[InhibitorName]bool
+	releases       map[InhibitorName]int
+}
+
+type fakeLockHold struct {
+	lock   *FakeDomainLock
+	domain InhibitorName
+}
+
+func (h fakeLockHold) Release(_ context.Context) error {
+	h.lock.mutex.Lock()
+	defer h.lock.mutex.Unlock()
+	if h.lock.releases == nil {
+		h.lock.releases = make(map[InhibitorName]int)
+	}
+	h.lock.releases[h.domain]++
+	if h.lock.releaseFailing[h.domain] {
+		return fmt.Errorf("can't release %s for %s", h.lock.LockName, h.domain)
+	}
+	delete(h.lock.held, h.domain)
+	return nil
+}
+
+func (f *FakeDomainLock) Name() string {
+	return f.LockName
+}
+
+func (f *FakeDomainLock) Applies(domain InhibitorName) bool {
+	return len(f.Domains) == 0 || slices.Contains(f.Domains, domain)
+}
+
+func (f *FakeDomainLock) Acquire(_ context.Context, domain InhibitorName) (DomainLockHold, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.failing[domain] {
+		return nil, fmt.Errorf("can't acquire %s for %s", f.LockName, domain)
+	}
+	if f.held == nil {
+		f.held = make(map[InhibitorName]bool)
+	}
+	f.held[domain] = true
+	return fakeLockHold{lock: f, domain: domain}, nil
+}
+
+// SetFailing makes Acquire fail for the domain
+func (f *FakeDomainLock) SetFailing(domain InhibitorName, failing bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.failing == nil {
+		f.failing = make(map[InhibitorName]bool)
+	}
+	f.failing[domain] = failing
+}
+
+// SetReleaseFailing makes Release fail for the domain
+func (f *FakeDomainLock) SetReleaseFailing(domain InhibitorName, failing bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.releaseFailing == nil {
+		f.releaseFailing = make(map[InhibitorName]bool)
+	}
+	f.releaseFailing[domain] = failing
+}
+
+// Releases returns the number of Release calls for the domain, including failed ones
+func (f *FakeDomainLock) Releases(domain InhibitorName) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.releases[domain]
+}
+
+// Held returns sorted names of domains holding the lock
+func (f *FakeDomainLock) Held() []InhibitorName {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	held := make([]InhibitorName, 0, len(f.held))
+	for domain := range f.held {
+		held = append(held, domain)
+	}
+	sort.Slice(held, func(i, j int) bool { return held[i] < held[j] })
+	return held
+}
@@ -0,0 +1,235 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/logging"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Environment variables hooks get in addition to the daemon environment
+const (
+	EnvEvent       = "LIBVIRT_KEEPAWAKE_EVENT"
+	EnvDomain      = "LIBVIRT_KEEPAWAKE_DOMAIN"
+	EnvDomainUUID  = "LIBVIRT_KEEPAWAKE_DOMAIN_UUID"
+	EnvCookie      = "LIBVIRT_KEEPAWAKE_COOKIE"
+	EnvPausedUntil = "LIBVIRT_KEEPAWAKE_PAUSED_UNTIL"
+	EnvOperation   = "LIBVIRT_KEEPAWAKE_OPERATION"
+	EnvError       = "LIBVIRT_KEEPAWAKE_ERROR"
+	EnvTime        = "LIBVIRT_KEEPAWAKE_TIME"
+)
+
+// maxOutput limits how much of hook output is logged on failure
+const maxOutput = 4096
+
+// HookEvents are kinds of events hooks are run for
+var HookEvents = []internal.EventKind{
+	internal.EventInhibitorActivated,
+	internal.EventInhibitorDeactivated,
+	internal.EventPaused,
+	internal.EventResumed,
+	internal.EventInhibitorFailed,
+}
+
+// Payload is the JSON document written to hook's stdin
+type Payload struct {
+	Event       internal.EventKind `json:"event"`
+	Domain      string             `json:"domain,omitempty"`
+	DomainUUID  string             `json:"domain_uuid,omitempty"`
+	Cookie      uint32             `json:"cookie,omitempty"`
+	PausedUntil *time.Time         `json:"paused_until,omitempty"`
+	Operation   internal.Operation `json:"operation,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	Time        time.Time          `json:"time"`
+}
+
+/*
+Runner executes user hooks when inhibition changes. Hooks are started in the order events happened, at most
+concurrency hooks run at the same time, and every hook is killed after timeout. Hook failures are only logged,
+they never affect the orchestrator.
+*/
+type Runner struct {
+	commands  []string
+	timeout   time.Duration
+	semaphore chan struct{}
+	dryRun    bool
+	events    chan internal.Event
+	// mutex guards sending to events against closing it, stopped is set when events is closed
+	mutex       sync.Mutex
+	stopped     bool
+	dispatching sync.WaitGroup
+	running     sync.WaitGroup
+}
+
+func NewRunner(commands []string, timeout time.Duration, concurrency int) *Runner {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Runner{
+		commands:  commands,
+		timeout:   timeout,
+		semaphore: make(chan struct{}, concurrency),
+		events:    make(chan internal.Event, 64),
+	}
+}
+
+// SetDryRun makes the runner only log hooks it would run, like the rest of the daemon in dry-run mode. Should be
+// called before Start
+func (r *Runner) SetDryRun(dryRun bool) {
+	r.dryRun = dryRun
+}
+
+// Start starts dispatching events to hooks
+func (r *Runner) Start() {
+	r.dispatching.Add(1)
+	go r.dispatch()
+}
+
+// Stop runs hooks for already queued events and waits for them, so hooks for inhibitors released on shutdown
+// aren't lost. Should be called after the orchestrator was stopped, events sent after Stop are dropped
+func (r *Runner) Stop() {
+	r.mutex.Lock()
+	r.stopped = true
+	close(r.events)
+	r.mutex.Unlock()
+	r.dispatching.Wait()
+	r.running.Wait()
+}
+
+// HandleEvent implements internal.EventListener
+func (r *Runner) HandleEvent(event internal.Event) {
+	if !slices.Contains(HookEvents, event.Kind) {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopped {
+		// e.g. the orchestrator outlived its shutdown timeout and released inhibitors later
+		log.Debugf("Hooks are stopped, dropping event %s", event.Kind)
+		return
+	}
+	select {
+	case r.events <- event:
+	default:
+		log.Warnf("Hooks queue is full, dropping event %s", event.Kind)
+	}
+}
+
+func (r *Runner) dispatch() {
+	defer r.dispatching.Done()
+	for event := range r.events {
+		for _, command := range r.commands {
+			// waiting for a free slot here keeps hooks starting in the order of events
+			r.semaphore <- struct{}{}
+			r.running.Add(1)
+			go func(command string, event internal.Event) {
+				defer func() {
+					<-r.semaphore
+					r.running.Done()
+				}()
+				r.run(command, event)
+			}(command, event)
+		}
+	}
+}
+
+func (r *Runner) run(command string, event internal.Event) {
+	hookLog := log.WithFields(log.Fields{"hook": command, "event": event.Kind})
+	if event.Domain != "" {
+		hookLog = hookLog.WithField(logging.FieldDomain, event.Domain)
+	}
+	if r.dryRun {
+		hookLog.Info("Dry run: would run hook")
+		return
+	}
+	stdin, err := json.Marshal(newPayload(event))
+	if err != nil {
+		hookLog.WithError(err).Error("Can't encode hook payload")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command)
+	cmd.Env = append(os.Environ(), environment(event)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// don't wait for children of the hook which keep output open after it was killed
+	cmd.WaitDelay = time.Second
+
+	hookLog.Debug("Running hook")
+	startedAt := time.Now()
+	err = cmd.Run()
+	hookLog = hookLog.WithField("duration", time.Since(startedAt).Round(time.Millisecond))
+	if ctx.Err() == context.DeadlineExceeded {
+		hookLog.WithField("output", truncate(output.String())).Errorf(
+			"Hook timed out after %s and was killed", r.timeout,
+		)
+		return
+	}
+	if err != nil {
+		hookLog.WithError(err).WithField("output", truncate(output.String())).Error("Hook failed")
+		return
+	}
+	hookLog.Debug("Hook finished")
+}
+
+func newPayload(event internal.Event) Payload {
+	payload := Payload{
+		Event:      event.Kind,
+		Domain:     string(event.Domain),
+		DomainUUID: event.DomainUUID,
+		Cookie:     uint32(event.Cookie),
+		Operation:  event.Operation,
+		Error:      event.Error,
+		Time:       event.Time,
+	}
+	if !event.PausedUntil.IsZero() {
+		payload.PausedUntil = &event.PausedUntil
+	}
+	return payload
+}
+
+func environment(event internal.Event) []string {
+	env := []string{
+		EnvEvent + "=" + string(event.Kind),
+		EnvTime + "=" + event.Time.Format(time.RFC3339),
+	}
+	if event.Domain != "" {
+		env = append(env, EnvDomain+"="+string(event.Domain))
+	}
+	if event.DomainUUID != "" {
+		env = append(env, EnvDomainUUID+"="+event.DomainUUID)
+	}
+	if event.Cookie != 0 {
+		env = append(env, EnvCookie+"="+strconv.FormatUint(uint64(event.Cookie), 10))
+	}
+	if !event.PausedUntil.IsZero() {
+		env = append(env, EnvPausedUntil+"="+event.PausedUntil.Format(time.RFC3339))
+	}
+	if event.Operation != "" {
+		env = append(env, EnvOperation+"="+string(event.Operation))
+	}
+	if event.Error != "" {
+		env = append(env, EnvError+"="+event.Error)
+	}
+	return env
+}
+
+func truncate(output string) string {
+	if len(output) <= maxOutput {
+		return output
+	}
+	return fmt.Sprintf("%s... (%d bytes more)", output[:maxOutput], len(output)-maxOutput)
+}
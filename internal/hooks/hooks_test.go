@@ -0,0 +1,158 @@
+package hooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"libvirt_keepawake/internal"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type HooksSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (s *HooksSuite) SetupTest() {
+	s.dir = s.T().TempDir()
+}
+
+// writeHook creates an executable shell script in the test directory
+func (s *HooksSuite) writeHook(name string, script string) string {
+	path := filepath.Join(s.dir, name)
+	s.Require().NoError(os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755))
+	return path
+}
+
+func (s *HooksSuite) waitForFile(path string) string {
+	var content []byte
+	s.Require().Eventually(func() bool {
+		var err error
+		content, err = os.ReadFile(path)
+		return err == nil && len(content) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	return string(content)
+}
+
+func (s *HooksSuite) TestEnvironmentAndStdin() {
+	hook := s.writeHook("hook", fmt.Sprintf(`
+env | grep ^LIBVIRT_KEEPAWAKE_ | sort > %[1]s/env.tmp
+cat > %[1]s/stdin
+mv %[1]s/env.tmp %[1]s/env
+`, s.dir))
+	runner := NewRunner([]string{hook}, 5*time.Second, 2)
+	runner.Start()
+	eventTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	runner.HandleEvent(internal.Event{
+		Kind:       internal.EventInhibitorActivated,
+		Domain:     "win11",
+		DomainUUID: "c7a5fdbd-edaf-9455-926a-d65c16db1809",
+		Cookie:     7,
+		Time:       eventTime,
+	})
+	runner.Stop()
+
+	s.Assert().Equal(strings.Join([]string{
+		"LIBVIRT_KEEPAWAKE_COOKIE=7",
+		"LIBVIRT_KEEPAWAKE_DOMAIN=win11",
+		"LIBVIRT_KEEPAWAKE_DOMAIN_UUID=c7a5fdbd-edaf-9455-926a-d65c16db1809",
+		"LIBVIRT_KEEPAWAKE_EVENT=activated",
+		"LIBVIRT_KEEPAWAKE_TIME=2024-05-01T10:00:00Z",
+	}, "\n")+"\n", s.waitForFile(filepath.Join(s.dir, "env")))
+	var payload Payload
+	s.Require().NoError(json.Unmarshal([]byte(s.waitForFile(filepath.Join(s.dir, "stdin"))), &payload))
+	s.Assert().Equal(Payload{
+		Event:      internal.EventInhibitorActivated,
+		Domain:     "win11",
+		DomainUUID: "c7a5fdbd-edaf-9455-926a-d65c16db1809",
+		Cookie:     7,
+		Time:       eventTime,
+	}, payload)
+}
+
+func (s *HooksSuite) TestOnlyInhibitionEvents() {
+	hook := s.writeHook("hook", fmt.Sprintf(`echo $LIBVIRT_KEEPAWAKE_EVENT >> %s/events`, s.dir))
+	runner := NewRunner([]string{hook}, 5*time.Second, 1)
+	runner.Start()
+
+	runner.HandleEvent(internal.Event{Kind: internal.EventActiveDomainsChanged})
+	runner.HandleEvent(internal.Event{Kind: internal.EventPaused, PausedUntil: time.Now().Add(time.Hour)})
+	runner.HandleEvent(internal.Event{Kind: internal.EventDomainDisabled, Domain: "win11"})
+	runner.HandleEvent(internal.Event{Kind: internal.EventResumed})
+	runner.Stop()
+
+	s.Assert().Equal("paused\nresumed\n", s.waitForFile(filepath.Join(s.dir, "events")))
+}
+
+// TestDryRun tests that hooks aren't run in dry-run mode
+func (s *HooksSuite) TestDryRun() {
+	hook := s.writeHook("hook", fmt.Sprintf(`echo $LIBVIRT_KEEPAWAKE_EVENT >> %s/events`, s.dir))
+	runner := NewRunner([]string{hook}, 5*time.Second, 1)
+	runner.SetDryRun(true)
+	runner.Start()
+
+	runner.HandleEvent(internal.Event{Kind: internal.EventPaused, PausedUntil: time.Now().Add(time.Hour)})
+	runner.Stop()
+
+	s.Assert().NoFileExists(filepath.Join(s.dir, "events"))
+}
+
+// TestEventAfterStop tests that events sent after Stop, e.g. by an orchestrator which didn't stop in time, are dropped
+func (s *HooksSuite) TestEventAfterStop() {
+	hook := s.writeHook("hook", fmt.Sprintf(`echo $LIBVIRT_KEEPAWAKE_EVENT >> %s/events`, s.dir))
+	runner := NewRunner([]string{hook}, 5*time.Second, 1)
+	runner.Start()
+	runner.Stop()
+
+	s.Assert().NotPanics(func() {
+		runner.HandleEvent(internal.Event{Kind: internal.EventInhibitorDeactivated, Domain: "win11"})
+	})
+	s.Assert().NoFileExists(filepath.Join(s.dir, "events"))
+}
+
+// TestConcurrencyLimit tests that with concurrency 1 hooks run one after another in the order of events
+func (s *HooksSuite) TestConcurrencyLimit() {
+	hook := s.writeHook("hook", fmt.Sprintf(`
+echo start $LIBVIRT_KEEPAWAKE_DOMAIN >> %[1]s/log
+sleep 0.1
+echo end $LIBVIRT_KEEPAWAKE_DOMAIN >> %[1]s/log
+`, s.dir))
+	runner := NewRunner([]string{hook}, 5*time.Second, 1)
+	runner.Start()
+
+	for _, domain := range []internal.InhibitorName{"domain1", "domain2", "domain3"} {
+		runner.HandleEvent(internal.Event{Kind: internal.EventInhibitorActivated, Domain: domain})
+	}
+	runner.Stop()
+
+	s.Assert().Equal(
+		"start domain1\nend domain1\nstart domain2\nend domain2\nstart domain3\nend domain3\n",
+		s.waitForFile(filepath.Join(s.dir, "log")),
+	)
+}
+
+// TestFailuresDontStopOtherHooks tests that failed, timed out and missing hooks don't prevent other hooks from running
+func (s *HooksSuite) TestFailuresDontStopOtherHooks() {
+	failing := s.writeHook("failing", "echo broken >&2\nexit 3")
+	slow := s.writeHook("slow", "sleep 10")
+	working := s.writeHook("working", fmt.Sprintf(`echo done > %s/done`, s.dir))
+	runner := NewRunner([]string{failing, slow, filepath.Join(s.dir, "missing"), working}, 200*time.Millisecond, 4)
+	runner.Start()
+	startedAt := time.Now()
+
+	runner.HandleEvent(internal.Event{Kind: internal.EventInhibitorDeactivated, Domain: "win11"})
+	runner.Stop()
+
+	s.Assert().Less(time.Since(startedAt), 5*time.Second, "slow hook must be killed after timeout")
+	s.Assert().Equal("done\n", s.waitForFile(filepath.Join(s.dir, "done")))
+}
+
+func TestRunHooksSuite(t *testing.T) {
+	suite.Run(t, new(HooksSuite))
+}
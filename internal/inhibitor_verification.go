@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"libvirt_keepawake/internal/dbus_inhibitor"
+	"libvirt_keepawake/internal/logging"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultVerifyInterval is how often held inhibitors are compared with the ones the power manager reports
+const DefaultVerifyInterval = time.Minute
+
+// listingSupport tells if the power manager can list inhibitors, it's detected on the first verification
+type listingSupport int
+
+const (
+	listingUnknown listingSupport = iota
+	listingSupported
+	listingUnsupported
+)
+
+// SetVerifyInterval sets how often held inhibitors are verified, 0 disables verification. Should be called before
+// Start
+func (o *Orchestrator) SetVerifyInterval(interval time.Duration) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.verifyInterval = interval
+}
+
+/*
+verifyInhibitors checks that every held inhibitor is still registered in the power manager and re-acquires the ones
+which vanished, e.g. because the power manager restarted or dropped them. Power managers which can't list inhibitors
+are detected once and never verified.
+*/
+func (o *Orchestrator) verifyInhibitors(ctx context.Context) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if len(o.currentInhibitorsCookies) == 0 || !o.detectListing(ctx) {
+		return
+	}
+	inhibitors, err := o.sleepInhibitor.GetInhibitors(ctx)
+	if errors.Is(err, dbus_inhibitor.ErrListingNotSupported) {
+		log.WithError(err).Info("Power manager can't list inhibitors, they won't be verified")
+		o.listing = listingUnsupported
+		return
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			log.WithError(err).Warn("Can't list inhibitors to verify them")
+		}
+		return
+	}
+	registered := make(map[string]bool, len(inhibitors))
+	for _, appName := range inhibitors {
+		registered[appName] = true
+	}
+	var vanished []InhibitorName
+	for name := range o.currentInhibitorsCookies {
+		if !registered[inhibitorAppName(name)] {
+			vanished = append(vanished, name)
+		}
+		delete(registered, inhibitorAppName(name))
+	}
+	for appName := range registered {
+		if strings.HasPrefix(appName, InhibitorAppNamePrefix) {
+			log.WithField(logging.FieldDomain, strings.TrimPrefix(appName, InhibitorAppNamePrefix)).Debug(
+				"Power manager has an inhibitor of this application which isn't held, e.g. of another instance",
+			)
+		}
+	}
+	sort.Slice(vanished, func(i, j int) bool { return vanished[i] < vanished[j] })
+	for _, name := range vanished {
+		o.reacquireInhibitor(ctx, name)
+	}
+}
+
+// detectListing checks once if the power manager can list inhibitors. Must be called with the mutex held
+func (o *Orchestrator) detectListing(ctx context.Context) bool {
+	if o.listing != listingUnknown {
+		return o.listing == listingSupported
+	}
+	detector, ok := o.sleepInhibitor.(dbus_inhibitor.ListingDetector)
+	if !ok {
+		o.listing = listingSupported
+		return true
+	}
+	supported, err := detector.SupportsListing(ctx)
+	if err != nil {
+		// detection is retried by the next verification
+		if ctx.Err() == nil {
+			log.WithError(err).Warn("Can't detect if power manager can list inhibitors")
+		}
+		return false
+	}
+	if supported {
+		o.listing = listingSupported
+	} else {
+		log.Info("Power manager can't list inhibitors, they won't be verified")
+		o.listing = listingUnsupported
+	}
+	return supported
+}
+
+/*
+reacquireInhibitor replaces the cookie of an inhibitor the power manager doesn't have anymore. If it can't be
+re-acquired, the cookie is dropped and the inhibitor is retried like any failed one. Must be called with the mutex
+held.
+*/
+func (o *Orchestrator) reacquireInhibitor(ctx context.Context, name InhibitorName) {
+	oldCookie := o.currentInhibitorsCookies[name]
+	details := o.inhibitorsDetails[name]
+	inhibitorLog := o.inhibitorLog(name, oldCookie)
+	inhibitorLog.Warn("Inhibitor vanished from the power manager, re-acquiring it")
+	cookie, success, err := o.sleepInhibitor.Inhibit(ctx, inhibitorAppName(name))
+	if err == nil && !success {
+		err = fmt.Errorf("inhibition for domain %s wasn't succesfull", name)
+	}
+	if err != nil {
+		// sleep isn't inhibited anymore, the next checks activate the inhibitor again, domain locks stay held
+		delete(o.currentInhibitorsCookies, name)
+		delete(o.inhibitorsDetails, name)
+		o.saveState()
+		o.emit(Event{Kind: EventInhibitorDeactivated, Domain: name, DomainUUID: details.domainUUID, Cookie: oldCookie})
+		if ctx.Err() == nil {
+			o.recordFailure(name, OperationInhibit, err)
+		}
+		return
+	}
+	o.currentInhibitorsCookies[name] = InhibitorCookie(cookie)
+	o.inhibitorsDetails[name] = inhibitorDetails{domainUUID: details.domainUUID, acquiredAt: time.Now()}
+	o.saveState()
+	o.emit(Event{
+		Kind:       EventInhibitorActivated,
+		Domain:     name,
+		DomainUUID: details.domainUUID,
+		Cookie:     InhibitorCookie(cookie),
+	})
+	o.inhibitorLog(name, InhibitorCookie(cookie)).Infof("Re-acquired vanished inhibitor, it replaces cookie %d", oldCookie)
+}
@@ -0,0 +1,281 @@
+package installer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+type InitSystem string
+
+const (
+	SystemdUser  InitSystem = "systemd-user"
+	OpenRC       InitSystem = "openrc"
+	XDGAutostart InitSystem = "xdg-autostart"
+)
+
+// InitSystems lists all supported init systems
+var InitSystems = []InitSystem{SystemdUser, OpenRC, XDGAutostart}
+
+// ErrStillEnabled is returned by Uninstall when the systemd unit or the OpenRC service is enabled, neither systemctl
+// nor rc-service can stop it once the service definition is removed
+var ErrStillEnabled = errors.New("service is still enabled")
+
+// Commands disabling and stopping the service, they have to run before the service definition is removed
+const (
+	systemdDisableCommand = "systemctl --user disable --now libvirt-keepawake.service"
+	openRCDisableCommand  = "rc-service --user libvirt-keepawake stop && rc-update --user del libvirt-keepawake default"
+)
+
+type Action string
+
+const (
+	ActionCreated   Action = "created"
+	ActionUpdated   Action = "updated"
+	ActionUnchanged Action = "unchanged"
+	ActionRemoved   Action = "removed"
+	ActionAbsent    Action = "absent"
+)
+
+// Change describes what was done with a file
+type Change struct {
+	Path   string
+	Action Action
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s", c.Action, c.Path)
+}
+
+// Options describe the service definition to generate
+type Options struct {
+	Init InitSystem
+	// BinaryPath is an absolute path to the daemon binary
+	BinaryPath string
+	// Args are passed to the daemon
+	Args []string
+	// ConfigHome is $XDG_CONFIG_HOME, service definitions are written under it
+	ConfigHome string
+}
+
+// ServiceFile is a generated service definition
+type ServiceFile struct {
+	Path    string
+	Content string
+	Mode    os.FileMode
+}
+
+type templateData struct {
+	ExecStart string
+	Binary    string
+	// Args is a shell quoted string of shell quoted arguments, because openrc-run evaluates command_args
+	Args string
+}
+
+/*
+Render generates the service definition for the init system:
+  - systemd-user: user unit started with the graphical session
+  - openrc: OpenRC user service(OpenRC 0.48+)
+  - xdg-autostart: desktop entry started by the desktop environment on login
+*/
+func Render(options Options) (ServiceFile, error) {
+	var (
+		path     string
+		mode     os.FileMode = 0o644
+		tmpl     *template.Template
+		execLine string
+	)
+	switch options.Init {
+	case SystemdUser:
+		path = filepath.Join(options.ConfigHome, "systemd", "user", "libvirt-keepawake.service")
+		tmpl = systemdUserTemplate
+		execLine = joinQuoted(options.BinaryPath, options.Args, quoteSystemd)
+	case OpenRC:
+		path = filepath.Join(options.ConfigHome, "rc", "init.d", "libvirt-keepawake")
+		mode = 0o755
+		tmpl = openRCTemplate
+	case XDGAutostart:
+		path = filepath.Join(options.ConfigHome, "autostart", "libvirt-keepawake.desktop")
+		tmpl = xdgAutostartTemplate
+		execLine = joinQuoted(options.BinaryPath, options.Args, quoteDesktopEntry)
+	default:
+		return ServiceFile{}, fmt.Errorf("unknown init system %q", options.Init)
+	}
+	var args []string
+	for _, arg := range options.Args {
+		args = append(args, quoteShell(arg))
+	}
+	var content bytes.Buffer
+	err := tmpl.Execute(&content, templateData{
+		ExecStart: execLine,
+		Binary:    quoteShell(options.BinaryPath),
+		Args:      quoteShell(strings.Join(args, " ")),
+	})
+	if err != nil {
+		return ServiceFile{}, err
+	}
+	return ServiceFile{Path: path, Content: content.String(), Mode: mode}, nil
+}
+
+// Install writes the service definition. Running it again with the same options changes nothing
+func Install(options Options) (Change, error) {
+	serviceFile, err := Render(options)
+	if err != nil {
+		return Change{}, err
+	}
+	change := Change{Path: serviceFile.Path, Action: ActionCreated}
+	existing, err := os.ReadFile(serviceFile.Path)
+	switch {
+	case err == nil && string(existing) == serviceFile.Content:
+		// content is the same, but permissions might have been changed
+		if err := os.Chmod(serviceFile.Path, serviceFile.Mode); err != nil {
+			return Change{}, err
+		}
+		change.Action = ActionUnchanged
+		return change, nil
+	case err == nil:
+		change.Action = ActionUpdated
+	case !errors.Is(err, os.ErrNotExist):
+		return Change{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(serviceFile.Path), 0o755); err != nil {
+		return Change{}, err
+	}
+	if err := os.WriteFile(serviceFile.Path, []byte(serviceFile.Content), serviceFile.Mode); err != nil {
+		return Change{}, err
+	}
+	if err := os.Chmod(serviceFile.Path, serviceFile.Mode); err != nil {
+		return Change{}, err
+	}
+	return change, nil
+}
+
+/*
+Uninstall removes the service definition. It refuses to remove an enabled systemd unit or OpenRC service with
+ErrStillEnabled, the user has to stop and disable it first. It doesn't run systemctl or rc-service itself.
+*/
+func Uninstall(options Options) (Change, error) {
+	serviceFile, err := Render(options)
+	if err != nil {
+		return Change{}, err
+	}
+	var enabledLink, disableCommand string
+	switch options.Init {
+	case SystemdUser:
+		// WantedBy= of the unit, systemctl enable links the unit there
+		enabledLink = filepath.Join(
+			filepath.Dir(serviceFile.Path), "graphical-session.target.wants", filepath.Base(serviceFile.Path),
+		)
+		disableCommand = systemdDisableCommand
+	case OpenRC:
+		// rc-update --user add links the service into the user runlevel
+		enabledLink = filepath.Join(options.ConfigHome, "rc", "runlevels", "default", filepath.Base(serviceFile.Path))
+		disableCommand = openRCDisableCommand
+	}
+	if enabledLink != "" {
+		if _, err := os.Lstat(enabledLink); err == nil {
+			return Change{}, fmt.Errorf("%w, run `%s` before uninstalling", ErrStillEnabled, disableCommand)
+		}
+	}
+	err = os.Remove(serviceFile.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Change{Path: serviceFile.Path, Action: ActionAbsent}, nil
+	}
+	if err != nil {
+		return Change{}, err
+	}
+	return Change{Path: serviceFile.Path, Action: ActionRemoved}, nil
+}
+
+// NextSteps returns commands user has to run to start the installed service or to forget the removed one
+func NextSteps(init InitSystem, uninstall bool) []string {
+	switch {
+	case init == SystemdUser && uninstall:
+		// the unit was disabled before it was removed, so only the manager has to forget it
+		return []string{"systemctl --user daemon-reload"}
+	case init == SystemdUser:
+		return []string{"systemctl --user daemon-reload", "systemctl --user enable --now libvirt-keepawake.service"}
+	case init == OpenRC && uninstall:
+		// the service was stopped and removed from the runlevel before its script was removed
+		return nil
+	case init == OpenRC:
+		return []string{"rc-update --user add libvirt-keepawake default", "rc-service --user libvirt-keepawake start"}
+	default:
+		return nil
+	}
+}
+
+func joinQuoted(binary string, args []string, quote func(string) string) string {
+	parts := []string{quote(binary)}
+	for _, arg := range args {
+		parts = append(parts, quote(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+// quoteSystemd quotes an argument for ExecStart, see systemd.service(5) "Command lines"
+func quoteSystemd(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\$%;") {
+		return arg
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `$$`, `%`, `%%`)
+	return `"` + replacer.Replace(arg) + `"`
+}
+
+// quoteDesktopEntry quotes an argument for Exec key, see "The Exec key" in the desktop entry specification
+func quoteDesktopEntry(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"'\\><~|&;$*?#()`%") {
+		return arg
+	}
+	replacer := strings.NewReplacer(`\`, `\\\\`, `"`, `\\"`, "`", "\\\\`", `$`, `\\$`, `%`, `%%`)
+	return `"` + replacer.Replace(arg) + `"`
+}
+
+// quoteShell quotes an argument for sh
+func quoteShell(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"'\\><~|&;$*?#()`{}[]!") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+var systemdUserTemplate = template.Must(template.New("systemd-user").Parse(`# Generated by libvirt-keepawake install
+[Unit]
+Description=Keep the host awake while libvirt VMs are running
+PartOf=graphical-session.target
+After=graphical-session.target
+
+[Service]
+Type=notify
+WatchdogSec=2min
+ExecStart={{.ExecStart}}
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=graphical-session.target
+`))
+
+var openRCTemplate = template.Must(template.New("openrc").Parse(`#!/sbin/openrc-run
+# Generated by libvirt-keepawake install
+
+description="Keep the host awake while libvirt VMs are running"
+command={{.Binary}}
+command_args={{.Args}}
+command_background=true
+pidfile="${XDG_RUNTIME_DIR}/libvirt-keepawake.pid"
+`))
+
+var xdgAutostartTemplate = template.Must(template.New("xdg-autostart").Parse(`# Generated by libvirt-keepawake install
+[Desktop Entry]
+Name=Libvirt-keepawake
+Comment=Keep the host awake while libvirt VMs are running
+Exec={{.ExecStart}}
+Terminal=false
+Type=Application
+X-GNOME-Autostart-enabled=true
+`))
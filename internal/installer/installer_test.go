@@ -0,0 +1,137 @@
+package installer
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+type InstallerSuite struct {
+	suite.Suite
+	configHome string
+}
+
+func (s *InstallerSuite) SetupTest() {
+	s.configHome = s.T().TempDir()
+}
+
+func (s *InstallerSuite) options(init InitSystem) Options {
+	return Options{
+		Init:       init,
+		BinaryPath: "/usr/bin/libvirt-keepawake",
+		Args:       []string{"--log-sink=journald", "--tray", "--state-file=/home/user/my state.json"},
+		ConfigHome: s.configHome,
+	}
+}
+
+// TestRenderGolden compares generated service definitions with testdata/<init>.golden.
+// Run `go test ./internal/installer/ -update` to regenerate them
+func (s *InstallerSuite) TestRenderGolden() {
+	for _, init := range InitSystems {
+		s.Run(string(init), func() {
+			serviceFile, err := Render(s.options(init))
+			s.Require().NoError(err)
+			goldenPath := filepath.Join("testdata", string(init)+".golden")
+			if *update {
+				s.Require().NoError(os.WriteFile(goldenPath, []byte(serviceFile.Content), 0o644))
+			}
+			golden, err := os.ReadFile(goldenPath)
+			s.Require().NoError(err)
+			s.Assert().Equal(string(golden), serviceFile.Content)
+		})
+	}
+}
+
+func (s *InstallerSuite) TestInstallIsIdempotent() {
+	options := s.options(OpenRC)
+	change, err := Install(options)
+	s.Require().NoError(err)
+	s.Assert().Equal(ActionCreated, change.Action)
+	s.Assert().Equal(filepath.Join(s.configHome, "rc", "init.d", "libvirt-keepawake"), change.Path)
+	info, err := os.Stat(change.Path)
+	s.Require().NoError(err)
+	s.Assert().Equal(os.FileMode(0o755), info.Mode().Perm())
+
+	change, err = Install(options)
+	s.Require().NoError(err)
+	s.Assert().Equal(ActionUnchanged, change.Action)
+
+	options.Args = []string{"--verbose"}
+	change, err = Install(options)
+	s.Require().NoError(err)
+	s.Assert().Equal(ActionUpdated, change.Action)
+}
+
+func (s *InstallerSuite) TestUninstall() {
+	options := s.options(XDGAutostart)
+	change, err := Uninstall(options)
+	s.Require().NoError(err)
+	s.Assert().Equal(ActionAbsent, change.Action)
+
+	_, err = Install(options)
+	s.Require().NoError(err)
+	change, err = Uninstall(options)
+	s.Require().NoError(err)
+	s.Assert().Equal(ActionRemoved, change.Action)
+	_, err = os.Stat(change.Path)
+	s.Assert().ErrorIs(err, os.ErrNotExist)
+}
+
+// TestUninstallEnabledUnit tests that an enabled systemd unit is removed only after it was disabled
+func (s *InstallerSuite) TestUninstallEnabledUnit() {
+	options := s.options(SystemdUser)
+	change, err := Install(options)
+	s.Require().NoError(err)
+	wantsDir := filepath.Join(s.configHome, "systemd", "user", "graphical-session.target.wants")
+	s.Require().NoError(os.MkdirAll(wantsDir, 0o755))
+	wantsLink := filepath.Join(wantsDir, "libvirt-keepawake.service")
+	s.Require().NoError(os.Symlink(change.Path, wantsLink))
+
+	_, err = Uninstall(options)
+	s.Assert().ErrorIs(err, ErrStillEnabled)
+	s.Assert().FileExists(change.Path)
+
+	// systemctl --user disable
+	s.Require().NoError(os.Remove(wantsLink))
+	change, err = Uninstall(options)
+	s.Require().NoError(err)
+	s.Assert().Equal(ActionRemoved, change.Action)
+	s.Assert().Equal([]string{"systemctl --user daemon-reload"}, NextSteps(SystemdUser, true))
+}
+
+// TestUninstallEnabledOpenRCService tests that an OpenRC service is removed only after it was deleted from the runlevel
+func (s *InstallerSuite) TestUninstallEnabledOpenRCService() {
+	options := s.options(OpenRC)
+	change, err := Install(options)
+	s.Require().NoError(err)
+	runlevelDir := filepath.Join(s.configHome, "rc", "runlevels", "default")
+	s.Require().NoError(os.MkdirAll(runlevelDir, 0o755))
+	runlevelLink := filepath.Join(runlevelDir, "libvirt-keepawake")
+	s.Require().NoError(os.Symlink(change.Path, runlevelLink))
+
+	_, err = Uninstall(options)
+	s.Assert().ErrorIs(err, ErrStillEnabled)
+	s.Assert().ErrorContains(err, "rc-service --user libvirt-keepawake stop")
+	s.Assert().FileExists(change.Path)
+
+	// rc-update --user del
+	s.Require().NoError(os.Remove(runlevelLink))
+	change, err = Uninstall(options)
+	s.Require().NoError(err)
+	s.Assert().Equal(ActionRemoved, change.Action)
+	s.Assert().Empty(NextSteps(OpenRC, true))
+}
+
+func (s *InstallerSuite) TestUnknownInitSystem() {
+	_, err := Install(s.options("runit"))
+	s.Assert().Error(err)
+}
+
+func TestRunInstallerSuite(t *testing.T) {
+	suite.Run(t, new(InstallerSuite))
+}
@@ -0,0 +1,119 @@
+package libvirt_hook
+
+// libvirt runs /etc/libvirt/hooks/qemu as root when a domain is started or stopped. The hook forwards the event to
+// daemons of all logged-in users over a datagram socket, so they don't have to wait for the next poll.
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SocketGlob matches sockets of daemons of all users, the hook runs as root and doesn't know which user to notify
+const SocketGlob = "/run/user/*/libvirt-keepawake/hook.sock"
+
+// sendTimeout is short, libvirt waits for the hook before it continues starting the domain
+const sendTimeout = 100 * time.Millisecond
+
+// maxMessageSize is more than enough for a message, domain XML isn't forwarded
+const maxMessageSize = 4096
+
+// Message is an event forwarded from libvirt hook to the daemon
+type Message struct {
+	Object       string `json:"object"`
+	Domain       string `json:"domain"`
+	UUID         string `json:"uuid,omitempty"`
+	Operation    string `json:"operation"`
+	SubOperation string `json:"sub_operation,omitempty"`
+}
+
+// TriggersCheck returns true for operations which change whether the domain is running
+func (m Message) TriggersCheck() bool {
+	switch m.Operation {
+	case "prepare", "start", "started", "stopped", "release", "restore", "reconnect":
+		return true
+	default:
+		return false
+	}
+}
+
+type domainXML struct {
+	Name string `xml:"name"`
+	UUID string `xml:"uuid"`
+}
+
+/*
+ParseArgs parses arguments libvirt passes to the hook(domain name, operation, sub-operation and extra argument) and
+domain XML it writes to stdin. XML is optional, only UUID is taken from it.
+*/
+func ParseArgs(object string, args []string, stdin []byte) (Message, error) {
+	if len(args) < 2 {
+		return Message{}, fmt.Errorf("expected at least domain name and operation, got %q", args)
+	}
+	message := Message{Object: object, Domain: args[0], Operation: args[1]}
+	if len(args) > 2 && args[2] != "-" {
+		message.SubOperation = args[2]
+	}
+	if len(stdin) > 0 {
+		var domain domainXML
+		if err := xml.Unmarshal(stdin, &domain); err == nil && domain.Name == message.Domain {
+			message.UUID = domain.UUID
+		}
+	}
+	return message, nil
+}
+
+// SocketPath returns path of the socket the daemon of the current user listens on
+func SocketPath() (string, error) {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return "", errors.New("XDG_RUNTIME_DIR isn't set")
+	}
+	return filepath.Join(runtimeDir, "libvirt-keepawake", "hook.sock"), nil
+}
+
+/*
+Forward sends message to every daemon socket matching pattern and returns number of daemons it was delivered to.
+Missing daemons aren't an error, the hook must never fail the domain start.
+*/
+func Forward(pattern string, message Message) int {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.WithError(err).Error("Can't encode hook message")
+		return 0
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		log.WithError(err).Error("Can't find daemon sockets")
+		return 0
+	}
+	delivered := 0
+	for _, path := range paths {
+		if err := send(path, data); err != nil {
+			log.WithField("socket", path).WithError(err).Debug("Can't forward hook event, daemon isn't running")
+			continue
+		}
+		delivered++
+	}
+	return delivered
+}
+
+func send(path string, data []byte) error {
+	conn, err := net.DialTimeout("unixgram", path, sendTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(time.Now().Add(sendTimeout)); err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
@@ -0,0 +1,89 @@
+package libvirt_hook
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+const domainXMLFixture = `<domain type='kvm'>
+  <name>win11</name>
+  <uuid>c7a5fdbd-edaf-9455-926a-d65c16db1809</uuid>
+  <memory unit='KiB'>8388608</memory>
+</domain>`
+
+type LibvirtHookSuite struct {
+	suite.Suite
+}
+
+func (s *LibvirtHookSuite) TestParseArgs() {
+	message, err := ParseArgs("qemu", []string{"win11", "started", "begin", "-"}, []byte(domainXMLFixture))
+
+	s.Require().NoError(err)
+	s.Assert().Equal(Message{
+		Object:       "qemu",
+		Domain:       "win11",
+		UUID:         "c7a5fdbd-edaf-9455-926a-d65c16db1809",
+		Operation:    "started",
+		SubOperation: "begin",
+	}, message)
+	s.Assert().True(message.TriggersCheck())
+}
+
+func (s *LibvirtHookSuite) TestParseArgsWithoutXML() {
+	message, err := ParseArgs("qemu", []string{"win11", "migrate", "-", "-"}, []byte("not xml"))
+
+	s.Require().NoError(err)
+	s.Assert().Equal(Message{Object: "qemu", Domain: "win11", Operation: "migrate"}, message)
+	s.Assert().False(message.TriggersCheck())
+
+	_, err = ParseArgs("qemu", []string{"win11"}, nil)
+	s.Assert().Error(err)
+}
+
+func (s *LibvirtHookSuite) TestForwardToListeners() {
+	dir := s.T().TempDir()
+	received := make(chan Message, 2)
+	for _, user := range []string{"1000", "1001"} {
+		listener := NewListener(filepath.Join(dir, user, "libvirt-keepawake", "hook.sock"), func(message Message) {
+			received <- message
+		})
+		s.Require().NoError(listener.Start())
+		defer listener.Stop()
+	}
+	message := Message{Object: "qemu", Domain: "win11", Operation: "started"}
+
+	delivered := Forward(filepath.Join(dir, "*", "libvirt-keepawake", "hook.sock"), message)
+
+	s.Assert().Equal(2, delivered)
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-received:
+			s.Assert().Equal(message, got)
+		case <-time.After(time.Second):
+			s.FailNow("message wasn't received")
+		}
+	}
+}
+
+// TestForwardWithoutDaemon tests that stale sockets and missing daemons are ignored
+func (s *LibvirtHookSuite) TestForwardWithoutDaemon() {
+	dir := s.T().TempDir()
+	path := filepath.Join(dir, "1000", "libvirt-keepawake", "hook.sock")
+	listener := NewListener(path, func(message Message) {})
+	s.Require().NoError(listener.Start())
+	// the socket file is left behind as if the daemon was killed
+	s.Require().NoError(listener.conn.Close())
+	listener.stopped.Wait()
+
+	delivered := Forward(filepath.Join(dir, "*", "libvirt-keepawake", "hook.sock"), Message{Operation: "started"})
+
+	s.Assert().Equal(0, delivered)
+	s.Assert().Equal(0, Forward(filepath.Join(dir, "missing", "*.sock"), Message{Operation: "started"}))
+}
+
+func TestRunLibvirtHookSuite(t *testing.T) {
+	suite.Run(t, new(LibvirtHookSuite))
+}
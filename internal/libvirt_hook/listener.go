@@ -0,0 +1,79 @@
+package libvirt_hook
+
+import (
+	"encoding/json"
+	"errors"
+	"libvirt_keepawake/internal/logging"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Listener receives messages forwarded by the hook
+type Listener struct {
+	path    string
+	handler func(Message)
+	conn    *net.UnixConn
+	stopped sync.WaitGroup
+}
+
+func NewListener(path string, handler func(Message)) *Listener {
+	return &Listener{path: path, handler: handler}
+}
+
+// Start creates the socket and starts receiving messages. Socket left by a previous instance is replaced
+func (l *Listener) Start() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o700); err != nil {
+		return err
+	}
+	if err := os.Remove(l.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: l.path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	l.conn = conn
+	l.stopped.Add(1)
+	go l.run()
+	return nil
+}
+
+// Stop closes and removes the socket
+func (l *Listener) Stop() {
+	if err := l.conn.Close(); err != nil {
+		log.WithError(err).Warn("Can't close hook socket")
+	}
+	l.stopped.Wait()
+	if err := os.Remove(l.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.WithError(err).Warn("Can't remove hook socket")
+	}
+}
+
+func (l *Listener) run() {
+	defer l.stopped.Done()
+	buffer := make([]byte, maxMessageSize)
+	for {
+		n, err := l.conn.Read(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.WithError(err).Error("Can't receive hook message")
+			continue
+		}
+		var message Message
+		if err := json.Unmarshal(buffer[:n], &message); err != nil {
+			log.WithError(err).Warn("Received malformed hook message")
+			continue
+		}
+		log.WithFields(log.Fields{
+			logging.FieldDomain: message.Domain,
+			"operation":         message.Operation,
+		}).Debug("Received libvirt hook event")
+		l.handler(message)
+	}
+}
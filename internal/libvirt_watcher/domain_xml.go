@@ -0,0 +1,119 @@
+package libvirt_watcher
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DomainDescription is the part of libvirt domain XML this application cares about
+type DomainDescription struct {
+	Name    string  `xml:"name"`
+	UUID    string  `xml:"uuid"`
+	Devices Devices `xml:"devices"`
+}
+
+type Devices struct {
+	Hostdevs   []Hostdev   `xml:"hostdev"`
+	Graphics   []Graphics  `xml:"graphics"`
+	Interfaces []Interface `xml:"interface"`
+}
+
+// HostdevType is the kind of a host device passed through to the domain
+type HostdevType string
+
+const (
+	HostdevPCI  HostdevType = "pci"
+	HostdevUSB  HostdevType = "usb"
+	HostdevMdev HostdevType = "mdev"
+	HostdevSCSI HostdevType = "scsi"
+)
+
+/*
+Hostdev is a host device passed through to the domain, e.g.
+
+	<hostdev mode='subsystem' type='pci' managed='yes'>
+	  <source><address domain='0x0000' bus='0x01' slot='0x00' function='0x0'/></source>
+	</hostdev>
+*/
+type Hostdev struct {
+	Mode   string        `xml:"mode,attr"`
+	Type   HostdevType   `xml:"type,attr"`
+	Model  string        `xml:"model,attr"`
+	Source HostdevSource `xml:"source"`
+}
+
+type HostdevSource struct {
+	// Vendor and Product are set for USB devices selected by ID
+	Vendor  *HexID          `xml:"vendor"`
+	Product *HexID          `xml:"product"`
+	Address *HostdevAddress `xml:"address"`
+}
+
+type HexID struct {
+	ID string `xml:"id,attr"`
+}
+
+// Value returns the ID as a number, libvirt writes IDs in hex with the 0x prefix
+func (h *HexID) Value() (uint16, error) {
+	value, err := strconv.ParseUint(strings.TrimPrefix(h.ID, "0x"), 16, 16)
+	return uint16(value), err
+}
+
+// HostdevAddress is a PCI address, USB bus and device or mdev UUID, depending on the hostdev type
+type HostdevAddress struct {
+	Domain   string `xml:"domain,attr"`
+	Bus      string `xml:"bus,attr"`
+	Slot     string `xml:"slot,attr"`
+	Function string `xml:"function,attr"`
+	Device   string `xml:"device,attr"`
+	UUID     string `xml:"uuid,attr"`
+}
+
+// PCIAddress returns the address in sysfs form, e.g. 0000:01:00.0
+func (a *HostdevAddress) PCIAddress() (string, error) {
+	var parts [4]uint64
+	for i, part := range []string{a.Domain, a.Bus, a.Slot, a.Function} {
+		value, err := strconv.ParseUint(strings.TrimPrefix(part, "0x"), 16, 32)
+		if err != nil {
+			return "", fmt.Errorf("invalid PCI address part %q: %w", part, err)
+		}
+		parts[i] = value
+	}
+	return fmt.Sprintf("%04x:%02x:%02x.%x", parts[0], parts[1], parts[2], parts[3]), nil
+}
+
+type Graphics struct {
+	// Type is spice, vnc, sdl, egl-headless, etc.
+	Type string `xml:"type,attr"`
+}
+
+type Interface struct {
+	// Type is network, bridge, direct, user, etc.
+	Type string `xml:"type,attr"`
+	MAC  struct {
+		Address string `xml:"address,attr"`
+	} `xml:"mac"`
+	Model struct {
+		Type string `xml:"type,attr"`
+	} `xml:"model"`
+}
+
+func ParseDomainXML(data string) (*DomainDescription, error) {
+	var description DomainDescription
+	if err := xml.Unmarshal([]byte(data), &description); err != nil {
+		return nil, fmt.Errorf("invalid domain XML: %w", err)
+	}
+	return &description, nil
+}
+
+// DescribeDomain reads and parses XML of the running domain
+func DescribeDomain(ctx context.Context, domain MinimalLibvirtDomain) (*DomainDescription, error) {
+	data, err := domain.GetXMLDesc(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDomainXML(data)
+}
@@ -1,6 +1,7 @@
 package libvirt_watcher
 
 import (
+	"context"
 	"fmt"
 	"libvirt.org/go/libvirt"
 	"sync"
@@ -10,21 +11,32 @@ import "github.com/stretchr/testify/mock"
 // fake for libvirt.connect
 type FakeLibvirtConnect struct {
 	mock.Mock
-	mu      sync.Mutex
-	domains []MinimalLibvirtDomain
+	mu              sync.Mutex
+	domains         []MinimalLibvirtDomain
+	inactiveDomains []MinimalLibvirtDomain
+	unresponsive    bool
 }
 
 func (f *FakeLibvirtConnect) ListAllDomains(
-	flags libvirt.ConnectListAllDomainsFlags,
+	ctx context.Context, flags libvirt.ConnectListAllDomainsFlags,
 ) ([]MinimalLibvirtDomain, error) {
-	if flags != libvirt.CONNECT_LIST_DOMAINS_ACTIVE {
-		return nil, fmt.Errorf("not implemented, only active Domains ae supported in fake")
-	}
 	f.mu.Lock()
-	activeDomains := make([]MinimalLibvirtDomain, len(f.domains))
-	copy(activeDomains, f.domains)
+	unresponsive := f.unresponsive
 	f.mu.Unlock()
-	return activeDomains, nil
+	if unresponsive {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch flags {
+	case libvirt.CONNECT_LIST_DOMAINS_ACTIVE:
+		return append([]MinimalLibvirtDomain{}, f.domains...), nil
+	case libvirt.CONNECT_LIST_DOMAINS_INACTIVE:
+		return append([]MinimalLibvirtDomain{}, f.inactiveDomains...), nil
+	default:
+		return nil, fmt.Errorf("not implemented, only active or inactive Domains are supported in fake")
+	}
 }
 
 // UpdateActiveDomains updates the list of active domains in the fake libvirt connection. Should be called
@@ -35,10 +47,133 @@ func (f *FakeLibvirtConnect) UpdateActiveDomains(domains []MinimalLibvirtDomain)
 	f.mu.Unlock()
 }
 
+// SetUnresponsive makes listing hang until the context is done, like a hung libvirtd
+func (f *FakeLibvirtConnect) SetUnresponsive(unresponsive bool) {
+	f.mu.Lock()
+	f.unresponsive = unresponsive
+	f.mu.Unlock()
+}
+
+// UpdateInactiveDomains updates the list of defined, but not running domains. Should be called only from tests
+func (f *FakeLibvirtConnect) UpdateInactiveDomains(domains []MinimalLibvirtDomain) {
+	f.mu.Lock()
+	f.inactiveDomains = domains
+	f.mu.Unlock()
+}
+
+// FakeDomainOperations records operations called on fake domains as "<domain>:<operation>", shared by domains to
+// keep the order
+type FakeDomainOperations struct {
+	mu         sync.Mutex
+	operations []string
+	// Failing operations return an error, keys are "<domain>:<operation>"
+	Failing map[string]bool
+	// IgnoringShutdown are names of domains which stay running after Shutdown
+	IgnoringShutdown map[string]bool
+	stopped          map[string]bool
+}
+
+func (o *FakeDomainOperations) record(domain string, operation string) error {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key := domain + ":" + operation
+	o.operations = append(o.operations, key)
+	if o.Failing[key] {
+		return fmt.Errorf("%s failed", key)
+	}
+	if o.stopped == nil {
+		o.stopped = make(map[string]bool)
+	}
+	switch operation {
+	case "shutdown":
+		o.stopped[domain] = !o.IgnoringShutdown[domain]
+	case "managedsave", "destroy":
+		o.stopped[domain] = true
+	case "create":
+		o.stopped[domain] = false
+	}
+	return nil
+}
+
+func (o *FakeDomainOperations) isActive(domain string) bool {
+	if o == nil {
+		return true
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return !o.stopped[domain]
+}
+
+func (o *FakeDomainOperations) Operations() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string{}, o.operations...)
+}
+
 type FakeLibvirtDomain struct {
 	Name string
+	UUID string
+	// Addresses are returned by GetIPAddresses
+	Addresses []string
+	// XML is returned by GetXMLDesc
+	XML string
+	// Operations records calls, nil disables recording
+	Operations *FakeDomainOperations
+	// Unresponsive makes calls which take a context block until it's done, like a wedged libvirtd
+	Unresponsive bool
 }
 
 func (f FakeLibvirtDomain) GetName() (string, error) {
 	return f.Name, nil
 }
+
+func (f FakeLibvirtDomain) GetUUIDString() (string, error) {
+	return f.UUID, nil
+}
+
+func (f FakeLibvirtDomain) IsActive() (bool, error) {
+	return f.Operations.isActive(f.Name), nil
+}
+
+func (f FakeLibvirtDomain) Suspend() error {
+	return f.Operations.record(f.Name, "suspend")
+}
+
+func (f FakeLibvirtDomain) Resume() error {
+	return f.Operations.record(f.Name, "resume")
+}
+
+func (f FakeLibvirtDomain) ManagedSave() error {
+	return f.Operations.record(f.Name, "managedsave")
+}
+
+func (f FakeLibvirtDomain) Create() error {
+	return f.Operations.record(f.Name, "create")
+}
+
+func (f FakeLibvirtDomain) Shutdown() error {
+	return f.Operations.record(f.Name, "shutdown")
+}
+
+func (f FakeLibvirtDomain) Destroy() error {
+	return f.Operations.record(f.Name, "destroy")
+}
+
+func (f FakeLibvirtDomain) GetIPAddresses(ctx context.Context) ([]string, error) {
+	if f.Unresponsive {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return f.Addresses, nil
+}
+
+func (f FakeLibvirtDomain) GetXMLDesc(ctx context.Context) (string, error) {
+	if f.Unresponsive {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	return f.XML, nil
+}
@@ -1,42 +1,211 @@
 package libvirt_watcher
 
 import (
+	"context"
+	"fmt"
+	"libvirt_keepawake/internal/activity_source"
+	"libvirt_keepawake/internal/logging"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 	"libvirt.org/go/libvirt"
 )
 
 type MinimalLibvirtConnect interface {
-	ListAllDomains(flags libvirt.ConnectListAllDomainsFlags) ([]MinimalLibvirtDomain, error)
+	// ListAllDomains gives up when ctx is done
+	ListAllDomains(ctx context.Context, flags libvirt.ConnectListAllDomainsFlags) ([]MinimalLibvirtDomain, error)
 }
 
+// DefaultCallTimeout limits libvirt calls, so a hung libvirtd can't block the daemon
+const DefaultCallTimeout = 30 * time.Second
+
 type LibvirtConnectAdapter struct {
-	Connect *libvirt.Connect
+	Connect     *libvirt.Connect
+	callTimeout time.Duration
 }
 
-func (a *LibvirtConnectAdapter) ListAllDomains(flags libvirt.ConnectListAllDomainsFlags) ([]MinimalLibvirtDomain, error) {
-	domains, err := a.Connect.ListAllDomains(flags)
+/*
+Dial opens a libvirt connection to uri. Read-only connections can list domains, but can't manage them. Calls give up
+after callTimeout.
+*/
+func Dial(uri string, readOnly bool, callTimeout time.Duration) (*LibvirtConnectAdapter, error) {
+	var connect *libvirt.Connect
+	var err error
+	if readOnly {
+		connect, err = libvirt.NewConnectReadOnly(uri)
+	} else {
+		connect, err = libvirt.NewConnect(uri)
+	}
 	if err != nil {
 		return nil, err
 	}
+	return &LibvirtConnectAdapter{Connect: connect, callTimeout: callTimeout}, nil
+}
+
+func (a *LibvirtConnectAdapter) Close() error {
+	_, err := a.Connect.Close()
+	return err
+}
+
+/*
+callWithTimeout runs call in a separate goroutine and gives up when ctx is done or timeout passed. libvirt calls
+can't be interrupted, so a call which was given up on is left to finish in the background.
+*/
+func callWithTimeout[T any](ctx context.Context, timeout time.Duration, call func() (T, error)) (T, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	type result struct {
+		value T
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		value, err := call()
+		results <- result{value, err}
+	}()
+	select {
+	case called := <-results:
+		return called.value, called.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// ListAllDomains lists domains, giving up when ctx is done or after the call timeout
+func (a *LibvirtConnectAdapter) ListAllDomains(
+	ctx context.Context, flags libvirt.ConnectListAllDomainsFlags,
+) ([]MinimalLibvirtDomain, error) {
+	domains, err := callWithTimeout(ctx, a.callTimeout, func() ([]libvirt.Domain, error) {
+		return a.Connect.ListAllDomains(flags)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't list domains: %w", err)
+	}
 	domainsAdapter := make([]MinimalLibvirtDomain, len(domains))
 	for i, domain := range domains {
-		domainsAdapter[i] = LibvirtDomainAdapter{&domain}
+		domainsAdapter[i] = LibvirtDomainAdapter{domain: &domain, callTimeout: a.callTimeout}
 	}
 	return domainsAdapter, nil
 }
 
+// MultiConnect lists domains from several libvirt connections, e.g. qemu:///system and qemu:///session
+type MultiConnect []MinimalLibvirtConnect
+
+func (m MultiConnect) ListAllDomains(
+	ctx context.Context, flags libvirt.ConnectListAllDomainsFlags,
+) ([]MinimalLibvirtDomain, error) {
+	var allDomains []MinimalLibvirtDomain
+	for _, connection := range m {
+		// if one connection fails, domains of this connection would look stopped, so the whole listing fails
+		domains, err := connection.ListAllDomains(ctx, flags)
+		if err != nil {
+			return nil, err
+		}
+		allDomains = append(allDomains, domains...)
+	}
+	return allDomains, nil
+}
+
 type MinimalLibvirtDomain interface {
 	GetName() (string, error)
+	GetUUIDString() (string, error)
+	IsActive() (bool, error)
+	// Suspend pauses vCPUs, memory stays allocated
+	Suspend() error
+	Resume() error
+	// ManagedSave saves memory to disk and stops the domain, the next Create restores it
+	ManagedSave() error
+	Create() error
+	// Shutdown asks the guest to shut down(ACPI power button), it returns before the guest stopped
+	Shutdown() error
+	// Destroy stops the domain immediately, like pulling the power cord
+	Destroy() error
+	// GetIPAddresses returns addresses of all domain interfaces, it gives up when ctx is done
+	GetIPAddresses(ctx context.Context) ([]string, error)
+	// GetXMLDesc returns XML of the domain, live one for running domains, it gives up when ctx is done
+	GetXMLDesc(ctx context.Context) (string, error)
 }
 
 type LibvirtDomainAdapter struct {
 	domain *libvirt.Domain
+	// callTimeout limits calls which take a context, like calls of the connection the domain was listed with
+	callTimeout time.Duration
 }
 
 func (a LibvirtDomainAdapter) GetName() (string, error) {
 	return a.domain.GetName()
 }
 
+func (a LibvirtDomainAdapter) GetUUIDString() (string, error) {
+	return a.domain.GetUUIDString()
+}
+
+func (a LibvirtDomainAdapter) IsActive() (bool, error) {
+	return a.domain.IsActive()
+}
+
+func (a LibvirtDomainAdapter) Suspend() error {
+	return a.domain.Suspend()
+}
+
+func (a LibvirtDomainAdapter) Resume() error {
+	return a.domain.Resume()
+}
+
+func (a LibvirtDomainAdapter) ManagedSave() error {
+	return a.domain.ManagedSave(0)
+}
+
+func (a LibvirtDomainAdapter) Create() error {
+	return a.domain.Create()
+}
+
+func (a LibvirtDomainAdapter) Shutdown() error {
+	return a.domain.Shutdown()
+}
+
+func (a LibvirtDomainAdapter) Destroy() error {
+	return a.domain.Destroy()
+}
+
+func (a LibvirtDomainAdapter) GetXMLDesc(ctx context.Context) (string, error) {
+	return callWithTimeout(ctx, a.callTimeout, func() (string, error) {
+		return a.domain.GetXMLDesc(0)
+	})
+}
+
+/*
+GetIPAddresses asks libvirt for addresses from DHCP leases of libvirt networks and falls back to the host ARP
+table, e.g. for domains on a bridge with an external DHCP server.
+*/
+func (a LibvirtDomainAdapter) GetIPAddresses(ctx context.Context) ([]string, error) {
+	return callWithTimeout(ctx, a.callTimeout, a.listIPAddresses)
+}
+
+func (a LibvirtDomainAdapter) listIPAddresses() ([]string, error) {
+	var addresses []string
+	var err error
+	for _, source := range []libvirt.DomainInterfaceAddressesSource{
+		libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE, libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_ARP,
+	} {
+		var interfaces []libvirt.DomainInterface
+		interfaces, err = a.domain.ListAllInterfaceAddresses(source)
+		if err != nil {
+			continue
+		}
+		for _, domainInterface := range interfaces {
+			for _, address := range domainInterface.Addrs {
+				addresses = append(addresses, address.Addr)
+			}
+		}
+		if len(addresses) > 0 {
+			return addresses, nil
+		}
+	}
+	return addresses, err
+}
+
 func (a LibvirtDomainAdapter) String() string {
 	name, err := a.GetName()
 	if err != nil {
@@ -46,18 +215,73 @@ func (a LibvirtDomainAdapter) String() string {
 	return name
 }
 
+// SourceName is the name of the activity source of running domains
+const SourceName = "libvirt"
+
+// LibvirtWatcher is an activity_source.ActivitySource of running domains
 type LibvirtWatcher struct {
 	libvirtConnection MinimalLibvirtConnect
-	//TODO events to get notified when domains have been started/stopped
-	// TODO interface
+	events            chan struct{}
 }
 
 func NewLibvirtWatcher(connection MinimalLibvirtConnect) *LibvirtWatcher {
-	return &LibvirtWatcher{libvirtConnection: connection}
+	return &LibvirtWatcher{libvirtConnection: connection, events: make(chan struct{}, 1)}
+}
+
+func (c *LibvirtWatcher) Name() string {
+	return SourceName
+}
+
+// Activities returns running domains, activity ID is the domain name
+func (c *LibvirtWatcher) Activities(ctx context.Context) ([]activity_source.Activity, error) {
+	domains, err := c.GetActiveDomains(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return domainActivities(domains, "running")
 }
 
-func (c *LibvirtWatcher) GetActiveDomains() ([]MinimalLibvirtDomain, error) {
-	domains, err := c.libvirtConnection.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_ACTIVE)
+// InactiveActivities returns defined domains which aren't running
+func (c *LibvirtWatcher) InactiveActivities(ctx context.Context) ([]activity_source.Activity, error) {
+	domains, err := c.GetInactiveDomains(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return domainActivities(domains, "not running")
+}
+
+func (c *LibvirtWatcher) Events() <-chan struct{} {
+	return c.events
+}
+
+// Notify tells the watcher domains were started or stopped, e.g. by the libvirt hook
+func (c *LibvirtWatcher) Notify() {
+	select {
+	case c.events <- struct{}{}:
+	default: // check is already scheduled
+	}
+}
+
+func domainActivities(domains []MinimalLibvirtDomain, reason string) ([]activity_source.Activity, error) {
+	activities := make([]activity_source.Activity, 0, len(domains))
+	for _, domain := range domains {
+		name, err := domain.GetName()
+		if err != nil {
+			return nil, fmt.Errorf("can't get name of domain: %w", err)
+		}
+		domainUUID, err := domain.GetUUIDString()
+		if err != nil {
+			log.WithField(logging.FieldDomain, name).WithError(err).Warn("Can't get UUID of domain")
+		}
+		activities = append(activities, activity_source.Activity{
+			ID: name, Label: name, Reason: reason, UUID: domainUUID, Object: domain,
+		})
+	}
+	return activities, nil
+}
+
+func (c *LibvirtWatcher) GetActiveDomains(ctx context.Context) ([]MinimalLibvirtDomain, error) {
+	domains, err := c.libvirtConnection.ListAllDomains(ctx, libvirt.CONNECT_LIST_DOMAINS_ACTIVE)
 	if err != nil {
 		return nil, err
 	}
@@ -65,3 +289,8 @@ func (c *LibvirtWatcher) GetActiveDomains() ([]MinimalLibvirtDomain, error) {
 	copy(domainsNames, domains)
 	return domainsNames, nil
 }
+
+// GetInactiveDomains returns domains which are defined, but not running
+func (c *LibvirtWatcher) GetInactiveDomains(ctx context.Context) ([]MinimalLibvirtDomain, error) {
+	return c.libvirtConnection.ListAllDomains(ctx, libvirt.CONNECT_LIST_DOMAINS_INACTIVE)
+}
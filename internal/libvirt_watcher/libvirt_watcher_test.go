@@ -1,7 +1,10 @@
 package libvirt_watcher
 
 import (
+	"context"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 )
@@ -23,7 +26,7 @@ func (s *LibvirtWatcherSuite) TestGetActiveDomains() {
 	watcher := NewLibvirtWatcher(fakeLibvirtConnect)
 
 	// act
-	activeDomains, err := watcher.GetActiveDomains()
+	activeDomains, err := watcher.GetActiveDomains(context.Background())
 
 	// assert
 	s.Assert().NoError(err)
@@ -36,6 +39,106 @@ func (s *LibvirtWatcherSuite) TestGetActiveDomains() {
 
 }
 
+func (s *LibvirtWatcherSuite) TestGetActiveDomainsFromMultipleConnections() {
+	systemConnect := new(FakeLibvirtConnect)
+	systemConnect.UpdateActiveDomains([]MinimalLibvirtDomain{FakeLibvirtDomain{Name: "domain1"}})
+	sessionConnect := new(FakeLibvirtConnect)
+	sessionConnect.UpdateActiveDomains([]MinimalLibvirtDomain{FakeLibvirtDomain{Name: "domain2"}})
+	watcher := NewLibvirtWatcher(MultiConnect{systemConnect, sessionConnect})
+
+	activeDomains, err := watcher.GetActiveDomains(context.Background())
+
+	s.Assert().NoError(err)
+	s.Assert().EqualValues(
+		[]MinimalLibvirtDomain{FakeLibvirtDomain{Name: "domain1"}, FakeLibvirtDomain{Name: "domain2"}},
+		activeDomains,
+	)
+}
+
+func (s *LibvirtWatcherSuite) TestGetInactiveDomains() {
+	connect := new(FakeLibvirtConnect)
+	connect.UpdateActiveDomains([]MinimalLibvirtDomain{FakeLibvirtDomain{Name: "domain1"}})
+	connect.UpdateInactiveDomains([]MinimalLibvirtDomain{FakeLibvirtDomain{Name: "domain2"}})
+	watcher := NewLibvirtWatcher(connect)
+
+	inactiveDomains, err := watcher.GetInactiveDomains(context.Background())
+
+	s.Assert().NoError(err)
+	s.Assert().EqualValues([]MinimalLibvirtDomain{FakeLibvirtDomain{Name: "domain2"}}, inactiveDomains)
+}
+
+// TestUnresponsiveConnection tests that listing gives up when the context is done
+func (s *LibvirtWatcherSuite) TestUnresponsiveConnection() {
+	systemConnect := new(FakeLibvirtConnect)
+	systemConnect.UpdateActiveDomains([]MinimalLibvirtDomain{FakeLibvirtDomain{Name: "domain1"}})
+	sessionConnect := new(FakeLibvirtConnect)
+	sessionConnect.SetUnresponsive(true)
+	watcher := NewLibvirtWatcher(MultiConnect{systemConnect, sessionConnect})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := watcher.Activities(ctx)
+
+	s.Assert().ErrorIs(err, context.DeadlineExceeded)
+}
+
+func (s *LibvirtWatcherSuite) TestDescribeDomain() {
+	data, err := os.ReadFile("testdata/win11-gpu.xml")
+	s.Require().NoError(err)
+
+	description, err := DescribeDomain(context.Background(), FakeLibvirtDomain{Name: "win11", XML: string(data)})
+
+	s.Require().NoError(err)
+	s.Assert().Equal("win11", description.Name)
+	s.Assert().Equal("5b1a3a4e-8c1f-4d7a-9a53-2f4e0c8d9b10", description.UUID)
+	s.Require().Len(description.Devices.Hostdevs, 3)
+	gpu := description.Devices.Hostdevs[0]
+	s.Assert().Equal(HostdevPCI, gpu.Type)
+	address, err := gpu.Source.Address.PCIAddress()
+	s.Require().NoError(err)
+	s.Assert().Equal("0000:01:00.0", address)
+	audio, err := description.Devices.Hostdevs[1].Source.Address.PCIAddress()
+	s.Require().NoError(err)
+	s.Assert().Equal("0000:01:00.1", audio)
+	mouse := description.Devices.Hostdevs[2]
+	s.Assert().Equal(HostdevUSB, mouse.Type)
+	vendor, err := mouse.Source.Vendor.Value()
+	s.Require().NoError(err)
+	s.Assert().Equal(uint16(0x046d), vendor)
+	product, err := mouse.Source.Product.Value()
+	s.Require().NoError(err)
+	s.Assert().Equal(uint16(0xc52b), product)
+	s.Assert().Equal([]Graphics{{Type: "spice"}}, description.Devices.Graphics)
+	s.Require().Len(description.Devices.Interfaces, 1)
+	s.Assert().Equal("network", description.Devices.Interfaces[0].Type)
+	s.Assert().Equal("52:54:00:12:34:56", description.Devices.Interfaces[0].MAC.Address)
+	s.Assert().Equal("virtio", description.Devices.Interfaces[0].Model.Type)
+}
+
+func (s *LibvirtWatcherSuite) TestDescribeDomainWithoutHostdevs() {
+	for file, expected := range map[string]Devices{
+		"testdata/linux-virtio.xml": {Graphics: []Graphics{{Type: "vnc"}}},
+		"testdata/render-mdev.xml": {Hostdevs: []Hostdev{{
+			Mode:   "subsystem",
+			Type:   HostdevMdev,
+			Model:  "vfio-pci",
+			Source: HostdevSource{Address: &HostdevAddress{UUID: "c2177883-f1bb-47f0-914d-32a22e3a8804"}},
+		}}},
+	} {
+		data, err := os.ReadFile(file)
+		s.Require().NoError(err)
+
+		description, err := ParseDomainXML(string(data))
+
+		s.Require().NoError(err)
+		s.Assert().Equal(expected.Hostdevs, description.Devices.Hostdevs, file)
+		s.Assert().Equal(expected.Graphics, description.Devices.Graphics, file)
+	}
+
+	_, err := ParseDomainXML("<domain>")
+	s.Assert().Error(err)
+}
+
 func TestRunLibvirtWatcherSuite(t *testing.T) {
 	suite.Run(t, new(LibvirtWatcherSuite))
 }
@@ -0,0 +1,107 @@
+package logging
+
+// Logrus hook which sends entries to journald using its native protocol
+// (https://systemd.io/JOURNAL_NATIVE_PROTOCOL/), so levels and structured fields are preserved.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const JournaldSocketPath = "/run/systemd/journal/socket"
+
+type JournaldHook struct {
+	socketPath string
+	conn       *net.UnixConn
+	mutex      sync.Mutex
+}
+
+func NewJournaldHook(socketPath string) *JournaldHook {
+	return &JournaldHook{socketPath: socketPath}
+}
+
+func (h *JournaldHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *JournaldHook) Fire(entry *log.Entry) error {
+	var buffer bytes.Buffer
+	writeJournaldField(&buffer, "MESSAGE", entry.Message)
+	writeJournaldField(&buffer, "PRIORITY", fmt.Sprint(journaldPriority(entry.Level)))
+	writeJournaldField(&buffer, "SYSLOG_IDENTIFIER", SyslogIdentifier)
+	for key, value := range entry.Data {
+		name := journaldFieldName(key)
+		if name == "" {
+			continue
+		}
+		writeJournaldField(&buffer, name, fmt.Sprint(value))
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.conn == nil {
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: h.socketPath, Net: "unixgram"})
+		if err != nil {
+			return err
+		}
+		h.conn = conn
+	}
+	_, err := h.conn.Write(buffer.Bytes())
+	return err
+}
+
+// writeJournaldField serializes one field. Values with newlines have to be written in the binary form
+func writeJournaldField(buffer *bytes.Buffer, name string, value string) {
+	buffer.WriteString(name)
+	if !strings.ContainsRune(value, '\n') {
+		buffer.WriteByte('=')
+		buffer.WriteString(value)
+		buffer.WriteByte('\n')
+		return
+	}
+	buffer.WriteByte('\n')
+	_ = binary.Write(buffer, binary.LittleEndian, uint64(len(value)))
+	buffer.WriteString(value)
+	buffer.WriteByte('\n')
+}
+
+// journaldFieldName converts logrus field key to a valid journald field name. Journald only accepts
+// uppercase letters, digits and underscores and reserves names starting with an underscore for itself.
+func journaldFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'):
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return ""
+	}
+	return name
+}
+
+func journaldPriority(level log.Level) int {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return 2
+	case log.ErrorLevel:
+		return 3
+	case log.WarnLevel:
+		return 4
+	case log.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
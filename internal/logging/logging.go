@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	logrusSyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// Names of the structured fields attached to log lines. Every line related to a domain or an inhibitor should
+// carry them, so logs can be filtered by domain/cookie regardless of the chosen sink.
+const (
+	FieldDomain  = "domain"
+	FieldCookie  = "cookie"
+	FieldBackend = "backend"
+)
+
+// SyslogIdentifier is a tag used for syslog and journald entries
+const SyslogIdentifier = "libvirt-keepawake"
+
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+type Sink string
+
+const (
+	SinkStdout   Sink = "stdout"
+	SinkSyslog   Sink = "syslog"
+	SinkJournald Sink = "journald"
+)
+
+// Setup configures the global logrus logger to use the given format and sink.
+// When journald is requested, but the journal socket doesn't exist, logs fall back to syslog.
+func Setup(format Format, sink Sink) error {
+	return setup(log.StandardLogger(), format, sink, JournaldSocketPath)
+}
+
+func setup(logger *log.Logger, format Format, sink Sink, journaldSocketPath string) error {
+	switch format {
+	case FormatText:
+		logger.SetFormatter(&log.TextFormatter{})
+	case FormatJSON:
+		logger.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q, supported formats are %q and %q", format, FormatText, FormatJSON)
+	}
+
+	switch sink {
+	case SinkStdout:
+		logger.SetOutput(os.Stdout)
+		return nil
+	case SinkJournald:
+		if _, err := os.Stat(journaldSocketPath); err == nil {
+			logger.AddHook(NewJournaldHook(journaldSocketPath))
+			logger.SetOutput(io.Discard)
+			return nil
+		}
+		logger.Warnf("Journald socket %s doesn't exist, will log to syslog instead", journaldSocketPath)
+		return setupSyslog(logger)
+	case SinkSyslog:
+		return setupSyslog(logger)
+	default:
+		return fmt.Errorf(
+			"unknown log sink %q, supported sinks are %q, %q and %q", sink, SinkStdout, SinkSyslog, SinkJournald,
+		)
+	}
+}
+
+// setupSyslog sends all logs to syslog via the local socket
+func setupSyslog(logger *log.Logger) error {
+	hook, err := logrusSyslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_DAEMON, SyslogIdentifier)
+	if err != nil {
+		return fmt.Errorf("can't connect to local syslog: %w", err)
+	}
+	// syslog adds its own timestamp
+	if formatter, ok := logger.Formatter.(*log.TextFormatter); ok {
+		formatter.DisableTimestamp = true
+	}
+	logger.AddHook(hook)
+	logger.SetOutput(io.Discard)
+	return nil
+}
@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type LoggingSuite struct {
+	suite.Suite
+}
+
+func (s *LoggingSuite) TestJSONFormatHasFields() {
+	logger := log.New()
+	s.Require().NoError(setup(logger, FormatJSON, SinkStdout, ""))
+	var output bytes.Buffer
+	logger.SetOutput(&output)
+
+	logger.WithFields(log.Fields{FieldDomain: "win11", FieldCookie: 42, FieldBackend: "test"}).Info("Inhibited")
+
+	var line map[string]interface{}
+	s.Require().NoError(json.Unmarshal(output.Bytes(), &line))
+	s.Assert().Equal("Inhibited", line["msg"])
+	s.Assert().Equal("win11", line[FieldDomain])
+	s.Assert().EqualValues(42, line[FieldCookie])
+	s.Assert().Equal("test", line[FieldBackend])
+}
+
+func (s *LoggingSuite) TestJournaldSink() {
+	socketPath := filepath.Join(s.T().TempDir(), "journal.socket")
+	journal, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	s.Require().NoError(err)
+	defer func() { _ = journal.Close() }()
+
+	logger := log.New()
+	s.Require().NoError(setup(logger, FormatText, SinkJournald, socketPath))
+
+	logger.WithFields(log.Fields{FieldDomain: "win11", "error": "first\nsecond"}).Warn("Can't inhibit")
+
+	datagram := make([]byte, 4096)
+	n, err := journal.Read(datagram)
+	s.Require().NoError(err)
+	message := datagram[:n]
+	s.Assert().Contains(string(message), "MESSAGE=Can't inhibit\n")
+	s.Assert().Contains(string(message), "PRIORITY=4\n")
+	s.Assert().Contains(string(message), "SYSLOG_IDENTIFIER=libvirt-keepawake\n")
+	s.Assert().Contains(string(message), "DOMAIN=win11\n")
+
+	// multiline values are sent in the binary form
+	var expectedError bytes.Buffer
+	expectedError.WriteString("ERROR\n")
+	_ = binary.Write(&expectedError, binary.LittleEndian, uint64(len("first\nsecond")))
+	expectedError.WriteString("first\nsecond\n")
+	s.Assert().Contains(string(message), expectedError.String())
+}
+
+func (s *LoggingSuite) TestUnknownFormatAndSink() {
+	s.Assert().Error(setup(log.New(), Format("xml"), SinkStdout, ""))
+	s.Assert().Error(setup(log.New(), FormatText, Sink("file"), ""))
+}
+
+func (s *LoggingSuite) TestJournaldFieldName() {
+	s.Assert().Equal("DOMAIN", journaldFieldName("domain"))
+	s.Assert().Equal("DOMAIN_UUID", journaldFieldName("domain-uuid"))
+	s.Assert().Equal("", journaldFieldName("_"))
+	s.Assert().Equal("", journaldFieldName("1st"))
+}
+
+func TestRunLoggingSuite(t *testing.T) {
+	suite.Run(t, new(LoggingSuite))
+}
@@ -0,0 +1,128 @@
+package login1_inhibitor
+
+// Fake org.freedesktop.login1 service which hands out inhibitor locks and emits PrepareFor* signals.
+// Intended for testing purposes only
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// fdSendDelay is time after which the fake closes its copy of the sent fd, godbus sends the reply after the method
+// returned, so it can't be closed right away
+const fdSendDelay = 200 * time.Millisecond
+
+type FakeLock struct {
+	What     string
+	Who      string
+	Why      string
+	Mode     string
+	Released bool
+}
+
+type FakeLogin1 struct {
+	dbusConnection *dbus.Conn
+	mutex          sync.Mutex
+	locks          []*FakeLock
+	// unresponsive is closed when the service responds again, nil while it's responsive
+	unresponsive chan struct{}
+}
+
+func NewFakeLogin1(dbusConnection *dbus.Conn) *FakeLogin1 {
+	return &FakeLogin1{dbusConnection: dbusConnection}
+}
+
+func (f *FakeLogin1) Start() error {
+	reply, err := f.dbusConnection.RequestName(Dest, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		log.Fatalf("Failed to request Name: %v on test dbus", err)
+	}
+	return f.dbusConnection.Export(f, Path, Interface)
+}
+
+func (f *FakeLogin1) Stop() {
+	f.SetUnresponsive(false)
+	if _, err := f.dbusConnection.ReleaseName(Dest); err != nil {
+		log.Warnf("Failed to release Name: %v on test dbus", err)
+	}
+	if err := f.dbusConnection.Close(); err != nil {
+		log.Warnf("Failed to close connection: %v on test dbus", err)
+	}
+}
+
+/*
+SetUnresponsive makes Inhibit calls hang until the service is made responsive again, like a wedged logind. Calls
+which hang when the service becomes responsive are handled as usual.
+*/
+func (f *FakeLogin1) SetUnresponsive(unresponsive bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if unresponsive && f.unresponsive == nil {
+		f.unresponsive = make(chan struct{})
+	} else if !unresponsive && f.unresponsive != nil {
+		close(f.unresponsive)
+		f.unresponsive = nil
+	}
+}
+
+func (f *FakeLogin1) waitUntilResponsive() {
+	f.mutex.Lock()
+	unresponsive := f.unresponsive
+	f.mutex.Unlock()
+	if unresponsive != nil {
+		<-unresponsive
+	}
+}
+
+// Inhibit handles Inhibit DBUS calls. The lock is released when all copies of the returned fd are closed
+func (f *FakeLogin1) Inhibit(what string, who string, why string, mode string) (dbus.UnixFD, *dbus.Error) {
+	f.waitUntilResponsive()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return 0, dbus.MakeFailedError(err)
+	}
+	lock := &FakeLock{What: what, Who: who, Why: why, Mode: mode}
+	f.mutex.Lock()
+	f.locks = append(f.locks, lock)
+	f.mutex.Unlock()
+	go func() {
+		// returns when the pipe is closed on both sides
+		_, _ = io.Copy(io.Discard, reader)
+		_ = reader.Close()
+		f.mutex.Lock()
+		lock.Released = true
+		f.mutex.Unlock()
+	}()
+	// the descriptor is taken before the close is scheduled, Fd races with Close
+	fd := writer.Fd()
+	time.AfterFunc(fdSendDelay, func() { _ = writer.Close() })
+	return dbus.UnixFD(fd), nil
+}
+
+// ActiveLocks returns locks which haven't been released yet
+func (f *FakeLogin1) ActiveLocks() []FakeLock {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var active []FakeLock
+	for _, lock := range f.locks {
+		if !lock.Released {
+			active = append(active, *lock)
+		}
+	}
+	return active
+}
+
+// EmitPrepareForSleep emits PrepareForSleep signal, start is true before sleep and false after wake up
+func (f *FakeLogin1) EmitPrepareForSleep(start bool) error {
+	return f.dbusConnection.Emit(Path, Interface+"."+SignalPrepareForSleep, start)
+}
+
+// EmitPrepareForShutdown emits PrepareForShutdown signal
+func (f *FakeLogin1) EmitPrepareForShutdown(start bool) error {
+	return f.dbusConnection.Emit(Path, Interface+"."+SignalPrepareForShutdown, start)
+}
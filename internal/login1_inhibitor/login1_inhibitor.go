@@ -0,0 +1,124 @@
+package login1_inhibitor
+
+// Client of systemd-logind(or elogind) inhibitor locks on the system bus. Unlike org.freedesktop.PowerManagement,
+// logind can delay sleep and shutdown, and block handling of lid switch and power keys.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const Dest = "org.freedesktop.login1"
+const Path dbus.ObjectPath = "/org/freedesktop/login1"
+const Interface = "org.freedesktop.login1.Manager"
+
+// What is an operation an inhibitor lock applies to
+type What string
+
+const (
+	WhatSleep            What = "sleep"
+	WhatShutdown         What = "shutdown"
+	WhatHandleLidSwitch  What = "handle-lid-switch"
+	WhatHandleSuspendKey What = "handle-suspend-key"
+	WhatHandlePowerKey   What = "handle-power-key"
+)
+
+type Mode string
+
+const (
+	// ModeBlock prevents the operation until the lock is released
+	ModeBlock Mode = "block"
+	// ModeDelay delays the operation until the lock is released or InhibitDelayMaxSec passed
+	ModeDelay Mode = "delay"
+)
+
+// Signals sent before and after sleep and shutdown, the argument is true before and false after
+const (
+	SignalPrepareForSleep    = "PrepareForSleep"
+	SignalPrepareForShutdown = "PrepareForShutdown"
+)
+
+// Who is shown as the owner of locks in `systemd-inhibit --list`
+const Who = "libvirt-keepawake"
+
+type Login1Inhibitor struct {
+	dbusConnection *dbus.Conn
+	// callTimeout limits every D-Bus call in addition to the context passed by the caller
+	callTimeout time.Duration
+}
+
+// NewLogin1Inhibitor creates a client using a connection to the system bus
+func NewLogin1Inhibitor(dbusConnection *dbus.Conn, callTimeout time.Duration) *Login1Inhibitor {
+	return &Login1Inhibitor{dbusConnection: dbusConnection, callTimeout: callTimeout}
+}
+
+/*
+Inhibit takes a lock for all whats, the lock is held until the returned file is closed. The call gives up when ctx
+is done or after the call timeout, so a wedged logind can't block the caller.
+*/
+func (l *Login1Inhibitor) Inhibit(ctx context.Context, whats []What, why string, mode Mode) (*os.File, error) {
+	whatNames := make([]string, len(whats))
+	for i, what := range whats {
+		whatNames[i] = string(what)
+	}
+	what := strings.Join(whatNames, ":")
+	lockLog := log.WithFields(log.Fields{"what": what, "mode": mode})
+	ctx, cancel := context.WithTimeout(ctx, l.callTimeout)
+	defer cancel()
+	var fd dbus.UnixFD
+	err := l.dbusConnection.Object(Dest, Path).CallWithContext(
+		ctx, Interface+".Inhibit", 0, what, Who, why, string(mode),
+	).Store(&fd)
+	if err != nil {
+		lockLog.WithError(err).Error("Can't take logind inhibitor lock")
+		return nil, err
+	}
+	lockLog.Debug("Took logind inhibitor lock")
+	return os.NewFile(uintptr(fd), fmt.Sprintf("login1-inhibitor-%s", what)), nil
+}
+
+/*
+Watch subscribes to SignalPrepareForSleep or SignalPrepareForShutdown. The channel gets true when the operation
+is about to start and false when it's finished(sleep only, there is no "after" for shutdown). Call the returned
+function to unsubscribe.
+*/
+func (l *Login1Inhibitor) Watch(signal string) (<-chan bool, func(), error) {
+	matchOptions := []dbus.MatchOption{
+		dbus.WithMatchInterface(Interface),
+		dbus.WithMatchMember(signal),
+		dbus.WithMatchObjectPath(Path),
+	}
+	if err := l.dbusConnection.AddMatchSignal(matchOptions...); err != nil {
+		return nil, nil, fmt.Errorf("can't subscribe to %s: %w", signal, err)
+	}
+	signals := make(chan *dbus.Signal, 8)
+	l.dbusConnection.Signal(signals)
+	starts := make(chan bool, 8)
+	go func() {
+		defer close(starts)
+		for received := range signals {
+			if received.Name != Interface+"."+signal || received.Path != Path || len(received.Body) != 1 {
+				continue
+			}
+			start, ok := received.Body[0].(bool)
+			if !ok {
+				continue
+			}
+			starts <- start
+		}
+	}()
+	unsubscribe := func() {
+		l.dbusConnection.RemoveSignal(signals)
+		close(signals)
+		if err := l.dbusConnection.RemoveMatchSignal(matchOptions...); err != nil {
+			log.WithError(err).Debugf("Can't unsubscribe from %s", signal)
+		}
+	}
+	return starts, unsubscribe, nil
+}
@@ -0,0 +1,97 @@
+package login1_inhibitor
+
+import (
+	"context"
+	"libvirt_keepawake/internal/dbus_inhibitor"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/suite"
+)
+
+type Login1InhibitorSuite struct {
+	suite.Suite
+	dbusProcess *os.Process
+	fakeLogin1  *FakeLogin1
+	inhibitor   *Login1Inhibitor
+}
+
+func (s *Login1InhibitorSuite) SetupTest() {
+	dbusSocketPath, dbusProcess, err := dbus_inhibitor.RunDbusServer()
+	if err != nil {
+		s.T().Fatalf("Can't start dbus server. Err %s", err)
+	}
+	s.dbusProcess = dbusProcess
+	serviceConn, err := dbus.Connect(dbusSocketPath)
+	s.Require().NoError(err)
+	s.fakeLogin1 = NewFakeLogin1(serviceConn)
+	s.Require().NoError(s.fakeLogin1.Start())
+	clientConn, err := dbus.Connect(dbusSocketPath)
+	s.Require().NoError(err)
+	s.inhibitor = NewLogin1Inhibitor(clientConn, dbus_inhibitor.DefaultCallTimeout)
+}
+
+func (s *Login1InhibitorSuite) TearDownTest() {
+	s.fakeLogin1.Stop()
+	if err := s.dbusProcess.Kill(); err != nil {
+		s.T().Fatalf("Can't kill dbus server with PID %d. Err %s", s.dbusProcess.Pid, err)
+	}
+}
+
+func (s *Login1InhibitorSuite) TestInhibitUntilClosed() {
+	lock, err := s.inhibitor.Inhibit(context.Background(), []What{WhatSleep, WhatShutdown}, "VM is running", ModeDelay)
+	s.Require().NoError(err)
+
+	s.Assert().Equal(
+		[]FakeLock{{What: "sleep:shutdown", Who: Who, Why: "VM is running", Mode: "delay"}},
+		s.fakeLogin1.ActiveLocks(),
+	)
+	// the fake's own copy of the fd must be closed too before the lock can be released
+	time.Sleep(fdSendDelay)
+	s.Require().NoError(lock.Close())
+	s.Assert().Eventually(func() bool {
+		return len(s.fakeLogin1.ActiveLocks()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestUnresponsiveLogind tests that Inhibit gives up after the timeout or when the context is cancelled
+func (s *Login1InhibitorSuite) TestUnresponsiveLogind() {
+	s.fakeLogin1.SetUnresponsive(true)
+	defer s.fakeLogin1.SetUnresponsive(false)
+	s.inhibitor.callTimeout = 100 * time.Millisecond
+
+	startedAt := time.Now()
+	_, err := s.inhibitor.Inhibit(context.Background(), []What{WhatSleep}, "VM is running", ModeDelay)
+	s.Assert().ErrorIs(err, context.DeadlineExceeded)
+	s.Assert().Less(time.Since(startedAt), time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.inhibitor.Inhibit(ctx, []What{WhatSleep}, "VM is running", ModeDelay)
+	s.Assert().ErrorIs(err, context.Canceled)
+}
+
+func (s *Login1InhibitorSuite) TestWatch() {
+	starts, unsubscribe, err := s.inhibitor.Watch(SignalPrepareForSleep)
+	s.Require().NoError(err)
+	defer unsubscribe()
+
+	s.Require().NoError(s.fakeLogin1.EmitPrepareForShutdown(true))
+	s.Require().NoError(s.fakeLogin1.EmitPrepareForSleep(true))
+	s.Require().NoError(s.fakeLogin1.EmitPrepareForSleep(false))
+
+	for _, expected := range []bool{true, false} {
+		select {
+		case start := <-starts:
+			s.Assert().Equal(expected, start)
+		case <-time.After(time.Second):
+			s.FailNow("signal wasn't received")
+		}
+	}
+}
+
+func TestRunLogin1InhibitorSuite(t *testing.T) {
+	suite.Run(t, new(Login1InhibitorSuite))
+}
@@ -1,10 +1,18 @@
 package internal
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"libvirt_keepawake/internal/activity_source"
 	"libvirt_keepawake/internal/dbus_inhibitor"
 	"libvirt_keepawake/internal/libvirt_watcher"
+	"libvirt_keepawake/internal/logging"
+	"libvirt_keepawake/internal/state"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -13,120 +21,547 @@ import (
 type InhibitorName string
 type InhibitorCookie uint32
 
+// InhibitorAppNamePrefix is prepended to domain names to build application names of inhibitors, so inhibitors
+// created by this application can be recognised in the power manager's list
+const InhibitorAppNamePrefix = "libvirt-keepawake:"
+
+// StateJournal persists held inhibitors and user decisions, so they can be recovered after a restart or a crash
+type StateJournal interface {
+	Load() (state.State, error)
+	Save(newState state.State) error
+}
+
+// DefaultShutdownTimeout bounds Stop, inhibitors which couldn't be released by then are left to the power manager
+const DefaultShutdownTimeout = 10 * time.Second
+
+// inhibitorDetails is additional information about a held inhibitor which is persisted in the journal
+type inhibitorDetails struct {
+	domainUUID string
+	acquiredAt time.Time
+}
+
 // Orchestrator Monitors all VMs and inhibits/uninhibits sleep when needed
 type Orchestrator struct {
-	sleepInhibitor           dbus_inhibitor.SleepInhibitor
-	libvirtWatcher           *libvirt_watcher.LibvirtWatcher
-	ticker                   *time.Ticker
-	done                     chan bool
+	sleepInhibitor  dbus_inhibitor.SleepInhibitor
+	sources         []activity_source.ActivitySource
+	ticker          *time.Ticker
+	shutdownTimeout time.Duration
+	// done receives the shutdown deadline from Stop, stopped is closed when the main loop finished the cleanup
+	done    chan time.Time
+	stopped chan struct{}
+	// cancel cancels in-flight calls of the main loop
+	cancel                   context.CancelFunc
+	trigger                  chan struct{}
+	mutex                    sync.Mutex
 	currentInhibitorsCookies map[InhibitorName]InhibitorCookie
+	inhibitorsDetails        map[InhibitorName]inhibitorDetails
+	pausedUntil              time.Time
+	disabledDomains          map[InhibitorName]bool
+	lastActiveDomains        []InhibitorName
+	listeners                []EventListener
+	journal                  StateJournal
+	domainLocks              []DomainLock
+	domainFilters            []DomainFilter
+	// heldLocks are holds of domain locks by domain and lock name
+	heldLocks   map[InhibitorName]map[string]DomainLockHold
+	retryPolicy RetryPolicy
+	// failures are consecutive failures of the last operation by domain, they're cleared when it succeeds
+	failures map[InhibitorName]Failure
+	// lockFailures are consecutive failures to release domain locks by domain and lock name
+	lockFailures map[InhibitorName]map[string]Failure
+	random       func() float64
+	// verifyInterval is how often held inhibitors are compared with the power manager's list, 0 disables it
+	verifyInterval time.Duration
+	listing        listingSupport
+	// leftoverInhibitors are journal records of a previous instance which couldn't be released, they're saved again
+	// until a later restart releases them
+	leftoverInhibitors []state.InhibitorRecord
+	// sourceActivities are activities from the last successful listing by source index, they stand in for activities
+	// of a source which fails to list them, so its inhibitors stay as they are
+	sourceActivities      map[int][]activity_source.Activity
+	sourceActivitiesMutex sync.Mutex
+}
+
+// Status is a snapshot of the orchestrator state
+type Status struct {
+	// ActiveDomains are names of domains which were running during the last check
+	ActiveDomains []InhibitorName
+	// Inhibitors are currently held inhibitors
+	Inhibitors map[InhibitorName]InhibitorCookie
+	// DisabledDomains are domains user asked not to inhibit sleep for
+	DisabledDomains []InhibitorName
+	// PausedUntil is zero when inhibition isn't paused
+	PausedUntil time.Time
+	// Failed are domains whose inhibitor couldn't be activated or released, it's being retried
+	Failed map[InhibitorName]Failure
 }
 
-func NewOrchestrator(sleepInhibitor dbus_inhibitor.SleepInhibitor, libvirtWatcher *libvirt_watcher.LibvirtWatcher, ticker *time.Ticker) *Orchestrator {
+/*
+NewOrchestrator creates an orchestrator inhibiting sleep for activities of all sources. Activities are identified by
+their source name and ID, e.g. "containers/nextcloud", except running domains, which keep bare names, so state files
+and inhibitors of previous versions and per-domain options keep working.
+*/
+func NewOrchestrator(
+	sleepInhibitor dbus_inhibitor.SleepInhibitor, ticker *time.Ticker, sources ...activity_source.ActivitySource,
+) *Orchestrator {
 	return &Orchestrator{
 		sleepInhibitor:           sleepInhibitor,
-		libvirtWatcher:           libvirtWatcher,
+		sources:                  sources,
 		ticker:                   ticker,
+		shutdownTimeout:          DefaultShutdownTimeout,
+		trigger:                  make(chan struct{}, 1),
 		currentInhibitorsCookies: make(map[InhibitorName]InhibitorCookie, 1),
+		inhibitorsDetails:        make(map[InhibitorName]inhibitorDetails, 1),
+		disabledDomains:          make(map[InhibitorName]bool),
+		heldLocks:                make(map[InhibitorName]map[string]DomainLockHold),
+		retryPolicy:              DefaultRetryPolicy,
+		failures:                 make(map[InhibitorName]Failure),
+		lockFailures:             make(map[InhibitorName]map[string]Failure),
+		random:                   rand.Float64,
+		verifyInterval:           DefaultVerifyInterval,
+		sourceActivities:         make(map[int][]activity_source.Activity),
 	}
 }
 
+// AddListener subscribes listener to orchestrator events. Should be called before Start
+func (o *Orchestrator) AddListener(listener EventListener) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.listeners = append(o.listeners, listener)
+}
+
+// SetJournal makes the orchestrator persist its state on every change. Should be called before RestoreState or
+// LoadState
+func (o *Orchestrator) SetJournal(journal StateJournal) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.journal = journal
+}
+
+// SetShutdownTimeout sets how long Stop waits for inhibitors to be released. Should be called before Start
+func (o *Orchestrator) SetShutdownTimeout(timeout time.Duration) {
+	o.shutdownTimeout = timeout
+}
+
 // Start Run the main loop of the orchestrator and start checking libvirt for VMs to
 // inhibit and inhibit sleep
 func (o *Orchestrator) Start() {
-	o.done = make(chan bool)
+	ctx, cancel := context.WithCancel(context.Background())
+	// buffered, so Stop doesn't wait for a check which is in progress
+	done := make(chan time.Time, 1)
+	stopped := make(chan struct{})
+	o.done = done
+	o.stopped = stopped
+	o.cancel = cancel
+	for _, source := range o.sources {
+		if events := source.Events(); events != nil {
+			go o.forwardEvents(events, ctx.Done())
+		}
+	}
+	o.mutex.Lock()
+	verifyInterval := o.verifyInterval
+	o.mutex.Unlock()
+	// nil channel never fires, so verification is disabled
+	var verify <-chan time.Time
+	var verifyTicker *time.Ticker
+	if verifyInterval > 0 {
+		verifyTicker = time.NewTicker(verifyInterval)
+		verify = verifyTicker.C
+	}
 	go func() {
 		for {
 			select {
 			case <-o.ticker.C:
-				log.Debug("Checking for active VMs to inhibit/uninhibit sleep")
-				activeDomains, err := o.libvirtWatcher.GetActiveDomains()
-				if err != nil {
-					log.Error("Can't list active domains")
-					continue
-				}
-				domainsWithoutInhibitors, err := o.determineDomainsWithoutInhibitors(activeDomains)
-				if err != nil {
-					log.Errorf("Can't determine domains without inhibitors. Err %s", err)
-					continue
-				}
-				inhibitorsWithoutDomains, err := o.determineInhibitorsWithoutDomains(activeDomains)
-				if err != nil {
-					log.Errorf("Can't determine inhibitors without domains. Err %s", err)
-					continue
-				}
-				for _, domainWithoutInhibitor := range domainsWithoutInhibitors {
-					log.Debugf("Will actiave inhibitor for domain %s without inhibitor", domainWithoutInhibitor)
-					err := o.activateInhibitorForDomain(domainWithoutInhibitor)
-					if err != nil {
-						log.Errorf("Can't activate inhibitor for domain %s with err %s", domainWithoutInhibitor, err)
-						continue
-					}
-					log.Infof("Activated inhibitor for domain %s", domainWithoutInhibitor)
-				}
-
-				for _, inhibitorWithoutDomain := range inhibitorsWithoutDomains {
-					err := o.deactivateInhibitor(inhibitorWithoutDomain)
-					if err != nil {
-						log.Errorf(
-							"Can't deactivate inhibitor for domain %s with err %s",
-							inhibitorWithoutDomain, err,
-						)
-						continue
-					}
-					log.Infof("Deactivated inhibitor for domain %s", inhibitorWithoutDomain)
-				}
-			case <-o.done: // On stop signal, clean all inhibitors
-				log.Debugf(
-					"Got stop signal for orchestrator, will clean all inhibitors %v", o.currentInhibitorsCookies,
-				)
-				for domainName, cookie := range o.currentInhibitorsCookies {
-					err := o.sleepInhibitor.UnInhibit(uint32(cookie))
-					if err != nil {
-						log.Errorf("Can't uninhibit sleep with err %s", err)
-					}
-					log.Infof("Uninhibited sleep on stopping for domain %s", domainName)
-				}
+				o.reconcile(ctx)
+			case <-o.trigger:
+				o.reconcile(ctx)
+			case <-verify:
+				o.verifyInhibitors(ctx)
+			case deadline := <-done: // On stop signal, clean all inhibitors
+				cleanupCtx, cancelCleanup := context.WithDeadline(context.Background(), deadline)
+				o.releaseAllInhibitors(cleanupCtx)
+				cancelCleanup()
 				o.ticker.Stop()
+				if verifyTicker != nil {
+					verifyTicker.Stop()
+				}
 				// confirm that all inhibitors are uninhibited
-				o.done <- true
+				close(stopped)
+				return
 			}
 		}
 	}()
 }
 
-// Stop stops main loop of the orchestrator and stop do a cleanup
+/*
+Stop cancels the check in progress, stops the main loop and releases all inhibitors. It waits at most the shutdown
+timeout, so a wedged power manager or libvirt can't block the daemon from exiting.
+*/
 func (o *Orchestrator) Stop() {
-	if o.done != nil {
-		o.done <- true
+	done := o.done
+	if done == nil {
+		// wasn't started or is already stopped, nothing to clean
+		return
 	}
+	o.done = nil
+	deadline := time.Now().Add(o.shutdownTimeout)
+	done <- deadline
+	o.cancel()
 	// waiting confirmation that all inhibitors are uninhibited
 	log.Debug("Waiting for confirmation that all inhibitors are uninhibited")
-	<-o.done
-	log.Debug("All inhibitors are uninhibited")
+	select {
+	case <-o.stopped:
+		log.Debug("All inhibitors are uninhibited")
+	case <-time.After(time.Until(deadline)):
+		log.Warnf("Orchestrator didn't stop in %s, inhibitors might be left behind", o.shutdownTimeout)
+	}
+}
+
+// forwardEvents triggers a check on every event of a source until stopped is closed
+func (o *Orchestrator) forwardEvents(events <-chan struct{}, stopped <-chan struct{}) {
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			o.Trigger()
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// Trigger asks the main loop to check domains right away instead of waiting for the next tick
+func (o *Orchestrator) Trigger() {
+	select {
+	case o.trigger <- struct{}{}:
+	default: // check is already scheduled
+	}
+}
+
+// Pause releases all inhibitors and doesn't activate new ones for the given duration, so the host can sleep
+// even if VMs are running
+func (o *Orchestrator) Pause(duration time.Duration) {
+	o.mutex.Lock()
+	o.pausedUntil = time.Now().Add(duration)
+	log.Infof("Inhibition paused until %s", o.pausedUntil.Format(time.DateTime))
+	o.saveState()
+	o.emit(Event{Kind: EventPaused, PausedUntil: o.pausedUntil})
+	o.mutex.Unlock()
+	o.Trigger()
+}
+
+// Resume cancels the pause, inhibitors will be activated again for running domains
+func (o *Orchestrator) Resume() {
+	o.mutex.Lock()
+	wasPaused := !o.pausedUntil.IsZero()
+	o.pausedUntil = time.Time{}
+	if wasPaused {
+		log.Info("Inhibition resumed")
+		o.saveState()
+		o.emit(Event{Kind: EventResumed})
+	}
+	o.mutex.Unlock()
+	o.Trigger()
+}
+
+// PausedUntil returns the end of the current pause or zero time if inhibition isn't paused
+func (o *Orchestrator) PausedUntil() time.Time {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.pausedUntil
+}
+
+// SetDomainEnabled allows or forbids inhibiting sleep for the domain. Disabled domains are ignored even if running
+func (o *Orchestrator) SetDomainEnabled(domain InhibitorName, enabled bool) {
+	o.mutex.Lock()
+	if enabled == !o.disabledDomains[domain] {
+		o.mutex.Unlock()
+		return
+	}
+	if enabled {
+		delete(o.disabledDomains, domain)
+		log.WithField(logging.FieldDomain, domain).Info("Inhibition enabled for domain")
+		o.saveState()
+		o.emit(Event{Kind: EventDomainEnabled, Domain: domain})
+	} else {
+		o.disabledDomains[domain] = true
+		log.WithField(logging.FieldDomain, domain).Info("Inhibition disabled for domain")
+		o.saveState()
+		o.emit(Event{Kind: EventDomainDisabled, Domain: domain})
+	}
+	o.mutex.Unlock()
+	o.Trigger()
+}
+
+// Status returns a snapshot of the current orchestrator state
+func (o *Orchestrator) Status() Status {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	status := Status{
+		ActiveDomains: append([]InhibitorName{}, o.lastActiveDomains...),
+		Inhibitors:    make(map[InhibitorName]InhibitorCookie, len(o.currentInhibitorsCookies)),
+		PausedUntil:   o.pausedUntil,
+		Failed:        make(map[InhibitorName]Failure, len(o.failures)),
+	}
+	for name, cookie := range o.currentInhibitorsCookies {
+		status.Inhibitors[name] = cookie
+	}
+	for name, failure := range o.failures {
+		status.Failed[name] = failure
+	}
+	for name := range o.disabledDomains {
+		status.DisabledDomains = append(status.DisabledDomains, name)
+	}
+	sort.Slice(status.DisabledDomains, func(i, j int) bool { return status.DisabledDomains[i] < status.DisabledDomains[j] })
+	return status
+}
+
+// reconcile lists activities and activates/deactivates inhibitors, so every activity has exactly one inhibitor.
+// While paused, all inhibitors are released.
+func (o *Orchestrator) reconcile(ctx context.Context) {
+	log.Debug("Checking for activities to inhibit/uninhibit sleep")
+	// deferred first, so it runs after the mutex is unlocked
+	defer o.checked(ctx)
+	activeDomains, err := o.listActivities(ctx)
+	if ctx.Err() != nil {
+		log.WithError(err).Debug("Check was cancelled, orchestrator is stopping")
+		return
+	}
+	if err != nil {
+		// other sources are still reconciled
+		log.WithError(err).Error("Can't list activities, keeping previous activities of failed sources")
+	}
+	idleDomains := o.findIdleDomains(ctx, activeDomains)
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.updateActiveDomains(activeDomains)
+	activeDomains = o.filterDisabledDomains(activeDomains)
+	// domain locks don't depend on pause, idleness or the sleep inhibitor
+	o.syncDomainLocks(ctx, activeDomains)
+	if !o.pausedUntil.IsZero() {
+		if time.Now().Before(o.pausedUntil) {
+			log.Debugf("Inhibition is paused until %s, ignoring active domains", o.pausedUntil.Format(time.DateTime))
+			activeDomains = nil
+		} else {
+			log.Info("Pause ended, inhibition resumed")
+			o.pausedUntil = time.Time{}
+			o.saveState()
+			o.emit(Event{Kind: EventResumed})
+		}
+	}
+	activeDomains = filterIdleDomains(activeDomains, idleDomains)
+
+	domainsWithoutInhibitors, err := o.determineDomainsWithoutInhibitors(activeDomains)
+	if err != nil {
+		log.WithError(err).Error("Can't determine domains without inhibitors")
+		return
+	}
+	inhibitorsWithoutDomains, err := o.determineInhibitorsWithoutDomains(activeDomains)
+	if err != nil {
+		log.WithError(err).Error("Can't determine inhibitors without domains")
+		return
+	}
+	// domains which still need an operation, failures of other domains are stale
+	pending := make(map[InhibitorName]bool, len(domainsWithoutInhibitors)+len(inhibitorsWithoutDomains))
+	for _, domainWithoutInhibitor := range domainsWithoutInhibitors {
+		name := InhibitorName(domainWithoutInhibitor.ID)
+		pending[name] = true
+		domainLog := log.WithField(logging.FieldDomain, name)
+		if o.retryPending(name, OperationInhibit) {
+			domainLog.Debug("Activating inhibitor failed, waiting before retrying")
+			continue
+		}
+		domainLog.Debug("Will activate inhibitor for domain without inhibitor")
+		cookie, err := o.activateInhibitorForDomain(ctx, domainWithoutInhibitor)
+		if err != nil {
+			// cancelled calls aren't failures of the power manager
+			if ctx.Err() == nil {
+				o.recordFailure(name, OperationInhibit, err)
+			}
+			continue
+		}
+		o.clearFailure(name)
+		o.inhibitorLog(name, cookie).Info("Activated inhibitor for domain")
+	}
+
+	for _, inhibitorWithoutDomain := range inhibitorsWithoutDomains {
+		pending[inhibitorWithoutDomain] = true
+		inhibitorLog := o.inhibitorLog(inhibitorWithoutDomain, o.currentInhibitorsCookies[inhibitorWithoutDomain])
+		if o.retryPending(inhibitorWithoutDomain, OperationUnInhibit) {
+			inhibitorLog.Debug("Deactivating inhibitor failed, waiting before retrying")
+			continue
+		}
+		err := o.deactivateInhibitor(ctx, inhibitorWithoutDomain)
+		if err != nil {
+			if ctx.Err() == nil {
+				o.recordFailure(inhibitorWithoutDomain, OperationUnInhibit, err)
+			}
+			continue
+		}
+		o.clearFailure(inhibitorWithoutDomain)
+		inhibitorLog.Info("Deactivated inhibitor for domain")
+	}
+	o.clearStaleFailures(pending)
+}
+
+// checked notifies listeners that a check finished unless it was cancelled
+func (o *Orchestrator) checked(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.emit(Event{Kind: EventChecked})
 }
 
 /*
-determineDomainsWithoutInhibitors determines all domains that don't have any active inhibitor
+listActivities lists activities of all sources with qualified IDs. If a source fails, its activities would look
+finished, so activities from its last successful listing are used instead and the error is returned along with
+activities of all sources.
 */
-func (o *Orchestrator) determineDomainsWithoutInhibitors(domains []libvirt_watcher.MinimalLibvirtDomain) ([]libvirt_watcher.MinimalLibvirtDomain, error) {
-	var domainsWithoutInhibitors []libvirt_watcher.MinimalLibvirtDomain
+func (o *Orchestrator) listActivities(ctx context.Context) ([]activity_source.Activity, error) {
+	o.sourceActivitiesMutex.Lock()
+	defer o.sourceActivitiesMutex.Unlock()
+	var allActivities []activity_source.Activity
+	var errs []error
+	for i, source := range o.sources {
+		activities, err := source.Activities(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("can't list activities of %s: %w", source.Name(), err))
+			allActivities = append(allActivities, o.sourceActivities[i]...)
+			continue
+		}
+		qualified := make([]activity_source.Activity, 0, len(activities))
+		for _, activity := range activities {
+			activity.ID = string(qualifiedName(source.Name(), activity.ID))
+			qualified = append(qualified, activity)
+		}
+		o.sourceActivities[i] = qualified
+		allActivities = append(allActivities, qualified...)
+	}
+	return allActivities, errors.Join(errs...)
+}
+
+// listInactiveActivities lists activities of sources which know inactive ones, e.g. stopped domains
+func (o *Orchestrator) listInactiveActivities(ctx context.Context) ([]activity_source.Activity, error) {
+	var allActivities []activity_source.Activity
+	for _, source := range o.sources {
+		lister, ok := source.(activity_source.InactiveLister)
+		if !ok {
+			continue
+		}
+		activities, err := lister.InactiveActivities(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("can't list inactive activities of %s: %w", source.Name(), err)
+		}
+		for _, activity := range activities {
+			activity.ID = string(qualifiedName(source.Name(), activity.ID))
+			allActivities = append(allActivities, activity)
+		}
+	}
+	return allActivities, nil
+}
+
+// qualifiedName builds the inhibitor name of an activity. Domains keep bare names for compatibility
+func qualifiedName(source string, id string) InhibitorName {
+	if source == libvirt_watcher.SourceName {
+		return InhibitorName(id)
+	}
+	return InhibitorName(source + "/" + id)
+}
+
+// updateActiveDomains remembers names of activities and notifies listeners if they changed.
+// Must be called with the mutex held
+func (o *Orchestrator) updateActiveDomains(activities []activity_source.Activity) {
+	names := make([]InhibitorName, 0, len(activities))
+	seen := make(map[InhibitorName]bool, len(activities))
+	for _, activity := range activities {
+		if seen[InhibitorName(activity.ID)] {
+			continue
+		}
+		seen[InhibitorName(activity.ID)] = true
+		names = append(names, InhibitorName(activity.ID))
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	if slices.Equal(names, o.lastActiveDomains) {
+		return
+	}
+	o.lastActiveDomains = names
+	o.emit(Event{Kind: EventActiveDomainsChanged})
+}
+
+// filterDisabledDomains removes activities user disabled inhibition for. Must be called with the mutex held
+func (o *Orchestrator) filterDisabledDomains(activities []activity_source.Activity) []activity_source.Activity {
+	var enabledActivities []activity_source.Activity
+	for _, activity := range activities {
+		if o.disabledDomains[InhibitorName(activity.ID)] {
+			log.WithField(logging.FieldDomain, activity.ID).Debug("Inhibition is disabled for domain, skipping")
+			continue
+		}
+		enabledActivities = append(enabledActivities, activity)
+	}
+	return enabledActivities
+}
+
+// releaseAllInhibitors uninhibits sleep for all domains, used when orchestrator is stopping
+func (o *Orchestrator) releaseAllInhibitors(ctx context.Context) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	log.Debugf(
+		"Got stop signal for orchestrator, will clean all inhibitors %v", o.currentInhibitorsCookies,
+	)
+	for name := range o.heldLocks {
+		o.releaseDomainLocks(ctx, name, true)
+	}
+	for domainName, cookie := range o.currentInhibitorsCookies {
+		inhibitorLog := o.inhibitorLog(domainName, cookie)
+		err := o.sleepInhibitor.UnInhibit(ctx, uint32(cookie))
+		if errors.Is(err, dbus_inhibitor.ErrCookieNotFound) {
+			inhibitorLog.WithError(err).Warn("Power manager doesn't know the inhibitor anymore, dropping its cookie")
+		} else if err != nil {
+			inhibitorLog.WithError(err).Error("Can't uninhibit sleep")
+			continue
+		}
+		domainUUID := o.inhibitorsDetails[domainName].domainUUID
+		delete(o.currentInhibitorsCookies, domainName)
+		delete(o.inhibitorsDetails, domainName)
+		o.emit(Event{Kind: EventInhibitorDeactivated, Domain: domainName, DomainUUID: domainUUID, Cookie: cookie})
+		inhibitorLog.Info("Uninhibited sleep on stopping")
+	}
+	o.saveState()
+}
+
+// emit sends event to all listeners. Must be called with the mutex held
+func (o *Orchestrator) emit(event Event) {
+	event.Time = time.Now()
+	for _, listener := range o.listeners {
+		listener.HandleEvent(event)
+	}
+}
+
+/*
+determineDomainsWithoutInhibitors determines all activities that don't have any active inhibitor
+*/
+func (o *Orchestrator) determineDomainsWithoutInhibitors(activities []activity_source.Activity) ([]activity_source.Activity, error) {
+	var domainsWithoutInhibitors []activity_source.Activity
+	// domains with the same name on different connections share one inhibitor
+	seen := make(map[InhibitorName]bool, len(activities))
 	log.Debugf(
 		"Will determine domains without inhibitors. Domains: %v. Current Inhibitors: %v",
-		domains,
+		activityIDs(activities),
 		o.currentInhibitorsCookies,
 	)
-	for _, domain := range domains {
-		domainName, err := domain.GetName()
-		if err != nil {
-			log.Errorf("Can't get name of domain %s with err %s", domain, err)
-			return domainsWithoutInhibitors, err
-		}
-		if _, found := o.currentInhibitorsCookies[InhibitorName(domainName)]; !found {
-			domainsWithoutInhibitors = append(domainsWithoutInhibitors, domain)
+	for _, activity := range activities {
+		name := InhibitorName(activity.ID)
+		if _, found := o.currentInhibitorsCookies[name]; !found && !seen[name] {
+			domainsWithoutInhibitors = append(domainsWithoutInhibitors, activity)
 		}
+		seen[name] = true
 	}
-	log.Debugf("Domains without inhibitors: %v", domainsWithoutInhibitors)
+	log.Debugf("Domains without inhibitors: %v", activityIDs(domainsWithoutInhibitors))
 	return domainsWithoutInhibitors, nil
 }
 
@@ -134,25 +569,20 @@ func (o *Orchestrator) determineDomainsWithoutInhibitors(domains []libvirt_watch
 determineInhibitorsWithoutDomains determines all inhibitors that are not
 associated(doesn't have the same name as domain) with any domain
 */
-func (o *Orchestrator) determineInhibitorsWithoutDomains(domains []libvirt_watcher.MinimalLibvirtDomain) ([]InhibitorName, error) {
+func (o *Orchestrator) determineInhibitorsWithoutDomains(activities []activity_source.Activity) ([]InhibitorName, error) {
 	var inhibitorsWithoutDomains []InhibitorName
 	domainsMap := map[InhibitorName]bool{}
 	log.Debugf(
 		"Will search for inhibitors without domains. Domains: %v. Current Inhibitors: %v",
-		domains,
+		activityIDs(activities),
 		o.currentInhibitorsCookies,
 	)
-	for _, domain := range domains {
-		domainName, err := domain.GetName()
-		if err != nil {
-			log.Errorf("Can't get name of domain %s with err %s", domain, err)
-			return inhibitorsWithoutDomains, err
-		}
-		domainsMap[InhibitorName(domainName)] = true
+	for _, activity := range activities {
+		domainsMap[InhibitorName(activity.ID)] = true
 	}
 	for inhibitorName := range o.currentInhibitorsCookies {
 		if _, found := domainsMap[inhibitorName]; !found {
-			log.Debugf("Found inhibitor %s without domain", inhibitorName)
+			log.WithField(logging.FieldDomain, inhibitorName).Debug("Found inhibitor without domain")
 			inhibitorsWithoutDomains = append(inhibitorsWithoutDomains, inhibitorName)
 		}
 	}
@@ -161,43 +591,110 @@ func (o *Orchestrator) determineInhibitorsWithoutDomains(domains []libvirt_watch
 }
 
 /*
-activateInhibitorForDomain activates an inhibitor for the given domain. Inhibitor name will be the same
-as the domain name
+activateInhibitorForDomain activates an inhibitor for the given activity and returns its cookie. Inhibitor name
+will be the same as the qualified activity ID
 */
-func (o *Orchestrator) activateInhibitorForDomain(domain libvirt_watcher.MinimalLibvirtDomain) error {
-	domainName, err := domain.GetName()
+func (o *Orchestrator) activateInhibitorForDomain(
+	ctx context.Context, activity activity_source.Activity,
+) (InhibitorCookie, error) {
+	domainName := activity.ID
+	domainLog := log.WithFields(log.Fields{
+		logging.FieldDomain:  domainName,
+		logging.FieldBackend: o.sleepInhibitor.Backend(),
+	})
+	cookie, success, err := o.sleepInhibitor.Inhibit(ctx, inhibitorAppName(InhibitorName(domainName)))
 	if err != nil {
-		log.Errorf("Can't get name of domain %s, err %s", domain, err)
-		return err
-	}
-	cookie, success, err := o.sleepInhibitor.Inhibit(domainName)
-	if err != nil {
-		log.Errorf("Can't inhibit sleep for domain %s with err %s", domainName, err)
-		return err
+		domainLog.WithError(err).Error("Can't inhibit sleep for domain")
+		return 0, err
 	}
 	if !success {
-		log.Errorf("Can't inhibit sleep for domain %s", domainName)
-		return fmt.Errorf("inhibition for domain %s wasn't succesfull", domainName)
+		domainLog.Error("Can't inhibit sleep for domain")
+		return 0, fmt.Errorf("inhibition for domain %s wasn't succesfull", domainName)
 	}
+	domainUUID := activity.UUID
 	o.currentInhibitorsCookies[InhibitorName(domainName)] = InhibitorCookie(cookie)
-	return nil
+	o.inhibitorsDetails[InhibitorName(domainName)] = inhibitorDetails{domainUUID: domainUUID, acquiredAt: time.Now()}
+	o.saveState()
+	o.emit(Event{
+		Kind:       EventInhibitorActivated,
+		Domain:     InhibitorName(domainName),
+		DomainUUID: domainUUID,
+		Cookie:     InhibitorCookie(cookie),
+	})
+	return InhibitorCookie(cookie), nil
 }
 
 /*
 deactivateInhibitor deactivates an inhibitor for the given domain.
 */
-func (o *Orchestrator) deactivateInhibitor(name InhibitorName) error {
+func (o *Orchestrator) deactivateInhibitor(ctx context.Context, name InhibitorName) error {
 	cookie, ok := o.currentInhibitorsCookies[name]
 	if !ok {
 		errMsg := fmt.Sprintf("Can't find cookie for inhibitor %s", name)
-		log.Error(errMsg)
+		log.WithField(logging.FieldDomain, name).Error(errMsg)
 		return errors.New(errMsg)
 	}
-	err := o.sleepInhibitor.UnInhibit(uint32(cookie))
-	if err != nil {
-		log.Errorf("Can't uninhibit sleep for domain %s with err %s", name, err)
+	inhibitorLog := o.inhibitorLog(name, cookie)
+	err := o.sleepInhibitor.UnInhibit(ctx, uint32(cookie))
+	if errors.Is(err, dbus_inhibitor.ErrCookieNotFound) {
+		// retrying can't help, the power manager already dropped the inhibitor, e.g. after its restart
+		inhibitorLog.WithError(err).Warn("Power manager doesn't know the inhibitor anymore, dropping its cookie")
+	} else if err != nil {
+		inhibitorLog.WithError(err).Error("Can't uninhibit sleep for domain")
 		return err
 	}
+	domainUUID := o.inhibitorsDetails[name].domainUUID
 	delete(o.currentInhibitorsCookies, name)
+	delete(o.inhibitorsDetails, name)
+	o.saveState()
+	o.emit(Event{Kind: EventInhibitorDeactivated, Domain: name, DomainUUID: domainUUID, Cookie: cookie})
 	return nil
 }
+
+// inhibitorLog returns a logger with fields identifying the inhibitor of the domain
+func (o *Orchestrator) inhibitorLog(name InhibitorName, cookie InhibitorCookie) *log.Entry {
+	return log.WithFields(log.Fields{
+		logging.FieldDomain:  name,
+		logging.FieldCookie:  cookie,
+		logging.FieldBackend: o.sleepInhibitor.Backend(),
+	})
+}
+
+// saveState persists held inhibitors and user decisions. Must be called with the mutex held
+func (o *Orchestrator) saveState() {
+	if o.journal == nil {
+		return
+	}
+	newState := state.State{PausedUntil: o.pausedUntil, UpdatedAt: time.Now()}
+	for name, cookie := range o.currentInhibitorsCookies {
+		details := o.inhibitorsDetails[name]
+		newState.Inhibitors = append(newState.Inhibitors, state.InhibitorRecord{
+			Domain:     string(name),
+			DomainUUID: details.domainUUID,
+			Backend:    o.sleepInhibitor.Backend(),
+			Cookie:     uint32(cookie),
+			AcquiredAt: details.acquiredAt,
+		})
+	}
+	newState.Inhibitors = append(newState.Inhibitors, o.leftoverInhibitors...)
+	for name := range o.disabledDomains {
+		newState.DisabledDomains = append(newState.DisabledDomains, string(name))
+	}
+	if err := o.journal.Save(newState); err != nil {
+		log.WithError(err).Error("Can't save state journal")
+	}
+}
+
+// inhibitorAppName returns application name used for the inhibitor of the domain
+func inhibitorAppName(name InhibitorName) string {
+	return InhibitorAppNamePrefix + string(name)
+}
+
+// activityIDs returns IDs of activities for logging
+func activityIDs(activities []activity_source.Activity) []string {
+	ids := make([]string, len(activities))
+	for i, activity := range activities {
+		ids[i] = activity.ID
+	}
+	return ids
+}
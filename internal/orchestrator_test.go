@@ -1,11 +1,18 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"libvirt_keepawake/internal/activity_source"
 	"libvirt_keepawake/internal/dbus_inhibitor"
 	"libvirt_keepawake/internal/libvirt_watcher"
+	"libvirt_keepawake/internal/state"
 	"os"
+	"path/filepath"
+	"slices"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -58,7 +65,7 @@ func (s *OrchestratorSuite) SetupTest() {
 	}
 
 	// Create a new dbus sleep inhibitor using the connected dbus connection.
-	s.sleepInhibitor = dbus_inhibitor.NewDbusSleepInhibitor(conn)
+	s.sleepInhibitor = dbus_inhibitor.NewDbusSleepInhibitor(conn, dbus_inhibitor.DefaultCallTimeout)
 
 	// Start the fake dbus service.
 	err = s.fakeDbusService.Start()
@@ -70,7 +77,7 @@ func (s *OrchestratorSuite) SetupTest() {
 	ticker := time.NewTicker(500 * time.Millisecond)
 
 	// Create a new orchestrator using the sleep inhibitor, libvirt watcher, and ticker.
-	s.orchestrator = NewOrchestrator(s.sleepInhibitor, s.watcher, ticker)
+	s.orchestrator = NewOrchestrator(s.sleepInhibitor, ticker, s.watcher)
 
 	// Start the orchestrator.
 	s.orchestrator.Start()
@@ -253,15 +260,650 @@ func (s *OrchestratorSuite) TestAddInhibitorsOnStoppingOrchestrator() {
 	s.assertActiveInhibitors([]string{})
 }
 
+// TestStopWithUnresponsivePowerManager tests that Stop gives up releasing inhibitors after the shutdown timeout
+func (s *OrchestratorSuite) TestStopWithUnresponsivePowerManager() {
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain1"}},
+	)
+	s.assertActiveInhibitors([]string{"domain1"})
+	s.fakeDbusService.SetUnresponsive(true)
+	defer s.fakeDbusService.SetUnresponsive(false)
+	s.orchestrator.SetShutdownTimeout(200 * time.Millisecond)
+
+	startedAt := time.Now()
+	s.orchestrator.Stop()
+
+	s.Assert().Less(time.Since(startedAt), time.Second)
+}
+
+// TestStopCancelsCheck tests that Stop cancels a check which is waiting for libvirt instead of waiting for it
+func (s *OrchestratorSuite) TestStopCancelsCheck() {
+	s.libvirtConnect.SetUnresponsive(true)
+	s.orchestrator.SetShutdownTimeout(time.Minute)
+	s.orchestrator.Trigger()
+	// let the check start
+	time.Sleep(50 * time.Millisecond)
+
+	startedAt := time.Now()
+	s.orchestrator.Stop()
+
+	s.Assert().Less(time.Since(startedAt), time.Second)
+}
+
+func (s *OrchestratorSuite) TestRetryPolicyDelay() {
+	policy := RetryPolicy{InitialDelay: time.Second, MaxDelay: 10 * time.Second, Jitter: 0.2}
+	middle := func() float64 { return 0.5 }
+
+	s.Assert().Equal(time.Second, policy.Delay(1, middle))
+	s.Assert().Equal(2*time.Second, policy.Delay(2, middle))
+	s.Assert().Equal(8*time.Second, policy.Delay(4, middle))
+	s.Assert().Equal(10*time.Second, policy.Delay(5, middle))
+	s.Assert().Equal(10*time.Second, policy.Delay(100, middle))
+	// jitter
+	s.Assert().Equal(800*time.Millisecond, policy.Delay(1, func() float64 { return 0 }))
+	s.Assert().Equal(12*time.Second, policy.Delay(100, func() float64 { return 1 }))
+}
+
+// TestInhibitRetry tests that failed inhibitors are retried with backoff, escalated and recovered
+func (s *OrchestratorSuite) TestInhibitRetry() {
+	listener := &recordingListener{}
+	s.orchestrator.AddListener(listener)
+	s.orchestrator.SetRetryPolicy(
+		RetryPolicy{InitialDelay: 50 * time.Millisecond, MaxDelay: time.Second, EscalateAfter: 2},
+	)
+	s.fakeDbusService.SetInhibitFailing(true)
+
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain1"}},
+	)
+	s.orchestrator.Trigger()
+
+	// retries don't wait for the 500ms tick
+	s.Require().Eventually(func() bool {
+		return slices.Contains(listener.kinds(), EventInhibitorFailed)
+	}, 400*time.Millisecond, 10*time.Millisecond)
+	failure := s.orchestrator.Status().Failed["domain1"]
+	s.Assert().Equal(OperationInhibit, failure.Operation)
+	s.Assert().GreaterOrEqual(failure.Count, 2)
+	s.Assert().Contains(failure.LastError, "Inhibit failed")
+
+	s.fakeDbusService.SetInhibitFailing(false)
+	s.assertActiveInhibitors([]string{"domain1"})
+	s.Assert().Empty(s.orchestrator.Status().Failed)
+	s.Assert().Contains(listener.kinds(), EventInhibitorRecovered)
+}
+
+// TestDropUnknownCookie tests that cookies the power manager doesn't know are dropped instead of being retried
+func (s *OrchestratorSuite) TestDropUnknownCookie() {
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain1"}},
+	)
+	s.assertActiveInhibitors([]string{"domain1"})
+	// the power manager restarted and lost its inhibitors
+	s.Require().Nil(s.fakeDbusService.UnInhibit(uint32(s.orchestrator.Status().Inhibitors["domain1"])))
+
+	s.libvirtConnect.UpdateActiveDomains(nil)
+	s.orchestrator.Trigger()
+
+	s.Assert().Eventually(func() bool {
+		return len(s.orchestrator.Status().Inhibitors) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	s.Assert().Empty(s.orchestrator.Status().Failed)
+}
+
+// TestVerifyReacquiresVanishedInhibitors tests that inhibitors the power manager lost are re-acquired periodically
+func (s *OrchestratorSuite) TestVerifyReacquiresVanishedInhibitors() {
+	s.orchestrator.Stop()
+	s.orchestrator = NewOrchestrator(s.sleepInhibitor, time.NewTicker(500*time.Millisecond), s.watcher)
+	s.orchestrator.SetVerifyInterval(50 * time.Millisecond)
+	s.orchestrator.Start()
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain1"}},
+	)
+	s.assertActiveInhibitors([]string{"domain1"})
+	oldCookie := s.orchestrator.Status().Inhibitors["domain1"]
+
+	s.Require().Nil(s.fakeDbusService.UnInhibit(uint32(oldCookie)))
+
+	s.assertActiveInhibitors([]string{"domain1"})
+	s.Assert().Eventually(func() bool {
+		cookie, found := s.orchestrator.Status().Inhibitors["domain1"]
+		return found && cookie != oldCookie
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+// TestVerifyWithoutListing tests that verification is skipped for power managers which can't list inhibitors
+func (s *OrchestratorSuite) TestVerifyWithoutListing() {
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain1"}},
+	)
+	s.assertActiveInhibitors([]string{"domain1"})
+	cookie := s.orchestrator.Status().Inhibitors["domain1"]
+	s.Require().Nil(s.fakeDbusService.UnInhibit(uint32(cookie)))
+	s.fakeDbusService.SetListingEnabled(false)
+	defer s.fakeDbusService.SetListingEnabled(true)
+
+	s.orchestrator.verifyInhibitors(context.Background())
+	// detected once, listing isn't tried again
+	s.fakeDbusService.SetListingEnabled(true)
+	s.orchestrator.verifyInhibitors(context.Background())
+
+	s.Assert().Equal(cookie, s.orchestrator.Status().Inhibitors["domain1"])
+	s.assertActiveInhibitors([]string{})
+}
+
+// TestPauseReleasesInhibitors tests that pause releases all inhibitors while domains are still running and resume
+// activates them again
+func (s *OrchestratorSuite) TestPauseReleasesInhibitors() {
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain1"},
+		},
+	)
+	s.assertActiveInhibitors([]string{"domain1"})
+
+	s.orchestrator.Pause(time.Hour)
+	s.assertActiveInhibitors([]string{})
+	assert.False(s.T(), s.orchestrator.PausedUntil().IsZero())
+
+	s.orchestrator.Resume()
+	s.assertActiveInhibitors([]string{"domain1"})
+	assert.True(s.T(), s.orchestrator.PausedUntil().IsZero())
+}
+
+// TestDisabledDomain tests that disabled domain doesn't inhibit sleep while other domains still do
+func (s *OrchestratorSuite) TestDisabledDomain() {
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain1"},
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain2"},
+		},
+	)
+	s.assertActiveInhibitors([]string{"domain1", "domain2"})
+
+	s.orchestrator.SetDomainEnabled("domain1", false)
+	s.assertActiveInhibitors([]string{"domain2"})
+	status := s.orchestrator.Status()
+	assert.Equal(s.T(), []InhibitorName{"domain1", "domain2"}, status.ActiveDomains)
+	assert.Equal(s.T(), []InhibitorName{"domain1"}, status.DisabledDomains)
+
+	s.orchestrator.SetDomainEnabled("domain1", true)
+	s.assertActiveInhibitors([]string{"domain1", "domain2"})
+}
+
+// TestPlan tests that plan describes decisions for running, disabled, duplicate and stopped domains
+func (s *OrchestratorSuite) TestPlan() {
+	s.orchestrator.SetDomainEnabled("domain2", false)
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain1"},
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain2"},
+			// the same name on another connection
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain1"},
+		},
+	)
+	s.libvirtConnect.UpdateInactiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain3"}},
+	)
+	// duplicate domain doesn't get a second inhibitor
+	s.assertActiveInhibitors([]string{"domain1"})
+
+	plan, err := s.orchestrator.Plan(context.Background())
+
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []PlanEntry{
+		{Domain: "domain1", Running: true, Action: PlanKeep, Reason: "running, inhibitor is already held"},
+		{
+			Domain:  "domain1",
+			Running: true,
+			Action:  PlanSkip,
+			Reason:  "another running domain has the same name and shares its inhibitor",
+		},
+		{Domain: "domain2", Running: true, Action: PlanSkip, Reason: "inhibition is disabled for the domain"},
+		{Domain: "domain3", Action: PlanSkip, Reason: "not running"},
+	}, plan)
+}
+
+// TestDomainLocks tests that domain locks follow running domains and failed locks are retried
+func (s *OrchestratorSuite) TestDomainLocks() {
+	shutdownLock := &FakeDomainLock{LockName: "shutdown", Domains: []InhibitorName{"domain1", "domain2"}}
+	shutdownLock.SetFailing("domain2", true)
+	s.restartWithDomainLock(shutdownLock, 0)
+
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain1"},
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain2"},
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain3"},
+		},
+	)
+	s.assertActiveInhibitors([]string{"domain1", "domain2", "domain3"})
+	assert.Eventually(s.T(), func() bool {
+		return slices.Equal([]InhibitorName{"domain1"}, shutdownLock.Held())
+	}, time.Second, 10*time.Millisecond)
+
+	shutdownLock.SetFailing("domain2", false)
+	assert.Eventually(s.T(), func() bool {
+		return slices.Equal([]InhibitorName{"domain1", "domain2"}, shutdownLock.Held())
+	}, time.Second, 10*time.Millisecond)
+
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain2"}},
+	)
+	s.assertActiveInhibitors([]string{"domain2"})
+	assert.Equal(s.T(), []InhibitorName{"domain2"}, shutdownLock.Held())
+
+	s.orchestrator.Stop()
+	assert.Empty(s.T(), shutdownLock.Held())
+}
+
+// TestDomainLocksWhilePaused tests that pausing inhibition releases only the sleep inhibitor
+func (s *OrchestratorSuite) TestDomainLocksWhilePaused() {
+	shutdownLock := &FakeDomainLock{LockName: "shutdown"}
+	s.restartWithDomainLock(shutdownLock, 0)
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain1"}},
+	)
+	s.assertActiveInhibitors([]string{"domain1"})
+
+	s.orchestrator.Pause(time.Hour)
+
+	s.assertActiveInhibitors([]string{})
+	assert.Equal(s.T(), []InhibitorName{"domain1"}, shutdownLock.Held())
+	// disabling the domain releases it
+	s.orchestrator.SetDomainEnabled("domain1", false)
+	assert.Eventually(s.T(), func() bool {
+		return len(shutdownLock.Held()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestDomainLocksWithFailingInhibit tests that domain locks are held while the power manager can't inhibit sleep
+func (s *OrchestratorSuite) TestDomainLocksWithFailingInhibit() {
+	shutdownLock := &FakeDomainLock{LockName: "shutdown"}
+	s.restartWithDomainLock(shutdownLock, 0)
+	s.fakeDbusService.SetInhibitFailing(true)
+	defer s.fakeDbusService.SetInhibitFailing(false)
+
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain1"}},
+	)
+
+	assert.Eventually(s.T(), func() bool {
+		return slices.Equal([]InhibitorName{"domain1"}, shutdownLock.Held())
+	}, time.Second, 10*time.Millisecond)
+	assert.Empty(s.T(), s.orchestrator.Status().Inhibitors)
+}
+
+// TestDomainLocksAfterFailedReacquire tests that domain locks stay held when a vanished inhibitor can't be
+// re-acquired
+func (s *OrchestratorSuite) TestDomainLocksAfterFailedReacquire() {
+	shutdownLock := &FakeDomainLock{LockName: "shutdown"}
+	s.restartWithDomainLock(shutdownLock, 50*time.Millisecond)
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain1"}},
+	)
+	s.assertActiveInhibitors([]string{"domain1"})
+	s.fakeDbusService.SetInhibitFailing(true)
+	defer s.fakeDbusService.SetInhibitFailing(false)
+
+	s.Require().Nil(s.fakeDbusService.UnInhibit(uint32(s.orchestrator.Status().Inhibitors["domain1"])))
+
+	assert.Eventually(s.T(), func() bool {
+		return len(s.orchestrator.Status().Inhibitors) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(s.T(), []InhibitorName{"domain1"}, shutdownLock.Held())
+}
+
+// TestDomainLocksReleaseRetry tests that holds which can't be released are kept and retried after the retry delay
+func (s *OrchestratorSuite) TestDomainLocksReleaseRetry() {
+	shutdownLock := &FakeDomainLock{LockName: "shutdown"}
+	s.restartWithDomainLock(shutdownLock, 0)
+	s.orchestrator.SetRetryPolicy(RetryPolicy{InitialDelay: 400 * time.Millisecond, MaxDelay: time.Second})
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain1"}},
+	)
+	s.assertActiveInhibitors([]string{"domain1"})
+	s.Require().Eventually(func() bool {
+		return slices.Equal([]InhibitorName{"domain1"}, shutdownLock.Held())
+	}, time.Second, 10*time.Millisecond)
+	shutdownLock.SetReleaseFailing("domain1", true)
+
+	s.libvirtConnect.UpdateActiveDomains(nil)
+	s.assertActiveInhibitors([]string{})
+	s.Require().Eventually(func() bool {
+		return shutdownLock.Releases("domain1") == 1
+	}, time.Second, 10*time.Millisecond)
+	// checks run every 100ms, but the release waits for the retry delay
+	assert.Never(s.T(), func() bool {
+		return shutdownLock.Releases("domain1") > 1
+	}, 200*time.Millisecond, 10*time.Millisecond)
+	assert.Equal(s.T(), []InhibitorName{"domain1"}, shutdownLock.Held())
+
+	shutdownLock.SetReleaseFailing("domain1", false)
+	assert.Eventually(s.T(), func() bool {
+		return len(shutdownLock.Held()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// restartWithDomainLock replaces the running orchestrator with a started one holding lock, verifyInterval 0 disables
+// verification
+func (s *OrchestratorSuite) restartWithDomainLock(lock DomainLock, verifyInterval time.Duration) {
+	s.orchestrator.Stop()
+	s.orchestrator = NewOrchestrator(s.sleepInhibitor, time.NewTicker(100*time.Millisecond), s.watcher)
+	s.orchestrator.AddDomainLock(lock)
+	s.orchestrator.SetVerifyInterval(verifyInterval)
+	s.orchestrator.Start()
+}
+
+// TestDomainFilters tests that idle domains don't get inhibitors and the inhibitor is released when a domain becomes
+// idle
+func (s *OrchestratorSuite) TestDomainFilters() {
+	s.orchestrator.Stop()
+	s.orchestrator = NewOrchestrator(s.sleepInhibitor, time.NewTicker(100*time.Millisecond), s.watcher)
+	filter := &FakeDomainFilter{}
+	filter.SetIdle("domain2", true)
+	s.orchestrator.AddDomainFilter(filter)
+	s.orchestrator.Start()
+
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain1"},
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain2"},
+		},
+	)
+	s.assertActiveInhibitors([]string{"domain1"})
+	plan, err := s.orchestrator.Plan(context.Background())
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []PlanEntry{
+		{Domain: "domain1", Running: true, Action: PlanKeep, Reason: "running, inhibitor is already held"},
+		{Domain: "domain2", Running: true, Action: PlanSkip, Reason: "domain is idle"},
+	}, plan)
+
+	filter.SetIdle("domain1", true)
+	filter.SetIdle("domain2", false)
+	s.assertActiveInhibitors([]string{"domain2"})
+	// running domains are reported even if idle
+	assert.Equal(s.T(), []InhibitorName{"domain1", "domain2"}, s.orchestrator.Status().ActiveDomains)
+}
+
+// TestMultipleSources tests that activities of all sources get inhibitors with source-qualified names and that
+// source events trigger a check right away
+func (s *OrchestratorSuite) TestMultipleSources() {
+	s.orchestrator.Stop()
+	containers := activity_source.NewFakeActivitySource("containers")
+	s.orchestrator = NewOrchestrator(s.sleepInhibitor, time.NewTicker(time.Hour), s.watcher, containers)
+	s.orchestrator.Start()
+
+	containers.UpdateActivities([]activity_source.Activity{{ID: "nextcloud", Label: "nextcloud", Reason: "running"}})
+	s.assertActiveInhibitors([]string{"containers/nextcloud"})
+
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain1"}},
+	)
+	s.watcher.Notify()
+	s.assertActiveInhibitors([]string{"containers/nextcloud", "domain1"})
+
+	containers.UpdateActivities(nil)
+	s.assertActiveInhibitors([]string{"domain1"})
+}
+
+// TestFailingSource tests that a source which can't list activities keeps its inhibitors and doesn't block others
+func (s *OrchestratorSuite) TestFailingSource() {
+	s.orchestrator.Stop()
+	containers := activity_source.NewFakeActivitySource("containers")
+	s.orchestrator = NewOrchestrator(s.sleepInhibitor, time.NewTicker(time.Hour), s.watcher, containers)
+	s.orchestrator.Start()
+	containers.UpdateActivities([]activity_source.Activity{{ID: "nextcloud", Label: "nextcloud", Reason: "running"}})
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain1"}},
+	)
+	s.watcher.Notify()
+	s.assertActiveInhibitors([]string{"containers/nextcloud", "domain1"})
+
+	containers.SetError(errors.New("permission denied"))
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain2"}},
+	)
+	s.watcher.Notify()
+
+	s.assertActiveInhibitors([]string{"containers/nextcloud", "domain2"})
+	containers.SetError(nil)
+	containers.UpdateActivities(nil)
+	s.assertActiveInhibitors([]string{"domain2"})
+}
+
+// restartWithJournal replaces the running orchestrator with a new one which uses a journal in a temp directory,
+// the new orchestrator isn't started
+func (s *OrchestratorSuite) restartWithJournal() *state.Journal {
+	s.orchestrator.Stop()
+	journal := state.NewJournal(filepath.Join(s.T().TempDir(), "state.json"))
+	s.orchestrator = NewOrchestrator(s.sleepInhibitor, time.NewTicker(500*time.Millisecond), s.watcher)
+	s.orchestrator.SetJournal(journal)
+	return journal
+}
+
+// journalRecord returns a journal record of an inhibitor created by the fake power manager
+func (s *OrchestratorSuite) journalRecord(domain string, domainUUID string, cookie uint32) state.InhibitorRecord {
+	return state.InhibitorRecord{
+		Domain: domain, DomainUUID: domainUUID, Backend: s.sleepInhibitor.Backend(), Cookie: cookie, AcquiredAt: time.Now(),
+	}
+}
+
+// TestRestoreStaleInhibitors tests that inhibitors left by a killed instance are adopted if their domain is still
+// running and released otherwise
+func (s *OrchestratorSuite) TestRestoreStaleInhibitors() {
+	journal := s.restartWithJournal()
+	// inhibitors created by "previous instance"
+	runningCookie, _, err := s.sleepInhibitor.Inhibit(context.Background(), inhibitorAppName("domain1"))
+	s.Require().NoError(err)
+	stoppedCookie, _, err := s.sleepInhibitor.Inhibit(context.Background(), inhibitorAppName("domain2"))
+	s.Require().NoError(err)
+	_, _, err = s.sleepInhibitor.Inhibit(context.Background(), inhibitorAppName("domain3"))
+	s.Require().NoError(err)
+	recreatedCookie, _, err := s.sleepInhibitor.Inhibit(context.Background(), inhibitorAppName("domain5"))
+	s.Require().NoError(err)
+	s.Require().NoError(journal.Save(state.State{Inhibitors: []state.InhibitorRecord{
+		s.journalRecord("domain1", "uuid1", runningCookie),
+		s.journalRecord("domain2", "uuid2", stoppedCookie),
+		s.journalRecord("domain4", "uuid4", 9999),
+		// domain with the same name, but different UUID is running now
+		s.journalRecord("domain5", "old-uuid5", recreatedCookie),
+		{Domain: "domain6", Backend: "other-backend", Cookie: 1},
+	}}))
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain1", UUID: "uuid1"},
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain5", UUID: "uuid5"},
+		},
+	)
+
+	report := s.orchestrator.RestoreState(context.Background())
+
+	assert.True(s.T(), report.ListingSupported)
+	assert.Equal(s.T(), []InhibitorName{"domain1"}, report.Adopted)
+	assert.Equal(s.T(), []InhibitorName{"domain2", "domain5"}, report.Released)
+	assert.Equal(s.T(), []InhibitorName{"domain4"}, report.Vanished)
+	assert.Equal(s.T(), []InhibitorName{"domain6"}, report.OtherBackend)
+	assert.Equal(s.T(), []string{inhibitorAppName("domain3")}, report.Unknown)
+	savedState, err := journal.Load()
+	s.Require().NoError(err)
+	// inhibitor of another backend is kept, so it can be released once that backend is used again
+	s.Require().Len(savedState.Inhibitors, 2)
+	assert.Equal(s.T(), "domain1", savedState.Inhibitors[0].Domain)
+	assert.Equal(s.T(), runningCookie, savedState.Inhibitors[0].Cookie)
+	assert.Equal(s.T(), "uuid1", savedState.Inhibitors[0].DomainUUID)
+	assert.Equal(s.T(), state.InhibitorRecord{Domain: "domain6", Backend: "other-backend", Cookie: 1},
+		savedState.Inhibitors[1])
+
+	// adopted inhibitor isn't duplicated by the main loop
+	s.orchestrator.Start()
+	s.assertActiveInhibitors([]string{"domain1", "domain3", "domain5"})
+	assert.Equal(s.T(), InhibitorCookie(runningCookie), s.orchestrator.Status().Inhibitors["domain1"])
+}
+
+// TestRestoreFailedRelease tests that inhibitors which couldn't be released stay in the journal for the next restart
+func (s *OrchestratorSuite) TestRestoreFailedRelease() {
+	journal := s.restartWithJournal()
+	cookie, _, err := s.sleepInhibitor.Inhibit(context.Background(), inhibitorAppName("domain1"))
+	s.Require().NoError(err)
+	record := s.journalRecord("domain1", "uuid1", cookie)
+	s.Require().NoError(journal.Save(state.State{Inhibitors: []state.InhibitorRecord{record}}))
+	s.fakeDbusService.SetUnInhibitFailing(true)
+
+	report := s.orchestrator.RestoreState(context.Background())
+
+	assert.Equal(s.T(), []InhibitorName{"domain1"}, report.Failed)
+	savedState, err := journal.Load()
+	s.Require().NoError(err)
+	s.Require().Len(savedState.Inhibitors, 1)
+	assert.Equal(s.T(), cookie, savedState.Inhibitors[0].Cookie)
+
+	// the next restart releases it
+	s.fakeDbusService.SetUnInhibitFailing(false)
+	s.orchestrator = NewOrchestrator(s.sleepInhibitor, time.NewTicker(500*time.Millisecond), s.watcher)
+	s.orchestrator.SetJournal(journal)
+	report = s.orchestrator.RestoreState(context.Background())
+
+	assert.Equal(s.T(), []InhibitorName{"domain1"}, report.Released)
+	savedState, err = journal.Load()
+	s.Require().NoError(err)
+	assert.Empty(s.T(), savedState.Inhibitors)
+	s.assertActiveInhibitors([]string{})
+}
+
+// TestRestoreWithoutListing tests that all journal inhibitors are released when power manager can't list them
+func (s *OrchestratorSuite) TestRestoreWithoutListing() {
+	journal := s.restartWithJournal()
+	cookie, _, err := s.sleepInhibitor.Inhibit(context.Background(), inhibitorAppName("domain1"))
+	s.Require().NoError(err)
+	s.Require().NoError(journal.Save(state.State{Inhibitors: []state.InhibitorRecord{
+		s.journalRecord("domain1", "", cookie),
+	}}))
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain1"}},
+	)
+	s.fakeDbusService.SetListingEnabled(false)
+
+	report := s.orchestrator.RestoreState(context.Background())
+
+	assert.False(s.T(), report.ListingSupported)
+	assert.Equal(s.T(), []InhibitorName{"domain1"}, report.Released)
+	s.fakeDbusService.SetListingEnabled(true)
+	s.assertActiveInhibitors([]string{})
+	// main loop creates a fresh inhibitor for the running domain
+	s.orchestrator.Start()
+	s.assertActiveInhibitors([]string{"domain1"})
+}
+
+// TestRestoreUserIntent tests that pause and disabled domains survive a restart
+func (s *OrchestratorSuite) TestRestoreUserIntent() {
+	journal := s.restartWithJournal()
+	pausedUntil := time.Now().Add(time.Hour)
+	s.Require().NoError(journal.Save(state.State{PausedUntil: pausedUntil, DisabledDomains: []string{"domain2"}}))
+
+	report := s.orchestrator.RestoreState(context.Background())
+
+	assert.True(s.T(), pausedUntil.Equal(report.PausedUntil))
+	assert.Equal(s.T(), []InhibitorName{"domain2"}, report.DisabledDomains)
+	status := s.orchestrator.Status()
+	assert.True(s.T(), pausedUntil.Equal(status.PausedUntil))
+	assert.Equal(s.T(), []InhibitorName{"domain2"}, status.DisabledDomains)
+
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain1"},
+			libvirt_watcher.FakeLibvirtDomain{Name: "domain2"},
+		},
+	)
+	s.orchestrator.Start()
+	s.orchestrator.Resume()
+	s.assertActiveInhibitors([]string{"domain1"})
+	savedState, err := journal.Load()
+	s.Require().NoError(err)
+	assert.True(s.T(), savedState.PausedUntil.IsZero())
+	assert.Equal(s.T(), []string{"domain2"}, savedState.DisabledDomains)
+}
+
+// TestRestoreCorruptedJournal tests that corrupted journal doesn't prevent the orchestrator from working
+func (s *OrchestratorSuite) TestRestoreCorruptedJournal() {
+	journal := s.restartWithJournal()
+	s.Require().NoError(os.WriteFile(journal.Path(), []byte("garbage"), 0o600))
+
+	report := s.orchestrator.RestoreState(context.Background())
+
+	assert.True(s.T(), report.Corrupted)
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain1"}},
+	)
+	s.orchestrator.Start()
+	s.assertActiveInhibitors([]string{"domain1"})
+	// state is saved right after the inhibitor has been activated
+	assert.Eventually(s.T(), func() bool {
+		savedState, err := journal.Load()
+		return err == nil && len(savedState.Inhibitors) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestLoadState tests that plan and dry-run mode see inhibitors of the running daemon as held without touching them
+func (s *OrchestratorSuite) TestLoadState() {
+	journal := s.restartWithJournal()
+	s.orchestrator.Stop()
+	savedState := state.State{Inhibitors: []state.InhibitorRecord{
+		s.journalRecord("domain1", "uuid1", 7),
+		s.journalRecord("domain2", "uuid2", 8),
+	}, DisabledDomains: []string{"domain3"}}
+	s.Require().NoError(journal.Save(savedState))
+	savedState, err := journal.Load()
+	s.Require().NoError(err)
+	s.libvirtConnect.UpdateActiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain1", UUID: "uuid1"}},
+	)
+	s.libvirtConnect.UpdateInactiveDomains(
+		[]libvirt_watcher.MinimalLibvirtDomain{libvirt_watcher.FakeLibvirtDomain{Name: "domain2", UUID: "uuid2"}},
+	)
+	noopInhibitor := dbus_inhibitor.NewNoopSleepInhibitor()
+	s.orchestrator = NewOrchestrator(noopInhibitor, time.NewTicker(time.Hour), s.watcher)
+	s.orchestrator.SetJournal(state.NewReadOnlyJournal(journal.Path()))
+
+	s.orchestrator.LoadState()
+
+	plan, err := s.orchestrator.Plan(context.Background())
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []PlanEntry{
+		{Domain: "domain1", Running: true, Action: PlanKeep, Reason: "running, inhibitor is already held"},
+		{Domain: "domain2", Action: PlanRelease, Reason: "not running"},
+	}, plan)
+	assert.Equal(s.T(), []InhibitorName{"domain3"}, s.orchestrator.Status().DisabledDomains)
+
+	// dry-run mode only pretends to release the inhibitor of the stopped domain
+	s.orchestrator.Start()
+	s.orchestrator.Trigger()
+	assert.Eventually(s.T(), func() bool {
+		return len(s.orchestrator.Status().Inhibitors) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(s.T(), InhibitorCookie(7), s.orchestrator.Status().Inhibitors["domain1"])
+	inhibitors, err := noopInhibitor.GetInhibitors(context.Background())
+	s.Require().NoError(err)
+	assert.Equal(s.T(), []string{inhibitorAppName("domain1")}, inhibitors)
+	s.assertActiveInhibitors([]string{})
+	loadedState, err := journal.Load()
+	s.Require().NoError(err)
+	assert.Equal(s.T(), savedState, loadedState)
+}
+
 // assertActiveInhibitors asserts that expectedInhibitors is equal to the list of active inhibitors.
 // function has some time period when it waits for the inhibitors to be activated.
-func (s *OrchestratorSuite) assertActiveInhibitors(expectedInhibitors []string) {
+func (s *OrchestratorSuite) assertActiveInhibitors(expectedDomains []string) {
+	expectedInhibitors := make([]string, 0, len(expectedDomains))
+	for _, domain := range expectedDomains {
+		expectedInhibitors = append(expectedInhibitors, inhibitorAppName(InhibitorName(domain)))
+	}
 	ticker := time.NewTicker(100 * time.Millisecond)
 	timer := time.NewTimer(10 * time.Second)
 	for {
 		select {
 		case <-ticker.C:
-			activeInhibitors, err := s.sleepInhibitor.GetInhibitors()
+			activeInhibitors, err := s.sleepInhibitor.GetInhibitors(context.Background())
 			assert.Nil(s.T(), err)
 			sort.Strings(activeInhibitors)
 			fmt.Println("active inhibitors", activeInhibitors)
@@ -279,6 +921,24 @@ func (s *OrchestratorSuite) assertActiveInhibitors(expectedInhibitors []string)
 	}
 }
 
+// recordingListener records kinds of orchestrator events
+type recordingListener struct {
+	mutex  sync.Mutex
+	events []EventKind
+}
+
+func (l *recordingListener) HandleEvent(event Event) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events = append(l.events, event.Kind)
+}
+
+func (l *recordingListener) kinds() []EventKind {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]EventKind{}, l.events...)
+}
+
 func TestRunOrchestratorSuite(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 	suite.Run(t, new(OrchestratorSuite))
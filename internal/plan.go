@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type PlanAction string
+
+const (
+	// PlanInhibit means an inhibitor will be created for the domain
+	PlanInhibit PlanAction = "inhibit"
+	// PlanKeep means the domain already has an inhibitor and it will be kept
+	PlanKeep PlanAction = "keep"
+	// PlanRelease means the inhibitor held for the domain will be released
+	PlanRelease PlanAction = "release"
+	// PlanSkip means nothing will be done for the domain
+	PlanSkip PlanAction = "skip"
+)
+
+// PlanEntry is the decision the orchestrator would make for a domain during the next check
+type PlanEntry struct {
+	Domain  InhibitorName
+	Running bool
+	Action  PlanAction
+	Reason  string
+}
+
+/*
+Plan lists all domains, running and stopped, and describes what the next check would do with each of them
+without touching the power manager. Inhibitors held for domains which don't exist anymore are listed as well.
+Running domains come first, both groups are sorted by name.
+*/
+func (o *Orchestrator) Plan(ctx context.Context) ([]PlanEntry, error) {
+	activeDomains, err := o.listActivities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inactiveDomains, err := o.listInactiveActivities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	idleDomains := o.findIdleDomains(ctx, activeDomains)
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	paused := !o.pausedUntil.IsZero() && time.Now().Before(o.pausedUntil)
+	var plan []PlanEntry
+	running := make(map[InhibitorName]bool, len(activeDomains))
+	for _, activity := range activeDomains {
+		name := InhibitorName(activity.ID)
+		_, held := o.currentInhibitorsCookies[name]
+		idleReason, idle := idleDomains[name]
+		entry := PlanEntry{Domain: name, Running: true}
+		switch {
+		case running[name]:
+			entry.Action, entry.Reason = PlanSkip, "another running domain has the same name and shares its inhibitor"
+		case paused:
+			entry.Action, entry.Reason = skipOrRelease(held), fmt.Sprintf(
+				"inhibition is paused until %s", o.pausedUntil.Format(time.DateTime),
+			)
+		case o.disabledDomains[name]:
+			entry.Action, entry.Reason = skipOrRelease(held), "inhibition is disabled for the domain"
+		case idle:
+			entry.Action, entry.Reason = skipOrRelease(held), idleReason
+		case held:
+			entry.Action, entry.Reason = PlanKeep, activity.Reason+", inhibitor is already held"
+		default:
+			entry.Action, entry.Reason = PlanInhibit, activity.Reason
+		}
+		running[name] = true
+		plan = append(plan, entry)
+	}
+
+	defined := make(map[InhibitorName]bool, len(inactiveDomains))
+	for _, activity := range inactiveDomains {
+		name := InhibitorName(activity.ID)
+		defined[name] = true
+		_, held := o.currentInhibitorsCookies[name]
+		// a running domain with the same name on another connection keeps the inhibitor
+		plan = append(plan, PlanEntry{Domain: name, Action: skipOrRelease(held && !running[name]), Reason: activity.Reason})
+	}
+	for name := range o.currentInhibitorsCookies {
+		if !running[name] && !defined[name] {
+			plan = append(plan, PlanEntry{Domain: name, Action: PlanRelease, Reason: "domain doesn't exist anymore"})
+		}
+	}
+	sort.SliceStable(plan, func(i, j int) bool {
+		if plan[i].Running != plan[j].Running {
+			return plan[i].Running
+		}
+		return plan[i].Domain < plan[j].Domain
+	})
+	return plan, nil
+}
+
+func skipOrRelease(held bool) PlanAction {
+	if held {
+		return PlanRelease
+	}
+	return PlanSkip
+}
@@ -0,0 +1,55 @@
+package power_guard
+
+import (
+	"context"
+	"fmt"
+	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/login1_inhibitor"
+	"strings"
+)
+
+/*
+HandleBlocker is an internal.DomainLock taking logind block lock on handling of the lid switch(and optionally
+suspend and power keys) for running domains. logind suspends the host on lid close by itself, ignoring
+org.freedesktop.PowerManagement inhibitors, so the lock is held even if that power manager is missing or failing.
+*/
+type HandleBlocker struct {
+	login1 *login1_inhibitor.Login1Inhibitor
+	whats  []login1_inhibitor.What
+	// domains are names of domains to block handling for, all running domains when it's empty
+	domains map[internal.InhibitorName]bool
+}
+
+func NewHandleBlocker(
+	login1 *login1_inhibitor.Login1Inhibitor, whats []login1_inhibitor.What, domains []string,
+) *HandleBlocker {
+	blocker := &HandleBlocker{
+		login1:  login1,
+		whats:   whats,
+		domains: make(map[internal.InhibitorName]bool, len(domains)),
+	}
+	for _, domain := range domains {
+		blocker.domains[internal.InhibitorName(domain)] = true
+	}
+	return blocker
+}
+
+func (b *HandleBlocker) Name() string {
+	names := make([]string, len(b.whats))
+	for i, what := range b.whats {
+		names[i] = string(what)
+	}
+	return strings.Join(names, ":")
+}
+
+func (b *HandleBlocker) Applies(domain internal.InhibitorName) bool {
+	return len(b.domains) == 0 || b.domains[domain]
+}
+
+func (b *HandleBlocker) Acquire(ctx context.Context, domain internal.InhibitorName) (internal.DomainLockHold, error) {
+	lock, err := b.login1.Inhibit(ctx, b.whats, fmt.Sprintf("VM %s is running", domain), login1_inhibitor.ModeBlock)
+	if err != nil {
+		return nil, err
+	}
+	return lockFile{lock}, nil
+}
@@ -0,0 +1,296 @@
+package power_guard
+
+import (
+	"context"
+	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/dbus_inhibitor"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"libvirt_keepawake/internal/login1_inhibitor"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/suite"
+)
+
+type PowerGuardSuite struct {
+	suite.Suite
+	dbusProcess    *os.Process
+	dbusSocketPath string
+	fakeLogin1     *login1_inhibitor.FakeLogin1
+	login1         *login1_inhibitor.Login1Inhibitor
+	operations     *libvirt_watcher.FakeDomainOperations
+	libvirtConnect *libvirt_watcher.FakeLibvirtConnect
+}
+
+func (s *PowerGuardSuite) SetupTest() {
+	dbusSocketPath, dbusProcess, err := dbus_inhibitor.RunDbusServer()
+	if err != nil {
+		s.T().Fatalf("Can't start dbus server. Err %s", err)
+	}
+	s.dbusProcess = dbusProcess
+	s.dbusSocketPath = dbusSocketPath
+	serviceConn, err := dbus.Connect(dbusSocketPath)
+	s.Require().NoError(err)
+	s.fakeLogin1 = login1_inhibitor.NewFakeLogin1(serviceConn)
+	s.Require().NoError(s.fakeLogin1.Start())
+	clientConn, err := dbus.Connect(dbusSocketPath)
+	s.Require().NoError(err)
+	s.login1 = login1_inhibitor.NewLogin1Inhibitor(clientConn, dbus_inhibitor.DefaultCallTimeout)
+
+	s.operations = &libvirt_watcher.FakeDomainOperations{Failing: map[string]bool{}}
+	s.libvirtConnect = new(libvirt_watcher.FakeLibvirtConnect)
+	s.libvirtConnect.UpdateActiveDomains([]libvirt_watcher.MinimalLibvirtDomain{
+		libvirt_watcher.FakeLibvirtDomain{Name: "win11", Operations: s.operations},
+		libvirt_watcher.FakeLibvirtDomain{Name: "linux", Operations: s.operations},
+		libvirt_watcher.FakeLibvirtDomain{Name: "router", Operations: s.operations},
+	})
+}
+
+func (s *PowerGuardSuite) TearDownTest() {
+	s.fakeLogin1.Stop()
+	if err := s.dbusProcess.Kill(); err != nil {
+		s.T().Fatalf("Can't kill dbus server with PID %d. Err %s", s.dbusProcess.Pid, err)
+	}
+}
+
+func (s *PowerGuardSuite) assertLocks(count int) {
+	s.Assert().Eventually(func() bool {
+		return len(s.fakeLogin1.ActiveLocks()) == count
+	}, 2*time.Second, 10*time.Millisecond, "expected %d locks", count)
+}
+
+func (s *PowerGuardSuite) assertOperations(expected ...string) {
+	s.Assert().Eventually(func() bool {
+		return slices.Equal(expected, s.operations.Operations())
+	}, 2*time.Second, 10*time.Millisecond, "operations %v", s.operations.Operations())
+}
+
+func (s *PowerGuardSuite) TestManagedSaveAndRestore() {
+	guard := NewSleepGuard(
+		s.login1, libvirt_watcher.NewLibvirtWatcher(s.libvirtConnect), SleepActionManagedSave, []string{"win11"},
+	)
+	s.Require().NoError(guard.Start())
+	defer guard.Stop()
+	s.Assert().Equal(
+		[]login1_inhibitor.FakeLock{{
+			What: "sleep",
+			Who:  login1_inhibitor.Who,
+			Why:  "Running VMs need to be saved before sleep",
+			Mode: "delay",
+		}},
+		s.fakeLogin1.ActiveLocks(),
+	)
+
+	s.Require().NoError(s.fakeLogin1.EmitPrepareForSleep(true))
+	s.assertOperations("win11:managedsave")
+	// lock is released, so the host can go to sleep
+	s.assertLocks(0)
+
+	s.Require().NoError(s.fakeLogin1.EmitPrepareForSleep(false))
+	s.assertOperations("win11:managedsave", "win11:create")
+	s.assertLocks(1)
+}
+
+// TestWakeUpWithoutSleep tests that the delay lock isn't taken again when it's still held
+func (s *PowerGuardSuite) TestWakeUpWithoutSleep() {
+	guard := NewSleepGuard(
+		s.login1, libvirt_watcher.NewLibvirtWatcher(s.libvirtConnect), SleepActionSuspend, []string{"win11"},
+	)
+	s.Require().NoError(guard.Start())
+
+	s.Require().NoError(s.fakeLogin1.EmitPrepareForSleep(false))
+	s.Assert().Never(func() bool {
+		return len(s.fakeLogin1.ActiveLocks()) > 1
+	}, 300*time.Millisecond, 10*time.Millisecond)
+
+	guard.Stop()
+	s.assertLocks(0)
+}
+
+// TestSuspendFailure tests that domains which couldn't be suspended aren't resumed and don't prevent sleep
+func (s *PowerGuardSuite) TestSuspendFailure() {
+	s.operations.Failing["linux:suspend"] = true
+	guard := NewSleepGuard(
+		s.login1, libvirt_watcher.NewLibvirtWatcher(s.libvirtConnect), SleepActionSuspend, []string{"win11", "linux"},
+	)
+	s.Require().NoError(guard.Start())
+	defer guard.Stop()
+
+	s.Require().NoError(s.fakeLogin1.EmitPrepareForSleep(true))
+	s.assertLocks(0)
+	s.Assert().ElementsMatch([]string{"win11:suspend", "linux:suspend"}, s.operations.Operations())
+
+	s.Require().NoError(s.fakeLogin1.EmitPrepareForSleep(false))
+	s.assertLocks(1)
+	s.Assert().Equal("win11:resume", s.operations.Operations()[2])
+	s.Assert().Len(s.operations.Operations(), 3)
+}
+
+func (s *PowerGuardSuite) TestShutdownBlocker() {
+	blocker := NewShutdownBlocker(s.login1, []string{"win11"})
+	s.Assert().True(blocker.Applies("win11"))
+	s.Assert().False(blocker.Applies("linux"))
+
+	lock, err := blocker.Acquire(context.Background(), "win11")
+
+	s.Require().NoError(err)
+	s.Assert().Equal(
+		[]login1_inhibitor.FakeLock{
+			{What: "shutdown", Who: login1_inhibitor.Who, Why: "VM win11 is running", Mode: "block"},
+		},
+		s.fakeLogin1.ActiveLocks(),
+	)
+	s.Require().NoError(lock.Release(context.Background()))
+	s.assertLocks(0)
+}
+
+func (s *PowerGuardSuite) TestHandleBlocker() {
+	blocker := NewHandleBlocker(
+		s.login1,
+		[]login1_inhibitor.What{login1_inhibitor.WhatHandleLidSwitch, login1_inhibitor.WhatHandlePowerKey},
+		nil,
+	)
+	s.Assert().Equal("handle-lid-switch:handle-power-key", blocker.Name())
+	s.Assert().True(blocker.Applies("linux"))
+
+	lock, err := blocker.Acquire(context.Background(), "linux")
+
+	s.Require().NoError(err)
+	s.Assert().Equal(
+		[]login1_inhibitor.FakeLock{{
+			What: "handle-lid-switch:handle-power-key",
+			Who:  login1_inhibitor.Who,
+			Why:  "VM linux is running",
+			Mode: "block",
+		}},
+		s.fakeLogin1.ActiveLocks(),
+	)
+	s.Require().NoError(lock.Release(context.Background()))
+	s.assertLocks(0)
+}
+
+// TestHandleBlockerWithoutPowerManager tests that lid close is blocked even when sleep can't be inhibited
+func (s *PowerGuardSuite) TestHandleBlockerWithoutPowerManager() {
+	// nothing implements org.freedesktop.PowerManagement on the test bus, so Inhibit fails
+	conn, err := dbus.Connect(s.dbusSocketPath)
+	s.Require().NoError(err)
+	defer conn.Close()
+	orchestrator := internal.NewOrchestrator(
+		dbus_inhibitor.NewDbusSleepInhibitor(conn, time.Second),
+		time.NewTicker(time.Hour),
+		libvirt_watcher.NewLibvirtWatcher(s.libvirtConnect),
+	)
+	orchestrator.AddDomainLock(
+		NewHandleBlocker(s.login1, []login1_inhibitor.What{login1_inhibitor.WhatHandleLidSwitch}, []string{"win11"}),
+	)
+	orchestrator.Start()
+	orchestrator.Trigger()
+
+	s.assertLocks(1)
+	s.Assert().Equal("handle-lid-switch", s.fakeLogin1.ActiveLocks()[0].What)
+	s.Assert().Empty(orchestrator.Status().Inhibitors)
+	orchestrator.Stop()
+	s.assertLocks(0)
+}
+
+func (s *PowerGuardSuite) TestGuestShutdown() {
+	s.operations.IgnoringShutdown = map[string]bool{"linux": true, "router": true}
+	guard := NewShutdownGuard(
+		s.login1,
+		libvirt_watcher.NewLibvirtWatcher(s.libvirtConnect),
+		ShutdownPolicy{Timeout: 100 * time.Millisecond, Fallback: FallbackManagedSave},
+		map[string]ShutdownPolicy{"router": {Timeout: 100 * time.Millisecond, Fallback: FallbackDestroy}},
+	)
+	guard.pollInterval = 10 * time.Millisecond
+	s.Require().NoError(guard.Start())
+	defer guard.Stop()
+	s.Assert().Equal(
+		[]login1_inhibitor.FakeLock{{
+			What: "shutdown",
+			Who:  login1_inhibitor.Who,
+			Why:  "Running VMs need to be shut down",
+			Mode: "delay",
+		}},
+		s.fakeLogin1.ActiveLocks(),
+	)
+
+	s.Require().NoError(s.fakeLogin1.EmitPrepareForShutdown(true))
+	s.assertLocks(0)
+	s.Assert().ElementsMatch(
+		[]string{
+			"win11:shutdown", "linux:shutdown", "linux:managedsave", "router:shutdown", "router:destroy",
+		},
+		s.operations.Operations(),
+	)
+
+	// shutdown was cancelled
+	s.Require().NoError(s.fakeLogin1.EmitPrepareForShutdown(false))
+	s.assertLocks(1)
+}
+
+func (s *PowerGuardSuite) TestGuestShutdownSkip() {
+	guard := NewShutdownGuard(
+		s.login1,
+		libvirt_watcher.NewLibvirtWatcher(s.libvirtConnect),
+		ShutdownPolicy{Skip: true},
+		map[string]ShutdownPolicy{"win11": {Timeout: time.Second, Fallback: FallbackNone}},
+	)
+	guard.pollInterval = 10 * time.Millisecond
+	s.Require().NoError(guard.Start())
+	defer guard.Stop()
+
+	s.Require().NoError(s.fakeLogin1.EmitPrepareForShutdown(true))
+	s.assertLocks(0)
+	s.Assert().Equal([]string{"win11:shutdown"}, s.operations.Operations())
+}
+
+// TestGuestShutdownAborted tests that stopping the guard while a domain shuts down doesn't apply the fallback
+func (s *PowerGuardSuite) TestGuestShutdownAborted() {
+	s.operations.IgnoringShutdown = map[string]bool{"win11": true}
+	guard := NewShutdownGuard(
+		s.login1,
+		libvirt_watcher.NewLibvirtWatcher(s.libvirtConnect),
+		ShutdownPolicy{Timeout: time.Minute, Fallback: FallbackDestroy},
+		nil,
+	)
+	guard.pollInterval = 10 * time.Millisecond
+	s.Require().NoError(guard.Start())
+
+	s.Require().NoError(s.fakeLogin1.EmitPrepareForShutdown(true))
+	s.Require().Eventually(func() bool {
+		return len(s.operations.Operations()) == 3
+	}, time.Second, 10*time.Millisecond)
+	guard.Stop()
+
+	s.Assert().ElementsMatch(
+		[]string{"win11:shutdown", "linux:shutdown", "router:shutdown"}, s.operations.Operations(),
+	)
+}
+
+func (s *PowerGuardSuite) TestParseShutdownPolicy() {
+	defaultPolicy := ShutdownPolicy{Timeout: time.Minute, Fallback: FallbackManagedSave}
+	domain, policy, err := ParseShutdownPolicy("win11=2m", defaultPolicy)
+	s.Require().NoError(err)
+	s.Assert().Equal("win11", domain)
+	s.Assert().Equal(ShutdownPolicy{Timeout: 2 * time.Minute, Fallback: FallbackManagedSave}, policy)
+
+	_, policy, err = ParseShutdownPolicy("router=10s:destroy", defaultPolicy)
+	s.Require().NoError(err)
+	s.Assert().Equal(ShutdownPolicy{Timeout: 10 * time.Second, Fallback: FallbackDestroy}, policy)
+
+	_, policy, err = ParseShutdownPolicy("linux=skip", defaultPolicy)
+	s.Require().NoError(err)
+	s.Assert().True(policy.Skip)
+
+	for _, spec := range []string{"win11", "=1m", "win11=", "win11=soon", "win11=1m:reboot"} {
+		_, _, err = ParseShutdownPolicy(spec, defaultPolicy)
+		s.Assert().Error(err, spec)
+	}
+}
+
+func TestRunPowerGuardSuite(t *testing.T) {
+	suite.Run(t, new(PowerGuardSuite))
+}
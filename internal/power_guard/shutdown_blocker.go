@@ -0,0 +1,57 @@
+package power_guard
+
+import (
+	"context"
+	"fmt"
+	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/login1_inhibitor"
+	"os"
+)
+
+/*
+ShutdownBlocker is an internal.DomainLock taking logind "shutdown" block lock for running domains, so desktop
+environments warn about running VMs instead of shutting down or rebooting right away.
+*/
+type ShutdownBlocker struct {
+	login1 *login1_inhibitor.Login1Inhibitor
+	// domains are names of domains to block shutdown for, all running domains when it's empty
+	domains map[internal.InhibitorName]bool
+}
+
+func NewShutdownBlocker(login1 *login1_inhibitor.Login1Inhibitor, domains []string) *ShutdownBlocker {
+	blocker := &ShutdownBlocker{login1: login1, domains: make(map[internal.InhibitorName]bool, len(domains))}
+	for _, domain := range domains {
+		blocker.domains[internal.InhibitorName(domain)] = true
+	}
+	return blocker
+}
+
+func (b *ShutdownBlocker) Name() string {
+	return "shutdown"
+}
+
+func (b *ShutdownBlocker) Applies(domain internal.InhibitorName) bool {
+	return len(b.domains) == 0 || b.domains[domain]
+}
+
+func (b *ShutdownBlocker) Acquire(ctx context.Context, domain internal.InhibitorName) (internal.DomainLockHold, error) {
+	lock, err := b.login1.Inhibit(
+		ctx,
+		[]login1_inhibitor.What{login1_inhibitor.WhatShutdown},
+		fmt.Sprintf("VM %s is running", domain),
+		login1_inhibitor.ModeBlock,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return lockFile{lock}, nil
+}
+
+// lockFile is a held logind lock, closing the file doesn't call logind, so it can't hang
+type lockFile struct {
+	file *os.File
+}
+
+func (l lockFile) Release(_ context.Context) error {
+	return l.file.Close()
+}
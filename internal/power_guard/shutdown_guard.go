@@ -0,0 +1,276 @@
+package power_guard
+
+import (
+	"context"
+	"fmt"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"libvirt_keepawake/internal/logging"
+	"libvirt_keepawake/internal/login1_inhibitor"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Fallback is what is done with a domain which didn't shut down in time
+type Fallback string
+
+const (
+	FallbackManagedSave Fallback = "managedsave"
+	FallbackDestroy     Fallback = "destroy"
+	// FallbackNone leaves the domain running, it's killed when libvirt stops
+	FallbackNone Fallback = "none"
+)
+
+var Fallbacks = []Fallback{FallbackManagedSave, FallbackDestroy, FallbackNone}
+
+// ShutdownPolicy describes how a domain is shut down together with the host
+type ShutdownPolicy struct {
+	// Skip leaves the domain to libvirt, e.g. when libvirt-guests already handles it
+	Skip     bool
+	Timeout  time.Duration
+	Fallback Fallback
+}
+
+// shutdownPollInterval is how often domain state is checked while waiting for guest shutdown
+const shutdownPollInterval = time.Second
+
+/*
+ParseShutdownPolicy parses per-domain policy in DOMAIN=TIMEOUT[:FALLBACK] or DOMAIN=skip form, e.g.
+win11=2m:managedsave. Missing fallback is taken from defaultPolicy.
+*/
+func ParseShutdownPolicy(spec string, defaultPolicy ShutdownPolicy) (string, ShutdownPolicy, error) {
+	domain, value, found := strings.Cut(spec, "=")
+	if !found || domain == "" || value == "" {
+		return "", ShutdownPolicy{}, fmt.Errorf("policy %q isn't in DOMAIN=TIMEOUT[:FALLBACK] form", spec)
+	}
+	if value == "skip" {
+		return domain, ShutdownPolicy{Skip: true}, nil
+	}
+	policy := defaultPolicy
+	timeout, fallback, hasFallback := strings.Cut(value, ":")
+	var err error
+	policy.Timeout, err = time.ParseDuration(timeout)
+	if err != nil {
+		return "", ShutdownPolicy{}, fmt.Errorf("invalid timeout in policy %q: %w", spec, err)
+	}
+	if hasFallback {
+		if !slices.Contains(Fallbacks, Fallback(fallback)) {
+			return "", ShutdownPolicy{}, fmt.Errorf("unknown fallback %q in policy %q", fallback, spec)
+		}
+		policy.Fallback = Fallback(fallback)
+	}
+	return domain, policy, nil
+}
+
+/*
+ShutdownGuard shuts guests down cleanly when the host powers off. It holds a logind shutdown delay lock, on
+PrepareForShutdown(true) it sends ACPI shutdown to every running domain, waits up to the domain's timeout and
+applies its fallback if the domain is still running. Domains are handled in parallel, the lock is released when
+all of them are done. If shutdown is cancelled(PrepareForShutdown(false)), the lock is taken again.
+*/
+type ShutdownGuard struct {
+	login1        *login1_inhibitor.Login1Inhibitor
+	watcher       *libvirt_watcher.LibvirtWatcher
+	defaultPolicy ShutdownPolicy
+	policies      map[string]ShutdownPolicy
+	pollInterval  time.Duration
+	done          chan struct{}
+	stopped       sync.WaitGroup
+	// state below is accessed only from the guard goroutine after Start
+	lock        *os.File
+	unsubscribe func()
+}
+
+func NewShutdownGuard(
+	login1 *login1_inhibitor.Login1Inhibitor,
+	watcher *libvirt_watcher.LibvirtWatcher,
+	defaultPolicy ShutdownPolicy,
+	policies map[string]ShutdownPolicy,
+) *ShutdownGuard {
+	return &ShutdownGuard{
+		login1:        login1,
+		watcher:       watcher,
+		defaultPolicy: defaultPolicy,
+		policies:      policies,
+		pollInterval:  shutdownPollInterval,
+		done:          make(chan struct{}),
+	}
+}
+
+// Start takes the delay lock and starts listening for PrepareForShutdown
+func (g *ShutdownGuard) Start() error {
+	starts, unsubscribe, err := g.login1.Watch(login1_inhibitor.SignalPrepareForShutdown)
+	if err != nil {
+		return err
+	}
+	if err := g.takeLock(); err != nil {
+		unsubscribe()
+		return err
+	}
+	g.unsubscribe = unsubscribe
+	g.stopped.Add(1)
+	go g.run(starts)
+	return nil
+}
+
+// Stop releases the delay lock
+func (g *ShutdownGuard) Stop() {
+	close(g.done)
+	g.stopped.Wait()
+	g.unsubscribe()
+	g.releaseLock()
+}
+
+func (g *ShutdownGuard) run(starts <-chan bool) {
+	defer g.stopped.Done()
+	for {
+		select {
+		case start, ok := <-starts:
+			if !ok {
+				return
+			}
+			if start {
+				g.beforeShutdown()
+			} else if g.lock == nil {
+				log.Info("Host shutdown was cancelled")
+				if err := g.takeLock(); err != nil {
+					log.WithError(err).Error("Guests won't be shut down with the host")
+				}
+			}
+		case <-g.done:
+			return
+		}
+	}
+}
+
+func (g *ShutdownGuard) takeLock() error {
+	lock, err := g.login1.Inhibit(
+		context.Background(),
+		[]login1_inhibitor.What{login1_inhibitor.WhatShutdown},
+		"Running VMs need to be shut down",
+		login1_inhibitor.ModeDelay,
+	)
+	if err != nil {
+		return fmt.Errorf("can't take logind shutdown delay lock: %w", err)
+	}
+	g.lock = lock
+	return nil
+}
+
+func (g *ShutdownGuard) releaseLock() {
+	if g.lock == nil {
+		return
+	}
+	if err := g.lock.Close(); err != nil {
+		log.WithError(err).Error("Can't release logind shutdown delay lock")
+	}
+	g.lock = nil
+}
+
+func (g *ShutdownGuard) policy(domain string) ShutdownPolicy {
+	if policy, found := g.policies[domain]; found {
+		return policy
+	}
+	return g.defaultPolicy
+}
+
+func (g *ShutdownGuard) beforeShutdown() {
+	log.Info("Host is shutting down, shutting down running domains")
+	domains, err := g.watcher.GetActiveDomains(context.Background())
+	if err != nil {
+		log.WithError(err).Error("Can't list active domains before shutdown")
+	}
+	var wg sync.WaitGroup
+	for _, domain := range domains {
+		name, err := domain.GetName()
+		if err != nil {
+			continue
+		}
+		policy := g.policy(name)
+		domainLog := log.WithField(logging.FieldDomain, name)
+		if policy.Skip {
+			domainLog.Info("Skipping domain shutdown according to policy")
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.shutdownDomain(domain, policy, domainLog)
+		}()
+	}
+	wg.Wait()
+	log.Info("All domains are handled, allowing host shutdown")
+	g.releaseLock()
+}
+
+func (g *ShutdownGuard) shutdownDomain(
+	domain libvirt_watcher.MinimalLibvirtDomain, policy ShutdownPolicy, domainLog *log.Entry,
+) {
+	startedAt := time.Now()
+	domainLog.Infof("Sending ACPI shutdown, waiting up to %s", policy.Timeout)
+	if err := domain.Shutdown(); err != nil {
+		domainLog.WithError(err).Error("Can't send ACPI shutdown to domain")
+	} else {
+		switch g.waitForShutdown(domain, startedAt.Add(policy.Timeout)) {
+		case shutdownCompleted:
+			domainLog.Infof("Domain shut down in %s", time.Since(startedAt).Round(time.Second))
+			return
+		case shutdownAborted:
+			domainLog.Info("Guard is stopping, leaving domain to finish its shutdown")
+			return
+		case shutdownTimedOut:
+			domainLog.Warnf("Domain didn't shut down in %s", policy.Timeout)
+		}
+	}
+
+	var err error
+	switch policy.Fallback {
+	case FallbackManagedSave:
+		domainLog.Info("Saving domain")
+		err = domain.ManagedSave()
+	case FallbackDestroy:
+		domainLog.Info("Destroying domain")
+		err = domain.Destroy()
+	default:
+		domainLog.Info("Leaving domain running")
+		return
+	}
+	if err != nil {
+		domainLog.WithError(err).Errorf("Can't %s domain", policy.Fallback)
+		return
+	}
+	domainLog.Infof("Domain handled with %s in %s", policy.Fallback, time.Since(startedAt).Round(time.Second))
+}
+
+type shutdownResult int
+
+const (
+	shutdownCompleted shutdownResult = iota
+	shutdownTimedOut
+	// shutdownAborted means the guard was stopped while waiting, the fallback mustn't be applied then
+	shutdownAborted
+)
+
+// waitForShutdown waits until the domain stops, the deadline passes or the guard is stopped
+func (g *ShutdownGuard) waitForShutdown(
+	domain libvirt_watcher.MinimalLibvirtDomain, deadline time.Time,
+) shutdownResult {
+	for {
+		active, err := domain.IsActive()
+		if err == nil && !active {
+			return shutdownCompleted
+		}
+		if time.Now().Add(g.pollInterval).After(deadline) {
+			return shutdownTimedOut
+		}
+		select {
+		case <-time.After(g.pollInterval):
+		case <-g.done:
+			return shutdownAborted
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package power_guard
+
+import (
+	"context"
+	"fmt"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"libvirt_keepawake/internal/logging"
+	"libvirt_keepawake/internal/login1_inhibitor"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SleepAction is what is done with a running domain before the host goes to sleep
+type SleepAction string
+
+const (
+	// SleepActionSuspend pauses vCPUs, it's fast, but the guest clock jumps after wake up
+	SleepActionSuspend SleepAction = "suspend"
+	// SleepActionManagedSave saves guest memory to disk and stops the domain, it survives the host losing power
+	SleepActionManagedSave SleepAction = "managedsave"
+)
+
+var SleepActions = []SleepAction{SleepActionSuspend, SleepActionManagedSave}
+
+/*
+SleepGuard handles domains when the host goes to sleep anyway, e.g. inhibition is paused or no power manager
+honoured the inhibitor. It holds a logind delay lock, so on PrepareForSleep(true) it has time to suspend or
+managedsave running domains before releasing the lock. On PrepareForSleep(false) handled domains are resumed(or
+restored) and the lock is taken again.
+*/
+type SleepGuard struct {
+	login1  *login1_inhibitor.Login1Inhibitor
+	watcher *libvirt_watcher.LibvirtWatcher
+	action  SleepAction
+	// domains are names of domains to handle, all running domains are handled when it's empty
+	domains map[string]bool
+	done    chan struct{}
+	stopped sync.WaitGroup
+	// state below is accessed only from the guard goroutine after Start
+	lock        *os.File
+	handled     []libvirt_watcher.MinimalLibvirtDomain
+	unsubscribe func()
+}
+
+func NewSleepGuard(
+	login1 *login1_inhibitor.Login1Inhibitor,
+	watcher *libvirt_watcher.LibvirtWatcher,
+	action SleepAction,
+	domains []string,
+) *SleepGuard {
+	guard := &SleepGuard{
+		login1:  login1,
+		watcher: watcher,
+		action:  action,
+		domains: make(map[string]bool, len(domains)),
+		done:    make(chan struct{}),
+	}
+	for _, domain := range domains {
+		guard.domains[domain] = true
+	}
+	return guard
+}
+
+// Start takes the delay lock and starts listening for PrepareForSleep
+func (g *SleepGuard) Start() error {
+	starts, unsubscribe, err := g.login1.Watch(login1_inhibitor.SignalPrepareForSleep)
+	if err != nil {
+		return err
+	}
+	if err := g.takeLock(); err != nil {
+		unsubscribe()
+		return err
+	}
+	g.unsubscribe = unsubscribe
+	g.stopped.Add(1)
+	go g.run(starts)
+	return nil
+}
+
+// Stop releases the delay lock. Domains handled before sleep stay as they are if the host didn't wake up yet
+func (g *SleepGuard) Stop() {
+	close(g.done)
+	g.stopped.Wait()
+	g.unsubscribe()
+	g.releaseLock()
+}
+
+func (g *SleepGuard) run(starts <-chan bool) {
+	defer g.stopped.Done()
+	for {
+		select {
+		case start, ok := <-starts:
+			if !ok {
+				return
+			}
+			if start {
+				g.beforeSleep()
+			} else {
+				g.afterWakeUp()
+			}
+		case <-g.done:
+			return
+		}
+	}
+}
+
+func (g *SleepGuard) takeLock() error {
+	lock, err := g.login1.Inhibit(
+		context.Background(),
+		[]login1_inhibitor.What{login1_inhibitor.WhatSleep},
+		fmt.Sprintf("Running VMs need to be %s before sleep", describeAction(g.action)),
+		login1_inhibitor.ModeDelay,
+	)
+	if err != nil {
+		return fmt.Errorf("can't take logind sleep delay lock: %w", err)
+	}
+	g.lock = lock
+	return nil
+}
+
+func (g *SleepGuard) releaseLock() {
+	if g.lock == nil {
+		return
+	}
+	if err := g.lock.Close(); err != nil {
+		log.WithError(err).Error("Can't release logind sleep delay lock")
+	}
+	g.lock = nil
+}
+
+// beforeSleep handles all qualifying domains in parallel, sleep is delayed only until InhibitDelayMaxSec
+func (g *SleepGuard) beforeSleep() {
+	log.Infof("Host is going to sleep, %s running domains", g.action)
+	domains, err := g.watcher.GetActiveDomains(context.Background())
+	if err != nil {
+		log.WithError(err).Error("Can't list active domains before sleep")
+	}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, domain := range domains {
+		name, err := domain.GetName()
+		if err != nil || (len(g.domains) > 0 && !g.domains[name]) {
+			continue
+		}
+		wg.Add(1)
+		go func(domain libvirt_watcher.MinimalLibvirtDomain, domainLog *log.Entry) {
+			defer wg.Done()
+			var err error
+			if g.action == SleepActionManagedSave {
+				err = domain.ManagedSave()
+			} else {
+				err = domain.Suspend()
+			}
+			if err != nil {
+				domainLog.WithError(err).Errorf("Can't %s domain before sleep", g.action)
+				return
+			}
+			domainLog.Infof("Domain is %s before sleep", describeAction(g.action))
+			mutex.Lock()
+			g.handled = append(g.handled, domain)
+			mutex.Unlock()
+		}(domain, log.WithField(logging.FieldDomain, name))
+	}
+	wg.Wait()
+	g.releaseLock()
+}
+
+func (g *SleepGuard) afterWakeUp() {
+	log.Info("Host woke up, resuming domains")
+	for _, domain := range g.handled {
+		name, _ := domain.GetName()
+		domainLog := log.WithField(logging.FieldDomain, name)
+		var err error
+		if g.action == SleepActionManagedSave {
+			// starting a domain with a managed save image restores it
+			err = domain.Create()
+		} else {
+			err = domain.Resume()
+		}
+		if err != nil {
+			domainLog.WithError(err).Error("Can't resume domain after sleep")
+			continue
+		}
+		domainLog.Info("Domain resumed after sleep")
+	}
+	g.handled = nil
+	// the lock is still held when logind reports a wake-up without a sleep, e.g. when sleep was cancelled
+	if g.lock != nil {
+		return
+	}
+	if err := g.takeLock(); err != nil {
+		log.WithError(err).Error("Domains won't be handled on the next sleep")
+	}
+}
+
+func describeAction(action SleepAction) string {
+	if action == SleepActionManagedSave {
+		return "saved"
+	}
+	return "suspended"
+}
@@ -0,0 +1,112 @@
+package power_profiles
+
+// Fake power-profiles-daemon tracking profile holds. Intended for testing purposes only
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+type FakeHold struct {
+	Cookie        uint32
+	Profile       string
+	Reason        string
+	ApplicationID string
+}
+
+type FakePowerProfiles struct {
+	dbusConnection *dbus.Conn
+	mutex          sync.Mutex
+	holds          map[uint32]FakeHold
+	lastCookie     uint32
+	// unresponsive is closed when the service responds again, nil while it's responsive
+	unresponsive chan struct{}
+}
+
+func NewFakePowerProfiles(dbusConnection *dbus.Conn) *FakePowerProfiles {
+	return &FakePowerProfiles{dbusConnection: dbusConnection, holds: make(map[uint32]FakeHold)}
+}
+
+func (f *FakePowerProfiles) Start() error {
+	reply, err := f.dbusConnection.RequestName(Dest, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		log.Fatalf("Failed to request Name: %v on test dbus", err)
+	}
+	return f.dbusConnection.Export(f, Path, Interface)
+}
+
+func (f *FakePowerProfiles) Stop() {
+	f.SetUnresponsive(false)
+	if _, err := f.dbusConnection.ReleaseName(Dest); err != nil {
+		log.Warnf("Failed to release Name: %v on test dbus", err)
+	}
+	if err := f.dbusConnection.Close(); err != nil {
+		log.Warnf("Failed to close connection: %v on test dbus", err)
+	}
+}
+
+// HoldProfile handles HoldProfile DBUS calls, only performance and power-saver can be held
+func (f *FakePowerProfiles) HoldProfile(profile string, reason string, applicationID string) (uint32, *dbus.Error) {
+	f.waitUntilResponsive()
+	if profile != string(ProfilePerformance) && profile != string(ProfilePowerSaver) {
+		return 0, dbus.NewError("net.hadess.PowerProfiles.Error.InvalidArgs", []interface{}{"invalid profile"})
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.lastCookie++
+	f.holds[f.lastCookie] = FakeHold{
+		Cookie: f.lastCookie, Profile: profile, Reason: reason, ApplicationID: applicationID,
+	}
+	return f.lastCookie, nil
+}
+
+// ReleaseProfile handles ReleaseProfile DBUS calls
+func (f *FakePowerProfiles) ReleaseProfile(cookie uint32) *dbus.Error {
+	f.waitUntilResponsive()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, found := f.holds[cookie]; !found {
+		return dbus.NewError("net.hadess.PowerProfiles.Error.InvalidArgs", []interface{}{"no hold with this cookie"})
+	}
+	delete(f.holds, cookie)
+	return nil
+}
+
+/*
+SetUnresponsive makes calls hang until the service is made responsive again, like a wedged daemon. Calls which hang
+when the service becomes responsive are handled as usual.
+*/
+func (f *FakePowerProfiles) SetUnresponsive(unresponsive bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if unresponsive && f.unresponsive == nil {
+		f.unresponsive = make(chan struct{})
+	} else if !unresponsive && f.unresponsive != nil {
+		close(f.unresponsive)
+		f.unresponsive = nil
+	}
+}
+
+func (f *FakePowerProfiles) waitUntilResponsive() {
+	f.mutex.Lock()
+	unresponsive := f.unresponsive
+	f.mutex.Unlock()
+	if unresponsive != nil {
+		<-unresponsive
+	}
+}
+
+// Holds returns active holds sorted by cookie
+func (f *FakePowerProfiles) Holds() []FakeHold {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	holds := make([]FakeHold, 0, len(f.holds))
+	for _, hold := range f.holds {
+		holds = append(holds, hold)
+	}
+	sort.Slice(holds, func(i, j int) bool { return holds[i].Cookie < holds[j].Cookie })
+	return holds
+}
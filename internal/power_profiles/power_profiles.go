@@ -0,0 +1,103 @@
+package power_profiles
+
+// Client of power-profiles-daemon, which switches the host between power-saver, balanced and performance profiles.
+// Holding a profile switches to it until all holds are released or their owners disconnect from the bus
+
+import (
+	"context"
+	"fmt"
+	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/logging"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const Dest = "net.hadess.PowerProfiles"
+const Path dbus.ObjectPath = "/net/hadess/PowerProfiles"
+const Interface = "net.hadess.PowerProfiles"
+
+type Profile string
+
+const (
+	ProfilePowerSaver  Profile = "power-saver"
+	ProfileBalanced    Profile = "balanced"
+	ProfilePerformance Profile = "performance"
+)
+
+// HoldableProfiles are profiles power-profiles-daemon accepts in HoldProfile, balanced is what it falls back to
+var HoldableProfiles = []Profile{ProfilePowerSaver, ProfilePerformance}
+
+// ApplicationID is shown as the holder of the profile, e.g. in `powerprofilesctl`
+const ApplicationID = "libvirt-keepawake"
+
+/*
+ProfileHolder is an internal.DomainLock holding a power profile for running domains, e.g. performance for gaming in
+a passthrough VM. Every domain has its own hold, the profile is switched back when the last one is released.
+*/
+type ProfileHolder struct {
+	dbusConnection *dbus.Conn
+	profile        Profile
+	// domains are names of domains to hold the profile for, all running domains when it's empty
+	domains map[internal.InhibitorName]bool
+	// callTimeout limits every D-Bus call in addition to the context passed by the caller
+	callTimeout time.Duration
+}
+
+// NewProfileHolder creates a holder using a connection to the system bus
+func NewProfileHolder(
+	dbusConnection *dbus.Conn, profile Profile, domains []string, callTimeout time.Duration,
+) *ProfileHolder {
+	holder := &ProfileHolder{
+		dbusConnection: dbusConnection,
+		profile:        profile,
+		domains:        make(map[internal.InhibitorName]bool, len(domains)),
+		callTimeout:    callTimeout,
+	}
+	for _, domain := range domains {
+		holder.domains[internal.InhibitorName(domain)] = true
+	}
+	return holder
+}
+
+func (h *ProfileHolder) Name() string {
+	return "power-profile"
+}
+
+func (h *ProfileHolder) Applies(domain internal.InhibitorName) bool {
+	return len(h.domains) == 0 || h.domains[domain]
+}
+
+func (h *ProfileHolder) Acquire(ctx context.Context, domain internal.InhibitorName) (internal.DomainLockHold, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.callTimeout)
+	defer cancel()
+	var cookie uint32
+	err := h.dbusConnection.Object(Dest, Path).CallWithContext(
+		ctx, Interface+".HoldProfile", 0, string(h.profile), fmt.Sprintf("VM %s is running", domain), ApplicationID,
+	).Store(&cookie)
+	if err != nil {
+		return nil, fmt.Errorf("can't hold %s power profile: %w", h.profile, err)
+	}
+	log.WithFields(log.Fields{
+		logging.FieldDomain:  domain,
+		logging.FieldCookie:  cookie,
+		logging.FieldBackend: Dest,
+	}).Debugf("Holding %s power profile", h.profile)
+	return profileHold{holder: h, cookie: cookie}, nil
+}
+
+type profileHold struct {
+	holder *ProfileHolder
+	cookie uint32
+}
+
+func (p profileHold) Release(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.holder.callTimeout)
+	defer cancel()
+	err := p.holder.dbusConnection.Object(Dest, Path).CallWithContext(ctx, Interface+".ReleaseProfile", 0, p.cookie).Err
+	if err != nil {
+		return fmt.Errorf("can't release %s power profile: %w", p.holder.profile, err)
+	}
+	return nil
+}
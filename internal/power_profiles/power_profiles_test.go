@@ -0,0 +1,143 @@
+package power_profiles
+
+import (
+	"context"
+	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/dbus_inhibitor"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/suite"
+)
+
+type PowerProfilesSuite struct {
+	suite.Suite
+	dbusProcess       *os.Process
+	fakePowerProfiles *FakePowerProfiles
+	clientConn        *dbus.Conn
+}
+
+func (s *PowerProfilesSuite) SetupTest() {
+	dbusSocketPath, dbusProcess, err := dbus_inhibitor.RunDbusServer()
+	if err != nil {
+		s.T().Fatalf("Can't start dbus server. Err %s", err)
+	}
+	s.dbusProcess = dbusProcess
+	serviceConn, err := dbus.Connect(dbusSocketPath)
+	s.Require().NoError(err)
+	s.fakePowerProfiles = NewFakePowerProfiles(serviceConn)
+	s.Require().NoError(s.fakePowerProfiles.Start())
+	s.clientConn, err = dbus.Connect(dbusSocketPath)
+	s.Require().NoError(err)
+}
+
+func (s *PowerProfilesSuite) TearDownTest() {
+	s.fakePowerProfiles.Stop()
+	if err := s.dbusProcess.Kill(); err != nil {
+		s.T().Fatalf("Can't kill dbus server with PID %d. Err %s", s.dbusProcess.Pid, err)
+	}
+}
+
+func (s *PowerProfilesSuite) TestHoldAndRelease() {
+	holder := NewProfileHolder(s.clientConn, ProfilePerformance, []string{"win11"}, dbus_inhibitor.DefaultCallTimeout)
+	s.Assert().True(holder.Applies("win11"))
+	s.Assert().False(holder.Applies("linux"))
+
+	hold, err := holder.Acquire(context.Background(), "win11")
+
+	s.Require().NoError(err)
+	s.Assert().Equal(
+		[]FakeHold{{Cookie: 1, Profile: "performance", Reason: "VM win11 is running", ApplicationID: ApplicationID}},
+		s.fakePowerProfiles.Holds(),
+	)
+	s.Require().NoError(hold.Release(context.Background()))
+	s.Assert().Empty(s.fakePowerProfiles.Holds())
+	// releasing twice fails, the daemon doesn't know the cookie anymore
+	s.Assert().Error(hold.Release(context.Background()))
+}
+
+func (s *PowerProfilesSuite) TestHoldInvalidProfile() {
+	holder := NewProfileHolder(s.clientConn, ProfileBalanced, nil, dbus_inhibitor.DefaultCallTimeout)
+	_, err := holder.Acquire(context.Background(), "win11")
+
+	s.Assert().Error(err)
+}
+
+// TestUnresponsiveDaemon tests that calls give up after the timeout or when the context is cancelled
+func (s *PowerProfilesSuite) TestUnresponsiveDaemon() {
+	holder := NewProfileHolder(s.clientConn, ProfilePerformance, nil, 100*time.Millisecond)
+	hold, err := holder.Acquire(context.Background(), "win11")
+	s.Require().NoError(err)
+	s.fakePowerProfiles.SetUnresponsive(true)
+	defer s.fakePowerProfiles.SetUnresponsive(false)
+
+	startedAt := time.Now()
+	_, err = holder.Acquire(context.Background(), "linux")
+	s.Assert().ErrorIs(err, context.DeadlineExceeded)
+	s.Assert().ErrorIs(hold.Release(context.Background()), context.DeadlineExceeded)
+	s.Assert().Less(time.Since(startedAt), time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Assert().ErrorIs(hold.Release(ctx), context.Canceled)
+}
+
+// TestOrchestratorHoldsProfile tests that the profile is held while the domain is running
+func (s *PowerProfilesSuite) TestOrchestratorHoldsProfile() {
+	libvirtConnect := new(libvirt_watcher.FakeLibvirtConnect)
+	orchestrator := internal.NewOrchestrator(
+		dbus_inhibitor.NewNoopSleepInhibitor(),
+		time.NewTicker(50*time.Millisecond),
+		libvirt_watcher.NewLibvirtWatcher(libvirtConnect),
+	)
+	orchestrator.AddDomainLock(
+		NewProfileHolder(s.clientConn, ProfilePerformance, nil, dbus_inhibitor.DefaultCallTimeout),
+	)
+	orchestrator.Start()
+	defer orchestrator.Stop()
+
+	libvirtConnect.UpdateActiveDomains([]libvirt_watcher.MinimalLibvirtDomain{
+		libvirt_watcher.FakeLibvirtDomain{Name: "win11"}, libvirt_watcher.FakeLibvirtDomain{Name: "linux"},
+	})
+	s.Assert().Eventually(func() bool {
+		return len(s.fakePowerProfiles.Holds()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	libvirtConnect.UpdateActiveDomains(nil)
+	s.Assert().Eventually(func() bool {
+		return len(s.fakePowerProfiles.Holds()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestStopWithUnresponsiveDaemon tests that Stop gives up releasing holds after the shutdown timeout
+func (s *PowerProfilesSuite) TestStopWithUnresponsiveDaemon() {
+	libvirtConnect := new(libvirt_watcher.FakeLibvirtConnect)
+	orchestrator := internal.NewOrchestrator(
+		dbus_inhibitor.NewNoopSleepInhibitor(),
+		time.NewTicker(50*time.Millisecond),
+		libvirt_watcher.NewLibvirtWatcher(libvirtConnect),
+	)
+	orchestrator.AddDomainLock(NewProfileHolder(s.clientConn, ProfilePerformance, nil, time.Minute))
+	orchestrator.SetShutdownTimeout(200 * time.Millisecond)
+	orchestrator.Start()
+	libvirtConnect.UpdateActiveDomains([]libvirt_watcher.MinimalLibvirtDomain{
+		libvirt_watcher.FakeLibvirtDomain{Name: "win11"},
+	})
+	s.Require().Eventually(func() bool {
+		return len(s.fakePowerProfiles.Holds()) == 1
+	}, time.Second, 10*time.Millisecond)
+	s.fakePowerProfiles.SetUnresponsive(true)
+	defer s.fakePowerProfiles.SetUnresponsive(false)
+
+	startedAt := time.Now()
+	orchestrator.Stop()
+
+	s.Assert().Less(time.Since(startedAt), time.Second)
+}
+
+func TestRunPowerProfilesSuite(t *testing.T) {
+	suite.Run(t, new(PowerProfilesSuite))
+}
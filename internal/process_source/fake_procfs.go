@@ -0,0 +1,73 @@
+package process_source
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FakeProcess is a process in FakeProcfs
+type FakeProcess struct {
+	PID       int
+	StartTime uint64
+	// Exe is the target of the exe link, no link if it's empty
+	Exe    string
+	Argv   []string
+	Cgroup string
+	UID    uint32
+}
+
+/*
+FakeProcfs is a procfs-like directory tree with the files ProcessSource reads.
+Intended for testing purposes only.
+*/
+type FakeProcfs struct {
+	Root string
+}
+
+func NewFakeProcfs(root string) *FakeProcfs {
+	return &FakeProcfs{Root: root}
+}
+
+func (f *FakeProcfs) AddProcess(process FakeProcess) error {
+	dir := filepath.Join(f.Root, strconv.Itoa(process.PID))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if process.Exe != "" {
+		if err := os.Symlink(process.Exe, filepath.Join(dir, "exe")); err != nil {
+			return err
+		}
+	}
+	var cmdline strings.Builder
+	for _, arg := range process.Argv {
+		cmdline.WriteString(arg + "\x00")
+	}
+	command := "kthread"
+	if len(process.Argv) > 0 {
+		command = filepath.Base(process.Argv[0])
+	}
+	// fields after the command up to starttime(field 22)
+	stat := fmt.Sprintf("%d (%s) S 1 %d %d 0 -1 4194560 100 0 0 0 5 2 0 0 20 0 1 0 %d 1000000 100\n",
+		process.PID, command, process.PID, process.PID, process.StartTime)
+	status := fmt.Sprintf("Name:\t%s\nState:\tS (sleeping)\nUid:\t%d\t%d\t%d\t%d\n",
+		command, process.UID, process.UID, process.UID, process.UID)
+	files := map[string]string{
+		"cmdline": cmdline.String(),
+		"stat":    stat,
+		"status":  status,
+		"cgroup":  "0::" + process.Cgroup + "\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FakeProcfs) RemoveProcess(pid int) error {
+	return os.RemoveAll(filepath.Join(f.Root, strconv.Itoa(pid)))
+}
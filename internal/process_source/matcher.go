@@ -0,0 +1,93 @@
+package process_source
+
+import (
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matcher selects processes, a process matches when all set conditions match
+type Matcher struct {
+	Name string
+	// Exe is a glob of the executable path, e.g. /usr/bin/qemu-system-*
+	Exe string
+	// Argv is matched against arguments joined with spaces
+	Argv *regexp.Regexp
+	// Cgroup is a cgroup v2 path the process is in or under, e.g. /system.slice/backup.service
+	Cgroup string
+	// UID is the real user ID, nil matches any user
+	UID *uint32
+}
+
+/*
+ParseMatcher parses matcher in NAME:KEY=VALUE[;KEY=VALUE...] form with keys exe, argv, cgroup and user, e.g.
+qemu:exe=/usr/bin/qemu-system-* or backup:argv=^(dd|rsync) ;user=backup. User is a name or a numeric ID.
+*/
+func ParseMatcher(spec string) (Matcher, error) {
+	name, conditions, found := strings.Cut(spec, ":")
+	if !found || name == "" || conditions == "" {
+		return Matcher{}, fmt.Errorf("matcher %q isn't in NAME:KEY=VALUE[;KEY=VALUE...] form", spec)
+	}
+	if strings.Contains(name, "/") {
+		return Matcher{}, fmt.Errorf("matcher name %q can't contain /", name)
+	}
+	matcher := Matcher{Name: name}
+	for _, condition := range strings.Split(conditions, ";") {
+		key, value, found := strings.Cut(condition, "=")
+		if !found || value == "" {
+			return Matcher{}, fmt.Errorf("condition %q of matcher %q isn't in KEY=VALUE form", condition, name)
+		}
+		var err error
+		switch key {
+		case "exe":
+			if _, err = filepath.Match(value, ""); err != nil {
+				err = fmt.Errorf("invalid exe glob: %w", err)
+			}
+			matcher.Exe = value
+		case "argv":
+			matcher.Argv, err = regexp.Compile(value)
+		case "cgroup":
+			matcher.Cgroup = strings.TrimSuffix(value, "/")
+		case "user":
+			var uid uint32
+			uid, err = lookupUID(value)
+			matcher.UID = &uid
+		default:
+			err = fmt.Errorf("unknown key %q, expected exe, argv, cgroup or user", key)
+		}
+		if err != nil {
+			return Matcher{}, fmt.Errorf("invalid matcher %q: %w", spec, err)
+		}
+	}
+	return matcher, nil
+}
+
+func lookupUID(nameOrID string) (uint32, error) {
+	if uid, err := strconv.ParseUint(nameOrID, 10, 32); err == nil {
+		return uint32(uid), nil
+	}
+	found, err := user.Lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	uid, err := strconv.ParseUint(found.Uid, 10, 32)
+	return uint32(uid), err
+}
+
+func (m Matcher) Matches(process Process) bool {
+	if m.Exe != "" {
+		if matched, _ := filepath.Match(m.Exe, process.Exe); !matched {
+			return false
+		}
+	}
+	if m.Argv != nil && !m.Argv.MatchString(strings.Join(process.Argv, " ")) {
+		return false
+	}
+	if m.Cgroup != "" && process.Cgroup != m.Cgroup && !strings.HasPrefix(process.Cgroup, m.Cgroup+"/") {
+		return false
+	}
+	return m.UID == nil || *m.UID == process.UID
+}
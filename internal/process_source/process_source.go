@@ -0,0 +1,212 @@
+package process_source
+
+// Activity source of processes started outside libvirt, e.g. QEMU run by hand or long dd and rsync jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"libvirt_keepawake/internal/activity_source"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// SourceName qualifies inhibitors of processes, e.g. "processes/qemu-4242"
+const SourceName = "processes"
+
+// DefaultScanInterval is how often procfs is scanned for new and exited processes
+const DefaultScanInterval = 5 * time.Second
+
+// maxReasonCommandLength shortens long command lines in reasons
+const maxReasonCommandLength = 80
+
+/*
+ProcessSource is an activity_source.ActivitySource of processes matching any of the matchers, the first matching
+matcher names the activity. Once started, it scans procfs periodically and notifies when matching processes change.
+With the real procfs it also holds a pidfd of every matching process, so exits are noticed right away.
+*/
+type ProcessSource struct {
+	procRoot     string
+	matchers     []Matcher
+	scanInterval time.Duration
+	selfPID      int
+	events       chan struct{}
+	// stopFds are the ends of a pipe, closing the write end wakes the scan loop up to stop
+	stopFds [2]int
+	stopped sync.WaitGroup
+	// state below is accessed only from the scan goroutine after Start
+	seen   map[string]bool
+	pidfds map[int]int
+}
+
+func NewProcessSource(procRoot string, matchers []Matcher, scanInterval time.Duration) *ProcessSource {
+	source := &ProcessSource{
+		procRoot:     procRoot,
+		matchers:     matchers,
+		scanInterval: scanInterval,
+		events:       make(chan struct{}, 1),
+		seen:         make(map[string]bool),
+		pidfds:       make(map[int]int),
+	}
+	// the daemon's own command line could match argv matchers
+	if procRoot == DefaultProcRoot {
+		source.selfPID = os.Getpid()
+	}
+	return source
+}
+
+func (p *ProcessSource) Name() string {
+	return SourceName
+}
+
+func (p *ProcessSource) Events() <-chan struct{} {
+	return p.events
+}
+
+/*
+Activities lists matching processes. Activity ID is "<matcher>-<pid>", UUID includes the start time of the process, so
+a reused PID isn't mistaken for the process an inhibitor was taken for.
+*/
+func (p *ProcessSource) Activities(_ context.Context) ([]activity_source.Activity, error) {
+	activities, _, err := p.scan()
+	return activities, err
+}
+
+func (p *ProcessSource) scan() ([]activity_source.Activity, []Process, error) {
+	processes, err := ListProcesses(p.procRoot)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't list processes: %w", err)
+	}
+	var activities []activity_source.Activity
+	var matched []Process
+	for _, process := range processes {
+		if process.PID == p.selfPID {
+			continue
+		}
+		for _, matcher := range p.matchers {
+			if !matcher.Matches(process) {
+				continue
+			}
+			command := strings.Join(process.Argv, " ")
+			if len(command) > maxReasonCommandLength {
+				command = command[:maxReasonCommandLength] + "…"
+			}
+			activities = append(activities, activity_source.Activity{
+				ID:     fmt.Sprintf("%s-%d", matcher.Name, process.PID),
+				Label:  fmt.Sprintf("%s(%d)", filepath.Base(process.Exe), process.PID),
+				Reason: fmt.Sprintf("process %q matches %s", command, matcher.Name),
+				UUID:   fmt.Sprintf("%d-%d", process.PID, process.StartTime),
+			})
+			matched = append(matched, process)
+			break
+		}
+	}
+	return activities, matched, nil
+}
+
+// Start starts scanning for process changes
+func (p *ProcessSource) Start() error {
+	if err := unix.Pipe2(p.stopFds[:], unix.O_CLOEXEC); err != nil {
+		return fmt.Errorf("can't create stop pipe: %w", err)
+	}
+	p.stopped.Add(1)
+	go p.run()
+	return nil
+}
+
+func (p *ProcessSource) Stop() {
+	_ = unix.Close(p.stopFds[1])
+	p.stopped.Wait()
+	_ = unix.Close(p.stopFds[0])
+}
+
+func (p *ProcessSource) run() {
+	defer p.stopped.Done()
+	defer p.closePidfds(nil)
+	for {
+		p.checkChanges()
+		if p.wait() {
+			return
+		}
+	}
+}
+
+// checkChanges notifies if matching processes changed since the last scan and watches new processes with pidfds
+func (p *ProcessSource) checkChanges() {
+	activities, processes, err := p.scan()
+	if err != nil {
+		log.WithError(err).Warn("Can't scan processes")
+		return
+	}
+	current := make(map[string]bool, len(activities))
+	for _, activity := range activities {
+		current[activity.UUID] = true
+	}
+	changed := len(current) != len(p.seen)
+	for uuid := range current {
+		changed = changed || !p.seen[uuid]
+	}
+	p.seen = current
+	if changed {
+		log.WithField("processes", len(activities)).Debug("Matching processes changed")
+		p.notify()
+	}
+
+	if p.procRoot != DefaultProcRoot {
+		// PIDs of another procfs root don't belong to this PID namespace
+		return
+	}
+	alive := make(map[int]bool, len(processes))
+	for _, process := range processes {
+		alive[process.PID] = true
+		if _, found := p.pidfds[process.PID]; found {
+			continue
+		}
+		pidfd, err := unix.PidfdOpen(process.PID, 0)
+		if err != nil {
+			// kernels before 5.3 don't have pidfd, periodic scans notice exits as well
+			log.WithField("pid", process.PID).WithError(err).Debug("Can't open pidfd")
+			continue
+		}
+		p.pidfds[process.PID] = pidfd
+	}
+	p.closePidfds(alive)
+}
+
+// closePidfds closes pidfds of processes which aren't alive, all of them if alive is nil
+func (p *ProcessSource) closePidfds(alive map[int]bool) {
+	for pid, pidfd := range p.pidfds {
+		if !alive[pid] {
+			_ = unix.Close(pidfd)
+			delete(p.pidfds, pid)
+		}
+	}
+}
+
+// wait waits for the next scan, an exit of a watched process or stop, returns true on stop
+func (p *ProcessSource) wait() bool {
+	fds := []unix.PollFd{{Fd: int32(p.stopFds[0]), Events: unix.POLLIN}}
+	for _, pidfd := range p.pidfds {
+		fds = append(fds, unix.PollFd{Fd: int32(pidfd), Events: unix.POLLIN})
+	}
+	_, err := unix.Poll(fds, int(p.scanInterval.Milliseconds()))
+	if err != nil && !errors.Is(err, unix.EINTR) {
+		log.WithError(err).Warn("Can't wait for process exits, falling back to periodic scans")
+		fds = fds[:1]
+		_, _ = unix.Poll(fds, int(p.scanInterval.Milliseconds()))
+	}
+	return fds[0].Revents != 0
+}
+
+func (p *ProcessSource) notify() {
+	select {
+	case p.events <- struct{}{}:
+	default: // check is already scheduled
+	}
+}
@@ -0,0 +1,185 @@
+package process_source
+
+import (
+	"context"
+	"fmt"
+	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/activity_source"
+	"libvirt_keepawake/internal/dbus_inhibitor"
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ProcessSourceSuite struct {
+	suite.Suite
+	procfs *FakeProcfs
+}
+
+func (s *ProcessSourceSuite) SetupTest() {
+	s.procfs = NewFakeProcfs(s.T().TempDir())
+	for _, process := range []FakeProcess{
+		{
+			PID: 100, StartTime: 5000, Exe: "/usr/bin/qemu-system-x86_64",
+			Argv:   []string{"qemu-system-x86_64", "-m", "4G", "-hda", "test.qcow2"},
+			Cgroup: "/user.slice/user-1000.slice/session-2.scope", UID: 1000,
+		},
+		{
+			PID: 200, StartTime: 6000, Exe: "/usr/bin/rsync (deleted)",
+			Argv: []string{"rsync", "-a", "/home", "/mnt/backup"}, Cgroup: "/system.slice/backup.service", UID: 0,
+		},
+		{
+			PID: 300, StartTime: 7000, Exe: "/usr/bin/bash",
+			Argv: []string{"bash"}, Cgroup: "/user.slice/user-1000.slice/session-2.scope", UID: 1000,
+		},
+		// kernel thread
+		{PID: 2, StartTime: 1},
+	} {
+		s.Require().NoError(s.procfs.AddProcess(process))
+	}
+}
+
+func (s *ProcessSourceSuite) parseMatchers(specs ...string) []Matcher {
+	var matchers []Matcher
+	for _, spec := range specs {
+		matcher, err := ParseMatcher(spec)
+		s.Require().NoError(err)
+		matchers = append(matchers, matcher)
+	}
+	return matchers
+}
+
+func (s *ProcessSourceSuite) TestParseMatcher() {
+	matcher, err := ParseMatcher("backup:argv=^(dd|rsync) ;user=0;cgroup=/system.slice/")
+	s.Require().NoError(err)
+	s.Assert().Equal("backup", matcher.Name)
+	s.Assert().Equal("^(dd|rsync) ", matcher.Argv.String())
+	s.Assert().Equal("/system.slice", matcher.Cgroup)
+	s.Require().NotNil(matcher.UID)
+	s.Assert().Equal(uint32(0), *matcher.UID)
+
+	for _, spec := range []string{
+		"qemu", "qemu:", ":exe=/usr/bin/qemu", "a/b:exe=/usr/bin/qemu", "qemu:exe", "qemu:path=/usr/bin/qemu",
+		"qemu:argv=(", "qemu:exe=[", "qemu:user=no-such-user-keepawake",
+	} {
+		_, err := ParseMatcher(spec)
+		s.Assert().Error(err, spec)
+	}
+}
+
+func (s *ProcessSourceSuite) TestActivities() {
+	source := NewProcessSource(s.procfs.Root, s.parseMatchers(
+		"qemu:exe=/usr/bin/qemu-system-*",
+		"backup:argv=^(dd|rsync) ;cgroup=/system.slice",
+		"shells:user=1000",
+	), time.Hour)
+
+	activities, err := source.Activities(context.Background())
+
+	s.Require().NoError(err)
+	s.Assert().Equal([]activity_source.Activity{
+		{
+			ID: "qemu-100", Label: "qemu-system-x86_64(100)", UUID: "100-5000",
+			Reason: `process "qemu-system-x86_64 -m 4G -hda test.qcow2" matches qemu`,
+		},
+		{
+			ID: "backup-200", Label: "rsync(200)", UUID: "200-6000",
+			Reason: `process "rsync -a /home /mnt/backup" matches backup`,
+		},
+		{ID: "shells-300", Label: "bash(300)", UUID: "300-7000", Reason: `process "bash" matches shells`},
+	}, activities)
+}
+
+func (s *ProcessSourceSuite) TestNoMatches() {
+	source := NewProcessSource(s.procfs.Root, s.parseMatchers(
+		"dd:exe=/usr/bin/dd", "backup:argv=^rsync;user=1000", "backup:argv=^rsync;cgroup=/system.slice/backup",
+	), time.Hour)
+
+	activities, err := source.Activities(context.Background())
+
+	s.Require().NoError(err)
+	s.Assert().Empty(activities)
+}
+
+// TestScanEvents tests that started and exited processes are noticed by periodic scans
+func (s *ProcessSourceSuite) TestScanEvents() {
+	source := NewProcessSource(s.procfs.Root, s.parseMatchers("dd:exe=/usr/bin/dd"), 10*time.Millisecond)
+	s.Require().NoError(source.Start())
+	defer source.Stop()
+
+	s.Require().NoError(s.procfs.AddProcess(FakeProcess{
+		PID: 400, StartTime: 8000, Exe: "/usr/bin/dd", Argv: []string{"dd", "if=/dev/zero", "of=/dev/sdb"},
+	}))
+	s.receiveEvent(source, "dd start")
+
+	s.Require().NoError(s.procfs.RemoveProcess(400))
+	s.receiveEvent(source, "dd exit")
+}
+
+// TestPidfdExit tests that an exit of a real process is noticed without waiting for the next scan
+func (s *ProcessSourceSuite) TestPidfdExit() {
+	marker := fmt.Sprintf("keepawake-test-%d", time.Now().UnixNano())
+	// read is a shell builtin, so there are no child processes and the marker is $0 in the command line
+	command := exec.Command("sh", "-c", "read line", marker)
+	stdin, err := command.StdinPipe()
+	s.Require().NoError(err)
+	defer stdin.Close()
+	s.Require().NoError(command.Start())
+	exited := make(chan struct{})
+	go func() {
+		_ = command.Wait()
+		close(exited)
+	}()
+	defer func() {
+		_ = command.Process.Kill()
+		<-exited
+	}()
+	source := NewProcessSource(DefaultProcRoot, s.parseMatchers("test:argv="+marker), time.Hour)
+	s.Require().NoError(source.Start())
+	defer source.Stop()
+	s.receiveEvent(source, "initial scan")
+	activities, err := source.Activities(context.Background())
+	s.Require().NoError(err)
+	s.Require().Len(activities, 1)
+
+	s.Require().NoError(command.Process.Kill())
+
+	s.receiveEvent(source, "process exit")
+}
+
+// TestOrchestrator tests that matching processes inhibit sleep with source qualified names
+func (s *ProcessSourceSuite) TestOrchestrator() {
+	source := NewProcessSource(s.procfs.Root, s.parseMatchers("qemu:exe=/usr/bin/qemu-system-*"), 10*time.Millisecond)
+	s.Require().NoError(source.Start())
+	defer source.Stop()
+	sleepInhibitor := dbus_inhibitor.NewNoopSleepInhibitor()
+	orchestrator := internal.NewOrchestrator(sleepInhibitor, time.NewTicker(time.Hour), source)
+	orchestrator.Start()
+	defer orchestrator.Stop()
+
+	s.Assert().Eventually(func() bool {
+		inhibitors, _ := sleepInhibitor.GetInhibitors(context.Background())
+		return slices.Equal([]string{internal.InhibitorAppNamePrefix + "processes/qemu-100"}, inhibitors)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	s.Require().NoError(s.procfs.RemoveProcess(100))
+	s.Assert().Eventually(func() bool {
+		inhibitors, _ := sleepInhibitor.GetInhibitors(context.Background())
+		return len(inhibitors) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func (s *ProcessSourceSuite) receiveEvent(source *ProcessSource, what string) {
+	select {
+	case <-source.Events():
+	case <-time.After(2 * time.Second):
+		s.Fail("no event after " + what)
+	}
+}
+
+func TestRunProcessSourceSuite(t *testing.T) {
+	suite.Run(t, new(ProcessSourceSuite))
+}
@@ -0,0 +1,151 @@
+package process_source
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultProcRoot is where procfs is mounted
+const DefaultProcRoot = "/proc"
+
+// Process is the part of /proc/PID matchers look at
+type Process struct {
+	PID int
+	// StartTime is in clock ticks after boot, together with PID it identifies the process
+	StartTime uint64
+	// Exe is the executable path, argv[0] if the exe link can't be read(other users' processes without root)
+	Exe    string
+	Argv   []string
+	Cgroup string
+	UID    uint32
+}
+
+/*
+ListProcesses reads all user space processes from procRoot. Processes which can't be read, e.g. because they exited
+meanwhile, are skipped, kernel threads are skipped as they have no command line.
+*/
+func ListProcesses(procRoot string) ([]Process, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	var processes []Process
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		process, err := ReadProcess(procRoot, pid)
+		if errors.Is(err, errKernelThread) {
+			continue
+		}
+		if err != nil {
+			// most likely the process exited while being read
+			log.WithField("pid", pid).WithError(err).Debug("Can't read process")
+			continue
+		}
+		processes = append(processes, process)
+	}
+	return processes, nil
+}
+
+var errKernelThread = errors.New("kernel thread")
+
+func ReadProcess(procRoot string, pid int) (Process, error) {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	process := Process{PID: pid}
+
+	cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline"))
+	if err != nil {
+		return Process{}, err
+	}
+	if len(cmdline) == 0 {
+		return Process{}, errKernelThread
+	}
+	process.Argv = strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+
+	exe, err := os.Readlink(filepath.Join(dir, "exe"))
+	if err == nil {
+		// the binary was replaced, e.g. by a package upgrade
+		process.Exe = strings.TrimSuffix(exe, " (deleted)")
+	} else {
+		process.Exe = process.Argv[0]
+	}
+
+	if process.StartTime, err = readStartTime(filepath.Join(dir, "stat")); err != nil {
+		return Process{}, err
+	}
+	if process.UID, err = readUID(filepath.Join(dir, "status")); err != nil {
+		return Process{}, err
+	}
+	if process.Cgroup, err = readCgroup(filepath.Join(dir, "cgroup")); err != nil {
+		return Process{}, err
+	}
+	return process, nil
+}
+
+// readStartTime reads field 22 of stat, fields are counted after the command which can contain spaces and parentheses
+func readStartTime(path string) (uint64, error) {
+	stat, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	commandEnd := bytes.LastIndexByte(stat, ')')
+	if commandEnd < 0 {
+		return 0, fmt.Errorf("invalid %s", path)
+	}
+	// the first field after the command is field 3(state)
+	fields := strings.Fields(string(stat[commandEnd+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("invalid %s", path)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// readUID reads the real user ID from status
+func readUID(path string) (uint32, error) {
+	status, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer status.Close()
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), "Uid:")
+		if !found {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			break
+		}
+		uid, err := strconv.ParseUint(fields[0], 10, 32)
+		return uint32(uid), err
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no Uid in %s", path)
+}
+
+// readCgroup reads the cgroup v2 path, on hybrid hierarchies it's the "0::" line
+func readCgroup(path string) (string, error) {
+	cgroups, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(cgroups), "\n") {
+		if cgroup, found := strings.CutPrefix(line, "0::"); found {
+			return cgroup, nil
+		}
+	}
+	return "", nil
+}
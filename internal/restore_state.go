@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"libvirt_keepawake/internal/dbus_inhibitor"
+	"libvirt_keepawake/internal/logging"
+	"libvirt_keepawake/internal/state"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RestoreReport describes what was recovered from the state journal at startup
+type RestoreReport struct {
+	// Corrupted is true when the journal was corrupted and was ignored
+	Corrupted bool
+	// PausedUntil is the restored pause end, zero if inhibition isn't paused
+	PausedUntil time.Time
+	// DisabledDomains are restored domains user disabled inhibition for
+	DisabledDomains []InhibitorName
+	// ListingSupported is false when the power manager can't list inhibitors
+	ListingSupported bool
+	// Adopted inhibitors belong to still running domains and are kept
+	Adopted []InhibitorName
+	// Released inhibitors belonged to stopped domains and were uninhibited
+	Released []InhibitorName
+	// Vanished inhibitors were in the journal, but the power manager doesn't have them anymore
+	Vanished []InhibitorName
+	// OtherBackend inhibitors were created by another backend and can't be released by the current one, they're kept
+	// in the journal
+	OtherBackend []InhibitorName
+	// Unknown inhibitors have our prefix, but aren't in the journal, so they can't be released without a cookie
+	Unknown []string
+	// Failed inhibitors couldn't be released, they're kept in the journal to be released by the next restart
+	Failed []InhibitorName
+}
+
+/*
+RestoreState recovers the state saved by a previous instance before the main loop starts. Pause and disabled
+domains are restored as they were. Inhibitors left behind(e.g. if the daemon was killed with SIGKILL) are reconciled
+using cookies from the journal: inhibitors of domains which are still running(same name and UUID) are adopted,
+others are released. Should be called before Start.
+
+When the power manager doesn't support GetInhibitors, it's impossible to tell if the cookies are still valid, so all
+of them are released and inhibitors for running domains will be created again by the main loop.
+*/
+func (o *Orchestrator) RestoreState(ctx context.Context) RestoreReport {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	report := RestoreReport{ListingSupported: true}
+	o.leftoverInhibitors = nil
+	if o.journal == nil {
+		return report
+	}
+	savedState, err := o.journal.Load()
+	if errors.Is(err, state.ErrCorrupted) {
+		log.WithError(err).Warn("State journal is corrupted, starting with an empty state")
+		report.Corrupted = true
+	} else if err != nil {
+		log.WithError(err).Error("Can't load state journal, stale inhibitors won't be released")
+	}
+
+	for _, domain := range savedState.DisabledDomains {
+		o.disabledDomains[InhibitorName(domain)] = true
+		report.DisabledDomains = append(report.DisabledDomains, InhibitorName(domain))
+	}
+	if savedState.PausedUntil.After(time.Now()) {
+		o.pausedUntil = savedState.PausedUntil
+		report.PausedUntil = savedState.PausedUntil
+		log.Infof("Restored pause until %s", o.pausedUntil.Format(time.DateTime))
+	}
+
+	listedAppNames := make(map[string]bool)
+	inhibitors, err := o.sleepInhibitor.GetInhibitors(ctx)
+	if errors.Is(err, dbus_inhibitor.ErrListingNotSupported) {
+		log.Info("Power manager can't list inhibitors, will release all inhibitors from the journal")
+		report.ListingSupported = false
+	} else if err != nil {
+		log.WithError(err).Error("Can't list inhibitors, will release all inhibitors from the journal")
+		report.ListingSupported = false
+	}
+	for _, appName := range inhibitors {
+		listedAppNames[appName] = true
+	}
+
+	// UUIDs of running domains by their names, only these domains can adopt inhibitors
+	runningDomains := make(map[InhibitorName]string)
+	if report.ListingSupported && o.pausedUntil.IsZero() {
+		activities, err := o.listActivities(ctx)
+		if err != nil {
+			log.WithError(err).Error("Can't list activities, inhibitors of failed sources will be released")
+		}
+		for _, activity := range o.filterDisabledDomains(activities) {
+			runningDomains[InhibitorName(activity.ID)] = activity.UUID
+		}
+	}
+
+	for _, record := range savedState.Inhibitors {
+		name := InhibitorName(record.Domain)
+		inhibitorLog := log.WithFields(log.Fields{
+			logging.FieldDomain:  name,
+			logging.FieldCookie:  record.Cookie,
+			logging.FieldBackend: record.Backend,
+		})
+		appName := inhibitorAppName(name)
+		runningUUID, running := runningDomains[name]
+		// a domain adopts only one inhibitor, duplicates are released
+		_, adopted := o.currentInhibitorsCookies[name]
+		switch {
+		case record.Backend != o.sleepInhibitor.Backend():
+			inhibitorLog.Warn("Stale inhibitor was created by another backend, can't release it, keeping it in the journal")
+			report.OtherBackend = append(report.OtherBackend, name)
+			o.leftoverInhibitors = append(o.leftoverInhibitors, record)
+			continue
+		case report.ListingSupported && !listedAppNames[appName]:
+			inhibitorLog.Info("Stale inhibitor is already gone")
+			report.Vanished = append(report.Vanished, name)
+		case running && !adopted && (record.DomainUUID == "" || record.DomainUUID == runningUUID):
+			inhibitorLog.Info("Adopted inhibitor of a running domain left by previous instance")
+			o.currentInhibitorsCookies[name] = InhibitorCookie(record.Cookie)
+			o.inhibitorsDetails[name] = inhibitorDetails{domainUUID: record.DomainUUID, acquiredAt: record.AcquiredAt}
+			report.Adopted = append(report.Adopted, name)
+		default:
+			err := o.sleepInhibitor.UnInhibit(ctx, record.Cookie)
+			switch {
+			case err == nil:
+				inhibitorLog.Info("Released stale inhibitor left by previous instance")
+				report.Released = append(report.Released, name)
+			case errors.Is(err, dbus_inhibitor.ErrCookieNotFound):
+				inhibitorLog.Info("Stale inhibitor is already gone")
+				report.Vanished = append(report.Vanished, name)
+			case !report.ListingSupported:
+				// without listing, an error most likely means the power manager already dropped the inhibitor
+				inhibitorLog.WithError(err).Info("Can't release stale inhibitor, it's probably already gone")
+				report.Vanished = append(report.Vanished, name)
+			default:
+				inhibitorLog.WithError(err).Error("Can't release stale inhibitor, keeping it in the journal")
+				report.Failed = append(report.Failed, name)
+				o.leftoverInhibitors = append(o.leftoverInhibitors, record)
+			}
+		}
+		delete(listedAppNames, appName)
+	}
+	for appName := range listedAppNames {
+		if strings.HasPrefix(appName, InhibitorAppNamePrefix) {
+			log.WithField(logging.FieldDomain, strings.TrimPrefix(appName, InhibitorAppNamePrefix)).Warn(
+				"Found inhibitor created by another instance, but its cookie is unknown, can't release it",
+			)
+			report.Unknown = append(report.Unknown, appName)
+		}
+	}
+	o.saveState()
+	o.emitRestored()
+	log.Infof(
+		"Stale inhibitors cleanup: adopted %d, released %d, vanished %d, other backend %d, unknown %d, failed %d",
+		len(report.Adopted), len(report.Released), len(report.Vanished), len(report.OtherBackend),
+		len(report.Unknown), len(report.Failed),
+	)
+	return report
+}
+
+/*
+LoadState loads the state saved by the running daemon without changing anything, plan and dry-run mode use it instead
+of RestoreState. Inhibitors from the journal are taken as held whatever backend created them, so it's shown which of
+them would be kept or released, but nothing is released and the power manager isn't asked. Should be called before
+Start.
+*/
+func (o *Orchestrator) LoadState() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.journal == nil {
+		return
+	}
+	savedState, err := o.journal.Load()
+	if err != nil {
+		log.WithError(err).Warn("Can't load state journal, starting with an empty state")
+	}
+	for _, domain := range savedState.DisabledDomains {
+		o.disabledDomains[InhibitorName(domain)] = true
+	}
+	if savedState.PausedUntil.After(time.Now()) {
+		o.pausedUntil = savedState.PausedUntil
+	}
+	adopter, canAdopt := o.sleepInhibitor.(dbus_inhibitor.Adopter)
+	for _, record := range savedState.Inhibitors {
+		name := InhibitorName(record.Domain)
+		if _, loaded := o.currentInhibitorsCookies[name]; loaded {
+			continue
+		}
+		o.currentInhibitorsCookies[name] = InhibitorCookie(record.Cookie)
+		o.inhibitorsDetails[name] = inhibitorDetails{domainUUID: record.DomainUUID, acquiredAt: record.AcquiredAt}
+		if canAdopt {
+			adopter.Adopt(record.Cookie, inhibitorAppName(name))
+		}
+		log.WithFields(log.Fields{
+			logging.FieldDomain:  name,
+			logging.FieldCookie:  record.Cookie,
+			logging.FieldBackend: record.Backend,
+		}).Debug("Loaded inhibitor from the journal")
+	}
+	o.emitRestored()
+}
+
+// emitRestored tells listeners about restored inhibitors and pause. Must be called with the mutex held
+func (o *Orchestrator) emitRestored() {
+	for name, cookie := range o.currentInhibitorsCookies {
+		o.emit(Event{
+			Kind:       EventInhibitorActivated,
+			Domain:     name,
+			DomainUUID: o.inhibitorsDetails[name].domainUUID,
+			Cookie:     cookie,
+		})
+	}
+	if !o.pausedUntil.IsZero() {
+		o.emit(Event{Kind: EventPaused, PausedUntil: o.pausedUntil})
+	}
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"libvirt_keepawake/internal/logging"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RetryPolicy decides when failed Inhibit and UnInhibit calls and releases of domain locks are retried
+type RetryPolicy struct {
+	// InitialDelay is the delay after the first failure, it doubles after every next failure up to MaxDelay
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	// Jitter is the fraction of the delay added or subtracted at random, e.g. 0.2 is ±20%
+	Jitter float64
+	// EscalateAfter is the number of consecutive failures EventInhibitorFailed is sent after, 0 disables it
+	EscalateAfter int
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	InitialDelay:  2 * time.Second,
+	MaxDelay:      5 * time.Minute,
+	Jitter:        0.2,
+	EscalateAfter: 3,
+}
+
+// Delay returns the delay before the next retry after failures consecutive failures, random returns [0, 1)
+func (p RetryPolicy) Delay(failures int, random func() float64) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxDelay)
+	return delay + time.Duration(float64(delay)*p.Jitter*(2*random()-1))
+}
+
+type Operation string
+
+const (
+	OperationInhibit   Operation = "inhibit"
+	OperationUnInhibit Operation = "uninhibit"
+	// OperationReleaseLock is only used for failures of domain locks, they don't send events
+	OperationReleaseLock Operation = "release lock"
+)
+
+// Failure describes consecutive failures of an operation with the inhibitor or a lock of a domain
+type Failure struct {
+	Operation Operation
+	Count     int
+	LastError string
+	RetryAt   time.Time
+}
+
+// SetRetryPolicy sets how failed inhibitor operations are retried. Should be called before Start
+func (o *Orchestrator) SetRetryPolicy(policy RetryPolicy) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.retryPolicy = policy
+}
+
+// retryPending checks if the last operation failed and its retry delay didn't pass yet. Must be called with the
+// mutex held
+func (o *Orchestrator) retryPending(name InhibitorName, operation Operation) bool {
+	failure, found := o.failures[name]
+	return found && failure.Operation == operation && time.Now().Before(failure.RetryAt)
+}
+
+/*
+recordFailure counts a failed operation and schedules a check for its retry. When the operation failed
+EscalateAfter times in a row, EventInhibitorFailed is sent. Must be called with the mutex held.
+*/
+func (o *Orchestrator) recordFailure(name InhibitorName, operation Operation, err error) {
+	failure := o.failures[name]
+	if failure.Operation != operation {
+		failure = Failure{Operation: operation}
+	}
+	failure.Count++
+	failure.LastError = err.Error()
+	delay := o.retryPolicy.Delay(failure.Count, o.random)
+	failure.RetryAt = time.Now().Add(delay)
+	o.failures[name] = failure
+	log.WithField(logging.FieldDomain, name).WithError(err).Warnf(
+		"Can't %s, failed %d times in a row, will retry in %s", operation, failure.Count, delay.Round(time.Millisecond),
+	)
+	time.AfterFunc(delay, o.Trigger)
+	if failure.Count == o.retryPolicy.EscalateAfter {
+		o.emit(Event{Kind: EventInhibitorFailed, Domain: name, Operation: operation, Error: failure.LastError})
+	}
+}
+
+// clearFailure forgets failures of the domain after a successful operation. Must be called with the mutex held
+func (o *Orchestrator) clearFailure(name InhibitorName) {
+	failure, found := o.failures[name]
+	if !found {
+		return
+	}
+	delete(o.failures, name)
+	log.WithField(logging.FieldDomain, name).Infof("Recovered after %d failures to %s", failure.Count, failure.Operation)
+	o.emit(Event{Kind: EventInhibitorRecovered, Domain: name, Operation: failure.Operation})
+}
+
+// clearStaleFailures forgets failures of domains which don't need any operation anymore, e.g. a domain stopped
+// before its inhibitor could be activated. Must be called with the mutex held
+func (o *Orchestrator) clearStaleFailures(pending map[InhibitorName]bool) {
+	for name := range o.failures {
+		if !pending[name] {
+			o.clearFailure(name)
+		}
+	}
+}
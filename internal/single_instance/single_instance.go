@@ -0,0 +1,152 @@
+package single_instance
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// BusName is a well-known session bus name owned by the running daemon
+const BusName = "io.github.anlorn.LibvirtKeepawake"
+
+// ErrAlreadyRunning is returned by Claim when another instance owns BusName and replacement wasn't requested
+var ErrAlreadyRunning = errors.New("another instance is already running")
+
+/*
+Instance guarantees only one daemon runs in a session by owning BusName. The name is always claimed with
+replacement allowed, so a new instance started with --replace can take it over. The replaced instance gets notified
+via Lost and is expected to release its inhibitors and exit.
+*/
+type Instance struct {
+	dbusConnection *dbus.Conn
+	signals        chan *dbus.Signal
+	lost           chan struct{}
+}
+
+/*
+Claim takes ownership of BusName. If another instance owns the name, ErrAlreadyRunning is returned unless replace
+is true. When replacing, Claim waits up to timeout for the previous instance to disconnect from the bus, so its
+inhibitors are already released when Claim returns.
+*/
+func Claim(dbusConnection *dbus.Conn, replace bool, timeout time.Duration) (*Instance, error) {
+	instance := &Instance{
+		dbusConnection: dbusConnection,
+		signals:        make(chan *dbus.Signal, 16),
+		lost:           make(chan struct{}),
+	}
+	err := dbusConnection.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.DBus"),
+		dbus.WithMatchMember("NameOwnerChanged"),
+		dbus.WithMatchArg(0, BusName),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("can't subscribe to %s owner changes: %w", BusName, err)
+	}
+	dbusConnection.Signal(instance.signals)
+
+	var previousOwner string
+	err = dbusConnection.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, BusName).Store(&previousOwner)
+	if err != nil {
+		previousOwner = ""
+	}
+
+	flags := dbus.NameFlagAllowReplacement | dbus.NameFlagDoNotQueue
+	if replace {
+		flags |= dbus.NameFlagReplaceExisting
+	}
+	reply, err := dbusConnection.RequestName(BusName, flags)
+	if err != nil {
+		dbusConnection.RemoveSignal(instance.signals)
+		return nil, fmt.Errorf("can't request name %s: %w", BusName, err)
+	}
+	switch reply {
+	case dbus.RequestNameReplyPrimaryOwner, dbus.RequestNameReplyAlreadyOwner:
+	case dbus.RequestNameReplyExists:
+		dbusConnection.RemoveSignal(instance.signals)
+		if replace {
+			return nil, fmt.Errorf("%w and doesn't allow replacement", ErrAlreadyRunning)
+		}
+		return nil, ErrAlreadyRunning
+	default:
+		dbusConnection.RemoveSignal(instance.signals)
+		return nil, fmt.Errorf("unexpected reply %d on requesting name %s", reply, BusName)
+	}
+
+	if previousOwner != "" && previousOwner != dbusConnection.Names()[0] {
+		log.Infof("Replaced previous instance %s, waiting for it to exit", previousOwner)
+		if err := instance.waitForExit(previousOwner, timeout); err != nil {
+			log.WithError(err).Warn("Previous instance didn't exit in time")
+		}
+	}
+	go instance.watch()
+	return instance, nil
+}
+
+// Lost is closed when another instance replaced this one
+func (i *Instance) Lost() <-chan struct{} {
+	return i.lost
+}
+
+// Release gives up BusName
+func (i *Instance) Release() {
+	i.dbusConnection.RemoveSignal(i.signals)
+	if _, err := i.dbusConnection.ReleaseName(BusName); err != nil {
+		log.WithError(err).Warnf("Can't release name %s", BusName)
+	}
+}
+
+// waitForExit waits until the previous owner disconnects from the bus
+func (i *Instance) waitForExit(previousOwner string, timeout time.Duration) error {
+	err := i.dbusConnection.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.DBus"),
+		dbus.WithMatchMember("NameOwnerChanged"),
+		dbus.WithMatchArg(0, previousOwner),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = i.dbusConnection.RemoveMatchSignal(
+			dbus.WithMatchInterface("org.freedesktop.DBus"),
+			dbus.WithMatchMember("NameOwnerChanged"),
+			dbus.WithMatchArg(0, previousOwner),
+		)
+	}()
+	// previous instance might have exited before we subscribed
+	var hasOwner bool
+	err = i.dbusConnection.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, previousOwner).Store(&hasOwner)
+	if err == nil && !hasOwner {
+		return nil
+	}
+	deadline := time.After(timeout)
+	for {
+		select {
+		case signal := <-i.signals:
+			if isNameOwnerChange(signal, previousOwner) && signal.Body[2] == "" {
+				log.Infof("Previous instance %s exited", previousOwner)
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("previous instance %s is still connected after %s", previousOwner, timeout)
+		}
+	}
+}
+
+// watch closes lost when BusName is taken by another connection
+func (i *Instance) watch() {
+	ownName := i.dbusConnection.Names()[0]
+	for signal := range i.signals {
+		if isNameOwnerChange(signal, BusName) && signal.Body[1] == ownName && signal.Body[2] != ownName {
+			log.Infof("Another instance %s replaced this one", signal.Body[2])
+			close(i.lost)
+			return
+		}
+	}
+}
+
+func isNameOwnerChange(signal *dbus.Signal, name string) bool {
+	return signal.Name == "org.freedesktop.DBus.NameOwnerChanged" && len(signal.Body) == 3 && signal.Body[0] == name
+}
@@ -0,0 +1,95 @@
+package single_instance
+
+import (
+	"libvirt_keepawake/internal/dbus_inhibitor"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/suite"
+)
+
+type SingleInstanceSuite struct {
+	suite.Suite
+	dbusSocketPath string
+	dbusProcess    *os.Process
+}
+
+func (s *SingleInstanceSuite) SetupTest() {
+	dbusSocketPath, dbusProcess, err := dbus_inhibitor.RunDbusServer()
+	if err != nil {
+		s.T().Fatalf("Can't start dbus server. Err %s", err)
+	}
+	s.dbusSocketPath = dbusSocketPath
+	s.dbusProcess = dbusProcess
+}
+
+func (s *SingleInstanceSuite) TearDownTest() {
+	if err := s.dbusProcess.Kill(); err != nil {
+		s.T().Fatalf("Can't kill dbus server with PID %d. Err %s", s.dbusProcess.Pid, err)
+	}
+}
+
+func (s *SingleInstanceSuite) connect() *dbus.Conn {
+	conn, err := dbus.Connect(s.dbusSocketPath)
+	s.Require().NoError(err)
+	return conn
+}
+
+func (s *SingleInstanceSuite) TestRefuseSecondInstance() {
+	first, err := Claim(s.connect(), false, time.Second)
+	s.Require().NoError(err)
+	defer first.Release()
+
+	_, err = Claim(s.connect(), false, time.Second)
+
+	s.Assert().ErrorIs(err, ErrAlreadyRunning)
+}
+
+func (s *SingleInstanceSuite) TestClaimAfterRelease() {
+	first, err := Claim(s.connect(), false, time.Second)
+	s.Require().NoError(err)
+	first.Release()
+
+	second, err := Claim(s.connect(), false, time.Second)
+	s.Require().NoError(err)
+	second.Release()
+}
+
+// TestReplace tests that the replaced instance gets notified and the new one waits for it to exit
+func (s *SingleInstanceSuite) TestReplace() {
+	firstConn := s.connect()
+	first, err := Claim(firstConn, false, time.Second)
+	s.Require().NoError(err)
+
+	claimed := make(chan *Instance)
+	go func() {
+		second, err := Claim(s.connect(), true, 10*time.Second)
+		s.Assert().NoError(err)
+		claimed <- second
+	}()
+
+	select {
+	case <-first.Lost():
+	case <-time.After(5 * time.Second):
+		s.T().Fatal("First instance wasn't notified about replacement")
+	}
+	// second instance waits until the first one exits
+	select {
+	case <-claimed:
+		s.T().Fatal("Second instance didn't wait for the first one to exit")
+	case <-time.After(300 * time.Millisecond):
+	}
+	s.Require().NoError(firstConn.Close())
+	select {
+	case second := <-claimed:
+		second.Release()
+	case <-time.After(5 * time.Second):
+		s.T().Fatal("Second instance didn't notice the first one exited")
+	}
+}
+
+func TestRunSingleInstanceSuite(t *testing.T) {
+	suite.Run(t, new(SingleInstanceSuite))
+}
@@ -0,0 +1,188 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const journalVersion = 2
+
+// ErrCorrupted is returned by Load when the journal can't be parsed or its checksum doesn't match. The corrupted
+// file is moved aside, so the next Save starts from scratch
+var ErrCorrupted = errors.New("state journal is corrupted")
+
+// InhibitorRecord describes an inhibitor held by the daemon
+type InhibitorRecord struct {
+	Domain     string    `json:"domain"`
+	DomainUUID string    `json:"domain_uuid,omitempty"`
+	Backend    string    `json:"backend"`
+	Cookie     uint32    `json:"cookie"`
+	AcquiredAt time.Time `json:"acquired_at"`
+}
+
+// State is everything the daemon needs to recover after a restart or a crash: inhibitors to clean up and
+// decisions made by the user
+type State struct {
+	Inhibitors []InhibitorRecord `json:"inhibitors"`
+	// PausedUntil is zero when inhibition isn't paused
+	PausedUntil     time.Time `json:"paused_until"`
+	DisabledDomains []string  `json:"disabled_domains"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// Journal persists State as JSON protected by a checksum. Writes are atomic, so a crash in the middle of a write
+// leaves the previous version intact.
+type Journal struct {
+	path     string
+	readOnly bool
+}
+
+type journalFile struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	State    json.RawMessage `json:"state"`
+}
+
+func NewJournal(path string) *Journal {
+	return &Journal{path: path}
+}
+
+// NewReadOnlyJournal returns a journal which loads state, but never changes the file. Used by dry-run and plan to
+// see what the daemon has saved without interfering with it
+func NewReadOnlyJournal(path string) *Journal {
+	return &Journal{path: path, readOnly: true}
+}
+
+// DefaultPath returns path of the journal in $XDG_STATE_HOME(~/.local/state by default)
+func DefaultPath() (string, error) {
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("can't determine state directory: %w", err)
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(stateHome, "libvirt-keepawake", "state.json"), nil
+}
+
+func (j *Journal) Path() string {
+	return j.path
+}
+
+// Load reads the saved state. Missing journal is not an error, it means nothing was saved yet. On corruption, the
+// file is renamed to <path>.corrupt and empty state is returned together with ErrCorrupted
+func (j *Journal) Load() (State, error) {
+	data, err := os.ReadFile(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return State{}, nil
+	}
+	if err != nil {
+		return State{}, err
+	}
+	loadedState, err := decode(data)
+	if err != nil && j.readOnly {
+		return State{}, fmt.Errorf("%w: %s", ErrCorrupted, err)
+	}
+	if err != nil {
+		corruptedPath := j.path + ".corrupt"
+		if renameErr := os.Rename(j.path, corruptedPath); renameErr != nil {
+			return State{}, fmt.Errorf("%w: %s, can't move it aside: %s", ErrCorrupted, err, renameErr)
+		}
+		return State{}, fmt.Errorf("%w: %s, moved to %s", ErrCorrupted, err, corruptedPath)
+	}
+	return loadedState, nil
+}
+
+// Save atomically replaces the journal with the given state
+func (j *Journal) Save(newState State) error {
+	if j.readOnly {
+		return nil
+	}
+	sort.Slice(newState.Inhibitors, func(i, k int) bool {
+		return newState.Inhibitors[i].Domain < newState.Inhibitors[k].Domain
+	})
+	sort.Strings(newState.DisabledDomains)
+	if newState.Inhibitors == nil {
+		newState.Inhibitors = []InhibitorRecord{}
+	}
+	if newState.DisabledDomains == nil {
+		newState.DisabledDomains = []string{}
+	}
+	if newState.UpdatedAt.IsZero() {
+		newState.UpdatedAt = time.Now()
+	}
+	stateData, err := json.Marshal(newState)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(journalFile{
+		Version:  journalVersion,
+		Checksum: checksum(stateData),
+		State:    stateData,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(j.path, data)
+}
+
+func decode(data []byte) (State, error) {
+	var file journalFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return State{}, fmt.Errorf("can't parse: %w", err)
+	}
+	if file.Version != journalVersion {
+		return State{}, fmt.Errorf("unsupported version %d", file.Version)
+	}
+	// MarshalIndent reformats the embedded state, Marshal compacts it back to the form the checksum was calculated on
+	compacted, err := json.Marshal(file.State)
+	if err != nil {
+		return State{}, fmt.Errorf("can't parse state: %w", err)
+	}
+	if checksum(compacted) != file.Checksum {
+		return State{}, errors.New("checksum mismatch")
+	}
+	var loadedState State
+	if err := json.Unmarshal(file.State, &loadedState); err != nil {
+		return State{}, fmt.Errorf("can't parse state: %w", err)
+	}
+	return loadedState, nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// writeFileAtomically writes data to a temporary file in the same directory and renames it over path, so readers
+// never see a partially written file
+func writeFileAtomically(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmpFile.Name()) }()
+	if _, err := tmpFile.Write(data); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
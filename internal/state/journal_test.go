@@ -0,0 +1,111 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type JournalSuite struct {
+	suite.Suite
+	journal *Journal
+}
+
+func (s *JournalSuite) SetupTest() {
+	s.journal = NewJournal(filepath.Join(s.T().TempDir(), "libvirt-keepawake", "state.json"))
+}
+
+func (s *JournalSuite) TestLoadMissing() {
+	loadedState, err := s.journal.Load()
+	s.Assert().NoError(err)
+	s.Assert().Equal(State{}, loadedState)
+}
+
+func (s *JournalSuite) TestSaveAndLoad() {
+	acquiredAt := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	savedState := State{
+		Inhibitors: []InhibitorRecord{
+			{Domain: "win11", DomainUUID: "c7a5fdbd-cdaf-9455-926a-d65c16db1809", Backend: "pm", Cookie: 3, AcquiredAt: acquiredAt},
+			{Domain: "linux", Backend: "pm", Cookie: 7, AcquiredAt: acquiredAt},
+		},
+		PausedUntil:     acquiredAt.Add(time.Hour),
+		DisabledDomains: []string{"test"},
+		UpdatedAt:       acquiredAt,
+	}
+	s.Require().NoError(s.journal.Save(savedState))
+
+	loadedState, err := s.journal.Load()
+	s.Require().NoError(err)
+	s.Assert().Equal([]string{"linux", "win11"}, []string{loadedState.Inhibitors[0].Domain, loadedState.Inhibitors[1].Domain})
+	s.Assert().Equal(uint32(3), loadedState.Inhibitors[1].Cookie)
+	s.Assert().Equal("c7a5fdbd-cdaf-9455-926a-d65c16db1809", loadedState.Inhibitors[1].DomainUUID)
+	s.Assert().True(acquiredAt.Equal(loadedState.Inhibitors[1].AcquiredAt))
+	s.Assert().True(savedState.PausedUntil.Equal(loadedState.PausedUntil))
+	s.Assert().Equal([]string{"test"}, loadedState.DisabledDomains)
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(filepath.Dir(s.journal.Path()))
+	s.Require().NoError(err)
+	s.Assert().Len(entries, 1)
+}
+
+func (s *JournalSuite) TestLoadCorrupted() {
+	s.Require().NoError(os.MkdirAll(filepath.Dir(s.journal.Path()), 0o700))
+	s.Require().NoError(os.WriteFile(s.journal.Path(), []byte("{not json"), 0o600))
+
+	loadedState, err := s.journal.Load()
+
+	s.Assert().ErrorIs(err, ErrCorrupted)
+	s.Assert().Equal(State{}, loadedState)
+	// corrupted file is moved aside
+	_, err = os.Stat(s.journal.Path() + ".corrupt")
+	s.Assert().NoError(err)
+	loadedState, err = s.journal.Load()
+	s.Assert().NoError(err)
+	s.Assert().Equal(State{}, loadedState)
+}
+
+func (s *JournalSuite) TestReadOnly() {
+	s.Require().NoError(s.journal.Save(State{DisabledDomains: []string{"domain1"}}))
+	readOnlyJournal := NewReadOnlyJournal(s.journal.Path())
+
+	s.Require().NoError(readOnlyJournal.Save(State{}))
+
+	loadedState, err := readOnlyJournal.Load()
+	s.Require().NoError(err)
+	s.Assert().Equal([]string{"domain1"}, loadedState.DisabledDomains)
+	// corrupted file is left for the daemon to deal with
+	s.Require().NoError(os.WriteFile(s.journal.Path(), []byte("{not json"), 0o600))
+	_, err = readOnlyJournal.Load()
+	s.Assert().ErrorIs(err, ErrCorrupted)
+	_, err = os.Stat(s.journal.Path())
+	s.Assert().NoError(err)
+}
+
+func (s *JournalSuite) TestLoadChecksumMismatch() {
+	s.Require().NoError(s.journal.Save(State{Inhibitors: []InhibitorRecord{{Domain: "win11", Cookie: 3}}}))
+	data, err := os.ReadFile(s.journal.Path())
+	s.Require().NoError(err)
+	tampered := strings.Replace(string(data), `"cookie": 3`, `"cookie": 4`, 1)
+	s.Require().NotEqual(string(data), tampered)
+	s.Require().NoError(os.WriteFile(s.journal.Path(), []byte(tampered), 0o600))
+
+	_, err = s.journal.Load()
+
+	s.Assert().ErrorIs(err, ErrCorrupted)
+}
+
+func (s *JournalSuite) TestDefaultPath() {
+	s.T().Setenv("XDG_STATE_HOME", "/tmp/state")
+	path, err := DefaultPath()
+	s.Assert().NoError(err)
+	s.Assert().Equal("/tmp/state/libvirt-keepawake/state.json", path)
+}
+
+func TestRunJournalSuite(t *testing.T) {
+	suite.Run(t, new(JournalSuite))
+}
@@ -0,0 +1,170 @@
+package stream_detector
+
+// Detects remote streaming sessions(e.g. Moonlight connected to Sunshine running inside a domain), so sleep is
+// inhibited only while somebody is actually using the domain
+
+import (
+	"context"
+	"fmt"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"libvirt_keepawake/internal/logging"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultPorts are ports used by Sunshine
+const DefaultPorts = "47984-48010"
+
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.First && port <= r.Last
+}
+
+// ParsePorts parses comma separated ports and port ranges, e.g. 47984-48010,8443
+func ParsePorts(spec string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, part := range strings.Split(spec, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		if !isRange {
+			last = first
+		}
+		firstPort, err := strconv.ParseUint(first, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %w", part, err)
+		}
+		lastPort, err := strconv.ParseUint(last, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %w", part, err)
+		}
+		if lastPort < firstPort {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		ranges = append(ranges, PortRange{First: uint16(firstPort), Last: uint16(lastPort)})
+	}
+	return ranges, nil
+}
+
+/*
+Detector is an internal.DomainFilter which considers a domain busy while the host sees an established flow to one of
+the domain addresses on one of the ports, and for linger after the last one ended, so short reconnects don't let
+the host fall asleep.
+*/
+type Detector struct {
+	procRoot string
+	ports    []PortRange
+	linger   time.Duration
+	// domains are names of domains to detect streaming for, other domains are always busy. All domains when empty
+	domains  map[string]bool
+	now      func() time.Time
+	mutex    sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func NewDetector(procRoot string, ports []PortRange, linger time.Duration, domains []string) *Detector {
+	detector := &Detector{
+		procRoot: procRoot,
+		ports:    ports,
+		linger:   linger,
+		domains:  make(map[string]bool, len(domains)),
+		now:      time.Now,
+		lastSeen: make(map[string]time.Time),
+	}
+	for _, domain := range domains {
+		detector.domains[domain] = true
+	}
+	return detector
+}
+
+func (d *Detector) Name() string {
+	return "streaming"
+}
+
+// NeedsInhibitor returns true if the domain has a streaming session. Domains are considered busy if their addresses
+// or connections can't be read, so a detection failure doesn't let the host sleep
+func (d *Detector) NeedsInhibitor(ctx context.Context, domain libvirt_watcher.MinimalLibvirtDomain) (bool, string) {
+	name, err := domain.GetName()
+	if err != nil || (len(d.domains) > 0 && !d.domains[name]) {
+		return true, ""
+	}
+	domainLog := log.WithField(logging.FieldDomain, name)
+	addresses, err := domain.GetIPAddresses(ctx)
+	if err != nil {
+		domainLog.WithError(err).Warn("Can't get domain addresses to detect streaming")
+		return true, "domain addresses are unknown"
+	}
+	flows, err := ReadFlows(d.procRoot)
+	if err != nil {
+		domainLog.WithError(err).Warn("Can't read connections to detect streaming")
+		return true, "connections can't be read"
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := d.now()
+	if client, found := d.findSession(parseAddresses(addresses), flows); found {
+		if _, wasStreaming := d.lastSeen[name]; !wasStreaming {
+			domainLog.WithField("client", client).Info("Streaming session started")
+		}
+		d.lastSeen[name] = now
+		return true, fmt.Sprintf("streaming to %s", client)
+	}
+	lastSeen, wasStreaming := d.lastSeen[name]
+	if !wasStreaming {
+		return false, "no streaming session"
+	}
+	if now.Sub(lastSeen) < d.linger {
+		return true, fmt.Sprintf("streaming session ended, lingering until %s", lastSeen.Add(d.linger).Format(time.DateTime))
+	}
+	domainLog.Info("Streaming session ended")
+	delete(d.lastSeen, name)
+	return false, "no streaming session"
+}
+
+/*
+findSession returns the client of the first flow to one of addresses on one of the ports. Only the server side is
+matched, the destination of the original direction or the source of the reply one, so connections the domain opens
+from an ephemeral port which happens to be in the range aren't sessions.
+*/
+func (d *Detector) findSession(addresses map[netip.Addr]bool, flows []Flow) (netip.Addr, bool) {
+	for _, flow := range flows {
+		// endpoints go in source, destination pairs, so the client is the other endpoint of the same pair
+		for _, server := range []int{1, 2} {
+			if server >= len(flow.Endpoints) {
+				break
+			}
+			endpoint := flow.Endpoints[server]
+			if addresses[endpoint.Addr()] && d.matchesPort(endpoint.Port()) {
+				return flow.Endpoints[server^1].Addr(), true
+			}
+		}
+	}
+	return netip.Addr{}, false
+}
+
+func (d *Detector) matchesPort(port uint16) bool {
+	for _, portRange := range d.ports {
+		if portRange.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseAddresses(addresses []string) map[netip.Addr]bool {
+	parsed := make(map[netip.Addr]bool, len(addresses))
+	for _, address := range addresses {
+		if addr, err := netip.ParseAddr(address); err == nil {
+			parsed[addr.Unmap()] = true
+		}
+	}
+	return parsed
+}
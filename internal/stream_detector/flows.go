@@ -0,0 +1,204 @@
+package stream_detector
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Flow is a network connection seen by the host
+type Flow struct {
+	Protocol string
+	// Endpoints are source, destination pairs, the first pair is the direction the flow was opened in. conntrack lists
+	// the reply direction as well, so with DNAT(port forwarding to the domain) the domain address appears only there
+	Endpoints []netip.AddrPort
+}
+
+// tcpEstablished is TCP_ESTABLISHED in /proc/net/tcp, connected UDP sockets have this state as well
+const tcpEstablished = "01"
+
+// conntrackTuple is one direction of a conntrack entry
+type conntrackTuple struct {
+	src, dst, sport, dport string
+}
+
+/*
+ParseConntrack parses /proc/net/nf_conntrack and returns established TCP connections and UDP flows which got a
+reply. Lines look like:
+
+	ipv4 2 tcp 6 431999 ESTABLISHED src=10.0.0.5 dst=192.168.122.50 sport=51234 dport=47984 src=192.168.122.50 ...
+*/
+func ParseConntrack(reader io.Reader) ([]Flow, error) {
+	var flows []Flow
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || (fields[2] != "tcp" && fields[2] != "udp") {
+			continue
+		}
+		var tuples []*conntrackTuple
+		established, replied := false, true
+		for _, field := range fields[3:] {
+			key, value, found := strings.Cut(field, "=")
+			if !found {
+				established = established || field == "ESTABLISHED"
+				replied = replied && field != "[UNREPLIED]"
+				continue
+			}
+			if key == "src" {
+				tuples = append(tuples, &conntrackTuple{})
+			}
+			if len(tuples) == 0 {
+				continue
+			}
+			tuple := tuples[len(tuples)-1]
+			switch key {
+			case "src":
+				tuple.src = value
+			case "dst":
+				tuple.dst = value
+			case "sport":
+				tuple.sport = value
+			case "dport":
+				tuple.dport = value
+			}
+		}
+		if !replied || (fields[2] == "tcp" && !established) {
+			continue
+		}
+		flow := Flow{Protocol: fields[2]}
+		for _, tuple := range tuples {
+			source, err := parseEndpoint(tuple.src, tuple.sport)
+			if err != nil {
+				return nil, fmt.Errorf("invalid conntrack line %q: %w", scanner.Text(), err)
+			}
+			destination, err := parseEndpoint(tuple.dst, tuple.dport)
+			if err != nil {
+				return nil, fmt.Errorf("invalid conntrack line %q: %w", scanner.Text(), err)
+			}
+			flow.Endpoints = append(flow.Endpoints, source, destination)
+		}
+		flows = append(flows, flow)
+	}
+	return flows, scanner.Err()
+}
+
+func parseEndpoint(address string, port string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, uint16(portNumber)), nil
+}
+
+/*
+ParseProcNet parses /proc/net/tcp, tcp6, udp or udp6 and returns connected sockets of the host. Addresses are hex
+32-bit words in host byte order, ports are big endian hex:
+
+	sl  local_address rem_address   st ...
+	0: 0100007F:BB80 0100007F:D4A2 01 ...
+*/
+func ParseProcNet(reader io.Reader, protocol string) ([]Flow, error) {
+	var flows []Flow
+	scanner := bufio.NewScanner(reader)
+	// header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != tcpEstablished {
+			continue
+		}
+		local, err := parseHexEndpoint(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s line %q: %w", protocol, scanner.Text(), err)
+		}
+		remote, err := parseHexEndpoint(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s line %q: %w", protocol, scanner.Text(), err)
+		}
+		flows = append(flows, Flow{Protocol: protocol, Endpoints: []netip.AddrPort{local, remote}})
+	}
+	return flows, scanner.Err()
+}
+
+func parseHexEndpoint(endpoint string) (netip.AddrPort, error) {
+	address, port, found := strings.Cut(endpoint, ":")
+	if !found {
+		return netip.AddrPort{}, errors.New("no port")
+	}
+	raw, err := hex.DecodeString(address)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %s", address)
+	}
+	// the kernel prints every 32-bit word with %08X in host byte order
+	for word := 0; word < len(raw); word += 4 {
+		binary.BigEndian.PutUint32(raw[word:], binary.NativeEndian.Uint32(raw[word:]))
+	}
+	addr, _ := netip.AddrFromSlice(raw)
+	portNumber, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr.Unmap(), uint16(portNumber)), nil
+}
+
+// conntrackDenied logs only once that nf_conntrack can't be read, it doesn't change while the daemon runs
+var conntrackDenied sync.Once
+
+/*
+ReadFlows reads connections from procRoot(/proc outside tests). conntrack sees traffic routed or bridged to domains,
+so it's preferred. Without the nf_conntrack module, or when it's readable only by root, only sockets of the host are
+seen, e.g. a client running on the host itself.
+*/
+func ReadFlows(procRoot string) ([]Flow, error) {
+	return readFlows(os.DirFS(procRoot))
+}
+
+func readFlows(procFS fs.FS) ([]Flow, error) {
+	conntrack, err := procFS.Open("net/nf_conntrack")
+	if err == nil {
+		defer conntrack.Close()
+		return ParseConntrack(conntrack)
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		conntrackDenied.Do(func() {
+			log.WithError(err).Info(
+				"Can't read conntrack, only connections of the host are seen, run as root to detect forwarded ones",
+			)
+		})
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	var flows []Flow
+	for _, protocol := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		file, err := procFS.Open("net/" + protocol)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		protocolFlows, err := ParseProcNet(file, strings.TrimSuffix(protocol, "6"))
+		_ = file.Close()
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, protocolFlows...)
+	}
+	return flows, nil
+}
@@ -0,0 +1,150 @@
+package stream_detector
+
+import (
+	"context"
+	"io/fs"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type StreamDetectorSuite struct {
+	suite.Suite
+	ports []PortRange
+	now   time.Time
+}
+
+func (s *StreamDetectorSuite) SetupTest() {
+	var err error
+	s.ports, err = ParsePorts(DefaultPorts)
+	s.Require().NoError(err)
+	s.now = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+}
+
+func (s *StreamDetectorSuite) newDetector(procRoot string, domains ...string) *Detector {
+	detector := NewDetector(procRoot, s.ports, 2*time.Minute, domains)
+	detector.now = func() time.Time { return s.now }
+	return detector
+}
+
+func domain(name string, addresses ...string) libvirt_watcher.FakeLibvirtDomain {
+	return libvirt_watcher.FakeLibvirtDomain{Name: name, Addresses: addresses}
+}
+
+func (s *StreamDetectorSuite) TestParseConntrack() {
+	file, err := os.Open("testdata/conntrack/net/nf_conntrack")
+	s.Require().NoError(err)
+	defer file.Close()
+
+	flows, err := ParseConntrack(file)
+
+	s.Require().NoError(err)
+	// TIME_WAIT, UNREPLIED and ICMP entries are skipped
+	s.Require().Len(flows, 5)
+	s.Assert().Equal(Flow{Protocol: "tcp", Endpoints: []netip.AddrPort{
+		netip.MustParseAddrPort("192.168.1.20:51234"),
+		netip.MustParseAddrPort("192.168.1.10:47984"),
+		netip.MustParseAddrPort("192.168.122.50:47984"),
+		netip.MustParseAddrPort("192.168.1.20:51234"),
+	}}, flows[0])
+	s.Assert().Equal("udp", flows[1].Protocol)
+	s.Assert().Equal(netip.MustParseAddrPort("[fd00::70]:47989"), flows[4].Endpoints[1])
+}
+
+func (s *StreamDetectorSuite) TestParseProcNet() {
+	flows, err := ReadFlows("testdata/procnet")
+
+	s.Require().NoError(err)
+	// listening and unconnected sockets are skipped
+	s.Assert().Equal([]Flow{
+		{Protocol: "tcp", Endpoints: []netip.AddrPort{
+			netip.MustParseAddrPort("192.168.122.1:51234"), netip.MustParseAddrPort("192.168.122.50:47984"),
+		}},
+		{Protocol: "tcp", Endpoints: []netip.AddrPort{
+			netip.MustParseAddrPort("192.168.122.1:51235"), netip.MustParseAddrPort("192.168.122.60:22"),
+		}},
+		{Protocol: "tcp", Endpoints: []netip.AddrPort{
+			netip.MustParseAddrPort("[fd00::1]:52000"), netip.MustParseAddrPort("[fd00::70]:47989"),
+		}},
+	}, flows)
+}
+
+// deniedConntrackFS is /proc of an unprivileged user, nf_conntrack is readable only by root
+type deniedConntrackFS struct {
+	fs.FS
+}
+
+func (f deniedConntrackFS) Open(name string) (fs.File, error) {
+	if name == "net/nf_conntrack" {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return f.FS.Open(name)
+}
+
+// TestConntrackPermissionDenied tests that host sockets are read when conntrack can't be
+func (s *StreamDetectorSuite) TestConntrackPermissionDenied() {
+	flows, err := readFlows(deniedConntrackFS{os.DirFS("testdata/procnet")})
+
+	s.Require().NoError(err)
+	s.Assert().Len(flows, 3)
+}
+
+func (s *StreamDetectorSuite) TestParsePorts() {
+	ports, err := ParsePorts("47984-48010, 8443")
+	s.Require().NoError(err)
+	s.Assert().Equal([]PortRange{{First: 47984, Last: 48010}, {First: 8443, Last: 8443}}, ports)
+
+	for _, spec := range []string{"", "http", "48010-47984", "1-70000"} {
+		_, err := ParsePorts(spec)
+		s.Assert().Error(err, spec)
+	}
+}
+
+func (s *StreamDetectorSuite) TestDetectStreaming() {
+	detector := s.newDetector("testdata/conntrack")
+
+	needed, reason := detector.NeedsInhibitor(context.Background(), domain("win11", "192.168.122.50"))
+	s.Assert().True(needed)
+	s.Assert().Equal("streaming to 192.168.1.20", reason)
+
+	// only the ssh connection and an outbound connection from a port in the range are established
+	needed, reason = detector.NeedsInhibitor(context.Background(), domain("linux", "192.168.122.60"))
+	s.Assert().False(needed)
+	s.Assert().Equal("no streaming session", reason)
+
+	needed, _ = detector.NeedsInhibitor(context.Background(), domain("ipv6", "192.168.122.70", "fd00::70"))
+	s.Assert().True(needed)
+}
+
+func (s *StreamDetectorSuite) TestLinger() {
+	detector := s.newDetector("testdata/conntrack")
+	needed, _ := detector.NeedsInhibitor(context.Background(), domain("win11", "192.168.122.50"))
+	s.Require().True(needed)
+
+	// the session ended
+	detector.procRoot = s.T().TempDir()
+	s.now = s.now.Add(time.Minute)
+	needed, reason := detector.NeedsInhibitor(context.Background(), domain("win11", "192.168.122.50"))
+	s.Assert().True(needed)
+	s.Assert().Equal("streaming session ended, lingering until 2024-05-01 12:02:00", reason)
+
+	s.now = s.now.Add(time.Minute)
+	needed, _ = detector.NeedsInhibitor(context.Background(), domain("win11", "192.168.122.50"))
+	s.Assert().False(needed)
+}
+
+func (s *StreamDetectorSuite) TestOnlyListedDomains() {
+	detector := s.newDetector("testdata/conntrack", "win11")
+
+	needed, _ := detector.NeedsInhibitor(context.Background(), domain("linux", "192.168.122.60"))
+
+	s.Assert().True(needed)
+}
+
+func TestRunStreamDetectorSuite(t *testing.T) {
+	suite.Run(t, new(StreamDetectorSuite))
+}
@@ -0,0 +1,83 @@
+package systemd_notify
+
+// Native implementation of the sd_notify(3) protocol, so the daemon can run as a Type=notify service without linking
+// libsystemd. Nothing is opened unless systemd set $NOTIFY_SOCKET, so other init systems like OpenRC aren't affected
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables set by systemd for Type=notify services
+const (
+	EnvNotifySocket = "NOTIFY_SOCKET"
+	EnvWatchdogUSec = "WATCHDOG_USEC"
+	EnvWatchdogPID  = "WATCHDOG_PID"
+)
+
+// sendTimeout limits how long a notification waits for space in the socket buffer of the service manager
+const sendTimeout = time.Second
+
+// Notifier sends state changes to the service manager over a datagram socket
+type Notifier struct {
+	conn *net.UnixConn
+}
+
+// NewNotifier connects to the notification socket, paths starting with "@" are in the abstract namespace
+func NewNotifier(socketPath string) (*Notifier, error) {
+	if !strings.HasPrefix(socketPath, "/") && !strings.HasPrefix(socketPath, "@") {
+		return nil, fmt.Errorf("unsupported notification socket %q", socketPath)
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to notification socket %s: %w", socketPath, err)
+	}
+	return &Notifier{conn: conn}, nil
+}
+
+/*
+FromEnvironment creates a notifier for $NOTIFY_SOCKET and returns the watchdog interval, which is 0 if the watchdog
+is disabled. The notifier is nil when the daemon wasn't started by systemd as a Type=notify service. Variables are
+removed from the environment, so child processes like hooks don't notify on behalf of the daemon.
+*/
+func FromEnvironment() (*Notifier, time.Duration, error) {
+	socketPath := os.Getenv(EnvNotifySocket)
+	watchdogUSec := os.Getenv(EnvWatchdogUSec)
+	watchdogPID := os.Getenv(EnvWatchdogPID)
+	for _, name := range []string{EnvNotifySocket, EnvWatchdogUSec, EnvWatchdogPID} {
+		_ = os.Unsetenv(name)
+	}
+	if socketPath == "" {
+		return nil, 0, nil
+	}
+	notifier, err := NewNotifier(socketPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	if watchdogUSec == "" || (watchdogPID != "" && watchdogPID != strconv.Itoa(os.Getpid())) {
+		return notifier, 0, nil
+	}
+	usec, err := strconv.ParseUint(watchdogUSec, 10, 63)
+	if err != nil {
+		_ = notifier.Close()
+		return nil, 0, fmt.Errorf("invalid %s %q: %w", EnvWatchdogUSec, watchdogUSec, err)
+	}
+	return notifier, time.Duration(usec) * time.Microsecond, nil
+}
+
+// Send sends assignments like "READY=1" in one datagram
+func (n *Notifier) Send(assignments ...string) error {
+	if err := n.conn.SetWriteDeadline(time.Now().Add(sendTimeout)); err != nil {
+		return err
+	}
+	_, err := n.conn.Write([]byte(strings.Join(assignments, "\n")))
+	return err
+}
+
+func (n *Notifier) Close() error {
+	return n.conn.Close()
+}
@@ -0,0 +1,154 @@
+package systemd_notify
+
+import (
+	"fmt"
+	"libvirt_keepawake/internal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxStatusNames limits how many inhibitors are named in STATUS, the rest are only counted
+const maxStatusNames = 5
+
+// Controller is implemented by internal.Orchestrator
+type Controller interface {
+	Status() internal.Status
+	Trigger()
+}
+
+/*
+Service reports the daemon state to systemd. READY=1 is sent after the first check of activities, STATUS= whenever
+held inhibitors change and STOPPING=1 on Stop. With the watchdog enabled, a check is asked for every half of the
+watchdog interval and WATCHDOG=1 is sent only when it finished, so a stuck main loop gets the daemon restarted.
+*/
+type Service struct {
+	notifier         *Notifier
+	controller       Controller
+	watchdogInterval time.Duration
+	events           chan internal.Event
+	done             chan struct{}
+	stopped          sync.WaitGroup
+	// state below is accessed only from the service goroutine
+	ready      bool
+	lastStatus string
+}
+
+func NewService(notifier *Notifier, controller Controller, watchdogInterval time.Duration) *Service {
+	return &Service{
+		notifier:         notifier,
+		controller:       controller,
+		watchdogInterval: watchdogInterval,
+		events:           make(chan internal.Event, 64),
+		done:             make(chan struct{}),
+	}
+}
+
+// Start starts reporting and asks for the first check, so readiness isn't delayed until the next tick
+func (s *Service) Start() {
+	s.stopped.Add(1)
+	go s.run()
+	s.controller.Trigger()
+}
+
+/*
+Stop stops reporting, tells systemd the daemon is stopping and closes the notifier. Should be called before the
+orchestrator is stopped, events of releasing inhibitors are ignored.
+*/
+func (s *Service) Stop() {
+	close(s.done)
+	s.stopped.Wait()
+	if err := s.notifier.Send("STOPPING=1", "STATUS=Releasing inhibitors"); err != nil {
+		log.WithError(err).Warn("Can't notify systemd about stopping")
+	}
+	if err := s.notifier.Close(); err != nil {
+		log.WithError(err).Warn("Can't close systemd notification socket")
+	}
+}
+
+// HandleEvent implements internal.EventListener
+func (s *Service) HandleEvent(event internal.Event) {
+	select {
+	case s.events <- event:
+	default:
+		log.Warnf("systemd notification queue is full, dropping event %s", event.Kind)
+	}
+}
+
+func (s *Service) run() {
+	defer s.stopped.Done()
+	// nil channel blocks forever, so there are no watchdog checks without the watchdog
+	var watchdog <-chan time.Time
+	if s.watchdogInterval > 0 {
+		ticker := time.NewTicker(s.watchdogInterval / 2)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+	for {
+		select {
+		case event := <-s.events:
+			s.handle(event)
+		case <-watchdog:
+			// the ping is sent when the check finishes, a stuck main loop never does
+			s.controller.Trigger()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Service) handle(event internal.Event) {
+	var assignments []string
+	if status := describeStatus(s.controller.Status()); status != s.lastStatus {
+		s.lastStatus = status
+		assignments = append(assignments, "STATUS="+status)
+	}
+	if event.Kind == internal.EventChecked {
+		if !s.ready {
+			s.ready = true
+			assignments = append(assignments, "READY=1")
+			log.Debug("First check finished, notifying systemd that the daemon is ready")
+		}
+		if s.watchdogInterval > 0 {
+			assignments = append(assignments, "WATCHDOG=1")
+		}
+	}
+	if len(assignments) == 0 {
+		return
+	}
+	if err := s.notifier.Send(assignments...); err != nil {
+		log.WithError(err).Warn("Can't notify systemd")
+	}
+}
+
+// describeStatus summarises held inhibitors in one line
+func describeStatus(status internal.Status) string {
+	var description string
+	switch {
+	case !status.PausedUntil.IsZero():
+		description = fmt.Sprintf("Paused until %s, not blocking sleep", status.PausedUntil.Format(time.DateTime))
+	case len(status.Inhibitors) == 0:
+		description = "Not blocking sleep"
+	default:
+		description = "Blocking sleep for " + joinNames(status.Inhibitors)
+	}
+	if len(status.Failed) > 0 {
+		description += "; power manager fails for " + joinNames(status.Failed)
+	}
+	return description
+}
+
+func joinNames[V any](inhibitors map[internal.InhibitorName]V) string {
+	names := make([]string, 0, len(inhibitors))
+	for name := range inhibitors {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	if len(names) <= maxStatusNames {
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(names[:maxStatusNames], ", "), len(names)-maxStatusNames)
+}
@@ -0,0 +1,161 @@
+package systemd_notify
+
+import (
+	"fmt"
+	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/activity_source"
+	"libvirt_keepawake/internal/dbus_inhibitor"
+	"libvirt_keepawake/internal/libvirt_watcher"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SystemdNotifySuite struct {
+	suite.Suite
+	socket     *net.UnixConn
+	socketPath string
+}
+
+// SetupTest listens on a datagram socket like systemd does for Type=notify services
+func (s *SystemdNotifySuite) SetupTest() {
+	s.socketPath = filepath.Join(s.T().TempDir(), "notify")
+	socket, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: s.socketPath, Net: "unixgram"})
+	s.Require().NoError(err)
+	s.socket = socket
+}
+
+func (s *SystemdNotifySuite) TearDownTest() {
+	_ = s.socket.Close()
+}
+
+func (s *SystemdNotifySuite) TestFromEnvironment() {
+	s.T().Setenv(EnvNotifySocket, "")
+	notifier, _, err := FromEnvironment()
+	s.Require().NoError(err)
+	s.Assert().Nil(notifier)
+
+	s.T().Setenv(EnvNotifySocket, s.socketPath)
+	s.T().Setenv(EnvWatchdogUSec, "3000000")
+	s.T().Setenv(EnvWatchdogPID, strconv.Itoa(os.Getpid()))
+	notifier, watchdogInterval, err := FromEnvironment()
+	s.Require().NoError(err)
+	s.Require().NotNil(notifier)
+	defer notifier.Close()
+	s.Assert().Equal(3*time.Second, watchdogInterval)
+	for _, name := range []string{EnvNotifySocket, EnvWatchdogUSec, EnvWatchdogPID} {
+		_, found := os.LookupEnv(name)
+		s.Assert().False(found, name)
+	}
+
+	// the watchdog is meant for another process
+	s.T().Setenv(EnvNotifySocket, s.socketPath)
+	s.T().Setenv(EnvWatchdogUSec, "3000000")
+	s.T().Setenv(EnvWatchdogPID, "1")
+	otherNotifier, watchdogInterval, err := FromEnvironment()
+	s.Require().NoError(err)
+	defer otherNotifier.Close()
+	s.Assert().Zero(watchdogInterval)
+
+	s.T().Setenv(EnvNotifySocket, "vsock:2:1234")
+	_, _, err = FromEnvironment()
+	s.Assert().Error(err)
+}
+
+func (s *SystemdNotifySuite) TestAbstractSocket() {
+	name := fmt.Sprintf("@libvirt-keepawake-test-%d", time.Now().UnixNano())
+	socket, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	s.Require().NoError(err)
+	defer socket.Close()
+	notifier, err := NewNotifier(name)
+	s.Require().NoError(err)
+	defer notifier.Close()
+
+	s.Require().NoError(notifier.Send("READY=1", "STATUS=Not blocking sleep"))
+
+	s.socket = socket
+	s.Assert().Equal([]string{"READY=1", "STATUS=Not blocking sleep"}, s.receive())
+}
+
+// TestService tests readiness after the first check, status of held inhibitors and stopping
+func (s *SystemdNotifySuite) TestService() {
+	source := activity_source.NewFakeActivitySource("containers")
+	orchestrator := internal.NewOrchestrator(dbus_inhibitor.NewNoopSleepInhibitor(), time.NewTicker(time.Hour), source)
+	service := s.startService(orchestrator, 0)
+
+	s.Assert().Equal([]string{"STATUS=Not blocking sleep", "READY=1"}, s.receive())
+
+	source.UpdateActivities([]activity_source.Activity{{ID: "nextcloud"}, {ID: "jellyfin"}})
+	s.Assert().Equal([]string{"STATUS=Blocking sleep for containers/jellyfin, containers/nextcloud"}, s.receive())
+
+	service.Stop()
+	s.Assert().Equal([]string{"STOPPING=1", "STATUS=Releasing inhibitors"}, s.receive())
+	orchestrator.Stop()
+}
+
+// TestWatchdog tests that the watchdog is pinged only while checks finish
+func (s *SystemdNotifySuite) TestWatchdog() {
+	connection := new(libvirt_watcher.FakeLibvirtConnect)
+	orchestrator := internal.NewOrchestrator(
+		dbus_inhibitor.NewNoopSleepInhibitor(), time.NewTicker(time.Hour), libvirt_watcher.NewLibvirtWatcher(connection),
+	)
+	service := s.startService(orchestrator, 100*time.Millisecond)
+	defer func() {
+		service.Stop()
+		orchestrator.Stop()
+	}()
+	s.Assert().Equal([]string{"STATUS=Not blocking sleep", "READY=1", "WATCHDOG=1"}, s.receive())
+	// pings don't depend on the orchestrator ticker
+	s.Assert().Equal([]string{"WATCHDOG=1"}, s.receive())
+
+	connection.SetUnresponsive(true)
+	// a check which was in progress might still finish
+	s.drain(150 * time.Millisecond)
+
+	s.Assert().Empty(s.drain(300 * time.Millisecond))
+}
+
+func (s *SystemdNotifySuite) startService(
+	orchestrator *internal.Orchestrator, watchdogInterval time.Duration,
+) *Service {
+	notifier, err := NewNotifier(s.socketPath)
+	s.Require().NoError(err)
+	service := NewService(notifier, orchestrator, watchdogInterval)
+	orchestrator.AddListener(service)
+	service.Start()
+	orchestrator.Start()
+	return service
+}
+
+// receive waits for the next datagram and returns its assignments
+func (s *SystemdNotifySuite) receive() []string {
+	s.Require().NoError(s.socket.SetReadDeadline(time.Now().Add(2 * time.Second)))
+	buffer := make([]byte, 4096)
+	n, err := s.socket.Read(buffer)
+	s.Require().NoError(err)
+	return strings.Split(string(buffer[:n]), "\n")
+}
+
+// drain returns assignments of all datagrams received within timeout
+func (s *SystemdNotifySuite) drain(timeout time.Duration) []string {
+	s.Require().NoError(s.socket.SetReadDeadline(time.Now().Add(timeout)))
+	var assignments []string
+	buffer := make([]byte, 4096)
+	for {
+		n, err := s.socket.Read(buffer)
+		if err != nil {
+			return assignments
+		}
+		assignments = append(assignments, strings.Split(string(buffer[:n]), "\n")...)
+	}
+}
+
+func TestRunSystemdNotifySuite(t *testing.T) {
+	suite.Run(t, new(SystemdNotifySuite))
+}
@@ -0,0 +1,291 @@
+package tray
+
+// com.canonical.dbusmenu implementation, see
+// https://github.com/AyatanaIndicators/libdbusmenu/blob/master/libdbusmenu-glib/dbus-menu.xml
+
+import (
+	"fmt"
+	"libvirt_keepawake/internal"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	menuRootId int32 = iota
+	menuPauseId
+	menuNoDomainsId
+	menuQuitId
+	menuSeparatorId
+	// ids of per-domain items start from menuFirstDomainId, they're assigned once per domain
+	menuFirstDomainId int32 = 100
+)
+
+type menuLayout struct {
+	Id         int32
+	Properties map[string]dbus.Variant
+	Children   []dbus.Variant
+}
+
+type menuItemProperties struct {
+	Id         int32
+	Properties map[string]dbus.Variant
+}
+
+type menuEvent struct {
+	Id        int32
+	EventId   string
+	Data      dbus.Variant
+	Timestamp uint32
+}
+
+// dbusMenu builds menu from the tray state and handles clicks
+type dbusMenu struct {
+	tray     *Tray
+	mutex    sync.Mutex
+	revision uint32
+	// domainIds are ids of per-domain items, they don't change when other domains appear, so a click on an item of
+	// an outdated layout still toggles the domain the user saw
+	domainIds map[internal.InhibitorName]int32
+	// domains maps ids of per-domain items back to domain names
+	domains map[int32]internal.InhibitorName
+}
+
+func newDbusMenu(tray *Tray) *dbusMenu {
+	return &dbusMenu{
+		tray:      tray,
+		revision:  1,
+		domainIds: make(map[internal.InhibitorName]int32),
+		domains:   make(map[int32]internal.InhibitorName),
+	}
+}
+
+// layoutUpdated tells the host that the menu has to be fetched again
+func (m *dbusMenu) layoutUpdated() {
+	m.mutex.Lock()
+	m.revision++
+	revision := m.revision
+	m.mutex.Unlock()
+	err := m.tray.dbusConnection.Emit(menuPath, menuInterface+".LayoutUpdated", revision, menuRootId)
+	if err != nil {
+		log.WithError(err).Error("Can't emit LayoutUpdated signal")
+	}
+}
+
+// items returns top level menu items for the status. Must be called with the mutex held
+func (m *dbusMenu) items(status internal.Status) []menuLayout {
+	var items []menuLayout
+	if status.PausedUntil.IsZero() {
+		items = append(items, menuItem(menuPauseId, map[string]dbus.Variant{
+			"label": dbus.MakeVariant("Allow sleep for 1h"),
+		}))
+	} else {
+		items = append(items, menuItem(menuPauseId, map[string]dbus.Variant{
+			"label": dbus.MakeVariant(fmt.Sprintf("Resume (paused until %s)", status.PausedUntil.Format(time.TimeOnly))),
+		}))
+	}
+	items = append(items, separator(menuSeparatorId))
+
+	disabled := make(map[internal.InhibitorName]bool, len(status.DisabledDomains))
+	for _, domain := range status.DisabledDomains {
+		disabled[domain] = true
+	}
+	domains := append([]internal.InhibitorName{}, status.ActiveDomains...)
+	for _, domain := range status.DisabledDomains {
+		if !slices.Contains(status.ActiveDomains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i] < domains[j] })
+
+	for _, domain := range domains {
+		id, found := m.domainIds[domain]
+		if !found {
+			id = menuFirstDomainId + int32(len(m.domainIds))
+			m.domainIds[domain] = id
+			m.domains[id] = domain
+		}
+		toggleState := int32(1)
+		if disabled[domain] {
+			toggleState = 0
+		}
+		items = append(items, menuItem(id, map[string]dbus.Variant{
+			"label":        dbus.MakeVariant(string(domain)),
+			"toggle-type":  dbus.MakeVariant("checkmark"),
+			"toggle-state": dbus.MakeVariant(toggleState),
+		}))
+	}
+	if len(domains) == 0 {
+		items = append(items, menuItem(menuNoDomainsId, map[string]dbus.Variant{
+			"label":   dbus.MakeVariant("No running VMs"),
+			"enabled": dbus.MakeVariant(false),
+		}))
+	}
+
+	items = append(items, separator(menuSeparatorId+1))
+	items = append(items, menuItem(menuQuitId, map[string]dbus.Variant{
+		"label": dbus.MakeVariant("Quit"),
+	}))
+	return items
+}
+
+func (m *dbusMenu) GetLayout(parentId int32, recursionDepth int32, propertyNames []string) (uint32, menuLayout, *dbus.Error) {
+	status := m.tray.currentStatus()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	items := m.items(status)
+	if parentId != menuRootId {
+		for _, item := range items {
+			if item.Id == parentId {
+				return m.revision, item, nil
+			}
+		}
+		return m.revision, menuLayout{}, dbus.MakeFailedError(fmt.Errorf("unknown menu item %d", parentId))
+	}
+	root := menuItem(menuRootId, map[string]dbus.Variant{"children-display": dbus.MakeVariant("submenu")})
+	if recursionDepth != 0 {
+		for _, item := range items {
+			root.Children = append(root.Children, dbus.MakeVariant(item))
+		}
+	}
+	return m.revision, root, nil
+}
+
+func (m *dbusMenu) GetGroupProperties(ids []int32, propertyNames []string) ([]menuItemProperties, *dbus.Error) {
+	status := m.tray.currentStatus()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var properties []menuItemProperties
+	for _, item := range m.items(status) {
+		if len(ids) == 0 || slices.Contains(ids, item.Id) {
+			properties = append(properties, menuItemProperties{Id: item.Id, Properties: item.Properties})
+		}
+	}
+	return properties, nil
+}
+
+func (m *dbusMenu) GetProperty(id int32, name string) (dbus.Variant, *dbus.Error) {
+	properties, err := m.GetGroupProperties([]int32{id}, []string{name})
+	if err != nil {
+		return dbus.Variant{}, err
+	}
+	if len(properties) == 0 {
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("unknown menu item %d", id))
+	}
+	value, ok := properties[0].Properties[name]
+	if !ok {
+		return dbus.Variant{}, dbus.MakeFailedError(errUnknownProperty(name))
+	}
+	return value, nil
+}
+
+func (m *dbusMenu) Event(id int32, eventId string, data dbus.Variant, timestamp uint32) *dbus.Error {
+	if eventId != "clicked" {
+		return nil
+	}
+	m.mutex.Lock()
+	domain, isDomain := m.domains[id]
+	m.mutex.Unlock()
+	controller := m.tray.controller
+	switch {
+	case id == menuPauseId:
+		if controller.Status().PausedUntil.IsZero() {
+			log.Infof("User asked to allow sleep for %s from tray", PauseDuration)
+			controller.Pause(PauseDuration)
+		} else {
+			log.Info("User asked to resume inhibition from tray")
+			controller.Resume()
+		}
+	case id == menuQuitId:
+		log.Info("User asked to quit from tray")
+		m.tray.quit()
+	case isDomain:
+		enabled := slices.Contains(controller.Status().DisabledDomains, domain)
+		controller.SetDomainEnabled(domain, enabled)
+	}
+	return nil
+}
+
+func (m *dbusMenu) EventGroup(events []menuEvent) ([]int32, *dbus.Error) {
+	for _, event := range events {
+		if err := m.Event(event.Id, event.EventId, event.Data, event.Timestamp); err != nil {
+			return nil, err
+		}
+	}
+	return []int32{}, nil
+}
+
+func (m *dbusMenu) AboutToShow(id int32) (bool, *dbus.Error) {
+	return false, nil
+}
+
+func (m *dbusMenu) AboutToShowGroup(ids []int32) ([]int32, []int32, *dbus.Error) {
+	return []int32{}, []int32{}, nil
+}
+
+func (m *dbusMenu) introspection() introspect.Introspectable {
+	return introspectionNode(introspect.Interface{
+		Name:    menuInterface,
+		Methods: introspect.Methods(m),
+		Signals: []introspect.Signal{
+			{Name: "ItemsPropertiesUpdated", Args: []introspect.Arg{
+				{Name: "updatedProps", Type: "a(ia{sv})"}, {Name: "removedProps", Type: "a(ias)"},
+			}},
+			{Name: "LayoutUpdated", Args: []introspect.Arg{{Name: "revision", Type: "u"}, {Name: "parent", Type: "i"}}},
+			{Name: "ItemActivationRequested", Args: []introspect.Arg{{Name: "id", Type: "i"}, {Name: "timestamp", Type: "u"}}},
+		},
+		Properties: []introspect.Property{
+			{Name: "Version", Type: "u", Access: "read"},
+			{Name: "TextDirection", Type: "s", Access: "read"},
+			{Name: "Status", Type: "s", Access: "read"},
+			{Name: "IconThemePath", Type: "as", Access: "read"},
+		},
+	})
+}
+
+// menuProperties implements org.freedesktop.DBus.Properties for the menu
+type menuProperties struct{}
+
+func (p *menuProperties) Get(iface string, property string) (dbus.Variant, *dbus.Error) {
+	if iface != menuInterface {
+		return dbus.Variant{}, dbus.MakeFailedError(errUnknownInterface(iface))
+	}
+	value, ok := p.values()[property]
+	if !ok {
+		return dbus.Variant{}, dbus.MakeFailedError(errUnknownProperty(property))
+	}
+	return value, nil
+}
+
+func (p *menuProperties) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	if iface != menuInterface {
+		return nil, dbus.MakeFailedError(errUnknownInterface(iface))
+	}
+	return p.values(), nil
+}
+
+func (p *menuProperties) Set(iface string, property string, value dbus.Variant) *dbus.Error {
+	return dbus.MakeFailedError(errReadOnly(property))
+}
+
+func (p *menuProperties) values() map[string]dbus.Variant {
+	return map[string]dbus.Variant{
+		"Version":       dbus.MakeVariant(uint32(3)),
+		"TextDirection": dbus.MakeVariant("ltr"),
+		"Status":        dbus.MakeVariant("normal"),
+		"IconThemePath": dbus.MakeVariant([]string{}),
+	}
+}
+
+func menuItem(id int32, properties map[string]dbus.Variant) menuLayout {
+	return menuLayout{Id: id, Properties: properties, Children: []dbus.Variant{}}
+}
+
+func separator(id int32) menuLayout {
+	return menuItem(id, map[string]dbus.Variant{"type": dbus.MakeVariant("separator")})
+}
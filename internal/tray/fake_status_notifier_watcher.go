@@ -0,0 +1,60 @@
+package tray
+
+// Fake dbus service which implements `org.kde.StatusNotifierWatcher` and records registered items.
+// Intended for testing purposes only
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+type FakeStatusNotifierWatcher struct {
+	dbusConnection *dbus.Conn
+	items          []string
+	mutex          sync.Mutex
+}
+
+func NewFakeStatusNotifierWatcher(dbusConnection *dbus.Conn) *FakeStatusNotifierWatcher {
+	return &FakeStatusNotifierWatcher{dbusConnection: dbusConnection}
+}
+
+func (w *FakeStatusNotifierWatcher) Start() error {
+	if err := w.dbusConnection.Export(w, watcherPath, watcherInterface); err != nil {
+		return err
+	}
+	reply, err := w.dbusConnection.RequestName(watcherDest, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return err
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return fmt.Errorf("name %s is already taken", watcherDest)
+	}
+	return nil
+}
+
+func (w *FakeStatusNotifierWatcher) Stop() {
+	if _, err := w.dbusConnection.ReleaseName(watcherDest); err != nil {
+		log.Warnf("Failed to release Name: %v on test dbus", err)
+	}
+	if err := w.dbusConnection.Close(); err != nil {
+		log.Warnf("Failed to close connection: %v on test dbus", err)
+	}
+}
+
+// RegisterStatusNotifierItem is the method that will handle the RegisterStatusNotifierItem D-Bus calls.
+func (w *FakeStatusNotifierWatcher) RegisterStatusNotifierItem(service string) *dbus.Error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.items = append(w.items, service)
+	return nil
+}
+
+// GetRegisteredItems returns all registered items. Should be called only from tests
+func (w *FakeStatusNotifierWatcher) GetRegisteredItems() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]string{}, w.items...)
+}
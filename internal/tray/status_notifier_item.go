@@ -0,0 +1,124 @@
+package tray
+
+// org.kde.StatusNotifierItem implementation, see
+// https://www.freedesktop.org/wiki/Specifications/StatusNotifierItem/StatusNotifierItem/
+
+import (
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+type iconPixmap struct {
+	Width  int32
+	Height int32
+	Data   []byte
+}
+
+type toolTip struct {
+	IconName    string
+	IconPixmaps []iconPixmap
+	Title       string
+	Description string
+}
+
+// statusNotifierItem handles method calls of org.kde.StatusNotifierItem. The menu is always shown by the host
+// (ItemIsMenu is true), so activation methods have nothing to do.
+type statusNotifierItem struct {
+	tray *Tray
+}
+
+func (i *statusNotifierItem) ContextMenu(x int32, y int32) *dbus.Error {
+	return nil
+}
+
+func (i *statusNotifierItem) Activate(x int32, y int32) *dbus.Error {
+	return nil
+}
+
+func (i *statusNotifierItem) SecondaryActivate(x int32, y int32) *dbus.Error {
+	return nil
+}
+
+func (i *statusNotifierItem) Scroll(delta int32, orientation string) *dbus.Error {
+	return nil
+}
+
+func (i *statusNotifierItem) introspection() introspect.Introspectable {
+	return introspectionNode(introspect.Interface{
+		Name:    itemInterface,
+		Methods: introspect.Methods(i),
+		Signals: []introspect.Signal{
+			{Name: "NewTitle"},
+			{Name: "NewIcon"},
+			{Name: "NewAttentionIcon"},
+			{Name: "NewOverlayIcon"},
+			{Name: "NewToolTip"},
+			{Name: "NewStatus", Args: []introspect.Arg{{Name: "status", Type: "s"}}},
+		},
+		Properties: []introspect.Property{
+			{Name: "Category", Type: "s", Access: "read"},
+			{Name: "Id", Type: "s", Access: "read"},
+			{Name: "Title", Type: "s", Access: "read"},
+			{Name: "Status", Type: "s", Access: "read"},
+			{Name: "WindowId", Type: "i", Access: "read"},
+			{Name: "IconName", Type: "s", Access: "read"},
+			{Name: "IconPixmap", Type: "a(iiay)", Access: "read"},
+			{Name: "OverlayIconName", Type: "s", Access: "read"},
+			{Name: "AttentionIconName", Type: "s", Access: "read"},
+			{Name: "ToolTip", Type: "(sa(iiay)ss)", Access: "read"},
+			{Name: "ItemIsMenu", Type: "b", Access: "read"},
+			{Name: "Menu", Type: "o", Access: "read"},
+		},
+	})
+}
+
+// itemProperties implements org.freedesktop.DBus.Properties for the item. Values are computed from the
+// last state snapshot on every call, hosts are notified about changes with New* signals.
+type itemProperties struct {
+	tray *Tray
+}
+
+func (p *itemProperties) Get(iface string, property string) (dbus.Variant, *dbus.Error) {
+	if iface != itemInterface {
+		return dbus.Variant{}, dbus.MakeFailedError(errUnknownInterface(iface))
+	}
+	value, ok := p.values()[property]
+	if !ok {
+		return dbus.Variant{}, dbus.MakeFailedError(errUnknownProperty(property))
+	}
+	return value, nil
+}
+
+func (p *itemProperties) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	if iface != itemInterface {
+		return nil, dbus.MakeFailedError(errUnknownInterface(iface))
+	}
+	return p.values(), nil
+}
+
+func (p *itemProperties) Set(iface string, property string, value dbus.Variant) *dbus.Error {
+	return dbus.MakeFailedError(errReadOnly(property))
+}
+
+func (p *itemProperties) values() map[string]dbus.Variant {
+	status := p.tray.currentStatus()
+	return map[string]dbus.Variant{
+		"Category":          dbus.MakeVariant("ApplicationStatus"),
+		"Id":                dbus.MakeVariant("libvirt-keepawake"),
+		"Title":             dbus.MakeVariant("Libvirt keepawake"),
+		"Status":            dbus.MakeVariant(itemStatus),
+		"WindowId":          dbus.MakeVariant(int32(0)),
+		"IconName":          dbus.MakeVariant(itemIcon(status)),
+		"IconPixmap":        dbus.MakeVariant([]iconPixmap{}),
+		"OverlayIconName":   dbus.MakeVariant(""),
+		"AttentionIconName": dbus.MakeVariant(""),
+		"ToolTip": dbus.MakeVariant(toolTip{
+			IconName:    itemIcon(status),
+			IconPixmaps: []iconPixmap{},
+			Title:       "Libvirt keepawake",
+			Description: tooltipText(status),
+		}),
+		"ItemIsMenu": dbus.MakeVariant(true),
+		"Menu":       dbus.MakeVariant(menuPath),
+	}
+}
@@ -0,0 +1,262 @@
+package tray
+
+import (
+	"fmt"
+	"libvirt_keepawake/internal"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+	log "github.com/sirupsen/logrus"
+)
+
+const watcherDest = "org.kde.StatusNotifierWatcher"
+const watcherPath dbus.ObjectPath = "/StatusNotifierWatcher"
+const watcherInterface = "org.kde.StatusNotifierWatcher"
+
+const itemPath dbus.ObjectPath = "/StatusNotifierItem"
+const itemInterface = "org.kde.StatusNotifierItem"
+const menuPath dbus.ObjectPath = "/MenuBar"
+const menuInterface = "com.canonical.dbusmenu"
+
+// itemStatus is always Active, many hosts hide Passive items and the menu has to stay reachable, e.g. to resume
+const itemStatus = "Active"
+
+const iconInhibited = "changes-prevent"
+const iconNotInhibited = "changes-allow"
+
+// PauseDuration is how long inhibition is paused from the tray menu
+const PauseDuration = time.Hour
+
+// Controller is implemented by internal.Orchestrator
+type Controller interface {
+	Status() internal.Status
+	Pause(duration time.Duration)
+	Resume()
+	SetDomainEnabled(domain internal.InhibitorName, enabled bool)
+}
+
+/*
+Tray shows a system tray icon using StatusNotifierItem(org.kde.StatusNotifierItem) and its menu using
+com.canonical.dbusmenu. The icon reflects whether sleep is inhibited, tooltip lists domains keeping the host awake
+and the menu allows to pause/resume inhibition, toggle inhibition per domain and quit the daemon.
+*/
+type Tray struct {
+	dbusConnection *dbus.Conn
+	controller     Controller
+	quit           func()
+	busName        string
+	refreshes      chan struct{}
+	signals        chan *dbus.Signal
+	done           chan struct{}
+	stopped        sync.WaitGroup
+	menu           *dbusMenu
+	mutex          sync.Mutex
+	status         internal.Status
+}
+
+// NewTray creates a tray icon backed by controller state. quit is called when user chooses "Quit" in the menu
+func NewTray(dbusConnection *dbus.Conn, controller Controller, quit func()) *Tray {
+	tray := &Tray{
+		dbusConnection: dbusConnection,
+		controller:     controller,
+		quit:           quit,
+		busName:        fmt.Sprintf("org.kde.StatusNotifierItem-%d-1", os.Getpid()),
+		refreshes:      make(chan struct{}, 1),
+		signals:        make(chan *dbus.Signal, 16),
+		done:           make(chan struct{}),
+	}
+	tray.menu = newDbusMenu(tray)
+	return tray
+}
+
+// Start exports the item and the menu on the bus and registers them in StatusNotifierWatcher. If there is no
+// watcher yet, the item will be registered as soon as the watcher appears
+func (t *Tray) Start() error {
+	status := t.controller.Status()
+	t.mutex.Lock()
+	t.status = status
+	t.mutex.Unlock()
+	reply, err := t.dbusConnection.RequestName(t.busName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return fmt.Errorf("can't request name %s: %w", t.busName, err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return fmt.Errorf("name %s is already taken", t.busName)
+	}
+	if err := t.export(); err != nil {
+		return err
+	}
+
+	err = t.dbusConnection.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.DBus"),
+		dbus.WithMatchMember("NameOwnerChanged"),
+		dbus.WithMatchArg(0, watcherDest),
+	)
+	if err != nil {
+		return fmt.Errorf("can't subscribe to %s changes: %w", watcherDest, err)
+	}
+	t.dbusConnection.Signal(t.signals)
+
+	if err := t.register(); err != nil {
+		log.WithError(err).Warn("Can't register tray icon, will register when StatusNotifierWatcher appears")
+	}
+	t.stopped.Add(1)
+	go t.run()
+	return nil
+}
+
+// Stop removes the tray icon
+func (t *Tray) Stop() {
+	close(t.done)
+	t.stopped.Wait()
+	t.dbusConnection.RemoveSignal(t.signals)
+	if _, err := t.dbusConnection.ReleaseName(t.busName); err != nil {
+		log.WithError(err).Warnf("Can't release name %s", t.busName)
+	}
+}
+
+// HandleEvent implements internal.EventListener
+func (t *Tray) HandleEvent(event internal.Event) {
+	// changes made by a check come with their own events
+	if event.Kind == internal.EventChecked {
+		return
+	}
+	select {
+	case t.refreshes <- struct{}{}:
+	default: // refresh is already scheduled
+	}
+}
+
+func (t *Tray) export() error {
+	item := &statusNotifierItem{tray: t}
+	if err := t.dbusConnection.Export(item, itemPath, itemInterface); err != nil {
+		return fmt.Errorf("can't export StatusNotifierItem: %w", err)
+	}
+	if err := t.dbusConnection.Export(&itemProperties{tray: t}, itemPath, "org.freedesktop.DBus.Properties"); err != nil {
+		return fmt.Errorf("can't export StatusNotifierItem properties: %w", err)
+	}
+	if err := t.dbusConnection.Export(item.introspection(), itemPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+		return fmt.Errorf("can't export StatusNotifierItem introspection: %w", err)
+	}
+	if err := t.dbusConnection.Export(t.menu, menuPath, menuInterface); err != nil {
+		return fmt.Errorf("can't export dbusmenu: %w", err)
+	}
+	if err := t.dbusConnection.Export(&menuProperties{}, menuPath, "org.freedesktop.DBus.Properties"); err != nil {
+		return fmt.Errorf("can't export dbusmenu properties: %w", err)
+	}
+	if err := t.dbusConnection.Export(t.menu.introspection(), menuPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+		return fmt.Errorf("can't export dbusmenu introspection: %w", err)
+	}
+	return nil
+}
+
+func (t *Tray) register() error {
+	obj := t.dbusConnection.Object(watcherDest, watcherPath)
+	call := obj.Call(watcherInterface+".RegisterStatusNotifierItem", 0, t.busName)
+	if call.Err != nil {
+		return call.Err
+	}
+	log.Infof("Registered tray icon %s", t.busName)
+	return nil
+}
+
+func (t *Tray) run() {
+	defer t.stopped.Done()
+	for {
+		select {
+		case <-t.refreshes:
+			t.refresh()
+		case signal := <-t.signals:
+			// watcher was (re)started, e.g. panel was restarted, so we need to register again
+			if signal.Name == "org.freedesktop.DBus.NameOwnerChanged" && len(signal.Body) == 3 {
+				if newOwner, ok := signal.Body[2].(string); ok && newOwner != "" {
+					if err := t.register(); err != nil {
+						log.WithError(err).Error("Can't register tray icon in new StatusNotifierWatcher")
+					}
+				}
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// refresh takes a fresh snapshot of the controller state and notifies the tray host about changes
+func (t *Tray) refresh() {
+	status := t.controller.Status()
+	t.mutex.Lock()
+	t.status = status
+	t.mutex.Unlock()
+	for _, signal := range []string{"NewIcon", "NewToolTip", "NewTitle"} {
+		if err := t.dbusConnection.Emit(itemPath, itemInterface+"."+signal); err != nil {
+			log.WithError(err).Errorf("Can't emit %s signal", signal)
+		}
+	}
+	t.menu.layoutUpdated()
+}
+
+func (t *Tray) currentStatus() internal.Status {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.status
+}
+
+func itemIcon(status internal.Status) string {
+	if len(status.Inhibitors) > 0 {
+		return iconInhibited
+	}
+	return iconNotInhibited
+}
+
+func tooltipText(status internal.Status) string {
+	text := stateText(status)
+	if len(status.Failed) > 0 {
+		domains := make([]string, 0, len(status.Failed))
+		for domain := range status.Failed {
+			domains = append(domains, string(domain))
+		}
+		sort.Strings(domains)
+		text += ". Power manager fails for: " + strings.Join(domains, ", ")
+	}
+	return text
+}
+
+func stateText(status internal.Status) string {
+	if !status.PausedUntil.IsZero() {
+		return fmt.Sprintf("Sleep allowed, paused until %s", status.PausedUntil.Format(time.TimeOnly))
+	}
+	if len(status.Inhibitors) == 0 {
+		return "Sleep allowed, no VMs keep the host awake"
+	}
+	domains := make([]string, 0, len(status.Inhibitors))
+	for domain := range status.Inhibitors {
+		domains = append(domains, string(domain))
+	}
+	sort.Strings(domains)
+	return "Sleep blocked by: " + strings.Join(domains, ", ")
+}
+
+// introspectionNode describes exported interface for org.freedesktop.DBus.Introspectable
+func introspectionNode(iface introspect.Interface) introspect.Introspectable {
+	return introspect.NewIntrospectable(&introspect.Node{
+		Interfaces: []introspect.Interface{prop.IntrospectData, iface},
+	})
+}
+
+func errUnknownInterface(iface string) error {
+	return fmt.Errorf("unknown interface %s", iface)
+}
+
+func errUnknownProperty(property string) error {
+	return fmt.Errorf("unknown property %s", property)
+}
+
+func errReadOnly(property string) error {
+	return fmt.Errorf("property %s is read-only", property)
+}
@@ -0,0 +1,218 @@
+package tray
+
+import (
+	"libvirt_keepawake/internal"
+	"libvirt_keepawake/internal/dbus_inhibitor"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/suite"
+)
+
+// fakeController keeps state in memory instead of the orchestrator
+type fakeController struct {
+	mutex  sync.Mutex
+	status internal.Status
+}
+
+func (c *fakeController) Status() internal.Status {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.status
+}
+
+func (c *fakeController) Pause(duration time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status.PausedUntil = time.Now().Add(duration)
+}
+
+func (c *fakeController) Resume() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status.PausedUntil = time.Time{}
+}
+
+func (c *fakeController) SetDomainEnabled(domain internal.InhibitorName, enabled bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status.DisabledDomains = slices.DeleteFunc(c.status.DisabledDomains, func(d internal.InhibitorName) bool {
+		return d == domain
+	})
+	if !enabled {
+		c.status.DisabledDomains = append(c.status.DisabledDomains, domain)
+	}
+}
+
+func (c *fakeController) setStatus(status internal.Status) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status = status
+}
+
+type TraySuite struct {
+	suite.Suite
+	dbusSocketPath string
+	dbusProcess    *os.Process
+	watcher        *FakeStatusNotifierWatcher
+	controller     *fakeController
+	quitCalled     chan struct{}
+	tray           *Tray
+	client         *dbus.Conn
+}
+
+func (s *TraySuite) SetupTest() {
+	dbusSocketPath, dbusProcess, err := dbus_inhibitor.RunDbusServer()
+	if err != nil {
+		s.T().Fatalf("Can't start dbus server. Err %s", err)
+	}
+	s.dbusSocketPath = dbusSocketPath
+	s.dbusProcess = dbusProcess
+	s.watcher = s.startWatcher()
+
+	s.controller = &fakeController{}
+	s.controller.setStatus(internal.Status{
+		ActiveDomains: []internal.InhibitorName{"win11"},
+		Inhibitors:    map[internal.InhibitorName]internal.InhibitorCookie{"win11": 1},
+	})
+	s.quitCalled = make(chan struct{}, 1)
+	conn, err := dbus.Connect(dbusSocketPath)
+	s.Require().NoError(err)
+	s.tray = NewTray(conn, s.controller, func() { s.quitCalled <- struct{}{} })
+	s.Require().NoError(s.tray.Start())
+
+	s.client, err = dbus.Connect(dbusSocketPath)
+	s.Require().NoError(err)
+}
+
+func (s *TraySuite) TearDownTest() {
+	s.tray.Stop()
+	if err := s.dbusProcess.Kill(); err != nil {
+		s.T().Fatalf("Can't kill dbus server with PID %d. Err %s", s.dbusProcess.Pid, err)
+	}
+}
+
+func (s *TraySuite) startWatcher() *FakeStatusNotifierWatcher {
+	conn, err := dbus.Connect(s.dbusSocketPath)
+	s.Require().NoError(err)
+	watcher := NewFakeStatusNotifierWatcher(conn)
+	s.Require().NoError(watcher.Start())
+	return watcher
+}
+
+func (s *TraySuite) TestRegisterInWatcher() {
+	s.Assert().Equal([]string{s.tray.busName}, s.watcher.GetRegisteredItems())
+
+	// when panel is restarted, the item is registered in the new watcher
+	s.watcher.Stop()
+	newWatcher := s.startWatcher()
+	s.Require().Eventually(func() bool {
+		return slices.Equal([]string{s.tray.busName}, newWatcher.GetRegisteredItems())
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func (s *TraySuite) TestIconAndToolTipReflectState() {
+	s.Assert().Equal(iconInhibited, s.getItemProperty("IconName").Value())
+	var tip toolTip
+	s.Require().NoError(s.getItemProperty("ToolTip").Store(&tip))
+	s.Assert().Equal("Sleep blocked by: win11", tip.Description)
+
+	s.controller.setStatus(internal.Status{ActiveDomains: []internal.InhibitorName{}})
+	s.tray.HandleEvent(internal.Event{Kind: internal.EventInhibitorDeactivated, Domain: "win11"})
+	s.Require().Eventually(func() bool {
+		return s.getItemProperty("IconName").Value() == iconNotInhibited
+	}, 5*time.Second, 50*time.Millisecond)
+	// the item stays visible, so the menu is reachable
+	s.Assert().Equal("Active", s.getItemProperty("Status").Value())
+}
+
+func (s *TraySuite) TestMenu() {
+	layout := s.getLayout()
+	var labels []string
+	for _, child := range layout.Children {
+		var item menuLayout
+		s.Require().NoError(dbus.Store([]interface{}{child.Value()}, &item))
+		if label, ok := item.Properties["label"]; ok {
+			labels = append(labels, label.Value().(string))
+		}
+	}
+	s.Assert().Equal([]string{"Allow sleep for 1h", "win11", "Quit"}, labels)
+
+	// pause
+	s.clickMenuItem(menuPauseId)
+	s.Assert().False(s.controller.Status().PausedUntil.IsZero())
+	// resume
+	s.clickMenuItem(menuPauseId)
+	s.Assert().True(s.controller.Status().PausedUntil.IsZero())
+
+	// toggle domain off and on
+	s.clickMenuItem(menuFirstDomainId)
+	s.Assert().Equal([]internal.InhibitorName{"win11"}, s.controller.Status().DisabledDomains)
+	s.clickMenuItem(menuFirstDomainId)
+	s.Assert().Empty(s.controller.Status().DisabledDomains)
+
+	s.clickMenuItem(menuQuitId)
+	select {
+	case <-s.quitCalled:
+	case <-time.After(5 * time.Second):
+		s.T().Fatal("Quit wasn't called")
+	}
+}
+
+// TestMenuDomainIds tests that a click on an item of an outdated layout toggles the domain shown in it
+func (s *TraySuite) TestMenuDomainIds() {
+	s.Require().Equal(menuFirstDomainId, s.getLayoutItem("win11").Id)
+
+	s.controller.setStatus(internal.Status{ActiveDomains: []internal.InhibitorName{"alpine", "win11"}})
+	s.tray.HandleEvent(internal.Event{Kind: internal.EventInhibitorDeactivated, Domain: "win11"})
+	s.Require().Eventually(func() bool {
+		return s.getLayoutItem("alpine").Id != 0
+	}, 5*time.Second, 50*time.Millisecond)
+	s.Assert().Equal(menuFirstDomainId, s.getLayoutItem("win11").Id)
+
+	s.clickMenuItem(menuFirstDomainId)
+	s.Assert().Equal([]internal.InhibitorName{"win11"}, s.controller.Status().DisabledDomains)
+}
+
+// getLayoutItem returns the top level item with the label, zero item if there is none
+func (s *TraySuite) getLayoutItem(label string) menuLayout {
+	for _, child := range s.getLayout().Children {
+		var item menuLayout
+		s.Require().NoError(dbus.Store([]interface{}{child.Value()}, &item))
+		if itemLabel, ok := item.Properties["label"]; ok && itemLabel.Value() == label {
+			return item
+		}
+	}
+	return menuLayout{}
+}
+
+func (s *TraySuite) getItemProperty(name string) dbus.Variant {
+	value, err := s.client.Object(s.tray.busName, itemPath).GetProperty(itemInterface + "." + name)
+	s.Require().NoError(err)
+	return value
+}
+
+func (s *TraySuite) getLayout() menuLayout {
+	var revision uint32
+	var layout menuLayout
+	err := s.client.Object(s.tray.busName, menuPath).Call(
+		menuInterface+".GetLayout", 0, menuRootId, int32(-1), []string{},
+	).Store(&revision, &layout)
+	s.Require().NoError(err)
+	return layout
+}
+
+func (s *TraySuite) clickMenuItem(id int32) {
+	call := s.client.Object(s.tray.busName, menuPath).Call(
+		menuInterface+".Event", 0, id, "clicked", dbus.MakeVariant(""), uint32(0),
+	)
+	s.Require().NoError(call.Err)
+}
+
+func TestRunTraySuite(t *testing.T) {
+	suite.Run(t, new(TraySuite))
+}